@@ -0,0 +1,235 @@
+package resource
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+)
+
+// AzureAuthorityHost is the Microsoft Entra ID endpoint with which service
+// principals authenticate, unless configured otherwise, e.g. for a sovereign
+// cloud.
+const AzureAuthorityHost = "https://login.microsoftonline.com"
+
+// AzureIMDSEndpoint is the Azure Instance Metadata Service endpoint from which
+// managed identity tokens are fetched.
+const AzureIMDSEndpoint = "http://169.254.169.254/metadata/identity/oauth2/token"
+
+// azureManagementResource is the audience of the Entra ID tokens exchanged
+// for ACR refresh tokens.
+const azureManagementResource = "https://management.azure.com/"
+
+// acrRefreshTokenUsername is the username given along with an ACR refresh
+// token.
+const acrRefreshTokenUsername = "00000000-0000-0000-0000-000000000000"
+
+// AzureAuth configures how to authenticate to Azure Container Registry with
+// a Microsoft Entra ID identity.
+type AzureAuth struct {
+	TenantID string `json:"tenant_id,omitempty"`
+	ClientID string `json:"client_id,omitempty"`
+
+	// ClientSecret authenticates as a service principal.
+	ClientSecret string `json:"client_secret,omitempty"`
+
+	// FederatedTokenFile authenticates with workload identity federation,
+	// e.g. AKS workload identity's AZURE_FEDERATED_TOKEN_FILE.
+	FederatedTokenFile string `json:"federated_token_file,omitempty"`
+
+	// ManagedIdentity authenticates as the worker's managed identity, or the
+	// user-assigned identity with the client ID if set.
+	ManagedIdentity bool `json:"managed_identity,omitempty"`
+
+	AuthorityHost string `json:"authority_host,omitempty"`
+}
+
+// AuthenticateToAzure sets the source's credentials to an ACR refresh token
+// obtained per its azure_auth, if configured.
+func (source *Source) AuthenticateToAzure() error {
+	if source.AzureAuth == nil {
+		return nil
+	}
+
+	if source.Username != "" || source.Password != "" {
+		return Invalid("cannot specify 'username' or 'password' with 'azure_auth'")
+	}
+
+	repo, err := source.NewRepository()
+	if err != nil {
+		return fmt.Errorf("resolve repository: %w", err)
+	}
+
+	registry := repo.RegistryStr()
+
+	token, err := AzureAccessToken(*source.AzureAuth, AzureIMDSEndpoint)
+	if err != nil {
+		return Categorize(CategoryAuth, fmt.Errorf("cannot authenticate with Azure: %w", err))
+	}
+
+	refreshToken, err := ACRRefreshToken("https://"+registry+"/oauth2/exchange", registry, source.AzureAuth.TenantID, token)
+	if err != nil {
+		return Categorize(CategoryAuth, fmt.Errorf("cannot authenticate with ACR %s: %w", registry, err))
+	}
+
+	source.Username = acrRefreshTokenUsername
+	source.Password = refreshToken
+
+	return nil
+}
+
+// AzureAccessToken returns an Entra ID access token for Azure Resource
+// Manager, with a client secret, a federated token, or a managed identity
+// from the given IMDS endpoint.
+func AzureAccessToken(auth AzureAuth, imds string) (string, error) {
+	client := &http.Client{Timeout: 30 * time.Second}
+
+	if auth.ManagedIdentity {
+		if auth.ClientSecret != "" || auth.FederatedTokenFile != "" {
+			return "", Invalid("azure_auth 'managed_identity' cannot be combined with 'client_secret' or 'federated_token_file'")
+		}
+
+		query := url.Values{}
+		query.Set("api-version", "2018-02-01")
+		query.Set("resource", azureManagementResource)
+		if auth.ClientID != "" {
+			query.Set("client_id", auth.ClientID)
+		}
+
+		req, err := http.NewRequestWithContext(RequestContext(), http.MethodGet, imds+"?"+query.Encode(), nil)
+		if err != nil {
+			return "", err
+		}
+
+		req.Header.Set("Metadata", "true")
+
+		return azureTokenRequest(client, req)
+	}
+
+	if auth.TenantID == "" || auth.ClientID == "" {
+		return "", Invalid("azure_auth requires 'tenant_id' and 'client_id', or 'managed_identity'")
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "client_credentials")
+	form.Set("client_id", auth.ClientID)
+	form.Set("scope", azureManagementResource+".default")
+
+	switch {
+	case auth.ClientSecret != "" && auth.FederatedTokenFile != "":
+		return "", Invalid("azure_auth cannot specify both 'client_secret' and 'federated_token_file'")
+	case auth.ClientSecret != "":
+		form.Set("client_secret", auth.ClientSecret)
+	case auth.FederatedTokenFile != "":
+		// the token is re-read each time as it's rotated
+		assertion, err := ioutil.ReadFile(os.ExpandEnv(auth.FederatedTokenFile))
+		if err != nil {
+			return "", fmt.Errorf("read federated token: %w", err)
+		}
+
+		form.Set("client_assertion_type", "urn:ietf:params:oauth:client-assertion-type:jwt-bearer")
+		form.Set("client_assertion", strings.TrimSpace(string(assertion)))
+	default:
+		return "", Invalid("azure_auth requires one of 'client_secret', 'federated_token_file', or 'managed_identity'")
+	}
+
+	authority := auth.AuthorityHost
+	if authority == "" {
+		authority = AzureAuthorityHost
+	}
+
+	endpoint := fmt.Sprintf("%s/%s/oauth2/v2.0/token", strings.TrimSuffix(authority, "/"), auth.TenantID)
+
+	req, err := http.NewRequestWithContext(RequestContext(), http.MethodPost, endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	return azureTokenRequest(client, req)
+}
+
+// ACRRefreshToken exchanges an Entra ID access token for a refresh token for
+// the registry, with which the registry's own token endpoint issues access
+// tokens as it would for a username and password.
+func ACRRefreshToken(endpoint string, registry string, tenant string, accessToken string) (string, error) {
+	form := url.Values{}
+	form.Set("grant_type", "access_token")
+	form.Set("service", registry)
+	form.Set("access_token", accessToken)
+	if tenant != "" {
+		form.Set("tenant", tenant)
+	}
+
+	req, err := http.NewRequestWithContext(RequestContext(), http.MethodPost, endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	client := &http.Client{Timeout: 30 * time.Second}
+
+	res, err := client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("exchange token: %w", err)
+	}
+
+	defer res.Body.Close()
+
+	err = transport.CheckError(res, http.StatusOK)
+	if err != nil {
+		return "", fmt.Errorf("exchange token: %w", err)
+	}
+
+	var body struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+
+	err = json.NewDecoder(res.Body).Decode(&body)
+	if err != nil {
+		return "", fmt.Errorf("decode refresh token: %w", err)
+	}
+
+	if body.RefreshToken == "" {
+		return "", fmt.Errorf("exchange token: no refresh token in response")
+	}
+
+	return body.RefreshToken, nil
+}
+
+func azureTokenRequest(client *http.Client, req *http.Request) (string, error) {
+	res, err := client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("get token: %w", err)
+	}
+
+	defer res.Body.Close()
+
+	err = transport.CheckError(res, http.StatusOK)
+	if err != nil {
+		return "", fmt.Errorf("get token: %w", err)
+	}
+
+	var body struct {
+		AccessToken string `json:"access_token"`
+	}
+
+	err = json.NewDecoder(res.Body).Decode(&body)
+	if err != nil {
+		return "", fmt.Errorf("decode token: %w", err)
+	}
+
+	if body.AccessToken == "" {
+		return "", fmt.Errorf("get token: no access token in response")
+	}
+
+	return body.AccessToken, nil
+}
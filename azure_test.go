@@ -0,0 +1,118 @@
+package resource_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/ghttp"
+
+	resource "github.com/concourse/registry-image-resource"
+)
+
+var _ = Describe("Azure authentication", func() {
+	var azure *ghttp.Server
+
+	BeforeEach(func() {
+		azure = ghttp.NewServer()
+	})
+
+	AfterEach(func() {
+		azure.Close()
+	})
+
+	It("authenticates as a service principal with a client secret", func() {
+		azure.AppendHandlers(ghttp.CombineHandlers(
+			ghttp.VerifyRequest("POST", "/some-tenant/oauth2/v2.0/token"),
+			func(w http.ResponseWriter, r *http.Request) {
+				Expect(r.ParseForm()).To(Succeed())
+				Expect(r.PostForm.Get("grant_type")).To(Equal("client_credentials"))
+				Expect(r.PostForm.Get("client_id")).To(Equal("some-client"))
+				Expect(r.PostForm.Get("client_secret")).To(Equal("some-secret"))
+				Expect(r.PostForm.Get("scope")).To(Equal("https://management.azure.com/.default"))
+			},
+			ghttp.RespondWith(http.StatusOK, `{"access_token":"some-aad-token","token_type":"Bearer"}`),
+		))
+
+		token, err := resource.AzureAccessToken(resource.AzureAuth{
+			TenantID:      "some-tenant",
+			ClientID:      "some-client",
+			ClientSecret:  "some-secret",
+			AuthorityHost: azure.URL(),
+		}, azure.URL()+"/imds")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(token).To(Equal("some-aad-token"))
+	})
+
+	It("authenticates with a federated token", func() {
+		tmp, err := ioutil.TempDir("", "azure-auth")
+		Expect(err).ToNot(HaveOccurred())
+		defer os.RemoveAll(tmp)
+
+		tokenFile := filepath.Join(tmp, "token")
+		Expect(ioutil.WriteFile(tokenFile, []byte("some-federated-token\n"), 0644)).To(Succeed())
+
+		azure.AppendHandlers(ghttp.CombineHandlers(
+			ghttp.VerifyRequest("POST", "/some-tenant/oauth2/v2.0/token"),
+			func(w http.ResponseWriter, r *http.Request) {
+				Expect(r.ParseForm()).To(Succeed())
+				Expect(r.PostForm.Get("client_assertion_type")).To(Equal("urn:ietf:params:oauth:client-assertion-type:jwt-bearer"))
+				Expect(r.PostForm.Get("client_assertion")).To(Equal("some-federated-token"))
+			},
+			ghttp.RespondWith(http.StatusOK, `{"access_token":"some-aad-token"}`),
+		))
+
+		token, err := resource.AzureAccessToken(resource.AzureAuth{
+			TenantID:           "some-tenant",
+			ClientID:           "some-client",
+			FederatedTokenFile: tokenFile,
+			AuthorityHost:      azure.URL(),
+		}, azure.URL()+"/imds")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(token).To(Equal("some-aad-token"))
+	})
+
+	It("authenticates as a managed identity", func() {
+		azure.AppendHandlers(ghttp.CombineHandlers(
+			ghttp.VerifyRequest("GET", "/imds", "api-version=2018-02-01&client_id=some-identity&resource=https%3A%2F%2Fmanagement.azure.com%2F"),
+			ghttp.VerifyHeaderKV("Metadata", "true"),
+			ghttp.RespondWith(http.StatusOK, `{"access_token":"some-aad-token"}`),
+		))
+
+		token, err := resource.AzureAccessToken(resource.AzureAuth{
+			ClientID:        "some-identity",
+			ManagedIdentity: true,
+		}, azure.URL()+"/imds")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(token).To(Equal("some-aad-token"))
+	})
+
+	It("requires a way to authenticate", func() {
+		_, err := resource.AzureAccessToken(resource.AzureAuth{
+			TenantID: "some-tenant",
+			ClientID: "some-client",
+		}, azure.URL()+"/imds")
+		Expect(err).To(MatchError(ContainSubstring("requires one of")))
+	})
+
+	It("exchanges an access token for an ACR refresh token", func() {
+		azure.AppendHandlers(ghttp.CombineHandlers(
+			ghttp.VerifyRequest("POST", "/oauth2/exchange"),
+			func(w http.ResponseWriter, r *http.Request) {
+				Expect(r.ParseForm()).To(Succeed())
+				Expect(r.PostForm.Get("grant_type")).To(Equal("access_token"))
+				Expect(r.PostForm.Get("service")).To(Equal("some.azurecr.io"))
+				Expect(r.PostForm.Get("tenant")).To(Equal("some-tenant"))
+				Expect(r.PostForm.Get("access_token")).To(Equal("some-aad-token"))
+			},
+			ghttp.RespondWith(http.StatusOK, `{"refresh_token":"some-refresh-token"}`),
+		))
+
+		token, err := resource.ACRRefreshToken(azure.URL()+"/oauth2/exchange", "some.azurecr.io", "some-tenant", "some-aad-token")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(token).To(Equal("some-refresh-token"))
+	})
+})
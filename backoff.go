@@ -35,7 +35,43 @@ func RetryOnRateLimit(op func() error) error {
 		}
 
 		return backoff.Permanent(err)
-	}, bo, func(err error, dur time.Duration) {
+	}, backoff.WithContext(bo, RequestContext()), func(err error, dur time.Duration) {
 		logrus.Warnf("too many requests; retrying in %s", dur)
 	})
 }
+
+// RetryOnNotFound retries the operation while the registry responds with 404
+// Not Found, for up to the given duration. Some registries are eventually
+// consistent and don't serve a manifest until a few seconds after it's pushed.
+func RetryOnNotFound(wait time.Duration, op func() error) error {
+	if wait <= 0 {
+		return op()
+	}
+
+	bo := backoff.NewExponentialBackOff()
+	if os.Getenv("TEST") == "true" {
+		bo.InitialInterval = 5 * time.Millisecond
+	} else {
+		bo.InitialInterval = 500 * time.Millisecond
+	}
+	bo.MaxInterval = 5 * time.Second
+	bo.MaxElapsedTime = wait
+
+	return backoff.RetryNotify(func() error {
+		err := op()
+		if err == nil {
+			return nil
+		}
+
+		var transportErr *transport.Error
+		if errors.As(err, &transportErr) {
+			if transportErr.StatusCode == http.StatusNotFound {
+				return err
+			}
+		}
+
+		return backoff.Permanent(err)
+	}, backoff.WithContext(bo, RequestContext()), func(err error, dur time.Duration) {
+		logrus.Warnf("not found; retrying in %s", dur)
+	})
+}
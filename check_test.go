@@ -7,14 +7,19 @@ import (
 	"encoding/json"
 	"encoding/pem"
 	"fmt"
+	"io"
 	"net/http"
+	"net/http/httptest"
 	"os/exec"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/google/go-containerregistry/pkg/name"
 	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
 	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/ginkgo/extensions/table"
 	. "github.com/onsi/gomega"
@@ -25,6 +30,7 @@ import (
 
 var _ = Describe("Check", func() {
 	var actualErr error
+	var actualErrOutput string
 
 	var req struct {
 		Source  resource.Source
@@ -48,12 +54,14 @@ var _ = Describe("Check", func() {
 		Expect(err).ToNot(HaveOccurred())
 
 		outBuf := new(bytes.Buffer)
+		errBuf := new(bytes.Buffer)
 
 		cmd.Stdin = bytes.NewBuffer(payload)
 		cmd.Stdout = outBuf
-		cmd.Stderr = GinkgoWriter
+		cmd.Stderr = io.MultiWriter(GinkgoWriter, errBuf)
 
 		actualErr = cmd.Run()
+		actualErrOutput = errBuf.String()
 		if actualErr == nil {
 			err = json.Unmarshal(outBuf.Bytes(), &res)
 			Expect(err).ToNot(HaveOccurred())
@@ -730,6 +738,338 @@ var _ = Describe("Check", func() {
 				})
 			})
 		})
+
+		Context("when the repository includes a tag and digest", func() {
+			BeforeEach(func() {
+				req.Source = resource.Source{
+					Repository: "concourse/test-image-static:latest@" + OLDER_STATIC_DIGEST,
+				}
+				req.Version = nil
+			})
+
+			It("returns only the pinned digest", func() {
+				Expect(actualErr).ToNot(HaveOccurred())
+
+				Expect(res).To(Equal([]resource.Version{
+					{Tag: "latest", Digest: OLDER_STATIC_DIGEST},
+				}))
+			})
+		})
+
+		Context("with a pin_policy", func() {
+			var registry *httptest.Server
+			var digest v1.Hash
+
+			BeforeEach(func() {
+				registry = newFakeRegistry()
+
+				req.Source = resource.Source{
+					Repository: strings.TrimPrefix(registry.URL, "http://") + "/fake-image",
+					Tag:        "latest",
+				}
+
+				image, err := random.Image(1024, 1)
+				Expect(err).ToNot(HaveOccurred())
+
+				digest, err = image.Digest()
+				Expect(err).ToNot(HaveOccurred())
+
+				for _, tag := range []string{"latest", "1.2.3"} {
+					ref, err := name.NewTag(req.Source.Repository + ":" + tag)
+					Expect(err).ToNot(HaveOccurred())
+
+					Expect(remote.Write(ref, image)).To(Succeed())
+				}
+			})
+
+			AfterEach(func() {
+				registry.Close()
+			})
+
+			Context("set to warn", func() {
+				BeforeEach(func() {
+					req.Source.PinPolicy = "warn"
+				})
+
+				It("warns about the mutable tag and returns the current digest", func() {
+					Expect(actualErr).ToNot(HaveOccurred())
+					Expect(actualErrOutput).To(ContainSubstring(`tracking mutable tag "latest"`))
+
+					Expect(res).To(Equal([]resource.Version{
+						{Tag: "latest", Digest: digest.String()},
+					}))
+				})
+			})
+
+			Context("set to fail", func() {
+				BeforeEach(func() {
+					req.Source.PinPolicy = "fail"
+				})
+
+				It("fails", func() {
+					Expect(actualErr).To(HaveOccurred())
+					Expect(actualErrOutput).To(ContainSubstring(`tracking mutable tag "latest" is not allowed by pin_policy`))
+				})
+
+				Context("when tracking a version tag", func() {
+					BeforeEach(func() {
+						req.Source.Tag = "1.2.3"
+					})
+
+					It("returns the current digest", func() {
+						Expect(actualErr).ToNot(HaveOccurred())
+						Expect(actualErrOutput).ToNot(ContainSubstring("mutable tag"))
+
+						Expect(res).To(Equal([]resource.Version{
+							{Tag: "1.2.3", Digest: digest.String()},
+						}))
+					})
+				})
+
+				Context("when pinned to a digest", func() {
+					BeforeEach(func() {
+						req.Source.Digest = digest.String()
+					})
+
+					It("returns the pinned digest", func() {
+						Expect(actualErr).ToNot(HaveOccurred())
+						Expect(actualErrOutput).ToNot(ContainSubstring("mutable tag"))
+
+						Expect(res).To(Equal([]resource.Version{
+							{Tag: "latest", Digest: digest.String()},
+						}))
+					})
+				})
+			})
+
+			Context("set to an unknown value", func() {
+				BeforeEach(func() {
+					req.Source.PinPolicy = "bogus"
+				})
+
+				It("fails", func() {
+					Expect(actualErr).To(HaveOccurred())
+					Expect(actualErrOutput).To(ContainSubstring(`unknown pin_policy "bogus"`))
+				})
+			})
+		})
+	})
+
+	Describe("tracking semver tags in a repository which does not exist yet", func() {
+		var registry *ghttp.Server
+
+		BeforeEach(func() {
+			registry = ghttp.NewServer()
+
+			registry.RouteToHandler("GET", "/v2/", ghttp.RespondWith(http.StatusOK, ""))
+			registry.RouteToHandler("GET", "/v2/some/fake-image/tags/list", ghttp.RespondWith(
+				http.StatusNotFound,
+				`{"errors":[{"code":"NAME_UNKNOWN","message":"repository name not known to registry"}]}`,
+			))
+
+			req.Source = resource.Source{
+				Repository: registry.Addr() + "/some/fake-image",
+			}
+		})
+
+		AfterEach(func() {
+			registry.Close()
+		})
+
+		JustBeforeEach(check)
+
+		It("returns no versions", func() {
+			Expect(actualErr).ToNot(HaveOccurred())
+			Expect(res).To(BeEmpty())
+		})
+	})
+
+	Describe("tracking semver tags in a repository which does not exist yet, with an empty 404 body", func() {
+		var registry *ghttp.Server
+
+		BeforeEach(func() {
+			registry = ghttp.NewServer()
+
+			registry.RouteToHandler("GET", "/v2/", ghttp.RespondWith(http.StatusOK, ""))
+			registry.RouteToHandler("GET", "/v2/some/fake-image/tags/list", ghttp.RespondWith(http.StatusNotFound, nil))
+
+			req.Source = resource.Source{
+				Repository: registry.Addr() + "/some/fake-image",
+			}
+		})
+
+		AfterEach(func() {
+			registry.Close()
+		})
+
+		JustBeforeEach(check)
+
+		It("returns no versions", func() {
+			Expect(actualErr).ToNot(HaveOccurred())
+			Expect(res).To(BeEmpty())
+		})
+	})
+
+	Describe("tracking semver tags when fetching a digest is rate limited", func() {
+		var registry *ghttp.Server
+		var digests map[string]v1.Hash
+		var rateLimits chan struct{}
+
+		BeforeEach(func() {
+			registry = ghttp.NewServer()
+			digests = map[string]v1.Hash{}
+			rateLimits = make(chan struct{}, 2)
+
+			registry.RouteToHandler("GET", "/v2/", ghttp.RespondWith(http.StatusOK, ""))
+			registry.RouteToHandler("GET", "/v2/some/fake-image/tags/list", ghttp.RespondWithJSONEncoded(http.StatusOK, registryTagsResponse{
+				Name: "some/fake-image",
+				Tags: []string{"1.0.0", "1.1.0", "1.2.0"},
+			}))
+
+			for _, tag := range []string{"1.0.0", "1.1.0", "1.2.0"} {
+				image, err := random.Image(1024, 1)
+				Expect(err).ToNot(HaveOccurred())
+
+				manifest, err := image.RawManifest()
+				Expect(err).ToNot(HaveOccurred())
+
+				mediaType, err := image.MediaType()
+				Expect(err).ToNot(HaveOccurred())
+
+				digests[tag], err = image.Digest()
+				Expect(err).ToNot(HaveOccurred())
+
+				respond := ghttp.RespondWith(http.StatusOK, manifest, http.Header{
+					"Content-Type":          {string(mediaType)},
+					"Content-Length":        {strconv.Itoa(len(manifest))},
+					"Docker-Content-Digest": {digests[tag].String()},
+				})
+
+				if tag == "1.1.0" {
+					// the HEAD, and then the GET it falls back to, are rate limited
+					limited := func(w http.ResponseWriter, r *http.Request) {
+						select {
+						case rateLimits <- struct{}{}:
+							ghttp.RespondWith(http.StatusTooManyRequests, "limited")(w, r)
+						default:
+							respond(w, r)
+						}
+					}
+
+					registry.RouteToHandler("HEAD", "/v2/some/fake-image/manifests/"+tag, limited)
+					registry.RouteToHandler("GET", "/v2/some/fake-image/manifests/"+tag, limited)
+				} else {
+					registry.RouteToHandler("HEAD", "/v2/some/fake-image/manifests/"+tag, respond)
+				}
+			}
+
+			req.Source = resource.Source{
+				Repository:       registry.Addr() + "/some/fake-image",
+				CheckConcurrency: 2,
+			}
+		})
+
+		AfterEach(func() {
+			registry.Close()
+		})
+
+		JustBeforeEach(check)
+
+		It("retries and returns every version", func() {
+			Expect(actualErr).ToNot(HaveOccurred())
+			Expect(rateLimits).To(HaveLen(2))
+			Expect(res).To(Equal([]resource.Version{
+				{Tag: "1.0.0", Digest: digests["1.0.0"].String()},
+				{Tag: "1.1.0", Digest: digests["1.1.0"].String()},
+				{Tag: "1.2.0", Digest: digests["1.2.0"].String()},
+			}))
+		})
+	})
+
+	Describe("pinning a digest which does not exist", func() {
+		var registry *httptest.Server
+
+		BeforeEach(func() {
+			registry = newFakeRegistry()
+
+			req.Source = resource.Source{
+				Repository: strings.TrimPrefix(registry.URL, "http://") + "/fake-image",
+				Digest:     OLDER_FAKE_DIGEST,
+			}
+		})
+
+		AfterEach(func() {
+			registry.Close()
+		})
+
+		JustBeforeEach(check)
+
+		It("exits non-zero and returns an error", func() {
+			Expect(actualErr).To(HaveOccurred())
+			Expect(actualErrOutput).To(ContainSubstring("pinned digest " + OLDER_FAKE_DIGEST + " not found"))
+		})
+	})
+
+	Describe("tracking semver tags with label_filters", func() {
+		var registry *httptest.Server
+		var digests map[string]v1.Hash
+
+		BeforeEach(func() {
+			registry = newFakeRegistry()
+			digests = map[string]v1.Hash{}
+
+			repo := strings.TrimPrefix(registry.URL, "http://") + "/fake-image"
+
+			for tag, vendor := range map[string]string{
+				"1.0.0": "some-vendor",
+				"1.1.0": "other-vendor",
+				"1.2.0": "some-vendor",
+			} {
+				image, err := random.Image(1024, 1)
+				Expect(err).ToNot(HaveOccurred())
+
+				cfg, err := image.ConfigFile()
+				Expect(err).ToNot(HaveOccurred())
+
+				cfg = cfg.DeepCopy()
+				cfg.Config.Labels = map[string]string{
+					"org.opencontainers.image.vendor": vendor,
+				}
+
+				image, err = mutate.ConfigFile(image, cfg)
+				Expect(err).ToNot(HaveOccurred())
+
+				digests[tag], err = image.Digest()
+				Expect(err).ToNot(HaveOccurred())
+
+				ref, err := name.ParseReference(repo + ":" + tag)
+				Expect(err).ToNot(HaveOccurred())
+
+				err = remote.Write(ref, image)
+				Expect(err).ToNot(HaveOccurred())
+			}
+
+			req.Source = resource.Source{
+				Repository: repo,
+				LabelFilters: map[string]string{
+					"org.opencontainers.image.vendor": "some-vendor",
+				},
+			}
+		})
+
+		AfterEach(func() {
+			registry.Close()
+		})
+
+		JustBeforeEach(check)
+
+		It("only returns versions with matching labels", func() {
+			Expect(actualErr).ToNot(HaveOccurred())
+			Expect(res).To(Equal([]resource.Version{
+				{Tag: "1.0.0", Digest: digests["1.0.0"].String()},
+				{Tag: "1.2.0", Digest: digests["1.2.0"].String()},
+			}))
+		})
 	})
 })
 
@@ -789,6 +1129,22 @@ var _ = DescribeTable("tracking semver tags",
 			Versions: []string{"latest"},
 		},
 	),
+	Entry("HEAD disabled for a registry returning bogus HEAD results",
+		SemverOrRegexTagCheckExample{
+			Tags: []testTag{
+				{
+					Tag:       "1.0.0",
+					ImageName: "random-1",
+				},
+				{
+					Tag:       "latest",
+					ImageName: "random-2",
+				},
+			},
+			BogusHEAD: true,
+			Versions:  []string{"1.0.0", "latest"},
+		},
+	),
 	Entry("simple tag regex",
 		SemverOrRegexTagCheckExample{
 			Tags: []testTag{
@@ -848,6 +1204,67 @@ var _ = DescribeTable("tracking semver tags",
 			Versions:      []string{"gem-182-git-6bd8a5e1a2b3", "gem-1337-git-4bd8a5e1a244", "gem-1338-git-4bd8a5e1a244"},
 		},
 	),
+	Entry("no HEAD support, simple tag regex where sorted is true",
+		SemverOrRegexTagCheckExample{
+			Tags: []testTag{
+				{
+					Tag:       "1.0.0",
+					ImageName: "random-1",
+				},
+				{
+					Tag:       "non-semver-tag",
+					ImageName: "random-2",
+				},
+				{
+					Tag:       "gem-1338-git-4bd8a5e1a244",
+					ImageName: "random-3",
+				},
+				{
+					Tag:       "gem-182-git-6bd8a5e1a2b3",
+					ImageName: "random-4",
+				},
+				{
+					Tag:       "gem-1337-git-4bd8a5e1a244",
+					ImageName: "random-5",
+				},
+			},
+			TagsToTime: map[string]time.Time{
+				"gem-1338-git-4bd8a5e1a244": time.Date(2024, 1, 4, 5, 0, 0, 0, time.UTC),
+				"gem-182-git-6bd8a5e1a2b3":  time.Date(2024, 1, 4, 0, 0, 0, 0, time.UTC),
+				"gem-1337-git-4bd8a5e1a244": time.Date(2024, 1, 4, 4, 0, 0, 0, time.UTC),
+			},
+			Regex:         "gem-(\\d+)-git-([a-f0-9]{12})",
+			CreatedAtSort: true,
+			NoHEAD:        true,
+			Versions:      []string{"gem-182-git-6bd8a5e1a2b3", "gem-1337-git-4bd8a5e1a244", "gem-1338-git-4bd8a5e1a244"},
+		},
+	),
+	Entry("tags sharing a digest where sorted is true",
+		SemverOrRegexTagCheckExample{
+			Tags: []testTag{
+				{
+					Tag:       "gem-1338-git-4bd8a5e1a244",
+					ImageName: "random-1",
+				},
+				{
+					Tag:       "gem-182-git-6bd8a5e1a2b3",
+					ImageName: "random-2",
+				},
+				{
+					Tag:       "gem-1337-git-4bd8a5e1a244",
+					ImageName: "random-1",
+				},
+			},
+			TagsToTime: map[string]time.Time{
+				"gem-1338-git-4bd8a5e1a244": time.Date(2024, 1, 4, 5, 0, 0, 0, time.UTC),
+				"gem-182-git-6bd8a5e1a2b3":  time.Date(2024, 1, 4, 0, 0, 0, 0, time.UTC),
+				"gem-1337-git-4bd8a5e1a244": time.Date(2024, 1, 4, 5, 0, 0, 0, time.UTC),
+			},
+			Regex:         "gem-(\\d+)-git-([a-f0-9]{12})",
+			CreatedAtSort: true,
+			Versions:      []string{"gem-182-git-6bd8a5e1a2b3", "gem-1338-git-4bd8a5e1a244", "gem-1337-git-4bd8a5e1a244"},
+		},
+	),
 	Entry("regex override semver constraint",
 		SemverOrRegexTagCheckExample{
 			Tags: []testTag{
@@ -931,6 +1348,112 @@ var _ = DescribeTable("tracking semver tags",
 			Versions:      []string{"3bd8a5e-dev", "67e3c33-dev"},
 		},
 	),
+	Entry("regex with deduplicated digests",
+		SemverOrRegexTagCheckExample{
+			Tags: []testTag{
+				{
+					Tag:       "1.0",
+					ImageName: "random-1",
+				},
+				{
+					Tag:       "1.0.0",
+					ImageName: "random-1",
+				},
+				{
+					Tag:       "1.1.0",
+					ImageName: "random-2",
+				},
+				{
+					Tag:       "1.0.1",
+					ImageName: "random-1",
+				},
+				{
+					Tag:       "1.1",
+					ImageName: "random-2",
+				},
+			},
+			Regex:         "^1\\.",
+			DedupeDigests: true,
+			Versions:      []string{"1.0.1", "1.1.0"},
+		},
+	),
+	Entry("regex with max versions",
+		SemverOrRegexTagCheckExample{
+			Tags: []testTag{
+				{
+					Tag:       "3bd8a5e-dev",
+					ImageName: "random-1",
+				},
+				{
+					Tag:       "67e3c33-dev",
+					ImageName: "random-2",
+				},
+				{
+					Tag:       "a1b2c3d-dev",
+					ImageName: "random-3",
+				},
+			},
+			Regex:       "-dev$",
+			MaxVersions: 2,
+			Versions:    []string{"67e3c33-dev", "a1b2c3d-dev"},
+		},
+	),
+	Entry("semver with max versions",
+		SemverOrRegexTagCheckExample{
+			Tags: []testTag{
+				{
+					Tag:       "2.0.0",
+					ImageName: "random-4",
+				},
+				{
+					Tag:       "1.0.0",
+					ImageName: "random-1",
+				},
+				{
+					Tag:       "1.2.0",
+					ImageName: "random-3",
+				},
+				{
+					Tag:       "1.1.0",
+					ImageName: "random-2",
+				},
+				{
+					Tag:       "latest",
+					ImageName: "random-4",
+				},
+			},
+			MaxVersions: 2,
+			Versions:    []string{"1.2.0", "2.0.0"},
+		},
+	),
+	Entry("semver with max versions from an older version",
+		SemverOrRegexTagCheckExample{
+			Tags: []testTag{
+				{
+					Tag:       "1.0.0",
+					ImageName: "random-1",
+				},
+				{
+					Tag:       "1.1.0",
+					ImageName: "random-2",
+				},
+				{
+					Tag:       "1.2.0",
+					ImageName: "random-3",
+				},
+				{
+					Tag:       "2.0.0",
+					ImageName: "random-4",
+				},
+			},
+			From: &resource.Version{
+				Tag:    "1.0.0",
+				Digest: "random-1",
+			},
+			MaxVersions: 1,
+			Versions:    []string{"1.0.0", "2.0.0"},
+		},
+	),
 	Entry("semver tag ordering",
 		SemverOrRegexTagCheckExample{
 			Tags: []testTag{
@@ -950,6 +1473,73 @@ var _ = DescribeTable("tracking semver tags",
 			Versions: []string{"1.0.0", "1.2.1", "2.0.0"},
 		},
 	),
+	Entry("tag prefix",
+		SemverOrRegexTagCheckExample{
+			Tags: []testTag{
+				{
+					Tag:       "release-1.10.0",
+					ImageName: "random-1",
+				},
+				{
+					Tag:       "release-1.2.3",
+					ImageName: "random-2",
+				},
+				{
+					Tag:       "2.0.0",
+					ImageName: "random-3",
+				},
+				{
+					Tag:       "release-candidate",
+					ImageName: "random-4",
+				},
+			},
+			TagPrefix: "release-",
+			Versions:  []string{"release-1.2.3", "release-1.10.0"},
+		},
+	),
+	Entry("four-component versions ignored by default",
+		SemverOrRegexTagCheckExample{
+			Tags: []testTag{
+				{
+					Tag:       "8.0.36",
+					ImageName: "random-1",
+				},
+				{
+					Tag:       "8.0.36.1",
+					ImageName: "random-2",
+				},
+			},
+			Versions: []string{"8.0.36"},
+		},
+	),
+	Entry("four-component versions with tolerant_versions",
+		SemverOrRegexTagCheckExample{
+			Tags: []testTag{
+				{
+					Tag:       "8.0.36.10",
+					ImageName: "random-1",
+				},
+				{
+					Tag:       "8.0.37",
+					ImageName: "random-2",
+				},
+				{
+					Tag:       "8.0.36",
+					ImageName: "random-3",
+				},
+				{
+					Tag:       "8.0.36.2",
+					ImageName: "random-4",
+				},
+				{
+					Tag:       "8.0.36.2.1",
+					ImageName: "random-5",
+				},
+			},
+			TolerantVersions: true,
+			Versions:         []string{"8.0.36", "8.0.36.2", "8.0.36.2.1", "8.0.36.10", "8.0.37"},
+		},
+	),
 	Entry("semver tag ordering with cursor",
 		SemverOrRegexTagCheckExample{
 			Tags: []testTag{
@@ -996,6 +1586,50 @@ var _ = DescribeTable("tracking semver tags",
 			Versions: []string{"1.0.0", "1.2.1", "2.0.0"},
 		},
 	),
+	Entry("semver tag ordering with initial tag",
+		SemverOrRegexTagCheckExample{
+			Tags: []testTag{
+				{
+					Tag:       "1.0.0",
+					ImageName: "random-1",
+				},
+				{
+					Tag:       "1.2.1",
+					ImageName: "random-3",
+				},
+				{
+					Tag:       "2.0.0",
+					ImageName: "random-5",
+				},
+			},
+			InitialTag: "1.2.1",
+			Versions:   []string{"1.2.1", "2.0.0"},
+		},
+	),
+	Entry("semver tag ordering with initial tag ignored for a cursor",
+		SemverOrRegexTagCheckExample{
+			Tags: []testTag{
+				{
+					Tag:       "1.0.0",
+					ImageName: "random-1",
+				},
+				{
+					Tag:       "1.2.1",
+					ImageName: "random-3",
+				},
+				{
+					Tag:       "2.0.0",
+					ImageName: "random-5",
+				},
+			},
+			From: &resource.Version{
+				Tag:    "1.0.0",
+				Digest: "random-1",
+			},
+			InitialTag: "1.2.1",
+			Versions:   []string{"1.0.0", "1.2.1", "2.0.0"},
+		},
+	),
 	Entry("semver constraint",
 		SemverOrRegexTagCheckExample{
 			Tags: []testTag{
@@ -1532,11 +2166,16 @@ type SemverOrRegexTagCheckExample struct {
 
 	PreReleases bool
 	Variant     string
+	TagPrefix   string
 
 	Regex         string
 	CreatedAtSort bool
+	DedupeDigests bool
+
+	MaxVersions int
 
 	SemverConstraint string
+	TolerantVersions bool
 
 	Repository     string
 	RegistryMirror string
@@ -1544,9 +2183,14 @@ type SemverOrRegexTagCheckExample struct {
 
 	From *resource.Version
 
+	InitialTag string
+
 	Versions []string
 
 	NoHEAD bool
+
+	// HEAD requests respond with the wrong digest, and are disabled
+	BogusHEAD bool
 }
 
 func (example SemverOrRegexTagCheckExample) Run() {
@@ -1573,9 +2217,16 @@ func (example SemverOrRegexTagCheckExample) Run() {
 			Repository:       repo.Name(),
 			PreReleases:      example.PreReleases,
 			Variant:          example.Variant,
+			TagPrefix:        example.TagPrefix,
 			SemverConstraint: example.SemverConstraint,
+			TolerantVersions: example.TolerantVersions,
 			Regex:            example.Regex,
 			CreatedAtSort:    example.CreatedAtSort,
+			DedupeDigests:    example.DedupeDigests,
+			MaxVersions:      example.MaxVersions,
+			InitialTag:       resource.Tag(example.InitialTag),
+
+			DisableHeadRequests: example.BogusHEAD,
 		},
 	}
 
@@ -1642,6 +2293,25 @@ func (example SemverOrRegexTagCheckExample) Run() {
 					"Content-Length": {strconv.Itoa(len(manifest))},
 				}),
 			)
+		} else if example.BogusHEAD {
+			registryServer.RouteToHandler(
+				"HEAD",
+				"/v2/"+repo.RepositoryStr()+"/manifests/"+tag.Tag,
+				ghttp.RespondWith(http.StatusOK, manifest, http.Header{
+					"Content-Type":          {string(mediaType)},
+					"Content-Length":        {strconv.Itoa(len(manifest))},
+					"Docker-Content-Digest": {OLDER_FAKE_DIGEST},
+				}),
+			)
+			registryServer.RouteToHandler(
+				"GET",
+				"/v2/"+repo.RepositoryStr()+"/manifests/"+tag.Tag,
+				ghttp.RespondWith(http.StatusOK, manifest, http.Header{
+					"Content-Type":          {string(mediaType)},
+					"Content-Length":        {strconv.Itoa(len(manifest))},
+					"Docker-Content-Digest": {digest.String()},
+				}),
+			)
 		} else {
 			registryServer.RouteToHandler(
 				"HEAD",
@@ -1691,6 +2361,12 @@ func (example SemverOrRegexTagCheckExample) Run() {
 					"Content-Length": {strconv.Itoa(len(configBytes))},
 				}),
 			)
+
+			if example.NoHEAD {
+				// without HEAD the digest comes from the mutated manifest itself
+				digest, _, err = v1.SHA256(bytes.NewReader(mutatedManifest))
+				Expect(err).ToNot(HaveOccurred())
+			}
 		}
 
 		tagVersions[tag.Tag] = resource.Version{
@@ -1724,6 +2400,25 @@ func (example SemverOrRegexTagCheckExample) Run() {
 	}
 
 	Expect(res).To(Equal(expectedVersions))
+
+	if example.BogusHEAD {
+		for _, r := range registryServer.ReceivedRequests() {
+			Expect(r.Method).ToNot(Equal("HEAD"))
+		}
+	}
+
+	if example.NoHEAD {
+		manifestGETs := map[string]int{}
+		for _, r := range registryServer.ReceivedRequests() {
+			if r.Method == "GET" && strings.Contains(r.URL.Path, "/manifests/") {
+				manifestGETs[r.URL.Path]++
+			}
+		}
+
+		for path, count := range manifestGETs {
+			Expect(count).To(Equal(1), "manifest fetched more than once: "+path)
+		}
+	}
 }
 
 func (example SemverOrRegexTagCheckExample) check(req resource.CheckRequest) resource.CheckResponse {
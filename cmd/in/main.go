@@ -3,6 +3,7 @@ package main
 import (
 	"os"
 
+	resource "github.com/concourse/registry-image-resource"
 	"github.com/concourse/registry-image-resource/commands"
 	color "github.com/fatih/color"
 	"github.com/sirupsen/logrus"
@@ -21,6 +22,6 @@ func main() {
 	err := command.Execute()
 	if err != nil {
 		logrus.Errorf("%s", err)
-		os.Exit(1)
+		os.Exit(resource.ReportError(os.Stderr, err))
 	}
 }
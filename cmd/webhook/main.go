@@ -0,0 +1,46 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+
+	resource "github.com/concourse/registry-image-resource"
+	"github.com/sirupsen/logrus"
+)
+
+func main() {
+	if len(os.Args) < 2 {
+		logrus.Fatalf("usage: %s <config.json>", os.Args[0])
+	}
+
+	configFile, err := os.Open(os.Args[1])
+	if err != nil {
+		logrus.Fatalf("open config: %s", err)
+	}
+
+	var config resource.WebhookConfig
+	decoder := json.NewDecoder(configFile)
+	decoder.DisallowUnknownFields()
+	err = decoder.Decode(&config)
+	if err != nil {
+		logrus.Fatalf("invalid config: %s", err)
+	}
+
+	configFile.Close()
+
+	if config.Listen == "" {
+		config.Listen = ":8080"
+	}
+
+	if config.Secret == "" {
+		logrus.Warnf("no secret configured; accepting webhooks from anyone")
+	}
+
+	logrus.Infof("listening on %s", config.Listen)
+
+	err = http.ListenAndServe(config.Listen, resource.NewWebhookHandler(config, http.DefaultClient))
+	if err != nil {
+		logrus.Fatalf("%s", err)
+	}
+}
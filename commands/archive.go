@@ -0,0 +1,319 @@
+package commands
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/klauspost/compress/zstd"
+	"github.com/sirupsen/logrus"
+)
+
+// annotation used by containerd (and nerdctl) to name an image on import
+const containerdImageNameAnnotation = "io.containerd.image.name"
+
+// annotation used by OCI layouts to name an entry in index.json
+const ociRefNameAnnotation = "org.opencontainers.image.ref.name"
+
+// writeOCIArchive writes the image as a tarball of an OCI image layout,
+// annotating its entry in index.json with the given annotations.
+func writeOCIArchive(path string, image v1.Image, annotations map[string]string) error {
+	layoutDir, err := ioutil.TempDir("", "oci-layout")
+	if err != nil {
+		return fmt.Errorf("create layout dir: %w", err)
+	}
+
+	defer os.RemoveAll(layoutDir)
+
+	lp, err := layout.Write(layoutDir, empty.Index)
+	if err != nil {
+		return fmt.Errorf("initialize layout: %w", err)
+	}
+
+	err = lp.AppendImage(image, layout.WithAnnotations(annotations))
+	if err != nil {
+		return fmt.Errorf("append image to layout: %w", err)
+	}
+
+	archive, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("create archive: %w", err)
+	}
+
+	err = tarDir(archive, layoutDir)
+	if err != nil {
+		archive.Close()
+		return fmt.Errorf("archive layout: %w", err)
+	}
+
+	return archive.Close()
+}
+
+// tarDir writes the contents of dir to w as a tar stream, with paths relative
+// to dir.
+func tarDir(w io.Writer, dir string) error {
+	tw := tar.NewWriter(w)
+
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+
+		if rel == "." {
+			return nil
+		}
+
+		var link string
+		if info.Mode()&os.ModeSymlink != 0 {
+			link, err = os.Readlink(path)
+			if err != nil {
+				return err
+			}
+		}
+
+		hdr, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+
+		hdr.Name = filepath.ToSlash(rel)
+		if info.IsDir() {
+			hdr.Name += "/"
+		}
+
+		err = tw.WriteHeader(hdr)
+		if err != nil {
+			return err
+		}
+
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+
+		defer f.Close()
+
+		_, err = io.Copy(tw, f)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	return tw.Close()
+}
+
+// isOCIArchive returns whether the tarball contains an OCI image layout
+// rather than the manifest.json of `docker save`, e.g. the output of
+// `buildx -o type=oci`.
+func isOCIArchive(path string) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+
+	defer f.Close()
+
+	isLayout := false
+
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return false, err
+		}
+
+		switch filepath.Clean(hdr.Name) {
+		case "manifest.json":
+			// newer versions of `docker save` write both; prefer manifest.json
+			return false, nil
+		case "oci-layout":
+			isLayout = true
+		}
+	}
+
+	return isLayout, nil
+}
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// decompressArchive returns the path of the tarball decompressed to a
+// temporary file if it is compressed with gzip or zstd, or else the path
+// itself. Tarballs are read more than once while loading them, so they're
+// only decompressed once up front.
+func decompressArchive(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+
+	defer f.Close()
+
+	magic := make([]byte, len(zstdMagic))
+	n, err := io.ReadFull(f, magic)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", err
+	}
+
+	magic = magic[:n]
+
+	_, err = f.Seek(0, io.SeekStart)
+	if err != nil {
+		return "", err
+	}
+
+	var r io.Reader
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		gr, err := gzip.NewReader(f)
+		if err != nil {
+			return "", fmt.Errorf("decompress gzip: %w", err)
+		}
+
+		defer gr.Close()
+
+		r = gr
+	case bytes.HasPrefix(magic, zstdMagic):
+		zr, err := zstd.NewReader(f)
+		if err != nil {
+			return "", fmt.Errorf("decompress zstd: %w", err)
+		}
+
+		defer zr.Close()
+
+		r = zr
+	default:
+		return path, nil
+	}
+
+	logrus.Debugf("decompressing %s", path)
+
+	// read while pushing, so the file is left for the container to be cleaned
+	// up with
+	decompressed, err := ioutil.TempFile("", "image-*.tar")
+	if err != nil {
+		return "", fmt.Errorf("create decompressed tarball: %w", err)
+	}
+
+	_, err = io.Copy(decompressed, r)
+	if err != nil {
+		decompressed.Close()
+		return "", fmt.Errorf("decompress %s: %w", path, err)
+	}
+
+	err = decompressed.Close()
+	if err != nil {
+		return "", err
+	}
+
+	return decompressed.Name(), nil
+}
+
+// extractOCIArchive extracts the OCI image layout in the tarball to dir.
+func extractOCIArchive(path string, dir string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+
+	defer f.Close()
+
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return err
+		}
+
+		if !filepath.IsLocal(hdr.Name) {
+			return fmt.Errorf("invalid path in archive: %s", hdr.Name)
+		}
+
+		dest := filepath.Join(dir, filepath.FromSlash(hdr.Name))
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(dest, 0755)
+			if err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			err = os.MkdirAll(filepath.Dir(dest), 0755)
+			if err != nil {
+				return err
+			}
+
+			file, err := os.Create(dest)
+			if err != nil {
+				return err
+			}
+
+			_, err = io.Copy(file, tr)
+			if err != nil {
+				file.Close()
+				return err
+			}
+
+			err = file.Close()
+			if err != nil {
+				return err
+			}
+		default:
+			// layouts only contain files and directories
+		}
+	}
+
+	return nil
+}
+
+// containerdImageName returns the fully-qualified name containerd would use
+// for the reference, e.g. docker.io/library/busybox:latest.
+func containerdImageName(ref name.Reference) string {
+	registry := ref.Context().RegistryStr()
+	if registry == name.DefaultRegistry {
+		// containerd normalizes Docker Hub references to docker.io
+		registry = "docker.io"
+	}
+
+	imageName := registry + "/" + ref.Context().RepositoryStr()
+
+	switch r := ref.(type) {
+	case name.Tag:
+		if r.TagStr() != "" {
+			imageName += ":" + r.TagStr()
+		}
+	case name.Digest:
+		imageName += "@" + r.DigestStr()
+	}
+
+	return imageName
+}
@@ -0,0 +1,108 @@
+package commands
+
+import (
+	"encoding/json"
+	"fmt"
+
+	resource "github.com/concourse/registry-image-resource"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/partial"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+// setArtifactType applies the artifact_type and config_media_type params to
+// the image or index to push.
+func setArtifactType(img partial.WithRawManifest, params resource.PutParams) (partial.WithRawManifest, error) {
+	if params.ConfigMediaType != "" {
+		image, ok := img.(v1.Image)
+		if !ok {
+			return nil, resource.Invalid("config_media_type requires an image, got %T", img)
+		}
+
+		img = mutate.ConfigMediaType(image, types.MediaType(params.ConfigMediaType))
+	}
+
+	if params.ArtifactType == "" {
+		return img, nil
+	}
+
+	// artifactType is only defined for OCI manifests
+	switch t := img.(type) {
+	case v1.Image:
+		return artifactImage{
+			Image:        mutate.MediaType(t, types.OCIManifestSchema1),
+			artifactType: params.ArtifactType,
+		}, nil
+	case v1.ImageIndex:
+		return artifactIndex{
+			ImageIndex:   mutate.IndexMediaType(t, types.OCIImageIndex),
+			artifactType: params.ArtifactType,
+		}, nil
+	default:
+		return nil, fmt.Errorf("cannot set artifact type of type (%T)", img)
+	}
+}
+
+// withArtifactType adds the artifactType field to a manifest, which
+// go-containerregistry doesn't model.
+func withArtifactType(manifest []byte, artifactType string) ([]byte, error) {
+	var fields map[string]json.RawMessage
+	err := json.Unmarshal(manifest, &fields)
+	if err != nil {
+		return nil, err
+	}
+
+	fields["artifactType"], err = json.Marshal(artifactType)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(fields)
+}
+
+type artifactImage struct {
+	v1.Image
+
+	artifactType string
+}
+
+func (i artifactImage) RawManifest() ([]byte, error) {
+	manifest, err := i.Image.RawManifest()
+	if err != nil {
+		return nil, err
+	}
+
+	return withArtifactType(manifest, i.artifactType)
+}
+
+func (i artifactImage) Digest() (v1.Hash, error) {
+	return partial.Digest(i)
+}
+
+func (i artifactImage) Size() (int64, error) {
+	return partial.Size(i)
+}
+
+type artifactIndex struct {
+	v1.ImageIndex
+
+	artifactType string
+}
+
+func (i artifactIndex) RawManifest() ([]byte, error) {
+	manifest, err := i.ImageIndex.RawManifest()
+	if err != nil {
+		return nil, err
+	}
+
+	return withArtifactType(manifest, i.artifactType)
+}
+
+func (i artifactIndex) Digest() (v1.Hash, error) {
+	return partial.Digest(i)
+}
+
+func (i artifactIndex) Size() (int64, error) {
+	return partial.Size(i)
+}
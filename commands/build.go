@@ -0,0 +1,92 @@
+package commands
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	resource "github.com/concourse/registry-image-resource"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+)
+
+// buildImage constructs a single-layer image from the rootfs directory
+// configured in params, applying the env and user from its metadata.json
+// along with any process configuration from params.
+func buildImage(src string, params resource.PutParams, platform resource.PlatformField) (v1.Image, error) {
+	rootfs := filepath.Join(src, params.Rootfs)
+
+	stat, err := os.Stat(rootfs)
+	if err != nil {
+		return nil, err
+	}
+
+	if !stat.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", rootfs)
+	}
+
+	layer, err := tarball.LayerFromOpener(func() (io.ReadCloser, error) {
+		pr, pw := io.Pipe()
+		go func() {
+			pw.CloseWithError(tarDir(pw, rootfs))
+		}()
+
+		return pr, nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("create layer: %w", err)
+	}
+
+	img, err := mutate.AppendLayers(empty.Image, layer)
+	if err != nil {
+		return nil, fmt.Errorf("append layer: %w", err)
+	}
+
+	cfg, err := img.ConfigFile()
+	if err != nil {
+		return nil, fmt.Errorf("get image config: %w", err)
+	}
+
+	plat := platform.V1Platform()
+
+	cfg = cfg.DeepCopy()
+	cfg.OS = plat.OS
+	cfg.Architecture = plat.Architecture
+	cfg.Variant = plat.Variant
+
+	if params.Metadata != "" {
+		metaFile, err := os.Open(filepath.Join(src, params.Metadata))
+		if err != nil {
+			return nil, fmt.Errorf("open metadata: %w", err)
+		}
+
+		defer metaFile.Close()
+
+		var meta ImageMetadata
+		err = json.NewDecoder(metaFile).Decode(&meta)
+		if err != nil {
+			return nil, fmt.Errorf("parse metadata: %w", err)
+		}
+
+		cfg.Config.Env = meta.Env
+		cfg.Config.User = meta.User
+	}
+
+	if len(params.Entrypoint) > 0 {
+		cfg.Config.Entrypoint = params.Entrypoint
+	}
+
+	if len(params.Cmd) > 0 {
+		cfg.Config.Cmd = params.Cmd
+	}
+
+	if params.WorkingDir != "" {
+		cfg.Config.WorkingDir = params.WorkingDir
+	}
+
+	return mutate.ConfigFile(img, cfg)
+}
@@ -0,0 +1,257 @@
+package commands
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	resource "github.com/concourse/registry-image-resource"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+const runtimeSpecVersion = "1.0.2"
+
+// RuntimeSpec is the subset of the OCI runtime spec's config.json needed to
+// run an image's default process with runc.
+type RuntimeSpec struct {
+	OCIVersion string         `json:"ociVersion"`
+	Process    RuntimeProcess `json:"process"`
+	Root       RuntimeRoot    `json:"root"`
+	Hostname   string         `json:"hostname,omitempty"`
+	Mounts     []RuntimeMount `json:"mounts,omitempty"`
+	Linux      *RuntimeLinux  `json:"linux,omitempty"`
+}
+
+type RuntimeProcess struct {
+	Terminal bool        `json:"terminal"`
+	User     RuntimeUser `json:"user"`
+	Args     []string    `json:"args"`
+	Env      []string    `json:"env,omitempty"`
+	Cwd      string      `json:"cwd"`
+}
+
+type RuntimeUser struct {
+	UID uint32 `json:"uid"`
+	GID uint32 `json:"gid"`
+}
+
+type RuntimeRoot struct {
+	Path     string `json:"path"`
+	Readonly bool   `json:"readonly"`
+}
+
+type RuntimeMount struct {
+	Destination string   `json:"destination"`
+	Type        string   `json:"type,omitempty"`
+	Source      string   `json:"source,omitempty"`
+	Options     []string `json:"options,omitempty"`
+}
+
+type RuntimeLinux struct {
+	Namespaces []RuntimeNamespace `json:"namespaces"`
+}
+
+type RuntimeNamespace struct {
+	Type string `json:"type"`
+}
+
+// defaultMounts mirrors the mounts generated by `runc spec`
+var defaultMounts = []RuntimeMount{
+	{Destination: "/proc", Type: "proc", Source: "proc"},
+	{Destination: "/dev", Type: "tmpfs", Source: "tmpfs", Options: []string{"nosuid", "strictatime", "mode=755", "size=65536k"}},
+	{Destination: "/dev/pts", Type: "devpts", Source: "devpts", Options: []string{"nosuid", "noexec", "newinstance", "ptmxmode=0666", "mode=0620", "gid=5"}},
+	{Destination: "/dev/shm", Type: "tmpfs", Source: "shm", Options: []string{"nosuid", "noexec", "nodev", "mode=1777", "size=65536k"}},
+	{Destination: "/dev/mqueue", Type: "mqueue", Source: "mqueue", Options: []string{"nosuid", "noexec", "nodev"}},
+	{Destination: "/sys", Type: "sysfs", Source: "sysfs", Options: []string{"nosuid", "noexec", "nodev", "ro"}},
+}
+
+func runtimeBundleFormat(dest string, image v1.Image, debug bool, heartbeat time.Duration, limits resource.ExtractLimits, owner *resource.RootfsOwner, stderr io.Writer) error {
+	err := rootfsFormat(dest, image, debug, heartbeat, limits, owner, stderr)
+	if err != nil {
+		return err
+	}
+
+	cfg, err := image.ConfigFile()
+	if err != nil {
+		return fmt.Errorf("inspect image config: %w", err)
+	}
+
+	rootfs := filepath.Join(dest, "rootfs")
+
+	user, err := resolveUser(rootfs, cfg.Config.User)
+	if err != nil {
+		return fmt.Errorf("resolve user %q: %w", cfg.Config.User, err)
+	}
+
+	cwd := cfg.Config.WorkingDir
+	if cwd == "" {
+		cwd = "/"
+	}
+
+	args := append(append([]string{}, cfg.Config.Entrypoint...), cfg.Config.Cmd...)
+	if len(args) == 0 {
+		args = []string{"sh"}
+	}
+
+	spec := RuntimeSpec{
+		OCIVersion: runtimeSpecVersion,
+		Process: RuntimeProcess{
+			User: user,
+			Args: args,
+			Env:  cfg.Config.Env,
+			Cwd:  cwd,
+		},
+		Root: RuntimeRoot{
+			Path: "rootfs",
+		},
+		Hostname: cfg.Config.Hostname,
+		Mounts:   defaultMounts,
+		Linux: &RuntimeLinux{
+			Namespaces: []RuntimeNamespace{
+				{Type: "pid"},
+				{Type: "network"},
+				{Type: "ipc"},
+				{Type: "uts"},
+				{Type: "mount"},
+			},
+		},
+	}
+
+	specFile, err := os.Create(filepath.Join(dest, "config.json"))
+	if err != nil {
+		return fmt.Errorf("create runtime config: %w", err)
+	}
+
+	enc := json.NewEncoder(specFile)
+	enc.SetIndent("", "  ")
+
+	err = enc.Encode(spec)
+	if err != nil {
+		specFile.Close()
+		return fmt.Errorf("write runtime config: %w", err)
+	}
+
+	err = specFile.Close()
+	if err != nil {
+		return fmt.Errorf("close runtime config file: %w", err)
+	}
+
+	return nil
+}
+
+// resolveUser converts an image config's user ("user", "uid", "user:group",
+// "uid:gid", etc.) to numeric IDs, consulting the rootfs's /etc/passwd and
+// /etc/group for names.
+func resolveUser(rootfs string, spec string) (RuntimeUser, error) {
+	if spec == "" {
+		return RuntimeUser{}, nil
+	}
+
+	userPart, groupPart := spec, ""
+	if i := strings.Index(spec, ":"); i != -1 {
+		userPart, groupPart = spec[:i], spec[i+1:]
+	}
+
+	var user RuntimeUser
+
+	if uid, err := strconv.ParseUint(userPart, 10, 32); err == nil {
+		user.UID = uint32(uid)
+
+		// use the user's primary group if one is listed
+		if entry, found, err := lookupIDFile(filepath.Join(rootfs, "etc", "passwd"), 2, userPart); err != nil {
+			return RuntimeUser{}, err
+		} else if found {
+			gid, err := strconv.ParseUint(entry[3], 10, 32)
+			if err != nil {
+				return RuntimeUser{}, fmt.Errorf("parse gid for %s: %w", userPart, err)
+			}
+
+			user.GID = uint32(gid)
+		}
+	} else {
+		entry, found, err := lookupIDFile(filepath.Join(rootfs, "etc", "passwd"), 0, userPart)
+		if err != nil {
+			return RuntimeUser{}, err
+		}
+
+		if !found {
+			return RuntimeUser{}, fmt.Errorf("user %s not found in /etc/passwd", userPart)
+		}
+
+		uid, err := strconv.ParseUint(entry[2], 10, 32)
+		if err != nil {
+			return RuntimeUser{}, fmt.Errorf("parse uid for %s: %w", userPart, err)
+		}
+
+		gid, err := strconv.ParseUint(entry[3], 10, 32)
+		if err != nil {
+			return RuntimeUser{}, fmt.Errorf("parse gid for %s: %w", userPart, err)
+		}
+
+		user.UID = uint32(uid)
+		user.GID = uint32(gid)
+	}
+
+	if groupPart == "" {
+		return user, nil
+	}
+
+	if gid, err := strconv.ParseUint(groupPart, 10, 32); err == nil {
+		user.GID = uint32(gid)
+		return user, nil
+	}
+
+	entry, found, err := lookupIDFile(filepath.Join(rootfs, "etc", "group"), 0, groupPart)
+	if err != nil {
+		return RuntimeUser{}, err
+	}
+
+	if !found {
+		return RuntimeUser{}, fmt.Errorf("group %s not found in /etc/group", groupPart)
+	}
+
+	gid, err := strconv.ParseUint(entry[2], 10, 32)
+	if err != nil {
+		return RuntimeUser{}, fmt.Errorf("parse gid for %s: %w", groupPart, err)
+	}
+
+	user.GID = uint32(gid)
+
+	return user, nil
+}
+
+// lookupIDFile finds the first line of a passwd(5) or group(5) style file
+// whose field at the given index matches value. A missing file is treated as
+// empty.
+func lookupIDFile(path string, field int, value string) ([]string, bool, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, false, nil
+		}
+
+		return nil, false, err
+	}
+
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		entry := strings.Split(scanner.Text(), ":")
+		if len(entry) < 4 {
+			continue
+		}
+
+		if entry[field] == value {
+			return entry, true, nil
+		}
+	}
+
+	return nil, false, scanner.Err()
+}
@@ -7,7 +7,9 @@ import (
 	"net/http"
 	"regexp"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/Masterminds/semver/v3"
@@ -44,47 +46,130 @@ func (c *Check) Execute() error {
 	setupLogging(c.stderr)
 
 	var req resource.CheckRequest
-	decoder := json.NewDecoder(c.stdin)
-	decoder.DisallowUnknownFields()
-	err := decoder.Decode(&req)
+	err := decodeRequest(c.stdin, &req)
 	if err != nil {
-		return fmt.Errorf("invalid payload: %s", err)
+		return err
 	}
 
-	if req.Source.AwsRegion != "" {
-		if !req.Source.AuthenticateToECR() {
-			return fmt.Errorf("cannot authenticate with ECR")
+	response, err := ResolveVersions(req)
+	if err != nil {
+		return err
+	}
+
+	err = json.NewEncoder(c.stdout).Encode(response)
+	if err != nil {
+		return fmt.Errorf("could not marshal JSON: %s", err)
+	}
+
+	return nil
+}
+
+// ResolveVersions returns the versions of the image configured by the
+// source, starting from the given version if any, as `check` does.
+// Calls run one at a time; see resource.Source.StartTimeout.
+func ResolveVersions(req resource.CheckRequest) (resource.CheckResponse, error) {
+	timeout, err := req.Source.StartTimeout()
+	if err != nil {
+		return nil, err
+	}
+
+	defer timeout.Stop()
+
+	response, err := resolveVersions(req)
+	return response, timeout.Explain(err)
+}
+
+func resolveVersions(req resource.CheckRequest) (resource.CheckResponse, error) {
+	err := req.Source.SplitReference()
+	if err != nil {
+		return resource.CheckResponse{}, resource.Categorize(resource.CategoryValidation, err)
+	}
+
+	err = req.Source.Authenticate()
+	if err != nil {
+		return resource.CheckResponse{}, err
+	}
+
+	err = req.Source.CheckAllowedRegistries()
+	if err != nil {
+		return resource.CheckResponse{}, err
+	}
+
+	err = checkPinPolicy(req.Source)
+	if err != nil {
+		return resource.CheckResponse{}, err
+	}
+
+	from := req.Version
+	if from == nil {
+		from, err = req.Source.InitialVersion()
+		if err != nil {
+			return resource.CheckResponse{}, err
 		}
 	}
 
-	mirrorSource, hasMirror, err := req.Source.Mirror()
+	sources, err := req.Source.SourcesToTry(true)
 	if err != nil {
-		return fmt.Errorf("failed to resolve mirror: %w", err)
+		return resource.CheckResponse{}, fmt.Errorf("failed to resolve mirror: %w", err)
 	}
 
 	var response resource.CheckResponse
 
-	if hasMirror {
-		response, err = check(mirrorSource, req.Version)
+	for i, source := range sources {
+		response, err = check(source, from)
+		if i == len(sources)-1 {
+			if err != nil {
+				return resource.CheckResponse{}, fmt.Errorf("checking %s failed: %w", source.Repository, err)
+			}
+
+			break
+		}
+
 		if err != nil {
-			logrus.Warnf("checking mirror %s failed: %s", mirrorSource.Repository, err)
+			logrus.Warnf("checking %s failed: %s", source.Repository, err)
 		} else if len(response) == 0 {
-			logrus.Warnf("checking mirror %s failed: tag not found", mirrorSource.Repository)
+			logrus.Warnf("checking %s failed: tag not found", source.Repository)
+		} else {
+			break
 		}
 	}
 
-	if len(response) == 0 {
-		response, err = check(req.Source, req.Version)
+	if len(req.Source.AwsECRIgnoreTagStatus) > 0 {
+		response, err = filterECRImages(req.Source, response)
 		if err != nil {
-			return fmt.Errorf("checking origin %s failed: %w", req.Source.Repository, err)
+			return resource.CheckResponse{}, err
 		}
 	}
 
-	err = json.NewEncoder(c.stdout).Encode(response)
-	if err != nil {
-		return fmt.Errorf("could not marshal JSON: %s", err)
+	if req.Source.ContentTrust != nil && req.Source.ContentTrust.Verify {
+		err = verifyContentTrust(req.Source, response...)
+		if err != nil {
+			return resource.CheckResponse{}, fmt.Errorf("content trust: %w", err)
+		}
+	}
+
+	return response, nil
+}
+
+func checkPinPolicy(source resource.Source) error {
+	switch source.PinPolicy {
+	case "":
+		return nil
+	case "warn", "fail":
+	default:
+		return resource.Invalid("unknown pin_policy %q (must be 'warn' or 'fail')", source.PinPolicy)
 	}
 
+	if !source.TracksFloatingTag() {
+		return nil
+	}
+
+	if source.PinPolicy == "fail" {
+		return resource.Invalid("tracking mutable tag %q is not allowed by pin_policy; track a version instead", source.Tag)
+	}
+
+	logrus.Warnf("tracking mutable tag %q; consider tracking a version instead", source.Tag)
+
 	return nil
 }
 
@@ -99,18 +184,31 @@ func check(source resource.Source, from *resource.Version) (resource.CheckRespon
 		return resource.CheckResponse{}, err
 	}
 
-	if source.Tag != "" {
-		return checkTag(repo.Tag(source.Tag.String()), source, from, opts...)
+	var response resource.CheckResponse
+	if source.Digest != "" {
+		response, err = checkDigest(repo.Digest(source.Digest), source, opts...)
+	} else if source.Tag != "" {
+		response, err = checkTag(repo.Tag(source.Tag.String()), source, from, opts...)
 	} else if source.Regex != "" {
-		return checkRepositoryRegex(repo, source, from, opts...)
+		response, err = checkRepositoryRegex(repo, source, from, opts...)
 	} else {
-		return checkRepository(repo, source, from, opts...)
+		response, err = checkRepository(repo, source, from, opts...)
+	}
+	if err != nil || len(source.LabelFilters) == 0 {
+		return response, err
 	}
+
+	return filterLabels(repo, source, response, opts...)
 }
 
 func checkRepository(repo name.Repository, source resource.Source, from *resource.Version, opts ...remote.Option) (resource.CheckResponse, error) {
 	tags, err := remote.List(repo, opts...)
 	if err != nil {
+		if isNewImage(err) {
+			// nothing has been pushed yet
+			return resource.CheckResponse{}, nil
+		}
+
 		return resource.CheckResponse{}, fmt.Errorf("list repository tags: %w", err)
 	}
 
@@ -126,13 +224,6 @@ func checkRepository(repo name.Repository, source resource.Source, from *resourc
 	var cursorVer *semver.Version
 	var latestTag string
 
-	if from != nil {
-		// assess the 'from' tag first so we can skip lower version numbers
-		sort.Slice(tags, func(i, j int) bool {
-			return tags[i] == from.Tag
-		})
-	}
-
 	var constraint *semver.Constraints
 	if source.SemverConstraint != "" {
 		constraint, err = semver.NewConstraint(source.SemverConstraint)
@@ -141,6 +232,7 @@ func checkRepository(repo name.Repository, source resource.Source, from *resourc
 		}
 	}
 
+	var candidates []tagCandidate
 	for _, identifier := range tags {
 		var ver *semver.Version
 		if identifier == bareTag {
@@ -155,7 +247,15 @@ func checkRepository(repo name.Repository, source resource.Source, from *resourc
 				verStr = strings.TrimSuffix(identifier, "-"+source.Variant)
 			}
 
-			ver, err = semver.NewVersion(verStr)
+			if source.TagPrefix != "" {
+				if !strings.HasPrefix(verStr, source.TagPrefix) {
+					continue
+				}
+
+				verStr = strings.TrimPrefix(verStr, source.TagPrefix)
+			}
+
+			ver, err = parseVersion(verStr, source.TolerantVersions)
 			if err != nil {
 				// not a version
 				continue
@@ -185,25 +285,90 @@ func checkRepository(repo name.Repository, source resource.Source, from *resourc
 					continue
 				}
 			}
+		}
 
-			if cursorVer != nil && (cursorVer.GreaterThan(ver) || cursorVer.Equal(ver)) {
-				// optimization: don't bother fetching digests for lesser (or equal but
-				// less specific, i.e. 6.3 vs 6.3.0) version tags
+		candidates = append(candidates, tagCandidate{
+			Identifier: identifier,
+			Version:    ver,
+		})
+	}
+
+	if source.MaxVersions > 0 {
+		candidates = newestCandidates(candidates, source.MaxVersions, from)
+	}
+
+	var resolved map[string]resolvedTag
+	if from != nil {
+		// resolve the 'from' tag first so we can skip lower version numbers
+		for _, candidate := range candidates {
+			if candidate.Identifier != from.Tag {
 				continue
 			}
+
+			resolved, err = resolveDigests(repo, source, []string{from.Tag}, opts...)
+			if err != nil {
+				return resource.CheckResponse{}, err
+			}
+
+			tag := resolved[from.Tag]
+			if tag.Found && (from.Digest == "" || tag.Digest.String() == from.Digest) {
+				// if the 'from' version exists and has the same digest, treat its
+				// version as a cursor in the tags, only considering newer versions
+				//
+				// an initial_tag without an initial_digest matches whichever digest
+				// the tag currently points to
+				cursorVer = candidate.Version
+			}
 		}
+	}
 
-		tagRef := repo.Tag(identifier)
+	var toResolve []string
+	var considered []tagCandidate
+	for _, candidate := range candidates {
+		if candidate.Version != nil && cursorVer != nil && candidate.Identifier != from.Tag && compareVersions(cursorVer, candidate.Version) >= 0 {
+			// optimization: don't bother fetching digests for lesser (or equal but
+			// less specific, i.e. 6.3 vs 6.3.0) version tags
+			continue
+		}
 
-		digest, found, err := headOrGet(tagRef, opts...)
-		if err != nil {
-			return resource.CheckResponse{}, fmt.Errorf("get tag digest: %w", err)
+		considered = append(considered, candidate)
+
+		if _, found := resolved[candidate.Identifier]; !found {
+			toResolve = append(toResolve, candidate.Identifier)
+		}
+	}
+
+	more, err := resolveDigests(repo, source, toResolve, opts...)
+	if err != nil {
+		return resource.CheckResponse{}, err
+	}
+
+	if resolved == nil {
+		resolved = more
+	} else {
+		for identifier, tag := range more {
+			resolved[identifier] = tag
 		}
+	}
+
+	if from != nil {
+		// the 'from' version wins ties between tags of the same digest
+		sort.SliceStable(considered, func(i, j int) bool {
+			return considered[i].Identifier == from.Tag && considered[j].Identifier != from.Tag
+		})
+	}
 
-		if !found {
+	for _, candidate := range considered {
+		identifier, ver := candidate.Identifier, candidate.Version
+
+		tag := resolved[identifier]
+		if !tag.Found {
 			continue
 		}
 
+		digest := tag.Digest
+		tagRef := repo.Tag(identifier)
+
 		tagDigests[identifier] = digest.String()
 
 		if ver != nil {
@@ -219,7 +384,7 @@ func checkRepository(repo name.Repository, source resource.Source, from *resourc
 				} else if existing.Prerelease() != "" && ver.Prerelease() == "" {
 					// favor final version over prereleases
 					shouldSet = true
-				} else if strings.Count(ver.Original(), ".") > strings.Count(existing.Original(), ".") {
+				} else if specificity(ver) > specificity(existing) {
 					// favor more specific semver tag (i.e. 3.2.1 over 3.2, 1.0.0-rc.2 over 1.0.0-rc)
 					shouldSet = true
 				}
@@ -229,14 +394,6 @@ func checkRepository(repo name.Repository, source resource.Source, from *resourc
 				digestVersions[digest.String()] = ver
 			}
 		}
-
-		if from != nil && identifier == from.Tag && digest.String() == from.Digest {
-			// if the 'from' version exists and has the same digest, treat its
-			// version as a cursor in the tags, only considering newer versions
-			//
-			// note: the 'from' version will always be the first one hit by this loop
-			cursorVer = ver
-		}
 	}
 
 	var tagVersions TagVersions
@@ -274,16 +431,56 @@ func checkRepository(repo name.Repository, source resource.Source, from *resourc
 	return response, nil
 }
 
+// tagCandidate is a tag which passed the version filters, whose digest is yet
+// to be fetched. Version is nil for the bare tag, e.g. 'latest'.
+type tagCandidate struct {
+	Identifier string
+	Version    *semver.Version
+}
+
+// newestCandidates keeps the bare tag and the newest max version tags, so that
+// digests aren't fetched for every tag of repositories with thousands of
+// them. The 'from' tag is kept too, so it still acts as the cursor.
+func newestCandidates(candidates []tagCandidate, max int, from *resource.Version) []tagCandidate {
+	var versioned []tagCandidate
+	var kept []tagCandidate
+	for _, candidate := range candidates {
+		if candidate.Version == nil {
+			kept = append(kept, candidate)
+		} else {
+			versioned = append(versioned, candidate)
+		}
+	}
+
+	sort.SliceStable(versioned, func(i, j int) bool {
+		return compareVersions(versioned[i].Version, versioned[j].Version) > 0
+	})
+
+	for i, candidate := range versioned {
+		if i < max || (from != nil && candidate.Identifier == from.Tag) {
+			kept = append(kept, candidate)
+		}
+	}
+
+	return kept
+}
+
 func checkRepositoryRegex(repo name.Repository, source resource.Source, from *resource.Version, opts ...remote.Option) (resource.CheckResponse, error) {
 	tags, err := remote.List(repo, opts...)
 	if err != nil {
+		if isNewImage(err) {
+			// nothing has been pushed yet
+			return resource.CheckResponse{}, nil
+		}
+
 		return resource.CheckResponse{}, fmt.Errorf("list repository tags: %w", err)
 	}
 
 	tagDigests := map[string]string{}
-	tagToTimeDigests := map[string]time.Time{}
+	fetchedDigests := map[string]*remote.Descriptor{}
 	matchedTags := make([]string, 0)
 
+	regexTags := []string{}
 	for _, identifier := range tags {
 		regex, _ := regexp.Compile(source.Regex)
 		if !regex.MatchString(identifier) {
@@ -291,30 +488,31 @@ func checkRepositoryRegex(repo name.Repository, source resource.Source, from *re
 			continue
 		}
 
-		tagRef := repo.Tag(identifier)
+		regexTags = append(regexTags, identifier)
+	}
 
-		digest, found, err := headOrGet(tagRef, opts...)
-		if err != nil {
-			return resource.CheckResponse{}, fmt.Errorf("get tag digest: %w", err)
-		}
+	if source.MaxVersions > 0 && !source.CreatedAtSort && len(regexTags) > source.MaxVersions {
+		// the last tags listed are emitted as the newest versions; sorting by
+		// creation time needs every digest, so those are limited once sorted
+		regexTags = regexTags[len(regexTags)-source.MaxVersions:]
+	}
+
+	resolved, err := resolveDigests(repo, source, regexTags, opts...)
+	if err != nil {
+		return resource.CheckResponse{}, err
+	}
 
-		if !found {
+	for _, identifier := range regexTags {
+		tag := resolved[identifier]
+		if !tag.Found {
 			continue
 		}
 
-		if source.CreatedAtSort {
-			// Call Get to get the Image and History of the tag
-			img, err := remote.Image(tagRef, opts...)
-			if err != nil {
-				return resource.CheckResponse{}, fmt.Errorf("get remote image: %w", err)
-			}
+		digest, fetched := tag.Digest, tag.Fetched
 
-			// This calls /blobs/sha256:<digest> to get the config file
-			configFile, err := img.ConfigFile()
-			if err != nil {
-				return resource.CheckResponse{}, fmt.Errorf("get remote image config file: %w", err)
-			}
-			tagToTimeDigests[identifier] = configFile.Created.Time
+		if fetched != nil {
+			// reuse the manifest already fetched by the GET fallback
+			fetchedDigests[digest.String()] = fetched
 		}
 
 		matchedTags = append(matchedTags, identifier)
@@ -322,13 +520,27 @@ func checkRepositoryRegex(repo name.Repository, source resource.Source, from *re
 		tagDigests[identifier] = digest.String()
 	}
 
-	// If CreatedAtSort is true, sort the matchedTags in descending order by looking up Time in tagToTimeDigests
+	// If CreatedAtSort is true, sort the matchedTags in descending order by looking up Time in digestTimes
 	if source.CreatedAtSort {
-		sort.Slice(matchedTags, func(i, j int) bool {
-			return tagToTimeDigests[matchedTags[i]].Before(tagToTimeDigests[matchedTags[j]])
+		digestTimes, err := createdAtTimes(repo, source, tagDigests, fetchedDigests, opts...)
+		if err != nil {
+			return resource.CheckResponse{}, err
+		}
+
+		// tags sharing a digest keep the order they were listed in
+		sort.SliceStable(matchedTags, func(i, j int) bool {
+			return digestTimes[tagDigests[matchedTags[i]]].Before(digestTimes[tagDigests[matchedTags[j]]])
 		})
 	}
 
+	if source.DedupeDigests {
+		matchedTags = dedupeDigests(matchedTags, tagDigests)
+	}
+
+	if source.MaxVersions > 0 && len(matchedTags) > source.MaxVersions {
+		matchedTags = matchedTags[len(matchedTags)-source.MaxVersions:]
+	}
+
 	response := resource.CheckResponse{}
 
 	// Using matchedTags here maintains the order of the response to the list tags call
@@ -342,6 +554,299 @@ func checkRepositoryRegex(repo name.Repository, source resource.Source, from *re
 	return response, nil
 }
 
+// dedupeDigests keeps one of the tags pointing to each digest, preferring the
+// most specific tag (e.g. 1.2.3 over 1.2 or latest), and then the newest. Each
+// kept tag takes the position of the newest tag of its digest.
+func dedupeDigests(tags []string, tagDigests map[string]string) []string {
+	kept := map[string]string{}
+	newest := map[string]int{}
+	for i, tag := range tags {
+		digest := tagDigests[tag]
+
+		existing, found := kept[digest]
+		if !found || tagSpecificity(tag) >= tagSpecificity(existing) {
+			kept[digest] = tag
+		}
+
+		newest[digest] = i
+	}
+
+	deduped := []string{}
+	for i, tag := range tags {
+		digest := tagDigests[tag]
+		if newest[digest] == i {
+			deduped = append(deduped, kept[digest])
+		}
+	}
+
+	return deduped
+}
+
+// tagSpecificity counts the separators in a tag, e.g. 1.2.3-alpine is more
+// specific than 1.2.3, which is more specific than 1.2.
+func tagSpecificity(tag string) int {
+	return strings.Count(tag, ".") + strings.Count(tag, "-") + strings.Count(tag, "_")
+}
+
+// resolvedTag is the digest a tag points to, if it was found.
+type resolvedTag struct {
+	Digest v1.Hash
+	Found  bool
+
+	// the manifest, if it was fetched by the GET fallback
+	Fetched *remote.Descriptor
+}
+
+// resolveDigests fetches the digest of each tag, check_concurrency at a time,
+// retrying any which are rate limited.
+func resolveDigests(repo name.Repository, source resource.Source, tags []string, opts ...remote.Option) (map[string]resolvedTag, error) {
+	resolved := make(map[string]resolvedTag, len(tags))
+
+	var lock sync.Mutex
+	err := forEachConcurrently(source.CheckWorkers(), tags, func(identifier string) error {
+		var tag resolvedTag
+		err := resource.RetryOnRateLimit(func() error {
+			var err error
+			tag.Digest, tag.Fetched, tag.Found, err = headOrGet(repo.Tag(identifier), source, opts...)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("get tag digest: %w", err)
+		}
+
+		lock.Lock()
+		resolved[identifier] = tag
+		lock.Unlock()
+
+		return nil
+	})
+
+	return resolved, err
+}
+
+// filterLabels omits versions whose image doesn't have the labels configured
+// by label_filters, fetching the config of each distinct digest.
+func filterLabels(repo name.Repository, source resource.Source, response resource.CheckResponse, opts ...remote.Option) (resource.CheckResponse, error) {
+	var digests []string
+	seen := map[string]bool{}
+	for _, version := range response {
+		if !seen[version.Digest] {
+			seen[version.Digest] = true
+			digests = append(digests, version.Digest)
+		}
+	}
+
+	var lock sync.Mutex
+	matches := map[string]bool{}
+	err := forEachConcurrently(source.CheckWorkers(), digests, func(digest string) error {
+		var labels map[string]string
+		err := resource.RetryOnRateLimit(func() error {
+			var err error
+			labels, err = imageLabels(repo.Digest(digest), opts...)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("get labels of %s: %w", digest, err)
+		}
+
+		matched := true
+		for key, value := range source.LabelFilters {
+			if labels[key] != value {
+				logrus.Debugf("skipping %s: label %s is %q, not %q", digest, key, labels[key], value)
+				matched = false
+				break
+			}
+		}
+
+		lock.Lock()
+		matches[digest] = matched
+		lock.Unlock()
+
+		return nil
+	})
+	if err != nil {
+		return resource.CheckResponse{}, err
+	}
+
+	filtered := resource.CheckResponse{}
+	for _, version := range response {
+		if matches[version.Digest] {
+			filtered = append(filtered, version)
+		}
+	}
+
+	return filtered, nil
+}
+
+// filterECRImages skips the versions whose images ECR reports as having a
+// status listed in aws_ecr_ignore_tag_status, e.g. so that a pipeline doesn't
+// trigger on an image which is about to expire.
+func filterECRImages(source resource.Source, response resource.CheckResponse) (resource.CheckResponse, error) {
+	if source.AwsRegion == "" {
+		return resource.CheckResponse{}, resource.Invalid("aws_ecr_ignore_tag_status requires aws_region")
+	}
+
+	if len(response) == 0 {
+		return response, nil
+	}
+
+	repo, err := source.NewRepository()
+	if err != nil {
+		return resource.CheckResponse{}, fmt.Errorf("resolve repository: %w", err)
+	}
+
+	var digests []string
+	seen := map[string]bool{}
+	for _, version := range response {
+		if !seen[version.Digest] {
+			seen[version.Digest] = true
+			digests = append(digests, version.Digest)
+		}
+	}
+
+	client, err := source.NewECRClient()
+	if err != nil {
+		return resource.CheckResponse{}, resource.Categorize(resource.CategoryAuth, fmt.Errorf("create ECR client: %w", err))
+	}
+
+	ignored, err := source.ECRIgnoredDigests(client, repo.RepositoryStr(), digests, time.Now())
+	if err != nil {
+		return resource.CheckResponse{}, fmt.Errorf("aws_ecr_ignore_tag_status: %w", err)
+	}
+
+	filtered := resource.CheckResponse{}
+	for _, version := range response {
+		if reason, found := ignored[version.Digest]; found {
+			logrus.Infof("skipping %s (%s): %s", version.Tag, version.Digest, reason)
+			continue
+		}
+
+		filtered = append(filtered, version)
+	}
+
+	return filtered, nil
+}
+
+// imageLabels returns the labels in the config of the image, or of the image
+// for the configured platform if the digest is of an index.
+func imageLabels(ref name.Digest, opts ...remote.Option) (map[string]string, error) {
+	img, err := remote.Image(ref, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg, err := img.ConfigFile()
+	if err != nil {
+		return nil, err
+	}
+
+	return cfg.Config.Labels, nil
+}
+
+// forEachConcurrently calls fn for each item, with up to workers calls at a
+// time, returning the first error. Items not yet started when an error occurs
+// are skipped.
+func forEachConcurrently(workers int, items []string, fn func(string) error) error {
+	var lock sync.Mutex
+	var firstErr error
+
+	work := make(chan string)
+
+	wg := new(sync.WaitGroup)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for item := range work {
+				lock.Lock()
+				failed := firstErr != nil
+				lock.Unlock()
+
+				if failed {
+					continue
+				}
+
+				err := fn(item)
+
+				lock.Lock()
+				if err != nil && firstErr == nil {
+					firstErr = err
+				}
+				lock.Unlock()
+			}
+		}()
+	}
+
+	for _, item := range items {
+		work <- item
+	}
+
+	close(work)
+	wg.Wait()
+
+	return firstErr
+}
+
+// createdAtTimes fetches the creation time of the image config of each
+// distinct digest, as many tags tend to share a digest.
+func createdAtTimes(repo name.Repository, source resource.Source, tagDigests map[string]string, fetched map[string]*remote.Descriptor, opts ...remote.Option) (map[string]time.Time, error) {
+	// fetch each digest via one of its tags
+	digests := map[string]string{}
+	for tag, digest := range tagDigests {
+		digests[digest] = tag
+	}
+
+	distinct := make([]string, 0, len(digests))
+	for digest := range digests {
+		distinct = append(distinct, digest)
+	}
+
+	times := make(map[string]time.Time, len(digests))
+
+	var lock sync.Mutex
+	err := forEachConcurrently(source.CheckWorkers(), distinct, func(digest string) error {
+		var created time.Time
+		err := resource.RetryOnRateLimit(func() error {
+			var err error
+			created, err = createdAt(repo.Tag(digests[digest]), fetched[digest], opts...)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+
+		lock.Lock()
+		times[digest] = created
+		lock.Unlock()
+
+		return nil
+	})
+
+	return times, err
+}
+
+func createdAt(ref name.Reference, fetched *remote.Descriptor, opts ...remote.Option) (time.Time, error) {
+	var img v1.Image
+	var err error
+	if fetched != nil {
+		img, err = fetched.Image()
+	} else {
+		img, err = remote.Image(ref, opts...)
+	}
+	if err != nil {
+		return time.Time{}, fmt.Errorf("get remote image: %w", err)
+	}
+
+	// This calls /blobs/sha256:<digest> to get the config file
+	configFile, err := img.ConfigFile()
+	if err != nil {
+		return time.Time{}, fmt.Errorf("get remote image config file: %w", err)
+	}
+
+	return configFile.Created.Time, nil
+}
+
 type TagVersion struct {
 	TagName string
 	Digest  string
@@ -351,20 +856,94 @@ type TagVersion struct {
 type TagVersions []TagVersion
 
 func (vs TagVersions) Len() int           { return len(vs) }
-func (vs TagVersions) Less(i, j int) bool { return vs[i].Version.LessThan(vs[j].Version) }
+func (vs TagVersions) Less(i, j int) bool { return compareVersions(vs[i].Version, vs[j].Version) < 0 }
 func (vs TagVersions) Swap(i, j int)      { vs[i], vs[j] = vs[j], vs[i] }
 
+// extendedVersion matches versions with more than three components, capturing
+// the first three, the rest, and the prerelease.
+var extendedVersion = regexp.MustCompile(`^v?([0-9]+\.[0-9]+\.[0-9]+)((?:\.[0-9]+)+)(-[0-9A-Za-z.-]+)?$`)
+
+// parseVersion parses a version tag. If tolerant, versions with more than
+// three components are accepted too, carrying the additional components in
+// the build metadata, which tags can't otherwise contain.
+func parseVersion(tag string, tolerant bool) (*semver.Version, error) {
+	ver, err := semver.NewVersion(tag)
+	if err == nil || !tolerant {
+		return ver, err
+	}
+
+	match := extendedVersion.FindStringSubmatch(tag)
+	if match == nil {
+		return nil, err
+	}
+
+	return semver.NewVersion(match[1] + match[3] + "+" + strings.TrimPrefix(match[2], "."))
+}
+
+// compareVersions compares versions like semver, followed by any additional
+// components parsed by parseVersion.
+func compareVersions(a, b *semver.Version) int {
+	if c := a.Compare(b); c != 0 {
+		return c
+	}
+
+	as := strings.Split(a.Metadata(), ".")
+	bs := strings.Split(b.Metadata(), ".")
+	for i := 0; i < len(as) || i < len(bs); i++ {
+		var an, bn uint64
+		if i < len(as) {
+			an, _ = strconv.ParseUint(as[i], 10, 64)
+		}
+
+		if i < len(bs) {
+			bn, _ = strconv.ParseUint(bs[i], 10, 64)
+		}
+
+		if an < bn {
+			return -1
+		} else if an > bn {
+			return 1
+		}
+	}
+
+	return 0
+}
+
+// specificity counts the components of the version, so that e.g. 3.2.1 is
+// favored over 3.2, and 1.0.0-rc.2 over 1.0.0-rc.
+func specificity(ver *semver.Version) int {
+	n := strings.Count(ver.Original(), ".")
+	if ver.Metadata() != "" {
+		// additional components follow a '+' rather than a '.'
+		n++
+	}
+
+	return n
+}
+
 func checkTag(tag name.Tag, source resource.Source, version *resource.Version, opts ...remote.Option) (resource.CheckResponse, error) {
-	digest, found, err := headOrGet(tag, opts...)
+	digest, _, found, err := headOrGet(tag, source, opts...)
 	if err != nil {
 		return resource.CheckResponse{}, fmt.Errorf("get remote image: %w", err)
 	}
 
 	response := resource.CheckResponse{}
-	if version != nil && found && version.Digest != digest.String() {
+	if source.TagHistory > 0 && found {
+		previous, err := previousDigests(tag, source, digest, opts...)
+		if err != nil {
+			return resource.CheckResponse{}, fmt.Errorf("get tag history: %w", err)
+		}
+
+		for _, previousDigest := range previous {
+			response = append(response, resource.Version{
+				Tag:    tag.TagStr(),
+				Digest: previousDigest,
+			})
+		}
+	} else if version != nil && found && version.Digest != digest.String() {
 		digestRef := tag.Repository.Digest(version.Digest)
 
-		_, found, err := headOrGet(digestRef, opts...)
+		_, _, found, err := headOrGet(digestRef, source, opts...)
 		if err != nil {
 			return resource.CheckResponse{}, fmt.Errorf("get remote image: %w", err)
 		}
@@ -387,34 +966,102 @@ func checkTag(tag name.Tag, source resource.Source, version *resource.Version, o
 	return response, nil
 }
 
-func headOrGet(ref name.Reference, imageOpts ...remote.Option) (v1.Hash, bool, error) {
-	v1Desc, err := remote.Head(ref, imageOpts...)
+// previousDigests returns up to tag_history digests the tag pointed to before
+// its current digest, oldest first, skipping any which no longer exist.
+func previousDigests(tag name.Tag, source resource.Source, current v1.Hash, opts ...remote.Option) ([]string, error) {
+	if tag.RegistryStr() != name.DefaultRegistry {
+		return nil, resource.Invalid("tag_history is only supported for Docker Hub, not %s", tag.RegistryStr())
+	}
+
+	history, err := resource.DockerHubTagHistory(resource.DockerHubAPI, tag.Repository, tag.TagStr(), source.BasicCredentials)
 	if err != nil {
-		if checkMissingManifest(err) {
-			return v1.Hash{}, false, nil
+		return nil, err
+	}
+
+	previous := []string{}
+	seen := map[string]bool{current.String(): true}
+	for i := len(history) - 1; i >= 0 && len(previous) < source.TagHistory; i-- {
+		if seen[history[i]] {
+			continue
 		}
 
-		remoteDesc, err := remote.Get(ref, imageOpts...)
+		seen[history[i]] = true
+
+		_, _, found, err := headOrGet(tag.Repository.Digest(history[i]), source, opts...)
 		if err != nil {
-			if checkMissingManifest(err) {
-				return v1.Hash{}, false, nil
-			}
+			return nil, fmt.Errorf("get remote image: %w", err)
+		}
 
-			return v1.Hash{}, false, err
+		if found {
+			previous = append([]string{history[i]}, previous...)
 		}
+	}
+
+	return previous, nil
+}
+
+// checkDigest returns the pinned digest as the only version, tagged with the
+// configured tag or 'latest'.
+func checkDigest(digest name.Digest, source resource.Source, opts ...remote.Option) (resource.CheckResponse, error) {
+	_, _, found, err := headOrGet(digest, source, opts...)
+	if err != nil {
+		return resource.CheckResponse{}, fmt.Errorf("get remote image: %w", err)
+	}
+
+	if !found {
+		// the pinned digest is expected to exist, unlike a tag which may be
+		// yet to be pushed
+		return resource.CheckResponse{}, fmt.Errorf("pinned digest %s not found", digest.DigestStr())
+	}
+
+	return resource.CheckResponse{
+		{
+			Tag:    source.DefaultVersionTag(),
+			Digest: digest.DigestStr(),
+		},
+	}, nil
+}
 
-		if (remoteDesc.Digest == v1.Hash{}) {
-			return v1.Hash{}, false, nil
+// headOrGet resolves the digest of the reference, falling back to fetching the
+// manifest when the registry does not support HEAD requests, or straight away
+// if they are disabled. In that case the fetched descriptor is returned too so
+// that callers needing the manifest don't have to fetch it again.
+func headOrGet(ref name.Reference, source resource.Source, imageOpts ...remote.Option) (v1.Hash, *remote.Descriptor, bool, error) {
+	if source.DisableHeadRequests {
+		return getDigest(ref, imageOpts...)
+	}
+
+	v1Desc, err := remote.Head(ref, imageOpts...)
+	if err != nil {
+		if checkMissingManifest(err) {
+			return v1.Hash{}, nil, false, nil
 		}
 
-		return remoteDesc.Digest, true, nil
+		return getDigest(ref, imageOpts...)
 	}
 
 	if (v1Desc.Digest == v1.Hash{}) {
-		return v1.Hash{}, false, nil
+		return v1.Hash{}, nil, false, nil
+	}
+
+	return v1Desc.Digest, nil, true, nil
+}
+
+func getDigest(ref name.Reference, imageOpts ...remote.Option) (v1.Hash, *remote.Descriptor, bool, error) {
+	remoteDesc, err := remote.Get(ref, imageOpts...)
+	if err != nil {
+		if checkMissingManifest(err) {
+			return v1.Hash{}, nil, false, nil
+		}
+
+		return v1.Hash{}, nil, false, err
+	}
+
+	if (remoteDesc.Digest == v1.Hash{}) {
+		return v1.Hash{}, nil, false, nil
 	}
 
-	return v1Desc.Digest, true, nil
+	return remoteDesc.Digest, remoteDesc, true, nil
 }
 
 func checkMissingManifest(err error) bool {
@@ -0,0 +1,82 @@
+package commands
+
+import (
+	"fmt"
+	"strings"
+
+	resource "github.com/concourse/registry-image-resource"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/sirupsen/logrus"
+)
+
+// tag suffixes cosign uses for signatures and attestations of a digest
+var cosignTagSuffixes = []string{".sig", ".att"}
+
+// copySignatures copies the cosign signatures and attestations and the OCI
+// referrers of the origin image to the repository it was pushed to.
+func copySignatures(origin name.Digest, source resource.Source, opts resource.Options) error {
+	srcOpts, err := source.PullOptions(origin.Context())
+	if err != nil {
+		return err
+	}
+
+	for _, suffix := range cosignTagSuffixes {
+		tag := strings.Replace(origin.DigestStr(), ":", "-", 1) + suffix
+
+		err := copyManifest(origin.Context().Tag(tag), opts.Repository.Tag(tag), srcOpts, opts.Remote)
+		if err != nil {
+			if checkMissingManifest(err) {
+				continue
+			}
+
+			return fmt.Errorf("copy %s: %w", tag, err)
+		}
+
+		logrus.Infof("copied %s", tag)
+	}
+
+	referrers, err := listReferrers(origin, srcOpts)
+	if err != nil {
+		return fmt.Errorf("list referrers: %w", err)
+	}
+
+	for _, desc := range referrers {
+		digest := desc.Digest.String()
+
+		dest := opts.Repository.Digest(digest)
+		err := writeReferrer(dest, func() error {
+			return copyManifest(origin.Context().Digest(digest), dest, srcOpts, opts.Remote)
+		}, opts.Remote)
+		if err != nil {
+			return fmt.Errorf("copy referrer %s: %w", digest, err)
+		}
+
+		logrus.Infof("copied referrer %s (%s)", digest, desc.ArtifactType)
+	}
+
+	return nil
+}
+
+func copyManifest(src name.Reference, dest name.Reference, srcOpts []remote.Option, destOpts []remote.Option) error {
+	desc, err := remote.Get(src, srcOpts...)
+	if err != nil {
+		return err
+	}
+
+	if desc.MediaType.IsIndex() {
+		index, err := desc.ImageIndex()
+		if err != nil {
+			return err
+		}
+
+		return remote.WriteIndex(dest, index, destOpts...)
+	}
+
+	image, err := desc.Image()
+	if err != nil {
+		return err
+	}
+
+	return remote.Write(dest, image, destOpts...)
+}
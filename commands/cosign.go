@@ -0,0 +1,649 @@
+package commands
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	resource "github.com/concourse/registry-image-resource"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/sirupsen/logrus"
+)
+
+// media type of the layers of a cosign signature image, each of which is a
+// signed payload
+const cosignSimpleSigningMediaType = "application/vnd.dev.cosign.simplesigning.v1+json"
+
+// layer annotations set by cosign
+const (
+	cosignSignatureAnnotation   = "dev.cosignproject.cosign/signature"
+	cosignCertificateAnnotation = "dev.sigstore.cosign/certificate"
+	cosignChainAnnotation       = "dev.sigstore.cosign/chain"
+	cosignBundleAnnotation      = "dev.sigstore.cosign/bundle"
+)
+
+const cosignSignatureType = "cosign container image signature"
+
+// certificate extensions set by Fulcio identifying the OIDC issuer
+var (
+	fulcioIssuerOID   = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 57264, 1, 1}
+	fulcioIssuerV2OID = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 57264, 1, 8}
+)
+
+type cosignPayload struct {
+	Critical struct {
+		Identity struct {
+			DockerReference string `json:"docker-reference"`
+		} `json:"identity"`
+		Image struct {
+			DockerManifestDigest string `json:"docker-manifest-digest"`
+		} `json:"image"`
+		Type string `json:"type"`
+	} `json:"critical"`
+	Optional map[string]interface{} `json:"optional"`
+}
+
+// cosignSignature is a single signature attached to an image by cosign.
+type cosignSignature struct {
+	Payload   []byte
+	Signature []byte
+
+	// set for keyless signatures
+	Certificate *x509.Certificate
+	Chain       []*x509.Certificate
+
+	// Rekor bundle proving the signature's inclusion in the transparency log
+	Bundle string
+}
+
+type rekorBundle struct {
+	SignedEntryTimestamp []byte             `json:"SignedEntryTimestamp"`
+	Payload              rekorBundlePayload `json:"Payload"`
+}
+
+// rekorBundlePayload is signed by Rekor as the SignedEntryTimestamp. Fields
+// are in the lexical order required for canonical JSON.
+type rekorBundlePayload struct {
+	Body           string `json:"body"`
+	IntegratedTime int64  `json:"integratedTime"`
+	LogID          string `json:"logID"`
+	LogIndex       int64  `json:"logIndex"`
+}
+
+// verifyCosignSignatures fetches the cosign signatures attached to the digest
+// and returns an error unless at least one of them satisfies the verify
+// params.
+func verifyCosignSignatures(repo name.Repository, digest string, verify resource.VerifyParams, opts ...remote.Option) error {
+	if (verify.CosignPublicKey == "") == (verify.Keyless == nil) {
+		return resource.Invalid("exactly one of 'cosign_public_key' or 'keyless' must be specified")
+	}
+
+	if verify.Keyless != nil {
+		switch verify.Keyless.Tlog {
+		case "", "online":
+		case "offline":
+			if verify.Keyless.RekorPublicKey == "" || verify.Keyless.FulcioRoots == "" {
+				return resource.Invalid("'rekor_public_key' and 'fulcio_roots' must be specified to verify offline")
+			}
+		default:
+			return resource.Invalid("unknown tlog %q (must be 'online' or 'offline')", verify.Keyless.Tlog)
+		}
+	}
+
+	signatures, err := fetchCosignSignatures(repo, digest, opts...)
+	if err != nil {
+		return err
+	}
+
+	var verifier func(cosignSignature) error
+	if verify.CosignPublicKey != "" {
+		publicKey, err := parsePublicKey(verify.CosignPublicKey)
+		if err != nil {
+			return fmt.Errorf("parse cosign public key: %w", err)
+		}
+
+		verifier = func(sig cosignSignature) error {
+			return verifySignature(publicKey, sig.Payload, sig.Signature)
+		}
+	} else {
+		roots, err := fulcioRoots(*verify.Keyless)
+		if err != nil {
+			return fmt.Errorf("load fulcio roots: %w", err)
+		}
+
+		verifier = func(sig cosignSignature) error {
+			return verifyKeylessSignature(sig, *verify.Keyless, roots)
+		}
+	}
+
+	var failures []string
+	for _, sig := range signatures {
+		err := verifier(sig)
+		if err == nil {
+			err = checkCosignPayload(sig.Payload, digest, verify.Annotations)
+		}
+
+		if err != nil {
+			failures = append(failures, err.Error())
+			continue
+		}
+
+		logrus.Infof("verified cosign signature of %s", digest)
+
+		return nil
+	}
+
+	if len(failures) == 0 {
+		return fmt.Errorf("no cosign signatures found for %s", digest)
+	}
+
+	return fmt.Errorf("no valid cosign signatures for %s: %s", digest, strings.Join(failures, "; "))
+}
+
+// fetchCosignSignatures returns the signatures stored in the signature image
+// cosign tags as sha256-<hex>.sig.
+func fetchCosignSignatures(repo name.Repository, digest string, opts ...remote.Option) ([]cosignSignature, error) {
+	sigTag := repo.Tag(strings.Replace(digest, ":", "-", 1) + ".sig")
+
+	sigImage, err := remote.Image(sigTag, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("fetch signatures %s: %w", sigTag, err)
+	}
+
+	manifest, err := sigImage.Manifest()
+	if err != nil {
+		return nil, fmt.Errorf("get signature manifest: %w", err)
+	}
+
+	var signatures []cosignSignature
+	for _, desc := range manifest.Layers {
+		if desc.MediaType != cosignSimpleSigningMediaType {
+			continue
+		}
+
+		sig, err := loadCosignSignature(sigImage, desc)
+		if err != nil {
+			return nil, fmt.Errorf("load signature %s: %w", desc.Digest, err)
+		}
+
+		signatures = append(signatures, sig)
+	}
+
+	return signatures, nil
+}
+
+func loadCosignSignature(sigImage v1.Image, desc v1.Descriptor) (cosignSignature, error) {
+	layer, err := sigImage.LayerByDigest(desc.Digest)
+	if err != nil {
+		return cosignSignature{}, err
+	}
+
+	rc, err := layer.Compressed()
+	if err != nil {
+		return cosignSignature{}, err
+	}
+
+	defer rc.Close()
+
+	payload, err := ioutil.ReadAll(rc)
+	if err != nil {
+		return cosignSignature{}, fmt.Errorf("read payload: %w", err)
+	}
+
+	signature, err := base64.StdEncoding.DecodeString(desc.Annotations[cosignSignatureAnnotation])
+	if err != nil {
+		return cosignSignature{}, fmt.Errorf("decode signature: %w", err)
+	}
+
+	sig := cosignSignature{
+		Payload:   payload,
+		Signature: signature,
+		Bundle:    desc.Annotations[cosignBundleAnnotation],
+	}
+
+	if certPEM := desc.Annotations[cosignCertificateAnnotation]; certPEM != "" {
+		certs, err := parseCertificates([]byte(certPEM))
+		if err != nil {
+			return cosignSignature{}, fmt.Errorf("parse certificate: %w", err)
+		}
+
+		if len(certs) != 1 {
+			return cosignSignature{}, fmt.Errorf("expected 1 certificate, got %d", len(certs))
+		}
+
+		sig.Certificate = certs[0]
+
+		sig.Chain, err = parseCertificates([]byte(desc.Annotations[cosignChainAnnotation]))
+		if err != nil {
+			return cosignSignature{}, fmt.Errorf("parse certificate chain: %w", err)
+		}
+	}
+
+	return sig, nil
+}
+
+// checkCosignPayload verifies that the signed payload refers to the digest
+// and carries the required annotations.
+func checkCosignPayload(payload []byte, digest string, annotations map[string]string) error {
+	var p cosignPayload
+	err := json.Unmarshal(payload, &p)
+	if err != nil {
+		return fmt.Errorf("parse payload: %w", err)
+	}
+
+	if p.Critical.Type != cosignSignatureType {
+		return fmt.Errorf("unknown payload type %q", p.Critical.Type)
+	}
+
+	if p.Critical.Image.DockerManifestDigest != digest {
+		return fmt.Errorf("payload is for %s", p.Critical.Image.DockerManifestDigest)
+	}
+
+	for k, v := range annotations {
+		actual, found := p.Optional[k]
+		if !found {
+			return fmt.Errorf("missing annotation %q", k)
+		}
+
+		if fmt.Sprint(actual) != v {
+			return fmt.Errorf("annotation %q is %q, not %q", k, actual, v)
+		}
+	}
+
+	return nil
+}
+
+func verifyKeylessSignature(sig cosignSignature, keyless resource.KeylessVerification, roots *x509.CertPool) error {
+	if sig.Certificate == nil {
+		return fmt.Errorf("signature has no certificate")
+	}
+
+	err := verifySignature(sig.Certificate.PublicKey, sig.Payload, sig.Signature)
+	if err != nil {
+		return err
+	}
+
+	err = checkCertificateIdentity(sig.Certificate, keyless.Identity, keyless.Issuer)
+	if err != nil {
+		return err
+	}
+
+	// Fulcio certificates are only valid for a few minutes, so they must be
+	// checked at the time the signature was recorded in the transparency log
+	var signedAt time.Time
+	if keyless.Tlog == "offline" {
+		signedAt, err = bundleIntegratedTime(keyless, sig)
+	} else {
+		signedAt, err = rekorIntegratedTime(keyless, sig)
+	}
+	if err != nil {
+		return fmt.Errorf("transparency log: %w", err)
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range sig.Chain {
+		intermediates.AddCert(cert)
+	}
+
+	_, err = sig.Certificate.Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		CurrentTime:   signedAt,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+	})
+	if err != nil {
+		return fmt.Errorf("verify certificate: %w", err)
+	}
+
+	return nil
+}
+
+func checkCertificateIdentity(cert *x509.Certificate, identity string, issuer string) error {
+	var identities []string
+	identities = append(identities, cert.EmailAddresses...)
+	for _, uri := range cert.URIs {
+		identities = append(identities, uri.String())
+	}
+
+	found := false
+	for _, id := range identities {
+		if id == identity {
+			found = true
+			break
+		}
+	}
+
+	if !found {
+		return fmt.Errorf("certificate identities %v do not include %q", identities, identity)
+	}
+
+	certIssuer, err := certificateIssuer(cert)
+	if err != nil {
+		return err
+	}
+
+	if certIssuer != issuer {
+		return fmt.Errorf("certificate issuer is %q, not %q", certIssuer, issuer)
+	}
+
+	return nil
+}
+
+// certificateIssuer returns the OIDC issuer recorded in the certificate by
+// Fulcio.
+func certificateIssuer(cert *x509.Certificate) (string, error) {
+	for _, ext := range cert.Extensions {
+		if ext.Id.Equal(fulcioIssuerV2OID) {
+			var issuer string
+			_, err := asn1.Unmarshal(ext.Value, &issuer)
+			if err != nil {
+				return "", fmt.Errorf("parse certificate issuer: %w", err)
+			}
+
+			return issuer, nil
+		}
+	}
+
+	for _, ext := range cert.Extensions {
+		if ext.Id.Equal(fulcioIssuerOID) {
+			return string(ext.Value), nil
+		}
+	}
+
+	return "", fmt.Errorf("certificate has no issuer extension")
+}
+
+func fulcioRoots(keyless resource.KeylessVerification) (*x509.CertPool, error) {
+	rootsPEM := []byte(keyless.FulcioRoots)
+	if len(rootsPEM) == 0 {
+		var err error
+		rootsPEM, err = fetchFulcioRoots(keyless.FulcioURL)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	certs, err := parseCertificates(rootsPEM)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("no certificates found")
+	}
+
+	pool := x509.NewCertPool()
+	for _, cert := range certs {
+		pool.AddCert(cert)
+	}
+
+	return pool, nil
+}
+
+func fetchFulcioRoots(fulcioURL string) ([]byte, error) {
+	if fulcioURL == "" {
+		fulcioURL = resource.DefaultFulcioURL
+	}
+
+	var bundle struct {
+		Chains []struct {
+			Certificates []string `json:"certificates"`
+		} `json:"chains"`
+	}
+
+	err := getJSON(strings.TrimSuffix(fulcioURL, "/")+"/api/v2/trustBundle", &bundle)
+	if err != nil {
+		return nil, err
+	}
+
+	var roots []byte
+	for _, chain := range bundle.Chains {
+		if len(chain.Certificates) == 0 {
+			continue
+		}
+
+		// the root is the last certificate of each chain
+		roots = append(roots, chain.Certificates[len(chain.Certificates)-1]...)
+		roots = append(roots, '\n')
+	}
+
+	return roots, nil
+}
+
+type rekorEntry struct {
+	Body           string `json:"body"`
+	IntegratedTime int64  `json:"integratedTime"`
+}
+
+type hashedRekord struct {
+	APIVersion string `json:"apiVersion,omitempty"`
+	Kind       string `json:"kind"`
+	Spec       struct {
+		Data struct {
+			Hash struct {
+				Algorithm string `json:"algorithm"`
+				Value     string `json:"value"`
+			} `json:"hash"`
+		} `json:"data"`
+		Signature struct {
+			Content   string `json:"content"`
+			PublicKey struct {
+				Content string `json:"content"`
+			} `json:"publicKey"`
+		} `json:"signature"`
+	} `json:"spec"`
+}
+
+// rekorIntegratedTime looks up the signature in the Rekor transparency log and
+// returns the time it was recorded.
+func rekorIntegratedTime(keyless resource.KeylessVerification, sig cosignSignature) (time.Time, error) {
+	rekorURL := keyless.RekorURL
+	if rekorURL == "" {
+		rekorURL = resource.DefaultRekorURL
+	}
+
+	rekorURL = strings.TrimSuffix(rekorURL, "/")
+
+	payloadHash := sha256.Sum256(sig.Payload)
+	hexHash := hex.EncodeToString(payloadHash[:])
+
+	var uuids []string
+	err := postJSON(rekorURL+"/api/v1/index/retrieve", map[string]string{"hash": "sha256:" + hexHash}, &uuids)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("search log: %w", err)
+	}
+
+	for _, uuid := range uuids {
+		var entries map[string]rekorEntry
+		err := getJSON(rekorURL+"/api/v1/log/entries/"+uuid, &entries)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("get log entry: %w", err)
+		}
+
+		for _, entry := range entries {
+			if rekorEntryMatches(entry.Body, sig) {
+				return time.Unix(entry.IntegratedTime, 0), nil
+			}
+		}
+	}
+
+	return time.Time{}, fmt.Errorf("no log entry found for signature")
+}
+
+// bundleIntegratedTime verifies the Rekor bundle attached to the signature
+// against the log's public key, without contacting the log, and returns the
+// time the signature was recorded.
+func bundleIntegratedTime(keyless resource.KeylessVerification, sig cosignSignature) (time.Time, error) {
+	if sig.Bundle == "" {
+		return time.Time{}, fmt.Errorf("signature has no rekor bundle")
+	}
+
+	var bundle rekorBundle
+	err := json.Unmarshal([]byte(sig.Bundle), &bundle)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("parse rekor bundle: %w", err)
+	}
+
+	rekorKey, err := parsePublicKey(keyless.RekorPublicKey)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("parse rekor public key: %w", err)
+	}
+
+	keyDER, err := x509.MarshalPKIXPublicKey(rekorKey)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("marshal rekor public key: %w", err)
+	}
+
+	// the log ID is the hash of the log's public key
+	logID := sha256.Sum256(keyDER)
+	if bundle.Payload.LogID != hex.EncodeToString(logID[:]) {
+		return time.Time{}, fmt.Errorf("rekor bundle is from another log (%s)", bundle.Payload.LogID)
+	}
+
+	buf := new(bytes.Buffer)
+	enc := json.NewEncoder(buf)
+	enc.SetEscapeHTML(false)
+
+	err = enc.Encode(bundle.Payload)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("canonicalize rekor bundle: %w", err)
+	}
+
+	err = verifySignature(rekorKey, bytes.TrimSuffix(buf.Bytes(), []byte("\n")), bundle.SignedEntryTimestamp)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("verify rekor bundle: %w", err)
+	}
+
+	if !rekorEntryMatches(bundle.Payload.Body, sig) {
+		return time.Time{}, fmt.Errorf("rekor bundle is for another signature")
+	}
+
+	return time.Unix(bundle.Payload.IntegratedTime, 0), nil
+}
+
+// rekorEntryMatches returns true if the base64-encoded log entry body records
+// the signature of the payload with the signature's certificate.
+func rekorEntryMatches(entryBody string, sig cosignSignature) bool {
+	payloadHash := sha256.Sum256(sig.Payload)
+	hexHash := hex.EncodeToString(payloadHash[:])
+
+	body, err := base64.StdEncoding.DecodeString(entryBody)
+	if err != nil {
+		return false
+	}
+
+	var rekord hashedRekord
+	err = json.Unmarshal(body, &rekord)
+	if err != nil || rekord.Kind != "hashedrekord" {
+		return false
+	}
+
+	if rekord.Spec.Data.Hash.Algorithm != "sha256" || rekord.Spec.Data.Hash.Value != hexHash {
+		return false
+	}
+
+	if rekord.Spec.Signature.Content != base64.StdEncoding.EncodeToString(sig.Signature) {
+		return false
+	}
+
+	certPEM, err := base64.StdEncoding.DecodeString(rekord.Spec.Signature.PublicKey.Content)
+	if err != nil {
+		return false
+	}
+
+	certs, err := parseCertificates(certPEM)
+	if err != nil || len(certs) != 1 {
+		return false
+	}
+
+	return certs[0].Equal(sig.Certificate)
+}
+
+func verifySignature(publicKey crypto.PublicKey, payload []byte, signature []byte) error {
+	digest := sha256.Sum256(payload)
+
+	switch key := publicKey.(type) {
+	case *ecdsa.PublicKey:
+		if !ecdsa.VerifyASN1(key, digest[:], signature) {
+			return fmt.Errorf("invalid signature")
+		}
+	case *rsa.PublicKey:
+		err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature)
+		if err != nil {
+			return fmt.Errorf("invalid signature: %w", err)
+		}
+	case ed25519.PublicKey:
+		if !ed25519.Verify(key, payload, signature) {
+			return fmt.Errorf("invalid signature")
+		}
+	default:
+		return fmt.Errorf("unsupported public key type %T", publicKey)
+	}
+
+	return nil
+}
+
+func parsePublicKey(keyPEM string) (crypto.PublicKey, error) {
+	block, _ := pem.Decode([]byte(keyPEM))
+	if block == nil {
+		return nil, fmt.Errorf("no PEM block found")
+	}
+
+	return x509.ParsePKIXPublicKey(block.Bytes)
+}
+
+func parseCertificates(certsPEM []byte) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, certsPEM = pem.Decode(certsPEM)
+		if block == nil {
+			break
+		}
+
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+
+		certs = append(certs, cert)
+	}
+
+	return certs, nil
+}
+
+func getJSON(url string, dest interface{}) error {
+	req, err := http.NewRequestWithContext(resource.RequestContext(), http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", url, res.Status)
+	}
+
+	return json.NewDecoder(res.Body).Decode(dest)
+}
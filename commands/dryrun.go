@@ -0,0 +1,147 @@
+package commands
+
+import (
+	"fmt"
+	"strings"
+
+	resource "github.com/concourse/registry-image-resource"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/sirupsen/logrus"
+)
+
+// tagChange is a tag which would be moved from one digest to another.
+type tagChange struct {
+	Tag string
+	Old string
+	New string
+}
+
+// tagReport describes what pushing an image would do to the repository's
+// tags.
+type tagReport struct {
+	Digest string
+
+	Created   []string
+	Changed   []tagChange
+	Untouched []string
+
+	// alias tags not bumped, as a newer version exists
+	SkippedAliases []string
+}
+
+// diffTags compares the tags which would be pushed, including aliases, with
+// the digests they currently point to.
+func diffTags(tags []name.Tag, aliases []aliasBump, skippedAliases []name.Tag, digest v1.Hash, source resource.Source, opts resource.Options) (tagReport, error) {
+	report := tagReport{
+		Digest: digest.String(),
+	}
+
+	all := append([]name.Tag{}, tags...)
+	for _, alias := range aliases {
+		all = append(all, alias.Tag)
+	}
+
+	pushed := map[string]bool{}
+	for _, tag := range all {
+		pushed[tag.TagStr()] = true
+	}
+
+	for _, tag := range all {
+		current, _, found, err := headOrGet(tag, source, opts.Remote...)
+		if err != nil {
+			return tagReport{}, fmt.Errorf("get digest of tag %s: %w", tag.TagStr(), err)
+		}
+
+		switch {
+		case !found:
+			report.Created = append(report.Created, tag.TagStr())
+		case current != digest:
+			report.Changed = append(report.Changed, tagChange{
+				Tag: tag.TagStr(),
+				Old: current.String(),
+				New: digest.String(),
+			})
+		default:
+			report.Untouched = append(report.Untouched, tag.TagStr())
+		}
+	}
+
+	for _, tag := range skippedAliases {
+		if pushed[tag.TagStr()] {
+			// pushed anyway, e.g. 'latest' configured as the source tag
+			continue
+		}
+
+		report.SkippedAliases = append(report.SkippedAliases, tag.TagStr())
+	}
+
+	return report, nil
+}
+
+// Log logs the report at the given level, one tag per line.
+func (report tagReport) Log(level logrus.Level) {
+	logrus.StandardLogger().Logf(level, "pushing %s would:", report.Digest)
+
+	for _, tag := range report.Created {
+		logrus.StandardLogger().Logf(level, "  create    %s", tag)
+	}
+
+	for _, change := range report.Changed {
+		logrus.StandardLogger().Logf(level, "  change    %s: %s -> %s", change.Tag, change.Old, change.New)
+	}
+
+	for _, tag := range report.Untouched {
+		logrus.StandardLogger().Logf(level, "  untouched %s", tag)
+	}
+
+	for _, tag := range report.SkippedAliases {
+		logrus.StandardLogger().Logf(level, "  skip      %s (a newer version exists)", tag)
+	}
+}
+
+// dryRunResponse emits the current version of the first tag which would have
+// been pushed, rather than the version which would have been, as Concourse
+// would record it and trigger jobs with an image that doesn't exist. If the
+// tag doesn't exist yet, there's no version to emit, so the put fails.
+func dryRunResponse(req resource.OutRequest, tags []name.Tag, report tagReport) (resource.OutResponse, error) {
+	tag := tags[0].TagStr()
+
+	var current string
+	for _, change := range report.Changed {
+		if change.Tag == tag {
+			current = change.Old
+		}
+	}
+
+	for _, untouched := range report.Untouched {
+		if untouched == tag {
+			current = report.Digest
+		}
+	}
+
+	if current == "" {
+		return resource.OutResponse{}, fmt.Errorf("dry run: nothing was pushed, and tag %s does not exist yet to emit as the version", tag)
+	}
+
+	tagNames := []string{}
+	for _, tag := range tags {
+		tagNames = append(tagNames, tag.TagStr())
+	}
+
+	metadata := append(req.Source.Metadata(), resource.MetadataField{
+		Name:  "tags",
+		Value: strings.Join(tagNames, " "),
+	}, resource.MetadataField{
+		Name:  "dry_run",
+		Value: "true",
+	})
+
+	return resource.OutResponse{
+		Version: resource.Version{
+			Tag:    tag,
+			Digest: current,
+		},
+		Metadata: metadata,
+	}, nil
+}
@@ -0,0 +1,360 @@
+package commands
+
+import (
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	resource "github.com/concourse/registry-image-resource"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/partial"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+	"github.com/sirupsen/logrus"
+)
+
+// blobStallTimeout is how long a layer download may go without receiving any
+// data before resuming it or falling back to another source.
+func blobStallTimeout() time.Duration {
+	if os.Getenv("TEST") == "true" {
+		return time.Second
+	}
+
+	return time.Minute
+}
+
+// blobResumes is how many times in a row a layer download is resumed from the
+// source it was being fetched from, when a read fails or stalls without
+// receiving any more data, before falling back to the next source.
+const blobResumes = 3
+
+// failoverImage resumes downloads of the layers of an image where they left
+// off when reading them fails or stalls, and fetches them from the fallback
+// sources (i.e. the origin or another mirror) when the source it was fetched
+// from fails to serve them, rather than restarting the whole download.
+type failoverImage struct {
+	v1.Image
+	source    resource.Source
+	fallbacks []resource.Source
+}
+
+func withLayerFailover(image v1.Image, source resource.Source, fallbacks []resource.Source) v1.Image {
+	return &failoverImage{
+		Image:     image,
+		source:    source,
+		fallbacks: fallbacks,
+	}
+}
+
+func (i *failoverImage) Layers() ([]v1.Layer, error) {
+	layers, err := i.Image.Layers()
+	if err != nil {
+		return nil, err
+	}
+
+	wrapped := make([]v1.Layer, len(layers))
+	for n, layer := range layers {
+		wrapped[n], err = i.layer(layer)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return wrapped, nil
+}
+
+func (i *failoverImage) LayerByDigest(digest v1.Hash) (v1.Layer, error) {
+	layer, err := i.Image.LayerByDigest(digest)
+	if err != nil {
+		return nil, err
+	}
+
+	return i.layer(layer)
+}
+
+func (i *failoverImage) LayerByDiffID(diffID v1.Hash) (v1.Layer, error) {
+	layer, err := i.Image.LayerByDiffID(diffID)
+	if err != nil {
+		return nil, err
+	}
+
+	return i.layer(layer)
+}
+
+func (i *failoverImage) layer(layer v1.Layer) (v1.Layer, error) {
+	// Uncompressed is derived from Compressed, so that it fails over too
+	return partial.CompressedToLayer(&failoverLayer{Layer: layer, image: i})
+}
+
+type failoverLayer struct {
+	v1.Layer
+	image *failoverImage
+}
+
+func (l *failoverLayer) Compressed() (io.ReadCloser, error) {
+	digest, err := l.Layer.Digest()
+	if err != nil {
+		return nil, err
+	}
+
+	source := l.image.source
+	sources := []blobSource{{
+		name: source.Repository,
+		open: func(offset int64) (io.ReadCloser, error) {
+			if offset == 0 {
+				return l.Layer.Compressed()
+			}
+
+			return openBlobRange(source, digest, offset)
+		},
+	}}
+
+	for _, fallback := range l.image.fallbacks {
+		fallback := fallback
+
+		sources = append(sources, blobSource{
+			name: fallback.Repository,
+			open: func(offset int64) (io.ReadCloser, error) {
+				if offset == 0 {
+					return openBlob(fallback, digest)
+				}
+
+				return openBlobRange(fallback, digest, offset)
+			},
+		})
+	}
+
+	h, err := v1.Hasher(digest.Algorithm)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &failoverReader{
+		digest:  digest,
+		sources: sources,
+		timeout: blobStallTimeout(),
+		hash:    h,
+	}
+
+	err = r.next()
+	if err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// openBlob fetches the layer with the digest from the source's repository.
+func openBlob(source resource.Source, digest v1.Hash) (io.ReadCloser, error) {
+	repo, err := source.NewRepository()
+	if err != nil {
+		return nil, fmt.Errorf("resolve repository name: %w", err)
+	}
+
+	opts, err := source.PullOptions(repo)
+	if err != nil {
+		return nil, err
+	}
+
+	layer, err := remote.Layer(repo.Digest(digest.String()), opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	return layer.Compressed()
+}
+
+// openBlobRange fetches the rest of the layer with the digest from the
+// source's repository, starting at the offset, with a Range request.
+func openBlobRange(source resource.Source, digest v1.Hash, offset int64) (io.ReadCloser, error) {
+	repo, err := source.NewRepository()
+	if err != nil {
+		return nil, fmt.Errorf("resolve repository name: %w", err)
+	}
+
+	rt, err := source.PullTransport(repo)
+	if err != nil {
+		return nil, err
+	}
+
+	u := url.URL{
+		Scheme: repo.Registry.Scheme(),
+		Host:   repo.RegistryStr(),
+		Path:   fmt.Sprintf("/v2/%s/blobs/%s", repo.RepositoryStr(), digest),
+	}
+
+	req, err := http.NewRequestWithContext(resource.RequestContext(), http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+
+	resp, err := (&http.Client{Transport: rt}).Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	err = transport.CheckError(resp, http.StatusOK, http.StatusPartialContent)
+	if err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+
+	if resp.StatusCode == http.StatusOK {
+		// the registry ignored the range, so skip what was already read
+		_, err = io.CopyN(ioutil.Discard, resp.Body, offset)
+		if err != nil {
+			resp.Body.Close()
+			return nil, err
+		}
+	}
+
+	return resp.Body, nil
+}
+
+type blobSource struct {
+	name string
+	open func(offset int64) (io.ReadCloser, error)
+}
+
+// failoverReader reads a blob from the first source that serves it, resuming
+// from where it left off if a read fails or stalls, first from the same source
+// and then from the next source. As the blob is content-addressed, every
+// source serves the same bytes, which are verified against the digest once
+// read in full.
+type failoverReader struct {
+	digest  v1.Hash
+	sources []blobSource
+	timeout time.Duration
+	hash    hash.Hash
+
+	current blobSource
+	resumes int
+	rc      io.ReadCloser
+	read    int64
+}
+
+// next opens the blob from the next source that serves it, skipping what was
+// already read.
+func (r *failoverReader) next() error {
+	err := fmt.Errorf("no more sources")
+	for len(r.sources) > 0 {
+		source := r.sources[0]
+		r.sources = r.sources[1:]
+
+		var rc io.ReadCloser
+		rc, err = source.open(r.read)
+		if err != nil {
+			if len(r.sources) > 0 {
+				logrus.Warnf("fetching layer %s from %s failed: %s", r.digest.Hex[0:12], source.name, err)
+			}
+
+			continue
+		}
+
+		if r.rc != nil {
+			logrus.Warnf("fetching layer %s from %s instead", r.digest.Hex[0:12], source.name)
+		}
+
+		r.current = source
+		r.resumes = 0
+		r.rc = rc
+
+		return nil
+	}
+
+	return err
+}
+
+// resume reopens the blob from the current source where it left off, or from
+// the next source once the current one has been resumed too many times.
+func (r *failoverReader) resume() error {
+	for r.resumes < blobResumes {
+		r.resumes++
+
+		rc, err := r.current.open(r.read)
+		if err != nil {
+			logrus.Warnf("resuming layer %s from %s failed: %s", r.digest.Hex[0:12], r.current.name, err)
+			continue
+		}
+
+		logrus.Infof("resuming layer %s from %s at %s", r.digest.Hex[0:12], r.current.name, humanBytes(r.read))
+
+		r.rc = rc
+
+		return nil
+	}
+
+	return r.next()
+}
+
+func (r *failoverReader) Read(p []byte) (int, error) {
+	for {
+		n, err := r.readOrStall(p)
+		r.read += int64(n)
+		r.hash.Write(p[:n])
+
+		if n > 0 {
+			// the source is making progress, so it may be resumed again
+			r.resumes = 0
+		}
+
+		if err == nil {
+			return n, nil
+		}
+
+		if err == io.EOF {
+			return n, r.verify()
+		}
+
+		logrus.Warnf("fetching layer %s from %s failed: %s", r.digest.Hex[0:12], r.current.name, err)
+
+		r.rc.Close()
+
+		if resumeErr := r.resume(); resumeErr != nil {
+			return n, fmt.Errorf("fetch layer %s: failed after %s: %w: %s", r.digest, humanBytes(r.read), err, resumeErr)
+		}
+
+		if n > 0 {
+			return n, nil
+		}
+	}
+}
+
+// verify returns io.EOF if the blob read matches its digest.
+func (r *failoverReader) verify() error {
+	actual := hex.EncodeToString(r.hash.Sum(nil))
+	if actual != r.digest.Hex {
+		return fmt.Errorf("fetch layer %s: digest mismatch: got %s:%s", r.digest, r.digest.Algorithm, actual)
+	}
+
+	return io.EOF
+}
+
+// readOrStall reads from the current source, giving up if no data arrives
+// within the timeout so that the download is resumed rather than hanging.
+func (r *failoverReader) readOrStall(p []byte) (int, error) {
+	rc := r.rc
+	stall := time.AfterFunc(r.timeout, func() {
+		// unblocks the read
+		rc.Close()
+	})
+
+	n, err := rc.Read(p)
+	if !stall.Stop() && err != nil {
+		err = fmt.Errorf("stalled for %s", r.timeout)
+	}
+
+	return n, err
+}
+
+func (r *failoverReader) Close() error {
+	return r.rc.Close()
+}
@@ -0,0 +1,215 @@
+package commands
+
+import (
+	"fmt"
+	"strings"
+
+	resource "github.com/concourse/registry-image-resource"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/partial"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/sirupsen/logrus"
+)
+
+// additionalRepository is a repository the image is pushed to along with the
+// source's.
+type additionalRepository struct {
+	source resource.Source
+	opts   resource.Options
+}
+
+// resolveAdditionalRepositories resolves the repositories and credentials of
+// the additional_repositories before anything is pushed, so that a
+// misconfigured repository fails the put up front.
+func resolveAdditionalRepositories(req resource.OutRequest) ([]additionalRepository, error) {
+	var repos []additionalRepository
+	for i, source := range req.Params.AdditionalRepositories {
+		err := source.SplitReference()
+		if err != nil {
+			return nil, resource.Invalid("additional_repositories[%d]: %s", i, err)
+		}
+
+		if source.Tag != "" || source.Digest != "" {
+			return nil, resource.Invalid("additional_repositories[%d]: the tags pushed are those pushed to the source's repository, so a tag or digest cannot be specified", i)
+		}
+
+		err = source.Authenticate()
+		if err != nil {
+			return nil, fmt.Errorf("additional_repositories[%d]: %w", i, err)
+		}
+
+		opts := source.NewOptions()
+		err = resource.RetryOnRateLimit(func() error {
+			return source.SetOptions(&opts)
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to set repo/auth options for %s: %w", source.Repository, err)
+		}
+
+		err = req.Source.CheckRegistryAllowed(opts.Repository.Registry)
+		if err != nil {
+			return nil, err
+		}
+
+		repos = append(repos, additionalRepository{
+			source: source,
+			opts:   opts,
+		})
+	}
+
+	return repos, nil
+}
+
+// pushAdditionalRepositories pushes the tags pushed to the source's repository
+// to each additional repository. The repositories in the same registry, with
+// the same credentials, are pushed to together, so that each blob is only
+// uploaded to the registry once and mounted into the rest of its repositories.
+// A failure to push to one registry doesn't stop the others from being pushed
+// to, but fails the put once they all have been tried.
+func pushAdditionalRepositories(req resource.OutRequest, img partial.WithRawManifest, digest v1.Hash, tags []name.Tag, origin name.Repository, repos []additionalRepository, signer cosignSigner) ([]string, error) {
+	var pushed []string
+	var failures []string
+	for _, group := range groupByRegistry(repos) {
+		err := pushRegistry(req, img, digest, tags, origin, group)
+		if err != nil {
+			for _, repo := range group {
+				logrus.Errorf("pushing to %s failed: %s", repo.opts.Repository, err)
+				failures = append(failures, fmt.Sprintf("%s: %s", repo.opts.Repository, err))
+			}
+
+			continue
+		}
+
+		for _, repo := range group {
+			err := finishAdditionalRepository(req, digest, tags, repo, signer)
+			if err != nil {
+				logrus.Errorf("pushing to %s failed: %s", repo.opts.Repository, err)
+				failures = append(failures, fmt.Sprintf("%s: %s", repo.opts.Repository, err))
+				continue
+			}
+
+			pushed = append(pushed, repo.opts.Repository.Name())
+		}
+	}
+
+	if len(failures) > 0 {
+		return pushed, fmt.Errorf("pushing to additional repositories failed: %s", strings.Join(failures, "; "))
+	}
+
+	return pushed, nil
+}
+
+// groupByRegistry groups the repositories which can be pushed to with the
+// same transport, i.e. those in the same registry with the same credentials,
+// in the order they're configured.
+func groupByRegistry(repos []additionalRepository) [][]additionalRepository {
+	var groups [][]additionalRepository
+
+	for _, repo := range repos {
+		grouped := false
+		for i, group := range groups {
+			if group[0].source.SharesTransport(repo.source) {
+				groups[i] = append(group, repo)
+				grouped = true
+				break
+			}
+		}
+
+		if !grouped {
+			groups = append(groups, []additionalRepository{repo})
+		}
+	}
+
+	return groups
+}
+
+// pushRegistry pushes the tags to every repository in the group with one
+// write, mounting the image's blobs from a repository in the registry which
+// has them: the source's repository if it's in the same registry, or else the
+// group's first repository, which is pushed to on its own first.
+func pushRegistry(req resource.OutRequest, img partial.WithRawManifest, digest v1.Hash, tags []name.Tag, origin name.Repository, group []additionalRepository) error {
+	if origin.RegistryStr() != group[0].opts.Repository.RegistryStr() {
+		first := group[0]
+
+		err := resource.RetryOnRateLimit(func() error {
+			return pushTags(req, []resource.Source{first.source}, img, repositoryTags(first.opts.Repository, tags), first.opts)
+		})
+		if err != nil {
+			return err
+		}
+
+		origin = first.opts.Repository
+		group = group[1:]
+	}
+
+	if len(group) == 0 {
+		return nil
+	}
+
+	// the repositories share a transport, and so any of their options
+	opts := group[0].opts
+
+	var sources []resource.Source
+	var groupTags []name.Tag
+	for _, repo := range group {
+		sources = append(sources, repo.source)
+		groupTags = append(groupTags, repositoryTags(repo.opts.Repository, tags)...)
+	}
+
+	mountable, err := mountableFrom(origin.Digest(digest.String()), opts)
+	if err != nil {
+		logrus.Warnf("not mounting blobs from %s: %s", origin, err)
+		mountable = img
+	}
+
+	return resource.RetryOnRateLimit(func() error {
+		return pushTags(req, sources, mountable, groupTags, opts)
+	})
+}
+
+// mountableFrom returns the image or index pushed to the reference, whose
+// blobs are mounted from its repository when it's pushed to another in the
+// same registry, rather than uploaded again.
+func mountableFrom(ref name.Digest, opts resource.Options) (partial.WithRawManifest, error) {
+	desc, err := remote.Get(ref, opts.Remote...)
+	if err != nil {
+		return nil, err
+	}
+
+	if desc.MediaType.IsIndex() {
+		return desc.ImageIndex()
+	}
+
+	return desc.Image()
+}
+
+// repositoryTags returns the tags with the same names in the repository.
+func repositoryTags(repo name.Repository, tags []name.Tag) []name.Tag {
+	var repoTags []name.Tag
+	for _, tag := range tags {
+		repoTags = append(repoTags, repo.Tag(tag.TagStr()))
+	}
+
+	return repoTags
+}
+
+// finishAdditionalRepository waits for the tags pushed to the repository to
+// be served, and signs the image there.
+func finishAdditionalRepository(req resource.OutRequest, digest v1.Hash, tags []name.Tag, repo additionalRepository, signer cosignSigner) error {
+	err := waitForTags(repositoryTags(repo.opts.Repository, tags), repo.source, repo.opts)
+	if err != nil {
+		return err
+	}
+
+	if signer != nil {
+		err = resource.RetryOnRateLimit(func() error {
+			return signWithCosign(repo.opts.Repository.Digest(digest.String()), signer, req.Source.Cosign.Annotations, repo.opts.Remote...)
+		})
+		if err != nil {
+			return fmt.Errorf("signing image failed: %w", err)
+		}
+	}
+
+	return nil
+}
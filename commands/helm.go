@@ -0,0 +1,200 @@
+package commands
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+// media types of Helm charts pushed to OCI registries
+const (
+	helmConfigMediaType     types.MediaType = "application/vnd.cncf.helm.config.v1+json"
+	helmChartMediaType      types.MediaType = "application/vnd.cncf.helm.chart.content.v1.tar+gzip"
+	helmProvenanceMediaType types.MediaType = "application/vnd.cncf.helm.chart.provenance.v1.prov"
+)
+
+func helmFormat(dest string, image v1.Image) error {
+	manifest, err := image.Manifest()
+	if err != nil {
+		return fmt.Errorf("get manifest: %w", err)
+	}
+
+	if manifest.Config.MediaType != helmConfigMediaType {
+		return fmt.Errorf("not a Helm chart: config media type is %s", manifest.Config.MediaType)
+	}
+
+	config, err := image.RawConfigFile()
+	if err != nil {
+		return fmt.Errorf("get chart metadata: %w", err)
+	}
+
+	err = ioutil.WriteFile(filepath.Join(dest, "chart.json"), config, 0644)
+	if err != nil {
+		return fmt.Errorf("write chart metadata: %w", err)
+	}
+
+	layers, err := image.Layers()
+	if err != nil {
+		return fmt.Errorf("get image layers: %w", err)
+	}
+
+	foundChart := false
+	for _, layer := range layers {
+		mediaType, err := layer.MediaType()
+		if err != nil {
+			return fmt.Errorf("get layer media type: %w", err)
+		}
+
+		switch mediaType {
+		case helmChartMediaType:
+			err = writeLayerBlob(filepath.Join(dest, "chart.tgz"), layer)
+			if err != nil {
+				return fmt.Errorf("write chart archive: %w", err)
+			}
+
+			err = extractChart(filepath.Join(dest, "chart.tgz"), filepath.Join(dest, "chart"))
+			if err != nil {
+				return fmt.Errorf("extract chart: %w", err)
+			}
+
+			foundChart = true
+		case helmProvenanceMediaType:
+			err = writeLayerBlob(filepath.Join(dest, "chart.tgz.prov"), layer)
+			if err != nil {
+				return fmt.Errorf("write chart provenance: %w", err)
+			}
+		}
+	}
+
+	if !foundChart {
+		return fmt.Errorf("no layer with media type %s", helmChartMediaType)
+	}
+
+	chartYAML, err := ioutil.ReadFile(filepath.Join(dest, "chart", "Chart.yaml"))
+	if err != nil {
+		return fmt.Errorf("read Chart.yaml: %w", err)
+	}
+
+	err = ioutil.WriteFile(filepath.Join(dest, "Chart.yaml"), chartYAML, 0644)
+	if err != nil {
+		return fmt.Errorf("write Chart.yaml: %w", err)
+	}
+
+	return nil
+}
+
+// writeLayerBlob writes the layer as it is stored in the registry, verifying
+// its digest.
+func writeLayerBlob(path string, layer v1.Layer) error {
+	digest, err := layer.Digest()
+	if err != nil {
+		return err
+	}
+
+	r, err := layer.Compressed()
+	if err != nil {
+		return err
+	}
+
+	defer r.Close()
+
+	vr, err := newVerifyingReader(r, digest)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(f, vr)
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+// extractChart extracts a chart archive, stripping the directory named after
+// the chart which it contains, e.g. mychart/Chart.yaml to dest/Chart.yaml.
+func extractChart(archive string, dest string) error {
+	f, err := os.Open(archive)
+	if err != nil {
+		return err
+	}
+
+	defer f.Close()
+
+	gr, err := gzip.NewReader(f)
+	if err != nil {
+		return err
+	}
+
+	tr := tar.NewReader(gr)
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return err
+		}
+
+		_, rel, found := strings.Cut(filepath.ToSlash(filepath.Clean(hdr.Name)), "/")
+		if !found {
+			// the chart directory itself
+			continue
+		}
+
+		if !filepath.IsLocal(rel) {
+			return fmt.Errorf("invalid path in chart: %s", hdr.Name)
+		}
+
+		path := filepath.Join(dest, filepath.FromSlash(rel))
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(path, 0755)
+			if err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			err = os.MkdirAll(filepath.Dir(path), 0755)
+			if err != nil {
+				return err
+			}
+
+			file, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+			if err != nil {
+				return err
+			}
+
+			_, err = io.Copy(file, tr)
+			if err != nil {
+				file.Close()
+				return err
+			}
+
+			err = file.Close()
+			if err != nil {
+				return err
+			}
+		default:
+			// charts only contain files and directories
+		}
+	}
+
+	return nil
+}
@@ -1,20 +1,26 @@
 package commands
 
 import (
+	"bytes"
+	"compress/gzip"
 	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 
 	resource "github.com/concourse/registry-image-resource"
 	"github.com/fatih/color"
 	"github.com/google/go-containerregistry/pkg/name"
 	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
 	"github.com/google/go-containerregistry/pkg/v1/remote"
-	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
 	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/klauspost/compress/zstd"
 	"github.com/sirupsen/logrus"
 )
 
@@ -23,6 +29,23 @@ type ImageMetadata struct {
 	User string   `json:"user"`
 }
 
+type LayerMetadata struct {
+	Digest    string `json:"digest"`
+	DiffID    string `json:"diff_id"`
+	Size      int64  `json:"size"`
+	MediaType string `json:"media_type"`
+}
+
+type ManifestMetadata struct {
+	Digest       string `json:"digest"`
+	Size         int64  `json:"size"`
+	MediaType    string `json:"media_type"`
+	OS           string `json:"os,omitempty"`
+	Architecture string `json:"architecture,omitempty"`
+	Variant      string `json:"variant,omitempty"`
+	OSVersion    string `json:"os_version,omitempty"`
+}
+
 type In struct {
 	stdin  io.Reader
 	stderr io.Writer
@@ -48,99 +71,222 @@ func (i *In) Execute() error {
 	setupLogging(i.stderr)
 
 	var req resource.InRequest
-	decoder := json.NewDecoder(i.stdin)
-	decoder.DisallowUnknownFields()
-	err := decoder.Decode(&req)
+	err := decodeRequest(i.stdin, &req)
+	if err != nil {
+		return err
+	}
+
+	if len(i.args) < 2 {
+		return fmt.Errorf("destination path not specified")
+	}
+
+	response, err := FetchImage(req, i.args[1], i.stderr)
+	if err != nil {
+		return err
+	}
+
+	err = json.NewEncoder(i.stdout).Encode(response)
+	if err != nil {
+		return fmt.Errorf("could not marshal JSON: %s", err)
+	}
+
+	return nil
+}
+
+// FetchImage fetches the version of the image to dest in the format
+// configured by the params, as `get` does. Progress is written to stderr.
+// Calls run one at a time; see resource.Source.StartTimeout.
+func FetchImage(req resource.InRequest, dest string, stderr io.Writer) (resource.InResponse, error) {
+	timeout, err := req.Source.StartTimeout()
 	if err != nil {
-		return fmt.Errorf("invalid payload: %s", err)
+		return resource.InResponse{}, err
+	}
+
+	defer timeout.Stop()
+
+	response, err := fetchImage(req, dest, stderr)
+	return response, timeout.Explain(err)
+}
+
+func fetchImage(req resource.InRequest, dest string, stderr io.Writer) (resource.InResponse, error) {
+	err := req.Source.SplitReference()
+	if err != nil {
+		return resource.InResponse{}, resource.Categorize(resource.CategoryValidation, err)
 	}
 
 	if req.Source.Debug {
 		logrus.SetLevel(logrus.DebugLevel)
 	}
 
-	if len(i.args) < 2 {
-		return fmt.Errorf("destination path not specified")
+	err = req.Source.Authenticate()
+	if err != nil {
+		return resource.InResponse{}, err
 	}
 
-	dest := i.args[1]
-
-	if req.Source.AwsRegion != "" {
-		if !req.Source.AuthenticateToECR() {
-			return fmt.Errorf("cannot authenticate with ECR")
-		}
+	err = req.Source.CheckAllowedRegistries()
+	if err != nil {
+		return resource.InResponse{}, err
 	}
 
 	repo, err := req.Source.NewRepository()
 	if err != nil {
-		return fmt.Errorf("failed to resolve repository: %w", err)
+		return resource.InResponse{}, fmt.Errorf("failed to resolve repository: %w", err)
 	}
 
-	tag := repo.Tag(req.Version.Tag)
+	version := req.Version
+	if req.Source.Digest != "" {
+		// tags are untrusted when pinned by digest, so refuse to fetch anything
+		// else, e.g. a version configured on the get step
+		if version.Digest == "" {
+			version.Digest = req.Source.Digest
+		} else if version.Digest != req.Source.Digest {
+			return resource.InResponse{}, resource.Invalid("version digest %s is not the pinned digest %s", version.Digest, req.Source.Digest)
+		}
+	}
+
+	if version.Tag == "" {
+		// e.g. a version pinned by digest alone
+		version.Tag = req.Source.DefaultVersionTag()
+	}
+
+	tag := repo.Tag(version.Tag)
 
-	if !req.Params.SkipDownload {
-		mirrorSource, hasMirror, err := req.Source.Mirror()
+	if req.Source.ContentTrust != nil && req.Source.ContentTrust.Verify {
+		err = verifyContentTrust(req.Source, version)
 		if err != nil {
-			return fmt.Errorf("failed to resolve mirror: %w", err)
+			return resource.InResponse{}, fmt.Errorf("content trust: %w", err)
 		}
+	}
 
-		usedMirror := false
-		if hasMirror {
-			err := downloadWithRetry(tag, mirrorSource, req.Params, req.Version, dest, i.stderr)
-			if err != nil {
-				logrus.Warnf("download from mirror %s failed: %s", mirrorSource.Repository, err)
-			} else {
-				usedMirror = true
-			}
+	stats := newTransferStats(false)
+
+	fetch := func(source resource.Source, fallbacks []resource.Source, retryRateLimit bool) error {
+		return downloadWithRetry(tag, source, fallbacks, req.Params, version, dest, stats, retryRateLimit, stderr)
+	}
+
+	if req.Params.SkipDownload {
+		fetch = func(source resource.Source, fallbacks []resource.Source, retryRateLimit bool) error {
+			return fetchMetadataWithRetry(source, version, dest, retryRateLimit, stderr)
 		}
+	}
 
-		if !usedMirror {
-			err := downloadWithRetry(tag, req.Source, req.Params, req.Version, dest, i.stderr)
-			if err != nil {
-				return fmt.Errorf("download failed: %w", err)
+	if !req.Params.SkipDownload || req.Params.FetchMetadata {
+		sources, err := req.Source.SourcesToTry(false)
+		if err != nil {
+			return resource.InResponse{}, fmt.Errorf("failed to resolve mirror: %w", err)
+		}
+
+		for i, source := range sources {
+			last := i == len(sources)-1
+
+			// with origin_first, the mirror is a fallback for when the origin is
+			// rate limited, so don't wait for the origin
+			err := fetch(source, sources[i+1:], last || !req.Source.OriginFirst())
+			if err == nil {
+				break
 			}
+
+			if last {
+				return resource.InResponse{}, fmt.Errorf("download failed: %w", err)
+			}
+
+			logrus.Warnf("download from %s failed: %s", source.Repository, err)
 		}
+
+		stats.Log()
+
+		pruneLayerCache(req.Source.LayerCachePath(), req.Source.LayerCacheMaxSize())
 	}
 
-	err = saveVersionInfo(dest, req.Version, req.Source.Repository)
+	err = saveVersionInfo(dest, version, req.Source.Repository)
 	if err != nil {
-		return fmt.Errorf("saving version info failed: %w", err)
+		return resource.InResponse{}, fmt.Errorf("saving version info failed: %w", err)
 	}
 
-	err = json.NewEncoder(os.Stdout).Encode(resource.InResponse{
-		Version: req.Version,
-		Metadata: append(req.Source.Metadata(), resource.MetadataField{
-			Name:  "tag",
-			Value: req.Version.Tag,
-		}),
+	metadata := append(req.Source.Metadata(), resource.MetadataField{
+		Name:  "tag",
+		Value: version.Tag,
 	})
-	if err != nil {
-		return fmt.Errorf("could not marshal JSON: %s", err)
+
+	if len(req.Source.MetadataLabels) > 0 {
+		labels, err := readLabels(dest)
+		if err != nil {
+			return resource.InResponse{}, err
+		}
+
+		metadata = append(metadata, req.Source.LabelMetadata(labels)...)
 	}
 
-	return nil
+	return resource.InResponse{
+		Version:  req.Version,
+		Metadata: append(metadata, stats.Metadata()...),
+	}, nil
 }
 
-func downloadWithRetry(tag name.Tag, source resource.Source, params resource.GetParams, version resource.Version, dest string, stderr io.Writer) error {
-	fmt.Fprintf(os.Stderr, "fetching %s@%s\n", color.GreenString(source.Repository), color.YellowString(version.Digest))
+// downloadWithRetry downloads the image from the source, fetching any layers
+// the source fails to serve from the fallbacks.
+func downloadWithRetry(tag name.Tag, source resource.Source, fallbacks []resource.Source, params resource.GetParams, version resource.Version, dest string, stats *transferStats, retryRateLimit bool, stderr io.Writer) error {
+	fmt.Fprintf(stderr, "fetching %s@%s\n", color.GreenString(source.Repository), color.YellowString(version.Digest))
 
 	repo, err := source.NewRepository()
 	if err != nil {
 		return fmt.Errorf("resolve repository name: %w", err)
 	}
 
-	return resource.RetryOnRateLimit(func() error {
-		opts, err := source.AuthOptions(repo, []string{transport.PullScope})
+	return retryOnRateLimit(retryRateLimit, func() error {
+		opts, err := source.PullOptions(repo)
 		if err != nil {
 			return err
 		}
 
-		image, err := remote.Image(repo.Digest(version.Digest), opts...)
+		if params.Verify != nil {
+			err = verifyCosignSignatures(repo, version.Digest, *params.Verify, opts...)
+			if err != nil {
+				return fmt.Errorf("verify signature: %w", err)
+			}
+		}
+
+		var desc *remote.Descriptor
+		err = resource.RetryOnNotFound(source.ConsistencyTimeout(), func() error {
+			desc, err = remote.Get(repo.Digest(version.Digest), opts...)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("get image: %w", err)
+		}
+
+		image, err := fetchedImage(desc, source)
 		if err != nil {
 			return fmt.Errorf("get image: %w", err)
 		}
 
-		err = saveImage(dest, tag, image, params.Format(), source.Debug, stderr)
+		err = writeManifestList(dest, desc)
+		if err != nil {
+			return err
+		}
+
+		// the runtime bundle's config.json is its runtime spec instead
+		err = writeManifestAndConfig(dest, image, params.Format() != "runtime-bundle")
+		if err != nil {
+			return err
+		}
+
+		err = writeImageSize(dest, image)
+		if err != nil {
+			return err
+		}
+
+		err = checkPlatform(image, source.Platform(), params.PlatformMismatch)
+		if err != nil {
+			return err
+		}
+
+		image = withLayerFailover(image, source, fallbacks)
+
+		// cached layers aren't transferred, so they're left out of the stats
+		image = withLayerCache(stats.Image(image), source.LayerCachePath())
+
+		err = saveImage(dest, tag, image, params, source.Debug, source.Heartbeat(), stderr)
 		if err != nil {
 			return fmt.Errorf("save image: %w", err)
 		}
@@ -149,18 +295,185 @@ func downloadWithRetry(tag name.Tag, source resource.Source, params resource.Get
 	})
 }
 
-func saveImage(dest string, tag name.Tag, image v1.Image, format string, debug bool, stderr io.Writer) error {
-	switch format {
+// retryOnRateLimit retries the operation while rate limited if retry is true,
+// i.e. unless there's another source to fall back to instead.
+func retryOnRateLimit(retry bool, op func() error) error {
+	if !retry {
+		return op()
+	}
+
+	return resource.RetryOnRateLimit(op)
+}
+
+// checkPlatform compares the platform in the image's config to the requested
+// platform, since registries with broken indexes may serve the wrong image.
+func checkPlatform(image v1.Image, platform resource.PlatformField, mismatch string) error {
+	switch mismatch {
+	case "", "warn", "fail":
+	default:
+		return resource.Invalid("unknown platform_mismatch %q (must be 'warn' or 'fail')", mismatch)
+	}
+
+	cfg, err := image.ConfigFile()
+	if err != nil {
+		return fmt.Errorf("inspect image config: %w", err)
+	}
+
+	// e.g. arm64/v8
+	arch, _, _ := strings.Cut(platform.Architecture, "/")
+
+	if (cfg.OS == "" || cfg.OS == platform.OS) && (cfg.Architecture == "" || cfg.Architecture == arch) {
+		return nil
+	}
+
+	if mismatch == "fail" {
+		return fmt.Errorf("image is for %s/%s, but %s/%s was requested", cfg.OS, cfg.Architecture, platform.OS, arch)
+	}
+
+	logrus.Warnf("image is for %s/%s, but %s/%s was requested", cfg.OS, cfg.Architecture, platform.OS, arch)
+
+	return nil
+}
+
+// fetchMetadataWithRetry writes the image's metadata, labels, and layers
+// without downloading any layers, fetching only its manifest and config.
+func fetchMetadataWithRetry(source resource.Source, version resource.Version, dest string, retryRateLimit bool, stderr io.Writer) error {
+	fmt.Fprintf(stderr, "fetching metadata for %s@%s\n", color.GreenString(source.Repository), color.YellowString(version.Digest))
+
+	repo, err := source.NewRepository()
+	if err != nil {
+		return fmt.Errorf("resolve repository name: %w", err)
+	}
+
+	return retryOnRateLimit(retryRateLimit, func() error {
+		opts, err := source.PullOptions(repo)
+		if err != nil {
+			return err
+		}
+
+		var desc *remote.Descriptor
+		err = resource.RetryOnNotFound(source.ConsistencyTimeout(), func() error {
+			desc, err = remote.Get(repo.Digest(version.Digest), opts...)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("get image: %w", err)
+		}
+
+		image, err := fetchedImage(desc, source)
+		if err != nil {
+			return fmt.Errorf("get image: %w", err)
+		}
+
+		err = writeManifestList(dest, desc)
+		if err != nil {
+			return err
+		}
+
+		err = writeManifestAndConfig(dest, image, true)
+		if err != nil {
+			return err
+		}
+
+		err = writeImageSize(dest, image)
+		if err != nil {
+			return err
+		}
+
+		err = writeImageMetadata(dest, image)
+		if err != nil {
+			return err
+		}
+
+		return writeLayers(dest, image)
+	})
+}
+
+func saveImage(dest string, tag name.Tag, image v1.Image, params resource.GetParams, debug bool, heartbeat time.Duration, stderr io.Writer) error {
+	umask, err := params.ParseUmask()
+	if err != nil {
+		return err
+	}
+
+	err = params.CheckRootfsOwner()
+	if err != nil {
+		return err
+	}
+
+	switch params.Format() {
 	case "oci":
 		err := ociFormat(dest, tag, image)
 		if err != nil {
 			return fmt.Errorf("write oci image: %w", err)
 		}
 	case "rootfs":
-		err := rootfsFormat(dest, image, debug, stderr)
+		err := rootfsFormat(dest, image, debug, heartbeat, params.ExtractLimits, params.RootfsOwner, stderr)
 		if err != nil {
 			return fmt.Errorf("write rootfs: %w", err)
 		}
+	case "rootfs-tgz":
+		err := rootfsTarballFormat(dest, image, params.Compression())
+		if err != nil {
+			return fmt.Errorf("write rootfs tarball: %w", err)
+		}
+	case "runtime-bundle":
+		err := runtimeBundleFormat(dest, image, debug, heartbeat, params.ExtractLimits, params.RootfsOwner, stderr)
+		if err != nil {
+			return fmt.Errorf("write runtime bundle: %w", err)
+		}
+	case "containerd":
+		err := containerdFormat(dest, tag, image)
+		if err != nil {
+			return fmt.Errorf("write containerd bundle: %w", err)
+		}
+	case "oci-archive":
+		err := ociArchiveFormat(dest, tag, image)
+		if err != nil {
+			return fmt.Errorf("write OCI archive: %w", err)
+		}
+	case "layers":
+		err := layersFormat(dest, image, debug, heartbeat, params.ExtractLimits, params.RootfsOwner, stderr)
+		if err != nil {
+			return fmt.Errorf("write layers: %w", err)
+		}
+	case "overlay":
+		err := overlayFormat(dest, image, debug, heartbeat, params.ExtractLimits, params.RootfsOwner, stderr)
+		if err != nil {
+			return fmt.Errorf("write overlay layers: %w", err)
+		}
+	case "helm":
+		err := helmFormat(dest, image)
+		if err != nil {
+			return fmt.Errorf("write helm chart: %w", err)
+		}
+	}
+
+	if params.RewriteAbsoluteSymlinks || params.WorldReadable || umask != 0 {
+		roots, err := extractedRoots(dest, params.Format())
+		if err != nil {
+			return err
+		}
+
+		for _, root := range roots {
+			if params.RewriteAbsoluteSymlinks {
+				err := rewriteAbsoluteSymlinks(root)
+				if err != nil {
+					return fmt.Errorf("rewrite symlinks: %w", err)
+				}
+			}
+
+			if params.WorldReadable || umask != 0 {
+				err := normalizePermissions(root, params.WorldReadable, umask)
+				if err != nil {
+					return fmt.Errorf("normalize permissions: %w", err)
+				}
+			}
+		}
+	}
+
+	err = writeLayers(dest, image)
+	if err != nil {
+		return err
 	}
 
 	return nil
@@ -182,6 +495,16 @@ func saveVersionInfo(dest string, version resource.Version, repo string) error {
 		return fmt.Errorf("write image repository: %w", err)
 	}
 
+	err = ioutil.WriteFile(filepath.Join(dest, "ref"), []byte(repo+"@"+version.Digest), 0644)
+	if err != nil {
+		return fmt.Errorf("write image ref: %w", err)
+	}
+
+	err = ioutil.WriteFile(filepath.Join(dest, "tag_ref"), []byte(repo+":"+version.Tag), 0644)
+	if err != nil {
+		return fmt.Errorf("write image tag ref: %w", err)
+	}
+
 	return nil
 }
 
@@ -204,12 +527,155 @@ func ociFormat(dest string, tag name.Tag, image v1.Image) error {
 	return nil
 }
 
-func rootfsFormat(dest string, image v1.Image, debug bool, stderr io.Writer) error {
-	err := unpackImage(filepath.Join(dest, "rootfs"), image, debug, stderr)
+func containerdFormat(dest string, tag name.Tag, image v1.Image) error {
+	imageName := containerdImageName(tag)
+
+	annotations := map[string]string{
+		containerdImageNameAnnotation: imageName,
+	}
+
+	if tag.TagStr() != "" {
+		annotations[ociRefNameAnnotation] = tag.TagStr()
+	}
+
+	err := writeOCIArchive(filepath.Join(dest, "image.tar"), image, annotations)
+	if err != nil {
+		return fmt.Errorf("write OCI archive: %w", err)
+	}
+
+	err = ioutil.WriteFile(filepath.Join(dest, "image-name"), []byte(imageName), 0644)
+	if err != nil {
+		return fmt.Errorf("write image name: %w", err)
+	}
+
+	config, err := image.ConfigFile()
+	if err != nil {
+		return fmt.Errorf("extract OCI config file: %s", err)
+	}
+
+	err = writeLabels(dest, config.Config.Labels)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func ociArchiveFormat(dest string, tag name.Tag, image v1.Image) error {
+	annotations := map[string]string{}
+	if tag.TagStr() != "" {
+		annotations[ociRefNameAnnotation] = tag.TagStr()
+	}
+
+	err := writeOCIArchive(filepath.Join(dest, "image.tar"), image, annotations)
+	if err != nil {
+		return err
+	}
+
+	config, err := image.ConfigFile()
+	if err != nil {
+		return fmt.Errorf("extract OCI config file: %s", err)
+	}
+
+	return writeLabels(dest, config.Config.Labels)
+}
+
+func rootfsFormat(dest string, image v1.Image, debug bool, heartbeat time.Duration, limits resource.ExtractLimits, owner *resource.RootfsOwner, stderr io.Writer) error {
+	err := unpackImage(filepath.Join(dest, "rootfs"), image, debug, heartbeat, limits, owner, stderr)
 	if err != nil {
 		return fmt.Errorf("extract image: %w", err)
 	}
 
+	return writeImageMetadata(dest, image)
+}
+
+func layersFormat(dest string, image v1.Image, debug bool, heartbeat time.Duration, limits resource.ExtractLimits, owner *resource.RootfsOwner, stderr io.Writer) error {
+	err := unpackLayers(filepath.Join(dest, "layers"), image, keepWhiteouts, debug, heartbeat, limits, owner, stderr)
+	if err != nil {
+		return fmt.Errorf("extract layers: %w", err)
+	}
+
+	return writeImageMetadata(dest, image)
+}
+
+func overlayFormat(dest string, image v1.Image, debug bool, heartbeat time.Duration, limits resource.ExtractLimits, owner *resource.RootfsOwner, stderr io.Writer) error {
+	err := unpackLayers(filepath.Join(dest, "layers"), image, overlayWhiteouts, debug, heartbeat, limits, owner, stderr)
+	if err != nil {
+		return fmt.Errorf("extract layers: %w", err)
+	}
+
+	layers, err := image.Layers()
+	if err != nil {
+		return fmt.Errorf("get image layers: %w", err)
+	}
+
+	// in the order of overlayfs's lowerdir, i.e. topmost first
+	order := ""
+	for i := len(layers) - 1; i >= 0; i-- {
+		order += filepath.Join("layers", strconv.Itoa(i)) + "\n"
+	}
+
+	err = ioutil.WriteFile(filepath.Join(dest, "order"), []byte(order), 0644)
+	if err != nil {
+		return fmt.Errorf("write layer order: %w", err)
+	}
+
+	return writeImageMetadata(dest, image)
+}
+
+func rootfsTarballFormat(dest string, image v1.Image, compression string) error {
+	var filename string
+	switch compression {
+	case "gzip":
+		filename = "rootfs.tar.gz"
+	case "zstd":
+		filename = "rootfs.tar.zst"
+	default:
+		return resource.Invalid("unknown compression: %q", compression)
+	}
+
+	archive, err := os.Create(filepath.Join(dest, filename))
+	if err != nil {
+		return fmt.Errorf("create rootfs archive: %w", err)
+	}
+
+	var zw io.WriteCloser
+	if compression == "zstd" {
+		zw, err = zstd.NewWriter(archive)
+		if err != nil {
+			archive.Close()
+			return fmt.Errorf("initialize zstd writer: %w", err)
+		}
+	} else {
+		zw = gzip.NewWriter(archive)
+	}
+
+	// mutate.Extract flattens the layers, applying whiteouts along the way
+	fs := mutate.Extract(image)
+	defer fs.Close()
+
+	_, err = io.Copy(zw, fs)
+	if err != nil {
+		zw.Close()
+		archive.Close()
+		return fmt.Errorf("flatten image: %w", err)
+	}
+
+	err = zw.Close()
+	if err != nil {
+		archive.Close()
+		return fmt.Errorf("compress rootfs archive: %w", err)
+	}
+
+	err = archive.Close()
+	if err != nil {
+		return fmt.Errorf("close rootfs archive: %w", err)
+	}
+
+	return writeImageMetadata(dest, image)
+}
+
+func writeImageMetadata(dest string, image v1.Image) error {
 	cfg, err := image.ConfigFile()
 	if err != nil {
 		return fmt.Errorf("inspect image config: %w", err)
@@ -267,3 +733,184 @@ func writeLabels(dest string, labelData map[string]string) error {
 
 	return nil
 }
+
+// readLabels reads the labels written by the fetch, if any, as not every
+// format or skip_download writes them.
+func readLabels(dest string) (map[string]string, error) {
+	labelsJSON, err := ioutil.ReadFile(filepath.Join(dest, "labels.json"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+
+		return nil, fmt.Errorf("read labels: %w", err)
+	}
+
+	var labels map[string]string
+	err = json.Unmarshal(labelsJSON, &labels)
+	if err != nil {
+		return nil, fmt.Errorf("parse labels: %w", err)
+	}
+
+	return labels, nil
+}
+
+// writeManifestAndConfig writes the raw manifest and config of the image, so
+// that e.g. its labels, entrypoint, layers, and platform can be inspected
+// without fetching it again.
+func writeManifestAndConfig(dest string, image v1.Image, writeConfig bool) error {
+	manifest, err := image.RawManifest()
+	if err != nil {
+		return fmt.Errorf("get image manifest: %w", err)
+	}
+
+	err = ioutil.WriteFile(filepath.Join(dest, "manifest.json"), manifest, 0644)
+	if err != nil {
+		return fmt.Errorf("write image manifest: %w", err)
+	}
+
+	if !writeConfig {
+		return nil
+	}
+
+	config, err := image.RawConfigFile()
+	if err != nil {
+		return fmt.Errorf("get image config: %w", err)
+	}
+
+	err = ioutil.WriteFile(filepath.Join(dest, "config.json"), config, 0644)
+	if err != nil {
+		return fmt.Errorf("write image config: %w", err)
+	}
+
+	return nil
+}
+
+// writeImageSize writes the total size of the image's manifest, config, and
+// (compressed) layers, i.e. how much pulling it transfers at most.
+func writeImageSize(dest string, image v1.Image) error {
+	manifest, err := image.Manifest()
+	if err != nil {
+		return fmt.Errorf("get image manifest: %w", err)
+	}
+
+	rawManifest, err := image.RawManifest()
+	if err != nil {
+		return fmt.Errorf("get image manifest: %w", err)
+	}
+
+	size := int64(len(rawManifest)) + manifest.Config.Size
+	for _, layer := range manifest.Layers {
+		size += layer.Size
+	}
+
+	err = ioutil.WriteFile(filepath.Join(dest, "size"), []byte(strconv.FormatInt(size, 10)), 0644)
+	if err != nil {
+		return fmt.Errorf("write image size: %w", err)
+	}
+
+	return nil
+}
+
+// writeManifestList writes the platforms and digests of the images in the
+// index, if the version is one, so that they can be iterated over without
+// fetching it again.
+func writeManifestList(dest string, desc *remote.Descriptor) error {
+	if !desc.MediaType.IsIndex() {
+		return nil
+	}
+
+	manifest, err := v1.ParseIndexManifest(bytes.NewReader(desc.Manifest))
+	if err != nil {
+		return fmt.Errorf("parse index manifest: %w", err)
+	}
+
+	manifests := []ManifestMetadata{}
+	for _, child := range manifest.Manifests {
+		metadata := ManifestMetadata{
+			Digest:    child.Digest.String(),
+			Size:      child.Size,
+			MediaType: string(child.MediaType),
+		}
+
+		if child.Platform != nil {
+			metadata.OS = child.Platform.OS
+			metadata.Architecture = child.Platform.Architecture
+			metadata.Variant = child.Platform.Variant
+			metadata.OSVersion = child.Platform.OSVersion
+		}
+
+		manifests = append(manifests, metadata)
+	}
+
+	manifestsFile, err := os.Create(filepath.Join(dest, "manifest-list.json"))
+	if err != nil {
+		return fmt.Errorf("create manifest list: %w", err)
+	}
+
+	err = json.NewEncoder(manifestsFile).Encode(manifests)
+	if err != nil {
+		return fmt.Errorf("write manifest list: %w", err)
+	}
+
+	err = manifestsFile.Close()
+	if err != nil {
+		return fmt.Errorf("close manifest list file: %w", err)
+	}
+
+	return nil
+}
+
+func writeLayers(dest string, image v1.Image) error {
+	layers, err := image.Layers()
+	if err != nil {
+		return fmt.Errorf("get image layers: %w", err)
+	}
+
+	layerData := []LayerMetadata{}
+	for _, layer := range layers {
+		digest, err := layer.Digest()
+		if err != nil {
+			return fmt.Errorf("get layer digest: %w", err)
+		}
+
+		diffID, err := layer.DiffID()
+		if err != nil {
+			return fmt.Errorf("get layer diff id: %w", err)
+		}
+
+		size, err := layer.Size()
+		if err != nil {
+			return fmt.Errorf("get layer size: %w", err)
+		}
+
+		mediaType, err := layer.MediaType()
+		if err != nil {
+			return fmt.Errorf("get layer media type: %w", err)
+		}
+
+		layerData = append(layerData, LayerMetadata{
+			Digest:    digest.String(),
+			DiffID:    diffID.String(),
+			Size:      size,
+			MediaType: string(mediaType),
+		})
+	}
+
+	layersFile, err := os.Create(filepath.Join(dest, "layers.json"))
+	if err != nil {
+		return fmt.Errorf("create image layers: %w", err)
+	}
+
+	err = json.NewEncoder(layersFile).Encode(layerData)
+	if err != nil {
+		return fmt.Errorf("write image layers: %w", err)
+	}
+
+	err = layersFile.Close()
+	if err != nil {
+		return fmt.Errorf("close image layers file: %w", err)
+	}
+
+	return nil
+}
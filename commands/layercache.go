@@ -0,0 +1,278 @@
+package commands
+
+import (
+	"encoding/hex"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/partial"
+	"github.com/sirupsen/logrus"
+)
+
+// cachePartialPrefix prefixes the layers being written to the cache.
+const cachePartialPrefix = ".partial-"
+
+// staleCachePartial is how old a partial layer must be to be pruned, as it
+// may otherwise still be being written by a concurrent get.
+const staleCachePartial = time.Hour
+
+// cachedImage reads the compressed layers of an image from a directory shared
+// by every get on the worker, and writes the layers it has to fetch there
+// once they have been verified, so that layers common to images (e.g. base
+// images) are only fetched once.
+type cachedImage struct {
+	v1.Image
+	dir string
+}
+
+func withLayerCache(image v1.Image, dir string) v1.Image {
+	if dir == "" {
+		return image
+	}
+
+	return &cachedImage{
+		Image: image,
+		dir:   dir,
+	}
+}
+
+func (i *cachedImage) Layers() ([]v1.Layer, error) {
+	layers, err := i.Image.Layers()
+	if err != nil {
+		return nil, err
+	}
+
+	wrapped := make([]v1.Layer, len(layers))
+	for n, layer := range layers {
+		wrapped[n], err = i.layer(layer)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return wrapped, nil
+}
+
+func (i *cachedImage) LayerByDigest(digest v1.Hash) (v1.Layer, error) {
+	layer, err := i.Image.LayerByDigest(digest)
+	if err != nil {
+		return nil, err
+	}
+
+	return i.layer(layer)
+}
+
+func (i *cachedImage) LayerByDiffID(diffID v1.Hash) (v1.Layer, error) {
+	layer, err := i.Image.LayerByDiffID(diffID)
+	if err != nil {
+		return nil, err
+	}
+
+	return i.layer(layer)
+}
+
+func (i *cachedImage) layer(layer v1.Layer) (v1.Layer, error) {
+	// Uncompressed is derived from Compressed, so that it's cached too
+	return partial.CompressedToLayer(&cachedLayer{Layer: layer, dir: i.dir})
+}
+
+type cachedLayer struct {
+	v1.Layer
+	dir string
+}
+
+func (l *cachedLayer) Compressed() (io.ReadCloser, error) {
+	digest, err := l.Layer.Digest()
+	if err != nil {
+		return nil, err
+	}
+
+	path := filepath.Join(l.dir, digest.Algorithm+"-"+digest.Hex)
+
+	cached, err := os.Open(path)
+	if err == nil {
+		logrus.Infof("layer %s: cached", digest.Hex[0:12])
+
+		// mark it as recently used, for pruning the least recently used layers
+		now := time.Now()
+		_ = os.Chtimes(path, now, now)
+
+		return cached, nil
+	}
+
+	if !os.IsNotExist(err) {
+		logrus.Warnf("reading layer %s from cache failed: %s", digest.Hex[0:12], err)
+	}
+
+	rc, err := l.Layer.Compressed()
+	if err != nil {
+		return nil, err
+	}
+
+	return newCachingReader(rc, digest, l.dir, path), nil
+}
+
+// cachingReader copies the layer into the cache as it's read, moving it into
+// place only once it has been read in full and matches its digest, so that
+// gets running at the same time never read a partial or corrupt layer.
+type cachingReader struct {
+	rc     io.ReadCloser
+	digest v1.Hash
+	path   string
+
+	tmp  *os.File
+	hash hash.Hash
+}
+
+func newCachingReader(rc io.ReadCloser, digest v1.Hash, dir string, path string) io.ReadCloser {
+	h, err := v1.Hasher(digest.Algorithm)
+	if err != nil {
+		return rc
+	}
+
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		logrus.Warnf("not caching layer %s: %s", digest.Hex[0:12], err)
+		return rc
+	}
+
+	tmp, err := ioutil.TempFile(dir, cachePartialPrefix+digest.Hex)
+	if err != nil {
+		logrus.Warnf("not caching layer %s: %s", digest.Hex[0:12], err)
+		return rc
+	}
+
+	return &cachingReader{
+		rc:     rc,
+		digest: digest,
+		path:   path,
+		tmp:    tmp,
+		hash:   h,
+	}
+}
+
+func (r *cachingReader) Read(p []byte) (int, error) {
+	n, err := r.rc.Read(p)
+	if r.tmp == nil {
+		return n, err
+	}
+
+	r.hash.Write(p[:n])
+
+	_, writeErr := r.tmp.Write(p[:n])
+	if writeErr != nil {
+		logrus.Warnf("not caching layer %s: %s", r.digest.Hex[0:12], writeErr)
+		r.discard()
+	} else if err == io.EOF {
+		r.commit()
+	}
+
+	return n, err
+}
+
+// commit moves the layer into the cache if it was read intact.
+func (r *cachingReader) commit() {
+	defer r.discard()
+
+	actual := hex.EncodeToString(r.hash.Sum(nil))
+	if actual != r.digest.Hex {
+		// reading the layer fails on its own
+		return
+	}
+
+	err := r.tmp.Close()
+	if err == nil {
+		err = os.Rename(r.tmp.Name(), r.path)
+	}
+
+	if err != nil {
+		logrus.Warnf("not caching layer %s: %s", r.digest.Hex[0:12], err)
+	}
+}
+
+// discard removes the partial layer, unless it was moved into the cache.
+func (r *cachingReader) discard() {
+	if r.tmp == nil {
+		return
+	}
+
+	r.tmp.Close()
+	os.Remove(r.tmp.Name())
+	r.tmp = nil
+}
+
+func (r *cachingReader) Close() error {
+	r.discard()
+	return r.rc.Close()
+}
+
+// pruneLayerCache removes the least recently used layers from the cache until
+// it's no larger than the max size, along with any stale partial layers, e.g.
+// left by a get which was interrupted.
+func pruneLayerCache(dir string, maxSize int64) {
+	if dir == "" {
+		return
+	}
+
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logrus.Warnf("pruning layer cache failed: %s", err)
+		}
+
+		return
+	}
+
+	var layers []os.FileInfo
+	var size int64
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+
+		if strings.HasPrefix(entry.Name(), cachePartialPrefix) {
+			if time.Since(entry.ModTime()) > staleCachePartial {
+				removeCached(dir, entry)
+			}
+
+			continue
+		}
+
+		layers = append(layers, entry)
+		size += entry.Size()
+	}
+
+	// the layers used by this get were just marked as used, so are pruned last
+	sort.Slice(layers, func(i, j int) bool {
+		return layers[i].ModTime().Before(layers[j].ModTime())
+	})
+
+	for _, layer := range layers {
+		if size <= maxSize {
+			break
+		}
+
+		if removeCached(dir, layer) {
+			size -= layer.Size()
+		}
+	}
+}
+
+func removeCached(dir string, entry os.FileInfo) bool {
+	err := os.Remove(filepath.Join(dir, entry.Name()))
+	if err != nil && !os.IsNotExist(err) {
+		logrus.Warnf("pruning %s from layer cache failed: %s", entry.Name(), err)
+		return false
+	}
+
+	logrus.Debugf("pruned %s from layer cache", entry.Name())
+
+	return true
+}
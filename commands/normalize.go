@@ -0,0 +1,105 @@
+package commands
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/sirupsen/logrus"
+)
+
+// extractedRoots returns the directories the format extracts filesystems to.
+func extractedRoots(dest string, format string) ([]string, error) {
+	switch format {
+	case "rootfs", "runtime-bundle":
+		return []string{filepath.Join(dest, "rootfs")}, nil
+	case "layers", "overlay":
+		return filepath.Glob(filepath.Join(dest, "layers", "*"))
+	default:
+		return nil, nil
+	}
+}
+
+// rewriteAbsoluteSymlinks rewrites symlinks to absolute paths to be relative
+// to the root instead, so that they resolve within it when it isn't used as
+// the root filesystem, e.g. /bin/bash linked from /usr/bin/sh becomes
+// ../../bin/bash.
+func rewriteAbsoluteSymlinks(root string) error {
+	return filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if info.Mode()&os.ModeSymlink == 0 {
+			return nil
+		}
+
+		target, err := os.Readlink(path)
+		if err != nil {
+			return err
+		}
+
+		if !filepath.IsAbs(target) {
+			return nil
+		}
+
+		rel, err := filepath.Rel(root, filepath.Dir(path))
+		if err != nil {
+			return err
+		}
+
+		relTarget, err := filepath.Rel(filepath.Join("/", rel), target)
+		if err != nil {
+			return err
+		}
+
+		logrus.Debugf("rewriting symlink %s from %s to %s", path, target, relTarget)
+
+		err = os.Remove(path)
+		if err != nil {
+			return err
+		}
+
+		err = os.Symlink(relTarget, path)
+		if err != nil {
+			return fmt.Errorf("rewrite symlink %s: %w", path, err)
+		}
+
+		return nil
+	})
+}
+
+// normalizePermissions makes the extracted files readable by anyone (and
+// directories and executables traversable and executable by anyone), and/or
+// removes the permissions in the umask.
+func normalizePermissions(root string, worldReadable bool, umask os.FileMode) error {
+	return filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if !info.Mode().IsRegular() && !info.IsDir() {
+			// symlink permissions are meaningless, and devices are left alone
+			return nil
+		}
+
+		mode := info.Mode()
+		perm := mode.Perm()
+
+		if worldReadable {
+			perm |= 0444
+
+			if info.IsDir() || perm&0100 != 0 {
+				perm |= 0111
+			}
+		}
+
+		perm &^= umask
+
+		if perm == mode.Perm() {
+			return nil
+		}
+
+		return os.Chmod(path, mode&^os.ModePerm|perm)
+	})
+}
@@ -1,24 +1,31 @@
 package commands
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net/http"
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/Masterminds/semver/v3"
 	resource "github.com/concourse/registry-image-resource"
 	"github.com/google/go-containerregistry/pkg/authn"
 	"github.com/google/go-containerregistry/pkg/name"
 	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
 	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
 	"github.com/google/go-containerregistry/pkg/v1/partial"
 	"github.com/google/go-containerregistry/pkg/v1/remote"
 	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
 	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/google/go-containerregistry/pkg/v1/types"
 	"github.com/simonshyu/notary-gcr/pkg/gcr"
 	"github.com/sirupsen/logrus"
 )
@@ -48,48 +55,87 @@ func (o *Out) Execute() error {
 	setupLogging(o.stderr)
 
 	var req resource.OutRequest
-	decoder := json.NewDecoder(o.stdin)
-	decoder.DisallowUnknownFields()
-	err := decoder.Decode(&req)
+	err := decodeRequest(o.stdin, &req)
 	if err != nil {
-		return fmt.Errorf("invalid payload: %s", err)
+		return err
+	}
+
+	if len(o.args) < 2 {
+		return fmt.Errorf("destination path not specified")
+	}
+
+	response, err := PushImage(req, o.args[1])
+	if err != nil {
+		return err
+	}
+
+	err = json.NewEncoder(o.stdout).Encode(response)
+	if err != nil {
+		return fmt.Errorf("could not marshal JSON: %s", err)
+	}
+
+	return nil
+}
+
+// PushImage pushes the image configured by the params, relative to the src
+// directory, as `put` does.
+// Calls run one at a time; see resource.Source.StartTimeout.
+func PushImage(req resource.OutRequest, src string) (resource.OutResponse, error) {
+	timeout, err := req.Source.StartTimeout()
+	if err != nil {
+		return resource.OutResponse{}, err
+	}
+
+	defer timeout.Stop()
+
+	response, err := pushImage(req, src)
+	return response, timeout.Explain(err)
+}
+
+func pushImage(req resource.OutRequest, src string) (resource.OutResponse, error) {
+	err := req.Source.SplitReference()
+	if err != nil {
+		return resource.OutResponse{}, resource.Categorize(resource.CategoryValidation, err)
 	}
 
 	if req.Source.Debug {
 		logrus.SetLevel(logrus.DebugLevel)
 	}
 
-	if len(o.args) < 2 {
-		return fmt.Errorf("destination path not specified")
+	err = req.Source.Authenticate()
+	if err != nil {
+		return resource.OutResponse{}, err
 	}
 
-	src := o.args[1]
-
-	if req.Source.AwsRegion != "" {
-		if !req.Source.AuthenticateToECR() {
-			return fmt.Errorf("cannot authenticate with ECR")
-		}
+	err = req.Source.CheckAllowedRegistries()
+	if err != nil {
+		return resource.OutResponse{}, err
 	}
 
 	tagsToPush := []name.Tag{}
+	aliases := []aliasBump{}
+	skippedAliases := []name.Tag{}
 
 	repo, err := req.Source.NewRepository()
 	if err != nil {
-		return fmt.Errorf("could not resolve repository: %w", err)
+		return resource.OutResponse{}, fmt.Errorf("could not resolve repository: %w", err)
 	}
 
 	if req.Source.Tag != "" {
 		tagsToPush = append(tagsToPush, repo.Tag(req.Source.Tag.String()))
 	}
 
+	var versionTag string
 	if req.Params.Version != "" {
-		ver, err := semver.NewVersion(req.Params.Version)
+		// accept the version as it appears in a tag fetched by get, e.g.
+		// release-1.2.3 with 'tag_prefix: release-'
+		ver, err := semver.NewVersion(strings.TrimPrefix(req.Params.Version, req.Source.TagPrefix))
 		if err != nil {
 			if err == semver.ErrInvalidSemVer {
-				return fmt.Errorf("invalid semantic version: %q", req.Params.Version)
+				return resource.OutResponse{}, resource.Invalid("invalid semantic version: %q", req.Params.Version)
 			}
 
-			return fmt.Errorf("failed to parse version: %w", err)
+			return resource.OutResponse{}, fmt.Errorf("failed to parse version: %w", err)
 		}
 
 		// vito: subtle gotcha here - if someone passes the version as v1.2.3, the
@@ -101,72 +147,196 @@ func (o *Out) Execute() error {
 		// just enforce it until someone complains enough; it seems more likely to
 		// be an accident than a legacy practice that must be preserved.
 		//
-		// if that's the person reading this: sorry! PR welcome! (maybe we should
-		// add tag_prefix:?)
-		tag := ver.String()
-		if req.Source.Variant != "" {
-			tag += "-" + req.Source.Variant
-		}
-
-		tagsToPush = append(tagsToPush, repo.Tag(tag))
-
-		if req.Params.BumpAliases && ver.Prerelease() == "" {
-			aliasTags, err := aliasesToBump(req, repo, ver)
-			if err != nil {
-				return fmt.Errorf("determine aliases: %w", err)
+		// if that's the person reading this: sorry! configure 'tag_prefix: v'
+		// instead.
+		versionTag = req.Source.TagPrefix + ver.String()
+
+		for _, variant := range req.Variants() {
+			tag := versionTag
+			if variant != "" {
+				tag += "-" + variant
 			}
 
-			tagsToPush = append(tagsToPush, aliasTags...)
+			tagsToPush = append(tagsToPush, repo.Tag(tag))
+
+			if req.Params.BumpAliases && ver.Prerelease() == "" {
+				aliasTags, err := aliasesToBump(req, repo, ver, variant)
+				if err != nil {
+					return resource.OutResponse{}, fmt.Errorf("determine aliases: %w", err)
+				}
+
+				bumped := map[string]bool{}
+				for _, tag := range aliasTags {
+					bumped[tag.TagStr()] = true
+
+					aliases = append(aliases, aliasBump{
+						Tag:     tag,
+						Version: ver,
+						Variant: variant,
+					})
+				}
+
+				latestTag, majorTag, minorTag := aliasNames(req.Source.TagPrefix, ver, variant)
+				for _, alias := range []string{latestTag, majorTag, minorTag} {
+					if !bumped[alias] {
+						skippedAliases = append(skippedAliases, repo.Tag(alias))
+					}
+				}
+			}
 		}
 	}
 
 	additionalTags, err := req.Params.ParseAdditionalTags(src)
 	if err != nil {
-		return fmt.Errorf("could not parse additional tags: %w", err)
+		return resource.OutResponse{}, fmt.Errorf("could not parse additional tags: %w", err)
+	}
+
+	templatedTags, err := req.Params.ParseAdditionalTagsTemplate(src, versionTag, req.Variants(), time.Now())
+	if err != nil {
+		return resource.OutResponse{}, fmt.Errorf("could not expand additional tags template: %w", err)
 	}
 
+	additionalTags = append(additionalTags, templatedTags...)
+
 	for _, tagName := range additionalTags {
 		tag, err := name.NewTag(fmt.Sprintf("%s:%s", req.Source.Repository, tagName))
 		if err != nil {
-			return fmt.Errorf("could not resolve repository/tag reference: %w", err)
+			return resource.OutResponse{}, fmt.Errorf("could not resolve repository/tag reference: %w", err)
 		}
 
 		tagsToPush = append(tagsToPush, tag)
 	}
 
 	if len(tagsToPush) == 0 {
-		return fmt.Errorf("no tag specified - need either 'version:' in params or 'tag:' in source")
+		return resource.OutResponse{}, resource.Invalid("no tag specified - need either 'version:' in params or 'tag:' in source")
 	}
 
-	imagePath := filepath.Join(src, req.Params.Image)
-	matches, err := filepath.Glob(imagePath)
+	expectedDigest, err := req.Params.ParseExpectedDigest(src)
 	if err != nil {
-		return fmt.Errorf("failed to glob path '%s': %w", req.Params.Image, err)
+		return resource.OutResponse{}, fmt.Errorf("could not parse expected digest: %w", err)
 	}
-	if len(matches) == 0 {
-		return fmt.Errorf("no files match glob '%s'", req.Params.Image)
+
+	var signer cosignSigner
+	if req.Source.Cosign != nil {
+		signer, err = newCosignSigner(*req.Source.Cosign)
+		if err != nil {
+			return resource.OutResponse{}, err
+		}
 	}
-	if len(matches) > 1 {
-		return fmt.Errorf("too many files match glob '%s': %v", req.Params.Image, matches)
+
+	var img partial.WithRawManifest
+	var origin *name.Digest
+	originSource := req.Source
+	if req.Params.FromRegistry != nil {
+		if req.Params.Image != "" || req.Params.Rootfs != "" {
+			return resource.OutResponse{}, resource.Invalid("cannot specify 'from_registry' with 'image' or 'rootfs' in params")
+		}
+
+		ref, loaded, err := loadFromRegistry(*req.Params.FromRegistry, req.Source)
+		if err != nil {
+			return resource.OutResponse{}, fmt.Errorf("could not load image from registry: %w", err)
+		}
+
+		img = loaded
+
+		if req.Params.CopySignatures {
+			origin = &ref
+			originSource = *req.Params.FromRegistry
+		}
+	} else if req.Params.Rootfs != "" {
+		if req.Params.Image != "" {
+			return resource.OutResponse{}, resource.Invalid("cannot specify both 'image' and 'rootfs' in params")
+		}
+
+		if req.Params.CopySignatures {
+			return resource.OutResponse{}, fmt.Errorf("copy_signatures requires 'image' to be the output of a get")
+		}
+
+		img, err = buildImage(src, req.Params, req.Source.Platform())
+		if err != nil {
+			return resource.OutResponse{}, fmt.Errorf("could not build image from rootfs '%s': %w", req.Params.Rootfs, err)
+		}
+	} else {
+		imagePath := filepath.Join(src, req.Params.Image)
+		matches, err := filepath.Glob(imagePath)
+		if err != nil {
+			return resource.OutResponse{}, fmt.Errorf("failed to glob path '%s': %w", req.Params.Image, err)
+		}
+		if len(matches) == 0 {
+			return resource.OutResponse{}, resource.Invalid("no files match glob '%s'", req.Params.Image)
+		}
+		if len(matches) > 1 {
+			return resource.OutResponse{}, resource.Invalid("too many files match glob '%s': %v", req.Params.Image, matches)
+		}
+
+		img, err = loadImage(matches[0], req.Source, req.Params.ArchiveTag)
+		if err != nil {
+			return resource.OutResponse{}, fmt.Errorf("could not load image from path '%s': %w", req.Params.Image, err)
+		}
+
+		if req.Params.CopySignatures {
+			ref, err := getOutputRef(matches[0], req.Source)
+			if err != nil {
+				return resource.OutResponse{}, fmt.Errorf("copy_signatures requires 'image' to be the output of a get: %w", err)
+			}
+
+			origin = &ref
+		}
+	}
+
+	if len(req.Params.Platforms) > 0 {
+		img, err = filterPlatforms(img, req.Params.Platforms)
+		if err != nil {
+			return resource.OutResponse{}, err
+		}
 	}
 
-	img, err := loadImage(matches[0])
+	labels, err := req.Params.ParseLabels(src)
 	if err != nil {
-		return fmt.Errorf("could not load image from path '%s': %w", req.Params.Image, err)
+		return resource.OutResponse{}, fmt.Errorf("could not parse labels: %w", err)
 	}
 
-	var h v1.Hash
+	if len(labels) > 0 {
+		img, err = addLabels(img, labels)
+		if err != nil {
+			return resource.OutResponse{}, err
+		}
+	}
+
+	if expectedDigest != "" {
+		// compared before recompressing or setting the artifact type, which
+		// change the digest, so that it can be taken from the build's output
+		loaded, err := imageDigest(img)
+		if err != nil {
+			return resource.OutResponse{}, err
+		}
+
+		if loaded.String() != expectedDigest {
+			return resource.OutResponse{}, resource.Invalid("image digest %s does not match expected digest %s", loaded, expectedDigest)
+		}
+	}
+
+	img, err = recompress(img, req.Params.Recompress)
+	if err != nil {
+		return resource.OutResponse{}, err
+	}
+
+	img, err = setArtifactType(img, req.Params)
+	if err != nil {
+		return resource.OutResponse{}, err
+	}
+
+	h, err := imageDigest(img)
+	if err != nil {
+		return resource.OutResponse{}, err
+	}
+
+	stats := newTransferStats(true)
 	switch t := img.(type) {
 	case v1.Image:
-		if h, err = t.Digest(); err != nil {
-			return fmt.Errorf("failed to get image digest: %w", err)
-		}
+		img = stats.Image(t)
 	case v1.ImageIndex:
-		if h, err = t.Digest(); err != nil {
-			return fmt.Errorf("failed to get index digest: %w", err)
-		}
-	default:
-		return fmt.Errorf("cannot get digest for type (%T)", img)
+		img = stats.Index(t)
 	}
 
 	opts := req.Source.NewOptions()
@@ -174,40 +344,188 @@ func (o *Out) Execute() error {
 		return req.Source.SetOptions(&opts)
 	})
 	if err != nil {
-		return fmt.Errorf("failed to set repo/auth options: %w", err)
+		return resource.OutResponse{}, fmt.Errorf("failed to set repo/auth options: %w", err)
+	}
+
+	additional, err := resolveAdditionalRepositories(req)
+	if err != nil {
+		return resource.OutResponse{}, err
+	}
+
+	if req.Params.DryRun || req.Source.Debug {
+		report, err := diffTags(tagsToPush, aliases, skippedAliases, h, req.Source, opts)
+		if err != nil {
+			return resource.OutResponse{}, fmt.Errorf("compare tags: %w", err)
+		}
+
+		if req.Params.DryRun {
+			report.Log(logrus.InfoLevel)
+
+			wouldPush := append([]name.Tag{}, tagsToPush...)
+			for _, alias := range aliases {
+				wouldPush = append(wouldPush, alias.Tag)
+			}
+
+			for _, repo := range additional {
+				logrus.Infof("would also push the tags to %s", repo.opts.Repository)
+			}
+
+			return dryRunResponse(req, wouldPush, report)
+		}
+
+		report.Log(logrus.DebugLevel)
 	}
 
+	// retries reuse the pusher configured in opts, so blobs which were already
+	// uploaded are skipped
+	var pushed []name.Tag
 	err = resource.RetryOnRateLimit(func() error {
-		return put(req, img, tagsToPush, opts)
+		pushed, err = put(req, img, tagsToPush, aliases, opts)
+		return err
 	})
 	if err != nil {
-		return fmt.Errorf("pushing image failed: %w", err)
+		return resource.OutResponse{}, fmt.Errorf("pushing image failed: %w", err)
+	}
+
+	stats.Log()
+
+	if origin != nil {
+		if origin.DigestStr() != h.String() {
+			logrus.Warnf("not copying signatures: pushed %s, but %s was fetched", h, origin.DigestStr())
+		} else {
+			err = copySignatures(*origin, originSource, opts)
+			if err != nil {
+				return resource.OutResponse{}, fmt.Errorf("copying signatures failed: %w", err)
+			}
+		}
+	}
+
+	if signer != nil {
+		err = resource.RetryOnRateLimit(func() error {
+			return signWithCosign(opts.Repository.Digest(h.String()), signer, req.Source.Cosign.Annotations, opts.Remote...)
+		})
+		if err != nil {
+			return resource.OutResponse{}, fmt.Errorf("signing image failed: %w", err)
+		}
+	}
+
+	var additionalPushed []string
+	if len(additional) > 0 {
+		additionalPushed, err = pushAdditionalRepositories(req, img, h, pushed, opts.Repository, additional, signer)
+		if err != nil {
+			return resource.OutResponse{}, err
+		}
 	}
 
 	pushedTags := []string{}
-	for _, tag := range tagsToPush {
+	for _, tag := range pushed {
 		pushedTags = append(pushedTags, tag.TagStr())
 	}
 
 	digest := opts.Repository.Digest(h.String())
-	err = json.NewEncoder(os.Stdout).Encode(resource.OutResponse{
+
+	metadata := append(req.Source.Metadata(), resource.MetadataField{
+		Name:  "tags",
+		Value: strings.Join(pushedTags, " "),
+	})
+
+	if image, ok := img.(v1.Image); ok && len(req.Source.MetadataLabels) > 0 {
+		cfg, err := image.ConfigFile()
+		if err != nil {
+			return resource.OutResponse{}, fmt.Errorf("get image config: %w", err)
+		}
+
+		metadata = append(metadata, req.Source.LabelMetadata(cfg.Config.Labels)...)
+	}
+
+	if len(additionalPushed) > 0 {
+		metadata = append(metadata, resource.MetadataField{
+			Name:  "additional_repositories",
+			Value: strings.Join(additionalPushed, " "),
+		})
+	}
+
+	if url := resource.WebURL(digest); url != "" {
+		metadata = append(metadata, resource.MetadataField{
+			Name:  "url",
+			Value: url,
+		})
+	}
+
+	return resource.OutResponse{
 		Version: resource.Version{
 			Tag:    tagsToPush[0].TagStr(),
 			Digest: digest.DigestStr(),
 		},
-		Metadata: append(req.Source.Metadata(), resource.MetadataField{
-			Name:  "tags",
-			Value: strings.Join(pushedTags, " "),
-		}),
-	})
+		Metadata: append(metadata, stats.Metadata()...),
+	}, nil
+}
+
+// aliasBump is an alias tag to bump to a version, e.g. 'latest' or '1.2' for
+// 1.2.3.
+type aliasBump struct {
+	Tag     name.Tag
+	Version *semver.Version
+	Variant string
+}
+
+func put(req resource.OutRequest, img partial.WithRawManifest, tags []name.Tag, aliases []aliasBump, opts resource.Options) ([]name.Tag, error) {
+	err := pushTags(req, []resource.Source{req.Source}, img, tags, opts)
 	if err != nil {
-		return fmt.Errorf("could not marshal JSON: %s", err)
+		return nil, err
 	}
 
-	return nil
+	if len(aliases) > 0 {
+		// another build may have pushed a newer version since the aliases were
+		// determined, so check again now that the version tags are pushed,
+		// narrowing the window for a race to the alias pushes themselves
+		aliasTags, err := recheckAliases(req, aliases)
+		if err != nil {
+			return nil, fmt.Errorf("determine aliases: %w", err)
+		}
+
+		if len(aliasTags) > 0 {
+			err = pushTags(req, []resource.Source{req.Source}, img, aliasTags, opts)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		tags = append(tags, aliasTags...)
+	}
+
+	err = waitForTags(tags, req.Source, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(req.Params.TagAnnotations) > 0 {
+		err = pushTagAnnotations(req.Params.TagAnnotations, img, tags, opts)
+		if err != nil {
+			return nil, fmt.Errorf("pushing tag annotations: %w", err)
+		}
+	}
+
+	if req.Source.ContentTrust != nil {
+		switch t := img.(type) {
+		case v1.Image:
+			err = signImages(req, t, tags)
+			if err != nil {
+				return nil, fmt.Errorf("signing image(s): %w", err)
+			}
+		default:
+			return nil, fmt.Errorf("cannot sign type (%T)", img)
+		}
+	}
+
+	return tags, nil
 }
 
-func put(req resource.OutRequest, img partial.WithRawManifest, tags []name.Tag, opts resource.Options) error {
+// pushTags pushes the image to the tags, which are in the repositories
+// configured by the sources, all at once so that blobs are only pushed once
+// per repository. Any repository which doesn't exist is created per its
+// source's aws_ecr_create_repository.
+func pushTags(req resource.OutRequest, sources []resource.Source, img partial.WithRawManifest, tags []name.Tag, opts resource.Options) error {
 	images := map[name.Reference]remote.Taggable{}
 	var identifiers []string
 	for _, tag := range tags {
@@ -215,43 +533,606 @@ func put(req resource.OutRequest, img partial.WithRawManifest, tags []name.Tag,
 		identifiers = append(identifiers, tag.Identifier())
 	}
 
+	if req.Params.PlatformTags {
+		index, ok := img.(v1.ImageIndex)
+		if !ok {
+			return fmt.Errorf("platform_tags requires an image index, got %T", img)
+		}
+
+		children, err := platformTags(index, tags)
+		if err != nil {
+			return fmt.Errorf("determine platform tags: %w", err)
+		}
+
+		for tag, child := range children {
+			images[tag] = child
+			identifiers = append(identifiers, tag.Identifier())
+		}
+	}
+
 	logrus.Infof("pushing tag(s) %s", strings.Join(identifiers, ", "))
 	err := remote.MultiWrite(images, opts.Remote...)
+	if err != nil && isRepositoryNotFound(err) {
+		created, createErr := createECRRepositories(sources)
+		if createErr != nil {
+			return createErr
+		}
+
+		if created {
+			logrus.Infof("pushing tag(s) %s", strings.Join(identifiers, ", "))
+			err = remote.MultiWrite(images, opts.Remote...)
+		}
+	}
 	if err != nil {
 		return fmt.Errorf("pushing tag(s): %w", err)
 	}
 
 	logrus.Info("pushed")
 
-	if req.Source.ContentTrust != nil {
-		switch t := img.(type) {
-		case v1.Image:
-			err = signImages(req, t, tags)
+	return nil
+}
+
+// recheckAliases lists the repository's tags again, skipping any alias which
+// a newer version has claimed in the meantime.
+func recheckAliases(req resource.OutRequest, aliases []aliasBump) ([]name.Tag, error) {
+	repo, err := req.Source.NewRepository()
+	if err != nil {
+		return nil, fmt.Errorf("resolve repository name: %w", err)
+	}
+
+	stillBumped := map[string]bool{}
+	checked := map[string]bool{}
+
+	var tags []name.Tag
+	for _, alias := range aliases {
+		key := alias.Version.String() + "-" + alias.Variant
+		if !checked[key] {
+			bumped, err := aliasesToBump(req, repo, alias.Version, alias.Variant)
 			if err != nil {
-				return fmt.Errorf("signing image(s): %w", err)
+				return nil, err
 			}
-		default:
-			return fmt.Errorf("cannot sign type (%T)", img)
+
+			for _, tag := range bumped {
+				stillBumped[tag.TagStr()] = true
+			}
+
+			checked[key] = true
+		}
+
+		if !stillBumped[alias.Tag.TagStr()] {
+			logrus.Warnf("not bumping %s: a newer version was pushed concurrently", alias.Tag.TagStr())
+			continue
+		}
+
+		tags = append(tags, alias.Tag)
+	}
+
+	return tags, nil
+}
+
+// waitForTags waits for the pushed tags to be served by registries which are
+// eventually consistent, before anything else refers to them.
+func waitForTags(tags []name.Tag, source resource.Source, opts resource.Options) error {
+	if source.ConsistencyWait == 0 {
+		return nil
+	}
+
+	for _, tag := range tags {
+		err := resource.RetryOnNotFound(source.ConsistencyTimeout(), func() error {
+			if source.DisableHeadRequests {
+				_, err := remote.Get(tag, opts.Remote...)
+				return err
+			}
+
+			_, err := remote.Head(tag, opts.Remote...)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("waiting for tag %s: %w", tag.TagStr(), err)
+		}
+	}
+
+	return nil
+}
+
+// artifact type of the referrers pushed to carry per-tag annotations
+const tagAnnotationsArtifactType = "application/vnd.concourse.tag-annotations.v1+json"
+
+// pushTagAnnotations pushes an artifact referring to the image for each tag
+// with annotations configured, carrying the annotations along with the name of
+// the tag. Registries without support for the referrers API are handled via
+// the referrers tag scheme.
+func pushTagAnnotations(tagAnnotations map[string]map[string]string, img partial.WithRawManifest, tags []name.Tag, opts resource.Options) error {
+	subject, err := descriptor(img)
+	if err != nil {
+		return fmt.Errorf("describe image: %w", err)
+	}
+
+	pushed := map[string]bool{}
+	for _, tag := range tags {
+		pushed[tag.TagStr()] = true
+	}
+
+	for tagName, annotations := range tagAnnotations {
+		if !pushed[tagName] {
+			logrus.Warnf("skipping annotations for tag %s, which was not pushed", tagName)
+			continue
+		}
+
+		artifactAnnotations := map[string]string{}
+		for k, v := range annotations {
+			artifactAnnotations[k] = v
+		}
+
+		artifactAnnotations[ociRefNameAnnotation] = tagName
+
+		artifact := mutate.ConfigMediaType(mutate.MediaType(empty.Image, types.OCIManifestSchema1), tagAnnotationsArtifactType)
+		artifact = mutate.Annotations(artifact, artifactAnnotations).(v1.Image)
+
+		// note: this must come last, as further mutations drop the subject
+		artifact = mutate.Subject(artifact, subject).(v1.Image)
+
+		digest, err := artifact.Digest()
+		if err != nil {
+			return fmt.Errorf("get artifact digest: %w", err)
+		}
+
+		logrus.Infof("annotating tag %s", tagName)
+
+		ref := opts.Repository.Digest(digest.String())
+		err = writeReferrer(ref, func() error {
+			return remote.Write(ref, artifact, opts.Remote...)
+		}, opts.Remote)
+		if err != nil {
+			return fmt.Errorf("push annotations for tag %s: %w", tagName, err)
 		}
 	}
 
 	return nil
 }
 
-func loadImage(path string) (partial.WithRawManifest, error) {
+func descriptor(img partial.WithRawManifest) (v1.Descriptor, error) {
+	manifest, err := img.RawManifest()
+	if err != nil {
+		return v1.Descriptor{}, err
+	}
+
+	var mediaType types.MediaType
+	switch t := img.(type) {
+	case v1.Image:
+		mediaType, err = t.MediaType()
+	case v1.ImageIndex:
+		mediaType, err = t.MediaType()
+	default:
+		return v1.Descriptor{}, fmt.Errorf("cannot get media type for type (%T)", img)
+	}
+	if err != nil {
+		return v1.Descriptor{}, err
+	}
+
+	digest, size, err := v1.SHA256(bytes.NewReader(manifest))
+	if err != nil {
+		return v1.Descriptor{}, err
+	}
+
+	return v1.Descriptor{
+		MediaType: mediaType,
+		Digest:    digest,
+		Size:      size,
+	}, nil
+}
+
+// annotations with which buildx links attestation manifests in an index to
+// the image they describe
+const (
+	attestationReferenceTypeAnnotation   = "vnd.docker.reference.type"
+	attestationReferenceDigestAnnotation = "vnd.docker.reference.digest"
+	attestationManifestType              = "attestation-manifest"
+)
+
+// filterPlatforms prunes the index to the images for the platforms, e.g.
+// linux/amd64 or linux/arm/v7, along with their attestation manifests.
+func filterPlatforms(img partial.WithRawManifest, platforms []string) (partial.WithRawManifest, error) {
+	index, ok := img.(v1.ImageIndex)
+	if !ok {
+		return nil, resource.Invalid("platforms requires an image index, got %T", img)
+	}
+
+	var specs []v1.Platform
+	for _, platform := range platforms {
+		spec, err := v1.ParsePlatform(platform)
+		if err != nil {
+			return nil, resource.Invalid("invalid platform %q: %s", platform, err)
+		}
+
+		specs = append(specs, *spec)
+	}
+
+	manifest, err := index.IndexManifest()
+	if err != nil {
+		return nil, err
+	}
+
+	removed := map[v1.Hash]bool{}
+	kept := 0
+	for _, desc := range manifest.Manifests {
+		if desc.Platform == nil || platformSuffix(*desc.Platform) == "" {
+			// e.g. attestation manifests, which follow the image they describe
+			continue
+		}
+
+		selected := false
+		for _, spec := range specs {
+			if desc.Platform.Satisfies(spec) {
+				selected = true
+				break
+			}
+		}
+
+		if selected {
+			kept++
+		} else {
+			removed[desc.Digest] = true
+		}
+	}
+
+	if kept == 0 {
+		return nil, resource.Invalid("no images in the index match platforms %v", platforms)
+	}
+
+	for _, desc := range manifest.Manifests {
+		if desc.Annotations[attestationReferenceTypeAnnotation] != attestationManifestType {
+			continue
+		}
+
+		subject, err := v1.NewHash(desc.Annotations[attestationReferenceDigestAnnotation])
+		if err == nil && removed[subject] {
+			removed[desc.Digest] = true
+		}
+	}
+
+	for _, desc := range manifest.Manifests {
+		if removed[desc.Digest] && desc.Platform != nil {
+			logrus.Infof("excluding %s (%s)", desc.Platform, desc.Digest)
+		}
+	}
+
+	return mutate.RemoveManifests(index, func(desc v1.Descriptor) bool {
+		return removed[desc.Digest]
+	}), nil
+}
+
+// platformTags maps each tag suffixed with the platform of each image in the
+// index (e.g. 1.2.3-arm64, 1.2.3-arm-v7, 1.2.3-windows-amd64) to that image.
+func platformTags(index v1.ImageIndex, tags []name.Tag) (map[name.Tag]v1.Image, error) {
+	manifest, err := index.IndexManifest()
+	if err != nil {
+		return nil, err
+	}
+
+	children := map[name.Tag]v1.Image{}
+	for _, desc := range manifest.Manifests {
+		if desc.Platform == nil || !desc.MediaType.IsImage() {
+			continue
+		}
+
+		suffix := platformSuffix(*desc.Platform)
+		if suffix == "" {
+			// e.g. attestation manifests with an unknown platform
+			continue
+		}
+
+		child, err := index.Image(desc.Digest)
+		if err != nil {
+			return nil, fmt.Errorf("get image %s: %w", desc.Digest, err)
+		}
+
+		for _, tag := range tags {
+			children[tag.Context().Tag(tag.TagStr()+"-"+suffix)] = child
+		}
+	}
+
+	return children, nil
+}
+
+func platformSuffix(platform v1.Platform) string {
+	if platform.Architecture == "" || platform.Architecture == "unknown" {
+		return ""
+	}
+
+	suffix := platform.Architecture
+	if platform.Variant != "" {
+		suffix += "-" + platform.Variant
+	}
+
+	if platform.OS != "" && platform.OS != "linux" {
+		suffix = platform.OS + "-" + suffix
+	}
+
+	return suffix
+}
+
+// addLabels merges the labels into the image's config, overriding any labels
+// it already has with the same keys.
+func addLabels(img partial.WithRawManifest, labels map[string]string) (partial.WithRawManifest, error) {
+	image, ok := img.(v1.Image)
+	if !ok {
+		return nil, resource.Invalid("labels_file requires an image, got %T", img)
+	}
+
+	cfg, err := image.ConfigFile()
+	if err != nil {
+		return nil, fmt.Errorf("get image config: %w", err)
+	}
+
+	cfg = cfg.DeepCopy()
+	if cfg.Config.Labels == nil {
+		cfg.Config.Labels = map[string]string{}
+	}
+
+	for key, value := range labels {
+		cfg.Config.Labels[key] = value
+	}
+
+	image, err = mutate.ConfigFile(image, cfg)
+	if err != nil {
+		return nil, fmt.Errorf("add labels: %w", err)
+	}
+
+	return image, nil
+}
+
+func loadImage(path string, source resource.Source, archiveTag string) (partial.WithRawManifest, error) {
 	stat, err := os.Stat(path)
 	if err != nil {
 		return nil, err
 	}
 
 	if !stat.IsDir() {
-		img, err := tarball.ImageFromPath(path, nil)
+		return loadArchive(path, archiveTag)
+	}
+
+	if archiveTag != "" {
+		return nil, resource.Invalid("archive_tag requires 'image' to be an archive written by `docker save`")
+	}
+
+	if _, err := os.Stat(filepath.Join(path, "digest")); err == nil {
+		return loadGetOutput(path, source)
+	}
+
+	return loadLayout(path)
+}
+
+// loadDockerArchive loads the image from a tarball written by `docker save`,
+// selecting the image with the archive tag if given.
+func loadDockerArchive(path string, archiveTag string) (partial.WithRawManifest, error) {
+	opener := func() (io.ReadCloser, error) {
+		return os.Open(path)
+	}
+
+	manifest, err := tarball.LoadManifest(opener)
+	if err != nil {
+		return nil, fmt.Errorf("loading %s as tarball: %w", path, err)
+	}
+
+	if archiveTag == "" {
+		if len(manifest) > 1 {
+			var tags []string
+			for _, desc := range manifest {
+				tags = append(tags, desc.RepoTags...)
+			}
+
+			return nil, resource.Invalid("archive contains %d images - specify which to push with archive_tag, one of: %s", len(manifest), strings.Join(tags, ", "))
+		}
+
+		img, err := tarball.Image(opener, nil)
 		if err != nil {
 			return nil, fmt.Errorf("loading %s as tarball: %w", path, err)
 		}
+
 		return img, nil
 	}
 
+	tag, err := name.NewTag(archiveTag)
+	if err != nil {
+		return nil, resource.Invalid("invalid archive_tag %q: %s", archiveTag, err)
+	}
+
+	img, err := tarball.Image(opener, &tag)
+	if err != nil {
+		return nil, resource.Invalid("loading %s from %s: %s", archiveTag, path, err)
+	}
+
+	return img, nil
+}
+
+// loadGetOutput loads the image fetched by a previous `get` of this resource
+// type, preferring a local copy of the image if one was saved and otherwise
+// fetching it by digest from the repository it came from.
+func loadGetOutput(dir string, source resource.Source) (partial.WithRawManifest, error) {
+	ociDir := filepath.Join(dir, "oci")
+	if stat, err := os.Stat(ociDir); err == nil && stat.IsDir() {
+		return loadLayout(ociDir)
+	}
+
+	imageTar := filepath.Join(dir, "image.tar")
+	if _, err := os.Stat(imageTar); err == nil {
+		img, err := loadArchive(imageTar, "")
+		if err == nil {
+			return img, nil
+		}
+
+		logrus.Warnf("could not load %s, pushing by reference instead: %s", imageTar, err)
+	}
+
+	ref, err := getOutputRef(dir, source)
+	if err != nil {
+		return nil, err
+	}
+
+	logrus.Infof("pushing %s by reference", ref)
+
+	opts, err := source.AuthOptions(ref.Context(), []string{transport.PullScope})
+	if err != nil {
+		return nil, err
+	}
+
+	desc, err := remote.Get(ref, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("get %s: %w", ref, err)
+	}
+
+	if desc.MediaType.IsIndex() {
+		return desc.ImageIndex()
+	}
+
+	return desc.Image()
+}
+
+// imageDigest returns the digest of the image or index.
+func imageDigest(img partial.WithRawManifest) (v1.Hash, error) {
+	switch t := img.(type) {
+	case v1.Image:
+		h, err := t.Digest()
+		if err != nil {
+			return v1.Hash{}, fmt.Errorf("failed to get image digest: %w", err)
+		}
+
+		return h, nil
+	case v1.ImageIndex:
+		h, err := t.Digest()
+		if err != nil {
+			return v1.Hash{}, fmt.Errorf("failed to get index digest: %w", err)
+		}
+
+		return h, nil
+	default:
+		return v1.Hash{}, fmt.Errorf("cannot get digest for type (%T)", img)
+	}
+}
+
+// loadFromRegistry loads the image or index to copy from another repository,
+// so that its blobs are streamed from registry to registry rather than
+// downloaded onto the worker first.
+func loadFromRegistry(from resource.Source, source resource.Source) (name.Digest, partial.WithRawManifest, error) {
+	err := from.SplitReference()
+	if err != nil {
+		return name.Digest{}, nil, resource.Invalid("from_registry: %s", err)
+	}
+
+	err = from.Authenticate()
+	if err != nil {
+		return name.Digest{}, nil, fmt.Errorf("from_registry: %w", err)
+	}
+
+	repo, err := from.NewRepository()
+	if err != nil {
+		return name.Digest{}, nil, fmt.Errorf("resolve repository name: %w", err)
+	}
+
+	err = source.CheckRegistryAllowed(repo.Registry)
+	if err != nil {
+		return name.Digest{}, nil, err
+	}
+
+	var ref name.Reference = repo.Tag(from.DefaultVersionTag())
+	if from.Digest != "" {
+		ref = repo.Digest(from.Digest)
+	}
+
+	opts, err := from.AuthOptions(repo, []string{transport.PullScope})
+	if err != nil {
+		return name.Digest{}, nil, err
+	}
+
+	var desc *remote.Descriptor
+	err = resource.RetryOnRateLimit(func() error {
+		desc, err = remote.Get(ref, opts...)
+		return err
+	})
+	if err != nil {
+		return name.Digest{}, nil, fmt.Errorf("get %s: %w", ref, err)
+	}
+
+	digest := repo.Digest(desc.Digest.String())
+
+	logrus.Infof("copying %s", digest)
+
+	if desc.MediaType.IsIndex() {
+		index, err := desc.ImageIndex()
+		return digest, index, err
+	}
+
+	image, err := desc.Image()
+	return digest, image, err
+}
+
+// getOutputRef returns the reference to the image fetched by a previous `get`
+// of this resource type.
+func getOutputRef(dir string, source resource.Source) (name.Digest, error) {
+	digest, err := ioutil.ReadFile(filepath.Join(dir, "digest"))
+	if err != nil {
+		return name.Digest{}, fmt.Errorf("read digest: %w", err)
+	}
+
+	repository, err := ioutil.ReadFile(filepath.Join(dir, "repository"))
+	if err != nil {
+		return name.Digest{}, fmt.Errorf("read repository: %w", err)
+	}
+
+	repo, err := name.NewRepository(strings.TrimSpace(string(repository)), source.RepositoryOptions()...)
+	if err != nil {
+		return name.Digest{}, fmt.Errorf("resolve repository: %w", err)
+	}
+
+	err = source.CheckRegistryAllowed(repo.Registry)
+	if err != nil {
+		return name.Digest{}, err
+	}
+
+	return repo.Digest(strings.TrimSpace(string(digest))), nil
+}
+
+// loadArchive loads a tarball written by `docker save` or an OCI archive, i.e.
+// a tarball of an OCI image layout, either of which may be compressed. The
+// archive tag selects one of the images of a `docker save` of several.
+func loadArchive(path string, archiveTag string) (partial.WithRawManifest, error) {
+	decompressed, err := decompressArchive(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading %s: %w", path, err)
+	}
+
+	path = decompressed
+
+	isLayout, err := isOCIArchive(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading %s: %w", path, err)
+	}
+
+	if !isLayout {
+		return loadDockerArchive(path, archiveTag)
+	}
+
+	if archiveTag != "" {
+		return nil, resource.Invalid("archive_tag requires 'image' to be an archive written by `docker save`, not an OCI archive")
+	}
+
+	// the layout's blobs are read while pushing, so the directory is left
+	// for the container to be cleaned up with
+	layoutDir, err := ioutil.TempDir("", "oci-archive")
+	if err != nil {
+		return nil, fmt.Errorf("create layout dir: %w", err)
+	}
+
+	err = extractOCIArchive(path, layoutDir)
+	if err != nil {
+		return nil, fmt.Errorf("extracting %s as OCI archive: %w", path, err)
+	}
+
+	return loadLayout(layoutDir)
+}
+
+func loadLayout(path string) (partial.WithRawManifest, error) {
 	ii, err := layout.ImageIndexFromPath(path)
 	if err != nil {
 		return nil, fmt.Errorf("loading %s as OCI layout: %w", path, err)
@@ -284,7 +1165,7 @@ func signImages(req resource.OutRequest, img v1.Image, tags []name.Tag) error {
 	}
 
 	for _, tag := range tags {
-		trustedRepo, err := gcr.NewTrustedGcrRepository(notaryConfigDir, tag, createRegistryAuth(req), createNotaryAuth(req))
+		trustedRepo, err := gcr.NewTrustedGcrRepository(notaryConfigDir, tag, createRegistryAuth(req.Source), createNotaryAuth(req.Source))
 		if err != nil {
 			return fmt.Errorf("create TrustedGcrRepository: %w", err)
 		}
@@ -302,29 +1183,29 @@ func signImages(req resource.OutRequest, img v1.Image, tags []name.Tag) error {
 
 // It's okay if both are blank. It will become an Anonymous Authenticator in
 // that case.
-func createRegistryAuth(req resource.OutRequest) *authn.Basic {
+func createRegistryAuth(source resource.Source) *authn.Basic {
 	return &authn.Basic{
-		Username: req.Source.Username,
-		Password: req.Source.Password,
+		Username: source.Username,
+		Password: source.Password,
 	}
 }
 
-func createNotaryAuth(req resource.OutRequest) *authn.Basic {
-	if req.Source.ContentTrust.Username != "" || req.Source.ContentTrust.Password != "" {
+func createNotaryAuth(source resource.Source) *authn.Basic {
+	if source.ContentTrust.Username != "" || source.ContentTrust.Password != "" {
 		return &authn.Basic{
-			Username: req.Source.ContentTrust.Username,
-			Password: req.Source.ContentTrust.Password,
+			Username: source.ContentTrust.Username,
+			Password: source.ContentTrust.Password,
 		}
 	}
 	// keep compatibility, fallback to using source.username & source.password
 	return &authn.Basic{
-		Username: req.Source.Username,
-		Password: req.Source.Password,
+		Username: source.Username,
+		Password: source.Password,
 	}
 }
 
-func aliasesToBump(req resource.OutRequest, repo name.Repository, ver *semver.Version) ([]name.Tag, error) {
-	variant := req.Source.Variant
+func aliasesToBump(req resource.OutRequest, repo name.Repository, ver *semver.Version, variant string) ([]name.Tag, error) {
+	prefix := req.Source.TagPrefix
 
 	repo, err := req.Source.NewRepository()
 	if err != nil {
@@ -357,6 +1238,14 @@ func aliasesToBump(req resource.OutRequest, repo name.Repository, ver *semver.Ve
 			versionStr = strings.TrimSuffix(versionStr, "-"+variant)
 		}
 
+		if prefix != "" {
+			if !strings.HasPrefix(versionStr, prefix) {
+				continue
+			}
+
+			versionStr = strings.TrimPrefix(versionStr, prefix)
+		}
+
 		remoteVer, err := semver.NewVersion(versionStr)
 		if err != nil {
 			continue
@@ -381,38 +1270,106 @@ func aliasesToBump(req resource.OutRequest, repo name.Repository, ver *semver.Ve
 		}
 	}
 
-	if bumpLatest {
-		latestTag := "latest"
-		if variant != "" {
-			latestTag = variant
-		}
+	latestTag, majorTag, minorTag := aliasNames(prefix, ver, variant)
 
+	if bumpLatest {
 		aliases = append(aliases, repo.Tag(latestTag))
 	}
 
 	if bumpMajor {
-		tagName := fmt.Sprintf("%d", ver.Major())
-		if variant != "" {
-			tagName += "-" + variant
-		}
-
-		aliases = append(aliases, repo.Tag(tagName))
+		aliases = append(aliases, repo.Tag(majorTag))
 	}
 
 	if bumpMinor {
-		tagName := fmt.Sprintf("%d.%d", ver.Major(), ver.Minor())
-		if variant != "" {
-			tagName += "-" + variant
+		aliases = append(aliases, repo.Tag(minorTag))
+	}
+
+	return aliases, nil
+}
+
+// aliasNames returns the names of the latest, major, and minor alias tags of
+// a version, e.g. 'latest', '1', and '1.2' for 1.2.3.
+func aliasNames(prefix string, ver *semver.Version, variant string) (string, string, string) {
+	latestTag := "latest"
+	majorTag := fmt.Sprintf("%s%d", prefix, ver.Major())
+	minorTag := fmt.Sprintf("%s%d.%d", prefix, ver.Major(), ver.Minor())
+
+	if variant != "" {
+		latestTag = variant
+		majorTag += "-" + variant
+		minorTag += "-" + variant
+	}
+
+	return latestTag, majorTag, minorTag
+}
+
+// isRepositoryNotFound returns true if a push failed because the repository
+// doesn't exist, as ECR does rather than creating it.
+func isRepositoryNotFound(err error) bool {
+	var terr *transport.Error
+	if !errors.As(err, &terr) || len(terr.Errors) == 0 {
+		return false
+	}
+
+	return terr.StatusCode == http.StatusNotFound && terr.Errors[0].Code == transport.NameUnknownErrorCode
+}
+
+// createECRRepositories creates the ECR repository of each source configured
+// with aws_ecr_create_repository, as a push found one of them didn't exist,
+// returning whether there were any.
+func createECRRepositories(sources []resource.Source) (bool, error) {
+	var created bool
+	for _, source := range sources {
+		if !source.AwsECRCreateRepository {
+			continue
+		}
+
+		repo, err := source.NewRepository()
+		if err != nil {
+			return false, fmt.Errorf("resolve repository name: %w", err)
+		}
+
+		err = createECRRepository(source, repo)
+		if err != nil {
+			return false, err
 		}
 
-		aliases = append(aliases, repo.Tag(tagName))
+		created = true
 	}
 
-	return aliases, nil
+	return created, nil
+}
+
+// createECRRepository creates the ECR repository which a push found didn't
+// exist, per aws_ecr_create_repository.
+func createECRRepository(source resource.Source, repo name.Repository) error {
+	if source.AwsRegion == "" {
+		return resource.Invalid("aws_ecr_create_repository requires aws_region")
+	}
+
+	client, err := source.NewECRClient()
+	if err != nil {
+		return resource.Categorize(resource.CategoryAuth, fmt.Errorf("create ECR client: %w", err))
+	}
+
+	logrus.Infof("creating ECR repository %s", repo.RepositoryStr())
+
+	err = source.CreateECRRepository(client, repo.RepositoryStr())
+	if err != nil {
+		return fmt.Errorf("create ECR repository %s: %w", repo.RepositoryStr(), err)
+	}
+
+	return nil
 }
 
 func isNewImage(err error) bool {
 	if e, ok := err.(*transport.Error); ok && e.StatusCode == http.StatusNotFound {
+		if len(e.Errors) == 0 {
+			// some registries, e.g. GCR and Artifactory, respond with an empty
+			// or non-JSON body
+			return true
+		}
+
 		return e.Errors[0].Code == transport.NameUnknownErrorCode || e.Errors[0].Code == "NOT_FOUND"
 	}
 
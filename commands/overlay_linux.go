@@ -0,0 +1,14 @@
+package commands
+
+import "syscall"
+
+// overlayWhiteout marks the path as removed in an overlayfs layer.
+func overlayWhiteout(path string) error {
+	return syscall.Mknod(path, syscall.S_IFCHR, 0)
+}
+
+// overlayOpaqueDir hides the contents of the directory in lower overlayfs
+// layers.
+func overlayOpaqueDir(dir string) error {
+	return syscall.Setxattr(dir, "trusted.overlay.opaque", []byte("y"), 0)
+}
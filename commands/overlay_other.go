@@ -0,0 +1,13 @@
+//go:build !linux
+
+package commands
+
+import "fmt"
+
+func overlayWhiteout(path string) error {
+	return fmt.Errorf("overlay whiteouts are only supported on Linux")
+}
+
+func overlayOpaqueDir(dir string) error {
+	return fmt.Errorf("overlay whiteouts are only supported on Linux")
+}
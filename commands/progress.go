@@ -0,0 +1,249 @@
+package commands
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fatih/color"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/vbauerster/mpb"
+	"github.com/vbauerster/mpb/decor"
+)
+
+// layerProgress reports the progress of reading each of an image's layers.
+type layerProgress interface {
+	// Reader wraps the reader for the i'th layer to track its progress.
+	Reader(i int, r io.Reader) io.Reader
+
+	// Done marks the i'th layer as completely read.
+	Done(i int)
+
+	// Wait blocks until all progress has been reported.
+	Wait()
+
+	// Stop stops reporting progress without waiting for every layer to be
+	// read, e.g. when reading one fails. It does nothing after Wait.
+	Stop()
+}
+
+// newLayerProgress returns live progress bars, or a periodic one-line
+// heartbeat if the interval is non-zero.
+func newLayerProgress(layers []v1.Layer, heartbeat time.Duration, out io.Writer) (layerProgress, error) {
+	if heartbeat > 0 {
+		return newHeartbeatProgress(layers, heartbeat, out)
+	}
+
+	return newBarProgress(layers, out)
+}
+
+type barProgress struct {
+	progress *mpb.Progress
+	bars     []*mpb.Bar
+
+	waited bool
+}
+
+func newBarProgress(layers []v1.Layer, out io.Writer) (*barProgress, error) {
+	progress := mpb.New(mpb.WithOutput(out))
+
+	bars := make([]*mpb.Bar, len(layers))
+
+	for i, layer := range layers {
+		size, err := layer.Size()
+		if err != nil {
+			return nil, err
+		}
+
+		digest, err := layer.Digest()
+		if err != nil {
+			return nil, err
+		}
+
+		bars[i] = progress.AddBar(
+			size,
+			mpb.PrependDecorators(decor.Name(color.HiBlackString(digest.Hex[0:12]))),
+			mpb.AppendDecorators(decor.CountersKibiByte("%.1f/%.1f")),
+		)
+	}
+
+	return &barProgress{
+		progress: progress,
+		bars:     bars,
+	}, nil
+}
+
+func (p *barProgress) Reader(i int, r io.Reader) io.Reader {
+	return p.bars[i].ProxyReader(r)
+}
+
+func (p *barProgress) Done(i int) {
+	p.bars[i].SetTotal(p.bars[i].Current(), true)
+}
+
+func (p *barProgress) Wait() {
+	p.progress.Wait()
+	p.waited = true
+}
+
+func (p *barProgress) Stop() {
+	if p.waited {
+		return
+	}
+
+	// the progress waits for every bar to complete otherwise, so complete
+	// them where they stopped; a bar which has already completed, e.g. once
+	// all of its layer was read, is left as it is
+	for i := range p.bars {
+		p.Done(i)
+	}
+
+	p.Wait()
+}
+
+// heartbeatProgress periodically prints a single line describing the layer
+// currently being read, for logs which can't render progress bars.
+type heartbeatProgress struct {
+	out    io.Writer
+	layers []heartbeatLayer
+
+	// index of the layer currently being read
+	current int32
+
+	stop     chan struct{}
+	stopOnce sync.Once
+	stopped  sync.WaitGroup
+
+	// serializes writes to out
+	lock sync.Mutex
+}
+
+type heartbeatLayer struct {
+	digest string
+	size   int64
+	read   int64
+
+	// bytes read as of the previous heartbeat, for measuring speed
+	lastRead int64
+}
+
+func newHeartbeatProgress(layers []v1.Layer, interval time.Duration, out io.Writer) (*heartbeatProgress, error) {
+	p := &heartbeatProgress{
+		out:    out,
+		layers: make([]heartbeatLayer, len(layers)),
+		stop:   make(chan struct{}),
+	}
+
+	for i, layer := range layers {
+		size, err := layer.Size()
+		if err != nil {
+			return nil, err
+		}
+
+		digest, err := layer.Digest()
+		if err != nil {
+			return nil, err
+		}
+
+		p.layers[i] = heartbeatLayer{
+			digest: digest.Hex[0:12],
+			size:   size,
+		}
+	}
+
+	p.stopped.Add(1)
+	go p.beat(interval)
+
+	return p, nil
+}
+
+func (p *heartbeatProgress) Reader(i int, r io.Reader) io.Reader {
+	atomic.StoreInt32(&p.current, int32(i))
+
+	return &countingReader{
+		Reader: r,
+		count:  &p.layers[i].read,
+	}
+}
+
+func (p *heartbeatProgress) Done(i int) {
+	layer := &p.layers[i]
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	fmt.Fprintf(p.out, "layer %d/%d %s: done (%s)\n", i+1, len(p.layers), layer.digest, humanBytes(atomic.LoadInt64(&layer.read)))
+}
+
+func (p *heartbeatProgress) Wait() {
+	p.Stop()
+}
+
+func (p *heartbeatProgress) Stop() {
+	p.stopOnce.Do(func() { close(p.stop) })
+	p.stopped.Wait()
+}
+
+func (p *heartbeatProgress) beat(interval time.Duration) {
+	defer p.stopped.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			p.report(interval)
+		case <-p.stop:
+			return
+		}
+	}
+}
+
+func (p *heartbeatProgress) report(interval time.Duration) {
+	i := int(atomic.LoadInt32(&p.current))
+	layer := &p.layers[i]
+
+	read := atomic.LoadInt64(&layer.read)
+	speed := float64(read-layer.lastRead) / interval.Seconds()
+	layer.lastRead = read
+
+	percent := 100.0
+	if layer.size > 0 {
+		percent = float64(read) / float64(layer.size) * 100
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	fmt.Fprintf(p.out, "layer %d/%d %s: %.1f%% (%s/%s) at %s/s\n", i+1, len(p.layers), layer.digest, percent, humanBytes(read), humanBytes(layer.size), humanBytes(int64(speed)))
+}
+
+type countingReader struct {
+	io.Reader
+	count *int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	atomic.AddInt64(r.count, int64(n))
+	return n, err
+}
+
+// humanBytes formats a byte count with binary units, e.g. 1.5 MiB.
+func humanBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,256 @@
+package commands
+
+import (
+	"fmt"
+	"io"
+
+	resource "github.com/concourse/registry-image-resource"
+	"github.com/google/go-containerregistry/pkg/compression"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/partial"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	recompressZstd = "zstd"
+	recompressBoth = "both"
+)
+
+// zstdAnnotation marks the zstd-compressed images in an index which also has
+// their gzip-compressed equivalents, as podman and buildah do, so that
+// runtimes which support zstd can prefer them.
+const zstdAnnotation = "io.github.containers.compression.zstd"
+
+// recompress re-encodes the layers of the image, or of each image in the
+// index, with zstd. With 'both', an index with the original images followed
+// by their zstd-compressed equivalents is pushed instead, so that runtimes
+// without zstd support can still pull it.
+func recompress(img partial.WithRawManifest, mode string) (partial.WithRawManifest, error) {
+	switch mode {
+	case "":
+		return img, nil
+	case recompressZstd, recompressBoth:
+	default:
+		return nil, resource.Invalid("unknown recompress %q (must be 'zstd' or 'both')", mode)
+	}
+
+	switch t := img.(type) {
+	case v1.Image:
+		zstdImage, err := zstdImage(t)
+		if err != nil {
+			return nil, err
+		}
+
+		if mode == recompressZstd {
+			return zstdImage, nil
+		}
+
+		cfg, err := t.ConfigFile()
+		if err != nil {
+			return nil, fmt.Errorf("get image config: %w", err)
+		}
+
+		return mutate.AppendManifests(
+			mutate.IndexMediaType(empty.Index, types.OCIImageIndex),
+			mutate.IndexAddendum{
+				Add:        t,
+				Descriptor: v1.Descriptor{Platform: cfg.Platform()},
+			},
+			mutate.IndexAddendum{
+				Add: zstdImage,
+				Descriptor: v1.Descriptor{
+					Platform:    cfg.Platform(),
+					Annotations: map[string]string{zstdAnnotation: "true"},
+				},
+			},
+		), nil
+	case v1.ImageIndex:
+		return zstdIndex(t, mode == recompressBoth)
+	default:
+		return nil, fmt.Errorf("cannot recompress type (%T)", img)
+	}
+}
+
+// zstdIndex recompresses each image in the index, keeping the original images
+// as well if keep is true. Attestation manifests are kept, referring to the
+// zstd-compressed images unless the originals are kept.
+func zstdIndex(index v1.ImageIndex, keep bool) (v1.ImageIndex, error) {
+	manifest, err := index.IndexManifest()
+	if err != nil {
+		return nil, err
+	}
+
+	recompressed := map[v1.Hash]v1.Hash{}
+	var originals, zstds, others []mutate.IndexAddendum
+	for _, desc := range manifest.Manifests {
+		if desc.MediaType.IsIndex() {
+			child, err := index.ImageIndex(desc.Digest)
+			if err != nil {
+				return nil, fmt.Errorf("get index %s: %w", desc.Digest, err)
+			}
+
+			others = append(others, mutate.IndexAddendum{Add: child, Descriptor: desc})
+			continue
+		}
+
+		image, err := index.Image(desc.Digest)
+		if err != nil {
+			return nil, fmt.Errorf("get image %s: %w", desc.Digest, err)
+		}
+
+		if desc.Annotations[attestationReferenceTypeAnnotation] == attestationManifestType {
+			others = append(others, mutate.IndexAddendum{Add: image, Descriptor: desc})
+			continue
+		}
+
+		originals = append(originals, mutate.IndexAddendum{Add: image, Descriptor: desc})
+
+		zstdImage, err := zstdImage(image)
+		if err != nil {
+			return nil, err
+		}
+
+		digest, err := zstdImage.Digest()
+		if err != nil {
+			return nil, err
+		}
+
+		recompressed[desc.Digest] = digest
+
+		zstdDesc := v1.Descriptor{
+			Platform:    desc.Platform,
+			Annotations: map[string]string{},
+		}
+
+		for key, value := range desc.Annotations {
+			zstdDesc.Annotations[key] = value
+		}
+
+		if keep {
+			zstdDesc.Annotations[zstdAnnotation] = "true"
+		}
+
+		zstds = append(zstds, mutate.IndexAddendum{Add: zstdImage, Descriptor: zstdDesc})
+	}
+
+	if !keep {
+		originals = nil
+
+		for i, other := range others {
+			subject, err := v1.NewHash(other.Descriptor.Annotations[attestationReferenceDigestAnnotation])
+			if err != nil {
+				continue
+			}
+
+			if digest, found := recompressed[subject]; found {
+				desc := other.Descriptor
+				desc.Annotations = map[string]string{}
+				for key, value := range other.Descriptor.Annotations {
+					desc.Annotations[key] = value
+				}
+
+				desc.Annotations[attestationReferenceDigestAnnotation] = digest.String()
+				others[i].Descriptor = desc
+			}
+		}
+	}
+
+	adds := append(append(originals, zstds...), others...)
+
+	return mutate.Annotations(
+		mutate.AppendManifests(mutate.IndexMediaType(empty.Index, types.OCIImageIndex), adds...),
+		manifest.Annotations,
+	).(v1.ImageIndex), nil
+}
+
+// zstdImage returns the image as an OCI image with its tar layers compressed
+// with zstd. Its config is unchanged, as the layers' contents are the same.
+func zstdImage(image v1.Image) (v1.Image, error) {
+	manifest, err := image.Manifest()
+	if err != nil {
+		return nil, fmt.Errorf("get image manifest: %w", err)
+	}
+
+	cfg, err := image.ConfigFile()
+	if err != nil {
+		return nil, fmt.Errorf("get image config: %w", err)
+	}
+
+	layers, err := image.Layers()
+	if err != nil {
+		return nil, fmt.Errorf("get image layers: %w", err)
+	}
+
+	var adds []mutate.Addendum
+	for i, layer := range layers {
+		desc := manifest.Layers[i]
+
+		switch desc.MediaType {
+		case types.DockerLayer, types.OCILayer, types.DockerUncompressedLayer, types.OCIUncompressedLayer:
+			layer, err = zstdLayer(layer)
+			if err != nil {
+				return nil, fmt.Errorf("recompress layer %s: %w", desc.Digest, err)
+			}
+		default:
+			// already zstd, or not a tar layer (e.g. a foreign layer or an
+			// artifact's contents)
+			logrus.Debugf("not recompressing %s layer %s", desc.MediaType, desc.Digest)
+		}
+
+		adds = append(adds, mutate.Addendum{
+			Layer:       layer,
+			Annotations: desc.Annotations,
+			URLs:        desc.URLs,
+		})
+	}
+
+	// the layers' diff IDs and history are restored with the config below
+	stripped := cfg.DeepCopy()
+	stripped.RootFS.DiffIDs = nil
+	stripped.History = nil
+
+	base, err := mutate.ConfigFile(mutate.MediaType(empty.Image, types.OCIManifestSchema1), stripped)
+	if err != nil {
+		return nil, err
+	}
+
+	appended, err := mutate.Append(base, adds...)
+	if err != nil {
+		return nil, err
+	}
+
+	recompressed, err := mutate.ConfigFile(appended, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	configMediaType := manifest.Config.MediaType
+	if configMediaType == types.DockerConfigJSON {
+		configMediaType = types.OCIConfigJSON
+	}
+
+	recompressed = mutate.ConfigMediaType(recompressed, configMediaType)
+
+	if len(manifest.Annotations) > 0 {
+		recompressed = mutate.Annotations(recompressed, manifest.Annotations).(v1.Image)
+	}
+
+	return recompressed, nil
+}
+
+// zstdLayer re-encodes the layer's contents with zstd. The layer is
+// compressed once to compute its digest and again as it's pushed, rather
+// than holding it in memory.
+func zstdLayer(layer v1.Layer) (v1.Layer, error) {
+	return tarball.LayerFromOpener(
+		func() (io.ReadCloser, error) {
+			return layer.Uncompressed()
+		},
+		tarball.WithCompression(compression.ZStd),
+		tarball.WithMediaType(types.OCILayerZStd),
+	)
+}
@@ -0,0 +1,181 @@
+package commands
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/sirupsen/logrus"
+)
+
+// referrersUnsupported returns whether the registry rejected a request to the
+// referrers API in a way that indicates it doesn't implement it.
+//
+// go-containerregistry only falls back to the referrers tag scheme when the
+// API returns 404 or 400, but some registries respond with one of these
+// instead.
+func referrersUnsupported(err error) bool {
+	var terr *transport.Error
+	if !errors.As(err, &terr) {
+		return false
+	}
+
+	switch terr.StatusCode {
+	case http.StatusMethodNotAllowed, http.StatusNotAcceptable, http.StatusNotImplemented:
+		return true
+	default:
+		return false
+	}
+}
+
+// referrersTag returns the tag used to list the referrers of a digest on
+// registries without the referrers API, e.g. sha256-abcd...
+func referrersTag(subject name.Digest) name.Tag {
+	return subject.Context().Tag(strings.Replace(subject.DigestStr(), ":", "-", 1))
+}
+
+// writeReferrer pushes a manifest with a subject by calling write, falling
+// back to adding it to the subject's referrers tag if the registry rejects
+// the referrers API.
+func writeReferrer(ref name.Digest, write func() error, opts []remote.Option) error {
+	err := write()
+	if err == nil || !referrersUnsupported(err) {
+		return err
+	}
+
+	// the manifest itself is pushed before the referrers API is checked, so it
+	// should be present
+	desc, getErr := remote.Get(ref, opts...)
+	if getErr != nil {
+		return err
+	}
+
+	var manifest struct {
+		ArtifactType string `json:"artifactType"`
+		Config       struct {
+			MediaType types.MediaType `json:"mediaType"`
+		} `json:"config"`
+		Annotations map[string]string `json:"annotations"`
+		Subject     *v1.Descriptor    `json:"subject"`
+	}
+
+	err = json.Unmarshal(desc.Manifest, &manifest)
+	if err != nil {
+		return fmt.Errorf("parse manifest: %w", err)
+	}
+
+	if manifest.Subject == nil {
+		return nil
+	}
+
+	artifactType := manifest.ArtifactType
+	if artifactType == "" {
+		artifactType = string(manifest.Config.MediaType)
+	}
+
+	subject := ref.Context().Digest(manifest.Subject.Digest.String())
+
+	logrus.Warnf("registry does not support the referrers API; adding %s to tag %s", ref.DigestStr(), referrersTag(subject).TagStr())
+
+	return addReferrer(subject, v1.Descriptor{
+		MediaType:    desc.MediaType,
+		Size:         desc.Size,
+		Digest:       desc.Digest,
+		ArtifactType: artifactType,
+		Annotations:  manifest.Annotations,
+	}, opts)
+}
+
+// addReferrer adds a descriptor to the index pushed to the subject's
+// referrers tag, creating it if needed.
+func addReferrer(subject name.Digest, desc v1.Descriptor, opts []remote.Option) error {
+	tag := referrersTag(subject)
+
+	index, err := referrersIndex(tag, opts)
+	if err != nil {
+		return err
+	}
+
+	for _, existing := range index.Manifests {
+		if existing.Digest == desc.Digest {
+			return nil
+		}
+	}
+
+	index.Manifests = append(index.Manifests, desc)
+
+	err = remote.Put(tag, rawIndex{index}, opts...)
+	if err != nil {
+		return fmt.Errorf("push referrers tag %s: %w", tag.TagStr(), err)
+	}
+
+	return nil
+}
+
+// listReferrers lists the referrers of a digest, reading the referrers tag if
+// the registry rejects the referrers API.
+func listReferrers(subject name.Digest, opts []remote.Option) ([]v1.Descriptor, error) {
+	referrers, err := remote.Referrers(subject, opts...)
+	if err != nil {
+		if !referrersUnsupported(err) {
+			return nil, err
+		}
+
+		index, err := referrersIndex(referrersTag(subject), opts)
+		if err != nil {
+			return nil, err
+		}
+
+		return index.Manifests, nil
+	}
+
+	manifest, err := referrers.IndexManifest()
+	if err != nil {
+		return nil, err
+	}
+
+	return manifest.Manifests, nil
+}
+
+func referrersIndex(tag name.Tag, opts []remote.Option) (v1.IndexManifest, error) {
+	index := v1.IndexManifest{
+		SchemaVersion: 2,
+		MediaType:     types.OCIImageIndex,
+	}
+
+	desc, err := remote.Get(tag, opts...)
+	if err != nil {
+		if checkMissingManifest(err) {
+			return index, nil
+		}
+
+		return index, fmt.Errorf("get referrers tag %s: %w", tag.TagStr(), err)
+	}
+
+	err = json.Unmarshal(desc.Manifest, &index)
+	if err != nil {
+		return index, fmt.Errorf("parse referrers tag %s: %w", tag.TagStr(), err)
+	}
+
+	return index, nil
+}
+
+// rawIndex pushes an index manifest as-is.
+type rawIndex struct {
+	manifest v1.IndexManifest
+}
+
+func (i rawIndex) RawManifest() ([]byte, error) {
+	return json.Marshal(i.manifest)
+}
+
+func (i rawIndex) MediaType() (types.MediaType, error) {
+	return types.OCIImageIndex, nil
+}
@@ -0,0 +1,55 @@
+package commands
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	resource "github.com/concourse/registry-image-resource"
+	"github.com/sirupsen/logrus"
+)
+
+// decodeRequest decodes the request, rejecting unknown fields so that typos
+// don't go unnoticed, unless the source sets strict: false. Unknown fields
+// are then ignored with a warning, so that pipelines shared across Concourse
+// installations can use params which older versions don't support yet.
+func decodeRequest(stdin io.Reader, req interface{}) error {
+	payload, err := ioutil.ReadAll(stdin)
+	if err != nil {
+		return resource.Invalid("invalid payload: %s", err)
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(payload))
+	decoder.DisallowUnknownFields()
+	err = decoder.Decode(req)
+	if err == nil {
+		return nil
+	}
+
+	// encoding/json doesn't export an error type for unknown fields
+	if !strings.HasPrefix(err.Error(), "json: unknown field") {
+		return resource.Invalid("invalid payload: %s", err)
+	}
+
+	var strictness struct {
+		Source struct {
+			Strict *bool `json:"strict"`
+		} `json:"source"`
+	}
+
+	if json.Unmarshal(payload, &strictness) != nil || strictness.Source.Strict == nil || *strictness.Source.Strict {
+		return resource.Invalid("invalid payload: %s", err)
+	}
+
+	// only the first unknown field is reported
+	logrus.Warnf("ignoring %s (and any others), which this version of the resource type does not support", strings.TrimPrefix(err.Error(), "json: "))
+
+	err = json.Unmarshal(payload, req)
+	if err != nil {
+		return resource.Invalid("invalid payload: %s", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,137 @@
+package commands
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	resource "github.com/concourse/registry-image-resource"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+// schema1Manifest is a legacy Docker schema 1 manifest, with its layers and
+// history listed from the top layer down.
+type schema1Manifest struct {
+	FSLayers []struct {
+		BlobSum string `json:"blobSum"`
+	} `json:"fsLayers"`
+
+	History []struct {
+		V1Compatibility string `json:"v1Compatibility"`
+	} `json:"history"`
+}
+
+// schema1Layer is the v1Compatibility JSON describing each layer; the top
+// layer's also includes the image's config.
+type schema1Layer struct {
+	Created         time.Time `json:"created"`
+	Author          string    `json:"author,omitempty"`
+	Comment         string    `json:"comment,omitempty"`
+	Throwaway       bool      `json:"throwaway,omitempty"`
+	Architecture    string    `json:"architecture,omitempty"`
+	OS              string    `json:"os,omitempty"`
+	Config          v1.Config `json:"config"`
+	ContainerConfig struct {
+		Cmd []string `json:"Cmd"`
+	} `json:"container_config"`
+}
+
+// fetchedImage returns the fetched image, converting legacy schema 1 images
+// to schema 2 if configured to.
+func fetchedImage(desc *remote.Descriptor, source resource.Source) (v1.Image, error) {
+	if !desc.MediaType.IsSchema1() {
+		return desc.Image()
+	}
+
+	if !source.ConvertSchema1 {
+		return nil, resource.Invalid("image uses the legacy Docker schema 1 manifest format (%s), which is not supported; push it again with a newer Docker, or set convert_schema1: true to convert it when fetching", desc.MediaType)
+	}
+
+	image, err := desc.Schema1()
+	if err != nil {
+		return nil, err
+	}
+
+	return convertSchema1(image)
+}
+
+// convertSchema1 converts a schema 1 image to schema 2, as the manifest and
+// config are derived from the v1Compatibility history.
+func convertSchema1(image v1.Image) (v1.Image, error) {
+	raw, err := image.RawManifest()
+	if err != nil {
+		return nil, err
+	}
+
+	var manifest schema1Manifest
+	err = json.Unmarshal(raw, &manifest)
+	if err != nil {
+		return nil, fmt.Errorf("parse schema 1 manifest: %w", err)
+	}
+
+	if len(manifest.FSLayers) == 0 || len(manifest.FSLayers) != len(manifest.History) {
+		return nil, fmt.Errorf("invalid schema 1 manifest: %d layers with %d history entries", len(manifest.FSLayers), len(manifest.History))
+	}
+
+	layers := make([]schema1Layer, len(manifest.History))
+	for i, history := range manifest.History {
+		err = json.Unmarshal([]byte(history.V1Compatibility), &layers[i])
+		if err != nil {
+			return nil, fmt.Errorf("parse schema 1 history: %w", err)
+		}
+	}
+
+	adds := []mutate.Addendum{}
+	for i := len(manifest.FSLayers) - 1; i >= 0; i-- {
+		layer := layers[i]
+
+		add := mutate.Addendum{
+			History: v1.History{
+				Created:    v1.Time{Time: layer.Created},
+				CreatedBy:  strings.Join(layer.ContainerConfig.Cmd, " "),
+				Author:     layer.Author,
+				Comment:    layer.Comment,
+				EmptyLayer: layer.Throwaway,
+			},
+		}
+
+		if !layer.Throwaway {
+			digest, err := v1.NewHash(manifest.FSLayers[i].BlobSum)
+			if err != nil {
+				return nil, fmt.Errorf("parse layer digest: %w", err)
+			}
+
+			add.Layer, err = image.LayerByDigest(digest)
+			if err != nil {
+				return nil, fmt.Errorf("get layer %s: %w", digest, err)
+			}
+		}
+
+		adds = append(adds, add)
+	}
+
+	converted, err := mutate.Append(empty.Image, adds...)
+	if err != nil {
+		return nil, fmt.Errorf("convert schema 1 image: %w", err)
+	}
+
+	cfg, err := converted.ConfigFile()
+	if err != nil {
+		return nil, fmt.Errorf("convert schema 1 image: %w", err)
+	}
+
+	cfg = cfg.DeepCopy()
+
+	top := layers[0]
+	cfg.Created = v1.Time{Time: top.Created}
+	cfg.Author = top.Author
+	cfg.Architecture = top.Architecture
+	cfg.OS = top.OS
+	cfg.Config = top.Config
+
+	return mutate.ConfigFile(converted, cfg)
+}
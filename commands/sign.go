@@ -0,0 +1,464 @@
+package commands
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"strings"
+
+	resource "github.com/concourse/registry-image-resource"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/static"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/nacl/secretbox"
+	"golang.org/x/crypto/scrypt"
+)
+
+// cosignSigner signs a payload, returning the signature to attach to the
+// image.
+type cosignSigner func(payload []byte) (cosignSignature, error)
+
+// newCosignSigner returns a signer for the configured key or keyless
+// identity, so that the config is validated before anything is pushed.
+func newCosignSigner(signing resource.CosignSigning) (cosignSigner, error) {
+	if (signing.Key == "") == (signing.Keyless == nil) {
+		return nil, resource.Invalid("exactly one of 'key' or 'keyless' must be specified for cosign")
+	}
+
+	if signing.Keyless != nil {
+		if signing.Keyless.IdentityToken == "" {
+			return nil, resource.Invalid("'identity_token' must be specified to sign keyless")
+		}
+
+		return func(payload []byte) (cosignSignature, error) {
+			return signKeyless(payload, *signing.Keyless)
+		}, nil
+	}
+
+	key, err := parsePrivateKey(signing.Key, signing.Password)
+	if err != nil {
+		return nil, resource.Invalid("parse cosign key: %s", err)
+	}
+
+	return func(payload []byte) (cosignSignature, error) {
+		signature, err := signPayload(key, payload)
+		if err != nil {
+			return cosignSignature{}, err
+		}
+
+		return cosignSignature{
+			Payload:   payload,
+			Signature: signature,
+		}, nil
+	}, nil
+}
+
+// signWithCosign signs the digest and adds the signature to the signature
+// image cosign tags as sha256-<hex>.sig, alongside any existing signatures.
+func signWithCosign(digest name.Digest, signer cosignSigner, annotations map[string]string, opts ...remote.Option) error {
+	var payload cosignPayload
+	payload.Critical.Identity.DockerReference = digest.Context().Name()
+	payload.Critical.Image.DockerManifestDigest = digest.DigestStr()
+	payload.Critical.Type = cosignSignatureType
+
+	if len(annotations) > 0 {
+		payload.Optional = map[string]interface{}{}
+		for key, value := range annotations {
+			payload.Optional[key] = value
+		}
+	}
+
+	payloadJSON, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	sig, err := signer(payloadJSON)
+	if err != nil {
+		return err
+	}
+
+	sigTag := digest.Context().Tag(strings.Replace(digest.DigestStr(), ":", "-", 1) + ".sig")
+
+	sigImage, err := remote.Image(sigTag, opts...)
+	if err != nil {
+		if !checkMissingManifest(err) {
+			return fmt.Errorf("fetch signatures %s: %w", sigTag, err)
+		}
+
+		sigImage = mutate.ConfigMediaType(mutate.MediaType(empty.Image, types.OCIManifestSchema1), types.OCIConfigJSON)
+	}
+
+	layerAnnotations := map[string]string{
+		cosignSignatureAnnotation: base64.StdEncoding.EncodeToString(sig.Signature),
+	}
+
+	if sig.Certificate != nil {
+		layerAnnotations[cosignCertificateAnnotation] = string(encodeCertificates(sig.Certificate))
+		layerAnnotations[cosignChainAnnotation] = string(encodeCertificates(sig.Chain...))
+	}
+
+	if sig.Bundle != "" {
+		layerAnnotations[cosignBundleAnnotation] = sig.Bundle
+	}
+
+	sigImage, err = mutate.Append(sigImage, mutate.Addendum{
+		Layer:       static.NewLayer(sig.Payload, cosignSimpleSigningMediaType),
+		Annotations: layerAnnotations,
+	})
+	if err != nil {
+		return fmt.Errorf("add signature: %w", err)
+	}
+
+	err = remote.Write(sigTag, sigImage, opts...)
+	if err != nil {
+		return fmt.Errorf("push signatures %s: %w", sigTag, err)
+	}
+
+	logrus.Infof("signed %s with cosign", digest.DigestStr())
+
+	return nil
+}
+
+// signKeyless signs the payload with an ephemeral key, certified by Fulcio
+// for the OIDC identity, and records the signature in Rekor.
+func signKeyless(payload []byte, keyless resource.KeylessSigning) (cosignSignature, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return cosignSignature{}, fmt.Errorf("generate key: %w", err)
+	}
+
+	chain, err := requestSigningCertificate(key, keyless)
+	if err != nil {
+		return cosignSignature{}, fmt.Errorf("request signing certificate: %w", err)
+	}
+
+	signature, err := signPayload(key, payload)
+	if err != nil {
+		return cosignSignature{}, err
+	}
+
+	sig := cosignSignature{
+		Payload:     payload,
+		Signature:   signature,
+		Certificate: chain[0],
+		Chain:       chain[1:],
+	}
+
+	sig.Bundle, err = uploadToRekor(keyless, sig)
+	if err != nil {
+		return cosignSignature{}, fmt.Errorf("upload to transparency log: %w", err)
+	}
+
+	return sig, nil
+}
+
+// requestSigningCertificate exchanges the identity token for a certificate
+// for the key, returning the certificate followed by its chain.
+func requestSigningCertificate(key *ecdsa.PrivateKey, keyless resource.KeylessSigning) ([]*x509.Certificate, error) {
+	subject, err := tokenSubject(keyless.IdentityToken)
+	if err != nil {
+		return nil, err
+	}
+
+	// prove possession of the key by signing the token's subject
+	proof, err := signPayload(key, []byte(subject))
+	if err != nil {
+		return nil, err
+	}
+
+	keyDER, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	var request struct {
+		Credentials struct {
+			OIDCIdentityToken string `json:"oidcIdentityToken"`
+		} `json:"credentials"`
+		PublicKeyRequest struct {
+			PublicKey struct {
+				Algorithm string `json:"algorithm"`
+				Content   string `json:"content"`
+			} `json:"publicKey"`
+			ProofOfPossession []byte `json:"proofOfPossession"`
+		} `json:"publicKeyRequest"`
+	}
+
+	request.Credentials.OIDCIdentityToken = keyless.IdentityToken
+	request.PublicKeyRequest.PublicKey.Algorithm = "ECDSA"
+	request.PublicKeyRequest.PublicKey.Content = string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: keyDER}))
+	request.PublicKeyRequest.ProofOfPossession = proof
+
+	type certificateChain struct {
+		Chain struct {
+			Certificates []string `json:"certificates"`
+		} `json:"chain"`
+	}
+
+	var response struct {
+		SignedCertificateEmbeddedSct *certificateChain `json:"signedCertificateEmbeddedSct"`
+		SignedCertificateDetachedSct *certificateChain `json:"signedCertificateDetachedSct"`
+	}
+
+	fulcioURL := keyless.FulcioURL
+	if fulcioURL == "" {
+		fulcioURL = resource.DefaultFulcioURL
+	}
+
+	err = postJSON(strings.TrimSuffix(fulcioURL, "/")+"/api/v2/signingCert", request, &response)
+	if err != nil {
+		return nil, err
+	}
+
+	issued := response.SignedCertificateEmbeddedSct
+	if issued == nil {
+		issued = response.SignedCertificateDetachedSct
+	}
+
+	if issued == nil {
+		return nil, fmt.Errorf("no certificate issued")
+	}
+
+	chain, err := parseCertificates([]byte(strings.Join(issued.Chain.Certificates, "\n")))
+	if err != nil {
+		return nil, fmt.Errorf("parse certificates: %w", err)
+	}
+
+	if len(chain) == 0 {
+		return nil, fmt.Errorf("no certificate issued")
+	}
+
+	return chain, nil
+}
+
+// tokenSubject returns the identity of the token which Fulcio expects to be
+// signed as proof of possession: its email, or else its subject.
+func tokenSubject(token string) (string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", resource.Invalid("identity token is not a JWT")
+	}
+
+	claimsJSON, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return "", resource.Invalid("decode identity token: %s", err)
+	}
+
+	var claims struct {
+		Subject string `json:"sub"`
+		Email   string `json:"email"`
+	}
+
+	err = json.Unmarshal(claimsJSON, &claims)
+	if err != nil {
+		return "", resource.Invalid("decode identity token: %s", err)
+	}
+
+	if claims.Email != "" {
+		return claims.Email, nil
+	}
+
+	return claims.Subject, nil
+}
+
+// uploadToRekor records the signature in the transparency log, returning the
+// bundle proving its inclusion.
+func uploadToRekor(keyless resource.KeylessSigning, sig cosignSignature) (string, error) {
+	payloadHash := sha256.Sum256(sig.Payload)
+
+	var entry hashedRekord
+	entry.APIVersion = "0.0.1"
+	entry.Kind = "hashedrekord"
+	entry.Spec.Data.Hash.Algorithm = "sha256"
+	entry.Spec.Data.Hash.Value = hex.EncodeToString(payloadHash[:])
+	entry.Spec.Signature.Content = base64.StdEncoding.EncodeToString(sig.Signature)
+	entry.Spec.Signature.PublicKey.Content = base64.StdEncoding.EncodeToString(encodeCertificates(sig.Certificate))
+
+	var entries map[string]struct {
+		rekorBundlePayload
+		Verification struct {
+			SignedEntryTimestamp []byte `json:"signedEntryTimestamp"`
+		} `json:"verification"`
+	}
+
+	rekorURL := keyless.RekorURL
+	if rekorURL == "" {
+		rekorURL = resource.DefaultRekorURL
+	}
+
+	err := postJSON(strings.TrimSuffix(rekorURL, "/")+"/api/v1/log/entries", entry, &entries)
+	if err != nil {
+		return "", err
+	}
+
+	for uuid, logged := range entries {
+		logrus.Infof("recorded signature in transparency log (index %d, uuid %s)", logged.LogIndex, uuid)
+
+		bundle, err := json.Marshal(rekorBundle{
+			SignedEntryTimestamp: logged.Verification.SignedEntryTimestamp,
+			Payload:              logged.rekorBundlePayload,
+		})
+		if err != nil {
+			return "", err
+		}
+
+		return string(bundle), nil
+	}
+
+	return "", fmt.Errorf("no log entry created")
+}
+
+func signPayload(key crypto.Signer, payload []byte) ([]byte, error) {
+	if _, ok := key.(ed25519.PrivateKey); ok {
+		return key.Sign(rand.Reader, payload, crypto.Hash(0))
+	}
+
+	digest := sha256.Sum256(payload)
+
+	return key.Sign(rand.Reader, digest[:], crypto.SHA256)
+}
+
+// encryptedCosignKey is the format of private keys generated by cosign,
+// encrypted with a key derived from the password.
+type encryptedCosignKey struct {
+	KDF struct {
+		Name   string `json:"name"`
+		Params struct {
+			N int `json:"N"`
+			R int `json:"r"`
+			P int `json:"p"`
+		} `json:"params"`
+		Salt []byte `json:"salt"`
+	} `json:"kdf"`
+
+	Cipher struct {
+		Name  string `json:"name"`
+		Nonce []byte `json:"nonce"`
+	} `json:"cipher"`
+
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+func parsePrivateKey(keyPEM string, password string) (crypto.Signer, error) {
+	block, _ := pem.Decode([]byte(keyPEM))
+	if block == nil {
+		return nil, fmt.Errorf("no PEM block found")
+	}
+
+	var key interface{}
+	var err error
+	switch block.Type {
+	case "ENCRYPTED SIGSTORE PRIVATE KEY", "ENCRYPTED COSIGN PRIVATE KEY":
+		var der []byte
+		der, err = decryptCosignKey(block.Bytes, password)
+		if err != nil {
+			return nil, err
+		}
+
+		key, err = x509.ParsePKCS8PrivateKey(der)
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("unsupported PEM block type %q", block.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported private key type %T", key)
+	}
+
+	return signer, nil
+}
+
+func decryptCosignKey(encrypted []byte, password string) ([]byte, error) {
+	var data encryptedCosignKey
+	err := json.Unmarshal(encrypted, &data)
+	if err != nil {
+		return nil, fmt.Errorf("parse encrypted key: %w", err)
+	}
+
+	if data.KDF.Name != "scrypt" || data.Cipher.Name != "nacl/secretbox" {
+		return nil, fmt.Errorf("unsupported key encryption (%s, %s)", data.KDF.Name, data.Cipher.Name)
+	}
+
+	derived, err := scrypt.Key([]byte(password), data.KDF.Salt, data.KDF.Params.N, data.KDF.Params.R, data.KDF.Params.P, 32)
+	if err != nil {
+		return nil, fmt.Errorf("derive key: %w", err)
+	}
+
+	var secret [32]byte
+	copy(secret[:], derived)
+
+	if len(data.Cipher.Nonce) != 24 {
+		return nil, fmt.Errorf("invalid nonce")
+	}
+
+	var nonce [24]byte
+	copy(nonce[:], data.Cipher.Nonce)
+
+	decrypted, ok := secretbox.Open(nil, data.Ciphertext, &nonce, &secret)
+	if !ok {
+		return nil, fmt.Errorf("decrypt key: incorrect password")
+	}
+
+	return decrypted, nil
+}
+
+func encodeCertificates(certs ...*x509.Certificate) []byte {
+	buf := new(bytes.Buffer)
+	for _, cert := range certs {
+		pem.Encode(buf, &pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+	}
+
+	return buf.Bytes()
+}
+
+func postJSON(url string, body interface{}, dest interface{}) error {
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(resource.RequestContext(), http.MethodPost, url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK && res.StatusCode != http.StatusCreated {
+		return fmt.Errorf("POST %s: %s", url, res.Status)
+	}
+
+	return json.NewDecoder(res.Body).Decode(dest)
+}
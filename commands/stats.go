@@ -0,0 +1,262 @@
+package commands
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+	"time"
+
+	resource "github.com/concourse/registry-image-resource"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/sirupsen/logrus"
+)
+
+// transferStats records how long each layer of an image took to transfer,
+// by timing reads of the layers' compressed contents.
+type transferStats struct {
+	// leave remote layers uninstrumented when pushing, so that the registry
+	// can mount them from their repository rather than transferring them
+	mount bool
+
+	lock   sync.Mutex
+	layers map[v1.Hash]*layerStats
+	order  []v1.Hash
+}
+
+type layerStats struct {
+	Size     int64
+	Duration time.Duration
+
+	// number of times the layer was read, including retries
+	Attempts int
+}
+
+func newTransferStats(mount bool) *transferStats {
+	return &transferStats{
+		mount:  mount,
+		layers: map[v1.Hash]*layerStats{},
+	}
+}
+
+// Image returns the image with its layers instrumented.
+func (s *transferStats) Image(image v1.Image) v1.Image {
+	return &statsImage{Image: image, stats: s}
+}
+
+// Index returns the index with the layers of its images instrumented.
+func (s *transferStats) Index(index v1.ImageIndex) v1.ImageIndex {
+	return &statsIndex{index: index, stats: s}
+}
+
+func (s *transferStats) layer(layer v1.Layer) v1.Layer {
+	if _, ok := layer.(*remote.MountableLayer); ok && s.mount {
+		return layer
+	}
+
+	return &statsLayer{Layer: layer, stats: s}
+}
+
+func (s *transferStats) start(digest v1.Hash) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	layer, found := s.layers[digest]
+	if !found {
+		layer = &layerStats{}
+		s.layers[digest] = layer
+		s.order = append(s.order, digest)
+	}
+
+	layer.Attempts++
+}
+
+func (s *transferStats) finish(digest v1.Hash, size int64, duration time.Duration) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	layer := s.layers[digest]
+	layer.Size = size
+	layer.Duration += duration
+}
+
+// Log prints a line summarizing the transfer of each layer.
+func (s *transferStats) Log() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for _, digest := range s.order {
+		layer := s.layers[digest]
+
+		retries := ""
+		if layer.Attempts > 1 {
+			retries = fmt.Sprintf(", %d retries", layer.Attempts-1)
+		}
+
+		logrus.Infof("layer %s: %s in %s (%s/s)%s", digest.Hex[0:12], humanBytes(layer.Size), layer.Duration.Round(time.Millisecond), humanBytes(speed(layer.Size, layer.Duration)), retries)
+	}
+}
+
+// Metadata returns the total size, time, and speed of the transfer.
+func (s *transferStats) Metadata() []resource.MetadataField {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if len(s.layers) == 0 {
+		return nil
+	}
+
+	var size int64
+	var duration time.Duration
+	for _, layer := range s.layers {
+		size += layer.Size
+		duration += layer.Duration
+	}
+
+	return []resource.MetadataField{
+		{Name: "bytes_transferred", Value: strconv.FormatInt(size, 10)},
+		{Name: "transfer_time", Value: duration.Round(time.Millisecond).String()},
+		{Name: "transfer_speed", Value: humanBytes(speed(size, duration)) + "/s"},
+	}
+}
+
+func speed(size int64, duration time.Duration) int64 {
+	if duration <= 0 {
+		return 0
+	}
+
+	return int64(float64(size) / duration.Seconds())
+}
+
+type statsImage struct {
+	v1.Image
+	stats *transferStats
+}
+
+func (i *statsImage) Layers() ([]v1.Layer, error) {
+	layers, err := i.Image.Layers()
+	if err != nil {
+		return nil, err
+	}
+
+	instrumented := make([]v1.Layer, len(layers))
+	for n, layer := range layers {
+		instrumented[n] = i.stats.layer(layer)
+	}
+
+	return instrumented, nil
+}
+
+func (i *statsImage) LayerByDigest(digest v1.Hash) (v1.Layer, error) {
+	layer, err := i.Image.LayerByDigest(digest)
+	if err != nil {
+		return nil, err
+	}
+
+	return i.stats.layer(layer), nil
+}
+
+func (i *statsImage) LayerByDiffID(diffID v1.Hash) (v1.Layer, error) {
+	layer, err := i.Image.LayerByDiffID(diffID)
+	if err != nil {
+		return nil, err
+	}
+
+	return i.stats.layer(layer), nil
+}
+
+type statsIndex struct {
+	index v1.ImageIndex
+	stats *transferStats
+}
+
+func (i *statsIndex) MediaType() (types.MediaType, error) {
+	return i.index.MediaType()
+}
+
+func (i *statsIndex) Digest() (v1.Hash, error) {
+	return i.index.Digest()
+}
+
+func (i *statsIndex) Size() (int64, error) {
+	return i.index.Size()
+}
+
+func (i *statsIndex) IndexManifest() (*v1.IndexManifest, error) {
+	return i.index.IndexManifest()
+}
+
+func (i *statsIndex) RawManifest() ([]byte, error) {
+	return i.index.RawManifest()
+}
+
+func (i *statsIndex) Image(digest v1.Hash) (v1.Image, error) {
+	image, err := i.index.Image(digest)
+	if err != nil {
+		return nil, err
+	}
+
+	return i.stats.Image(image), nil
+}
+
+func (i *statsIndex) ImageIndex(digest v1.Hash) (v1.ImageIndex, error) {
+	index, err := i.index.ImageIndex(digest)
+	if err != nil {
+		return nil, err
+	}
+
+	return i.stats.Index(index), nil
+}
+
+type statsLayer struct {
+	v1.Layer
+	stats *transferStats
+}
+
+func (l *statsLayer) Compressed() (io.ReadCloser, error) {
+	digest, err := l.Layer.Digest()
+	if err != nil {
+		return nil, err
+	}
+
+	rc, err := l.Layer.Compressed()
+	if err != nil {
+		return nil, err
+	}
+
+	l.stats.start(digest)
+
+	return &statsReader{
+		ReadCloser: rc,
+		digest:     digest,
+		stats:      l.stats,
+		started:    time.Now(),
+	}, nil
+}
+
+type statsReader struct {
+	io.ReadCloser
+
+	digest  v1.Hash
+	stats   *transferStats
+	started time.Time
+	read    int64
+	closed  bool
+}
+
+func (r *statsReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.read += int64(n)
+	return n, err
+}
+
+func (r *statsReader) Close() error {
+	if !r.closed {
+		r.closed = true
+		r.stats.finish(r.digest, r.read, time.Since(r.started))
+	}
+
+	return r.ReadCloser.Close()
+}
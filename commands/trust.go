@@ -0,0 +1,63 @@
+package commands
+
+import (
+	"encoding/hex"
+	"fmt"
+	"os"
+
+	resource "github.com/concourse/registry-image-resource"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+	"github.com/simonshyu/notary-gcr/pkg/gcr"
+	"github.com/sirupsen/logrus"
+)
+
+// verifyContentTrust resolves each version's tag through the Notary server
+// configured in content_trust, failing if the tag is not signed or if its
+// signed digest differs from the version's digest.
+func verifyContentTrust(source resource.Source, versions ...resource.Version) error {
+	repo, err := source.NewRepository()
+	if err != nil {
+		return fmt.Errorf("resolve repository: %w", err)
+	}
+
+	contentTrust := *source.ContentTrust
+	if contentTrust.Scopes == "" {
+		// only read access is needed to verify, as opposed to signing
+		contentTrust.Scopes = transport.PullScope
+	}
+
+	notaryConfigDir, err := contentTrust.PrepareConfigDir()
+	if err != nil {
+		return fmt.Errorf("prepare notary-config-dir: %w", err)
+	}
+
+	defer os.RemoveAll(notaryConfigDir)
+
+	for _, version := range versions {
+		tag := repo.Tag(version.Tag)
+
+		trustedRepo, err := gcr.NewTrustedGcrRepository(notaryConfigDir, tag, createRegistryAuth(source), createNotaryAuth(source))
+		if err != nil {
+			return fmt.Errorf("create TrustedGcrRepository: %w", err)
+		}
+
+		target, err := trustedRepo.Verify()
+		if err != nil {
+			return fmt.Errorf("verify %s: %w", tag, err)
+		}
+
+		hash, found := target.Hashes["sha256"]
+		if !found {
+			return fmt.Errorf("verify %s: no sha256 digest in trust data", tag)
+		}
+
+		signedDigest := "sha256:" + hex.EncodeToString(hash)
+		if signedDigest != version.Digest {
+			return fmt.Errorf("verify %s: digest %s is not signed (signed digest is %s)", tag, version.Digest, signedDigest)
+		}
+
+		logrus.Debugf("verified signature of %s@%s", tag, version.Digest)
+	}
+
+	return nil
+}
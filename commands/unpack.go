@@ -2,65 +2,124 @@ package commands
 
 import (
 	"archive/tar"
+	"bufio"
+	"bytes"
 	"compress/gzip"
+	"encoding/hex"
+	"fmt"
+	"hash"
 	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"runtime"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/concourse/go-archive/tarfs"
-	"github.com/fatih/color"
+	resource "github.com/concourse/registry-image-resource"
 	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/klauspost/compress/zstd"
 	"github.com/sirupsen/logrus"
-	"github.com/vbauerster/mpb"
-	"github.com/vbauerster/mpb/decor"
 )
 
 const whiteoutPrefix = ".wh."
 const whiteoutOpaqueDir = whiteoutPrefix + whiteoutPrefix + ".opq"
 
-func unpackImage(dest string, img v1.Image, debug bool, out io.Writer) error {
+// whiteoutMode determines what is done with the whiteout files marking paths
+// removed by a layer.
+type whiteoutMode int
+
+const (
+	// remove the paths from the layers extracted so far
+	applyWhiteouts whiteoutMode = iota
+
+	// extract the whiteout files as-is
+	keepWhiteouts
+
+	// convert them to overlayfs whiteouts, i.e. character devices and opaque
+	// directories
+	overlayWhiteouts
+)
+
+func unpackImage(dest string, img v1.Image, debug bool, heartbeat time.Duration, limits resource.ExtractLimits, owner *resource.RootfsOwner, out io.Writer) error {
 	layers, err := img.Layers()
 	if err != nil {
 		return err
 	}
 
-	chown := os.Getuid() == 0
+	chown := os.Getuid() == 0 || (owner != nil && runtime.GOOS != "windows")
 
 	if debug {
 		out = ioutil.Discard
 	}
 
-	progress := mpb.New(mpb.WithOutput(out))
+	progress, err := newLayerProgress(layers, heartbeat, out)
+	if err != nil {
+		return err
+	}
+
+	// don't keep reporting progress if extracting a layer fails
+	defer progress.Stop()
 
-	bars := make([]*mpb.Bar, len(layers))
+	limiter := &extractLimiter{limits: limits}
 
+	lazyPull := lazyPullLayers(img, len(layers))
+
+	// iterate over layers in reverse order; no need to write things files that
+	// are modified by later layers anyway
 	for i, layer := range layers {
-		size, err := layer.Size()
-		if err != nil {
-			return err
-		}
+		logrus.Debugf("extracting layer %d of %d", i+1, len(layers))
 
-		digest, err := layer.Digest()
+		err := extractLayer(dest, layer, progress, i, limiter, chown, owner, applyWhiteouts, lazyPull[i])
 		if err != nil {
 			return err
 		}
+	}
 
-		bars[i] = progress.AddBar(
-			size,
-			mpb.PrependDecorators(decor.Name(color.HiBlackString(digest.Hex[0:12]))),
-			mpb.AppendDecorators(decor.CountersKibiByte("%.1f/%.1f")),
-		)
+	progress.Wait()
+
+	return nil
+}
+
+// unpackLayers extracts each layer into its own directory, numbered by the
+// layer's index, without applying whiteouts.
+func unpackLayers(dest string, img v1.Image, whiteouts whiteoutMode, debug bool, heartbeat time.Duration, limits resource.ExtractLimits, owner *resource.RootfsOwner, out io.Writer) error {
+	layers, err := img.Layers()
+	if err != nil {
+		return err
 	}
 
-	// iterate over layers in reverse order; no need to write things files that
-	// are modified by later layers anyway
+	chown := os.Getuid() == 0 || (owner != nil && runtime.GOOS != "windows")
+
+	if debug {
+		out = ioutil.Discard
+	}
+
+	progress, err := newLayerProgress(layers, heartbeat, out)
+	if err != nil {
+		return err
+	}
+
+	// don't keep reporting progress if extracting a layer fails
+	defer progress.Stop()
+
+	limiter := &extractLimiter{limits: limits}
+
+	lazyPull := lazyPullLayers(img, len(layers))
+
 	for i, layer := range layers {
 		logrus.Debugf("extracting layer %d of %d", i+1, len(layers))
 
-		err := extractLayer(dest, layer, bars[i], chown)
+		layerDest := filepath.Join(dest, strconv.Itoa(i))
+
+		err := os.MkdirAll(layerDest, 0755)
+		if err != nil {
+			return err
+		}
+
+		err = extractLayer(layerDest, layer, progress, i, limiter, chown, owner, whiteouts, lazyPull[i])
 		if err != nil {
 			return err
 		}
@@ -71,18 +130,30 @@ func unpackImage(dest string, img v1.Image, debug bool, out io.Writer) error {
 	return nil
 }
 
-func extractLayer(dest string, layer v1.Layer, bar *mpb.Bar, chown bool) error {
+func extractLayer(dest string, layer v1.Layer, progress layerProgress, i int, limiter *extractLimiter, chown bool, owner *resource.RootfsOwner, whiteouts whiteoutMode, lazyPull bool) error {
+	digest, err := layer.Digest()
+	if err != nil {
+		return err
+	}
+
 	r, err := layer.Compressed()
 	if err != nil {
 		return err
 	}
 
-	gr, err := gzip.NewReader(bar.ProxyReader(r))
+	vr, err := newVerifyingReader(r, digest)
+	if err != nil {
+		return err
+	}
+
+	dr, err := decompressLayer(progress.Reader(i, vr))
 	if err != nil {
 		return err
 	}
 
-	tr := tar.NewReader(gr)
+	defer dr.Close()
+
+	tr := tar.NewReader(dr)
 
 	for {
 		hdr, err := tr.Next()
@@ -94,6 +165,11 @@ func extractLayer(dest string, layer v1.Layer, bar *mpb.Bar, chown bool) error {
 			return err
 		}
 
+		if lazyPull && lazyPullMetadata[filepath.Clean(hdr.Name)] {
+			logrus.Debugf("skipping %s", hdr.Name)
+			continue
+		}
+
 		path := filepath.Join(dest, filepath.Clean(hdr.Name))
 		base := filepath.Base(path)
 		dir := filepath.Dir(path)
@@ -104,7 +180,48 @@ func extractLayer(dest string, layer v1.Layer, bar *mpb.Bar, chown bool) error {
 
 		log.Debug("unpacking")
 
-		if base == whiteoutOpaqueDir {
+		err = limiter.add(hdr)
+		if err != nil {
+			return err
+		}
+
+		if owner != nil {
+			// chowned as each entry is extracted, rather than afterwards
+			hdr.Uid = owner.UID
+			hdr.Gid = owner.GID
+		}
+
+		if whiteouts == overlayWhiteouts && base == whiteoutOpaqueDir {
+			log.Debugf("marking %s opaque", dir)
+
+			err := os.MkdirAll(dir, 0755)
+			if err != nil {
+				return err
+			}
+
+			err = overlayOpaqueDir(dir)
+			if err != nil {
+				return fmt.Errorf("mark %s opaque: %w", hdr.Name, err)
+			}
+
+			continue
+		} else if whiteouts == overlayWhiteouts && strings.HasPrefix(base, whiteoutPrefix) {
+			removedPath := filepath.Join(dir, strings.TrimPrefix(base, whiteoutPrefix))
+
+			log.Debugf("whiting out %s", removedPath)
+
+			err := os.MkdirAll(dir, 0755)
+			if err != nil {
+				return err
+			}
+
+			err = overlayWhiteout(removedPath)
+			if err != nil {
+				return fmt.Errorf("white out %s: %w", hdr.Name, err)
+			}
+
+			continue
+		} else if whiteouts == applyWhiteouts && base == whiteoutOpaqueDir {
 			fi, err := os.Lstat(dir)
 			if err != nil && !os.IsNotExist(err) {
 				return err
@@ -127,7 +244,7 @@ func extractLayer(dest string, layer v1.Layer, bar *mpb.Bar, chown bool) error {
 				}
 			}
 			continue
-		} else if strings.HasPrefix(base, whiteoutPrefix) {
+		} else if whiteouts == applyWhiteouts && strings.HasPrefix(base, whiteoutPrefix) {
 			// layer has marked a file as deleted
 			name := strings.TrimPrefix(base, whiteoutPrefix)
 			removedPath := filepath.Join(dir, name)
@@ -175,7 +292,14 @@ func extractLayer(dest string, layer v1.Layer, bar *mpb.Bar, chown bool) error {
 		}
 	}
 
-	err = gr.Close()
+	err = dr.Close()
+	if err != nil {
+		return err
+	}
+
+	// the tar stream ends before the end of the blob; read the rest so that
+	// its digest is verified, now that the decompressor is done reading it
+	_, err = io.Copy(ioutil.Discard, vr)
 	if err != nil {
 		return err
 	}
@@ -185,7 +309,146 @@ func extractLayer(dest string, layer v1.Layer, bar *mpb.Bar, chown bool) error {
 		return err
 	}
 
-	bar.SetTotal(bar.Current(), true)
+	progress.Done(i)
+
+	return nil
+}
+
+// lazyPullMetadata are the entries which eStargz layers add to the root of
+// the layer for lazy pulling, which aren't part of the image's filesystem.
+var lazyPullMetadata = map[string]bool{
+	"stargz.index.json":     true,
+	".prefetch.landmark":    true,
+	".no.prefetch.landmark": true,
+}
+
+// lazyPullAnnotations mark a layer descriptor as eStargz or zstd:chunked, with
+// the digest of its table of contents.
+var lazyPullAnnotations = []string{
+	"containerd.io/snapshot/stargz/toc.digest",
+	"io.github.containers.zstd-chunked.manifest-checksum",
+}
+
+// lazyPullLayers returns which of the image's layers are formatted for lazy
+// pulling, per their annotations, so that only their lazy pulling metadata is
+// left out; any other layer may legitimately ship files with the same names.
+func lazyPullLayers(img v1.Image, count int) []bool {
+	lazyPull := make([]bool, count)
+
+	manifest, err := img.Manifest()
+	if err != nil || len(manifest.Layers) != count {
+		// e.g. a schema 1 image, which predates lazy pulling
+		return lazyPull
+	}
+
+	for i, desc := range manifest.Layers {
+		for _, annotation := range lazyPullAnnotations {
+			if desc.Annotations[annotation] != "" {
+				lazyPull[i] = true
+			}
+		}
+	}
+
+	return lazyPull
+}
+
+// decompressLayer returns the layer's tar stream, detecting whether the layer
+// is compressed with gzip (including eStargz) or zstd (including
+// zstd:chunked, whose table of contents is in a skippable frame), or not at
+// all.
+func decompressLayer(r io.Reader) (io.ReadCloser, error) {
+	br := bufio.NewReader(r)
+
+	magic, err := br.Peek(len(zstdMagic))
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		return gzip.NewReader(br)
+	case bytes.HasPrefix(magic, zstdMagic):
+		// decode in the calling goroutine, rather than reading ahead of it
+		zr, err := zstd.NewReader(br, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, fmt.Errorf("decompress zstd: %w", err)
+		}
+
+		return zr.IOReadCloser(), nil
+	default:
+		return ioutil.NopCloser(br), nil
+	}
+}
+
+// extractLimiter enforces the extraction limits across all of an image's
+// layers, failing before anything over the limits is written to disk.
+type extractLimiter struct {
+	limits resource.ExtractLimits
+
+	size  int64
+	files int
+}
+
+func (l *extractLimiter) add(hdr *tar.Header) error {
+	if l.limits.MaxFileSize > 0 && hdr.Size > l.limits.MaxFileSize {
+		return fmt.Errorf("%s is %d bytes, exceeding max_file_size of %d bytes", hdr.Name, hdr.Size, l.limits.MaxFileSize)
+	}
+
+	l.files++
+	if l.limits.MaxFiles > 0 && l.files > l.limits.MaxFiles {
+		return fmt.Errorf("image has more than max_files of %d files", l.limits.MaxFiles)
+	}
+
+	l.size += hdr.Size
+	if l.limits.MaxSize > 0 && l.size > l.limits.MaxSize {
+		return fmt.Errorf("image exceeds max_size of %d bytes", l.limits.MaxSize)
+	}
 
 	return nil
 }
+
+// verifyingReader hashes a blob as it is read, failing the read that reaches
+// the end of the blob if its digest does not match.
+type verifyingReader struct {
+	r        io.Reader
+	hash     hash.Hash
+	expected v1.Hash
+	err      error
+}
+
+func newVerifyingReader(r io.Reader, expected v1.Hash) (*verifyingReader, error) {
+	h, err := v1.Hasher(expected.Algorithm)
+	if err != nil {
+		return nil, err
+	}
+
+	return &verifyingReader{
+		r:        r,
+		hash:     h,
+		expected: expected,
+	}, nil
+}
+
+func (r *verifyingReader) Read(p []byte) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+
+	n, err := r.r.Read(p)
+	r.hash.Write(p[:n])
+
+	if err == io.EOF {
+		actual := v1.Hash{
+			Algorithm: r.expected.Algorithm,
+			Hex:       hex.EncodeToString(r.hash.Sum(nil)),
+		}
+
+		if actual != r.expected {
+			err = fmt.Errorf("layer digest mismatch: expected %s, got %s", r.expected, actual)
+		}
+
+		r.err = err
+	}
+
+	return n, err
+}
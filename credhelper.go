@@ -0,0 +1,128 @@
+package resource
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// dockerHubServerURL is the server URL under which the Docker CLI stores
+// Docker Hub credentials, in both config.json and credential helpers.
+const dockerHubServerURL = "https://index.docker.io/v1/"
+
+// credentialHelperIdentityToken is the username a credential helper returns
+// when the secret is an identity (refresh) token rather than a password.
+const credentialHelperIdentityToken = "<token>"
+
+// helperCredentials are the credentials a credential helper returns.
+type helperCredentials struct {
+	ServerURL string
+	Username  string
+	Secret    string
+}
+
+// credentialHelperNotFound is what helpers print when they have no
+// credentials for the server.
+const credentialHelperNotFound = "credentials not found in native keychain"
+
+// getFromCredentialHelper runs docker-credential-<helper> get, as the Docker
+// CLI does, returning the credentials it has for the server, or nil if it has
+// none.
+func getFromCredentialHelper(helper string, serverURL string) (*helperCredentials, error) {
+	program := "docker-credential-" + helper
+
+	cmd := exec.CommandContext(RequestContext(), program, "get")
+	cmd.Stdin = strings.NewReader(serverURL)
+
+	stdout := new(bytes.Buffer)
+	stderr := new(bytes.Buffer)
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+
+	err := cmd.Run()
+	if err != nil {
+		if strings.Contains(stdout.String(), credentialHelperNotFound) || strings.Contains(stderr.String(), credentialHelperNotFound) {
+			return nil, nil
+		}
+
+		return nil, fmt.Errorf("%s get: %w: %s", program, err, strings.TrimSpace(stdout.String()+stderr.String()))
+	}
+
+	var creds helperCredentials
+	err = json.Unmarshal(stdout.Bytes(), &creds)
+	if err != nil {
+		return nil, fmt.Errorf("%s get: parse output: %w", program, err)
+	}
+
+	return &creds, nil
+}
+
+// credentialHelperServerURL returns the server URL to look up a registry's
+// credentials with, which for Docker Hub is its legacy v1 URL.
+func credentialHelperServerURL(registry string) string {
+	if isDockerHub(registry) {
+		return dockerHubServerURL
+	}
+
+	return registry
+}
+
+func isDockerHub(registry string) bool {
+	switch registry {
+	case "index.docker.io", "docker.io", "registry-1.docker.io":
+		return true
+	default:
+		return false
+	}
+}
+
+// AuthenticateWithCredentialHelper sets the source's credentials to those
+// its credential_helper has for the registry, if configured.
+func (source *Source) AuthenticateWithCredentialHelper() error {
+	if source.CredentialHelper == "" {
+		return nil
+	}
+
+	if source.Username != "" || source.Password != "" || source.DockerConfig != "" {
+		return Invalid("cannot specify 'username', 'password', or 'docker_config' with 'credential_helper'")
+	}
+
+	if strings.ContainsAny(source.CredentialHelper, `/\`) {
+		return Invalid("invalid credential_helper %q: must be the name of a docker-credential-<name> program", source.CredentialHelper)
+	}
+
+	repo, err := source.NewRepository()
+	if err != nil {
+		return fmt.Errorf("resolve repository: %w", err)
+	}
+
+	creds, err := getFromCredentialHelper(source.CredentialHelper, credentialHelperServerURL(repo.RegistryStr()))
+	if err != nil {
+		return Categorize(CategoryAuth, fmt.Errorf("credential_helper: %w", err))
+	}
+
+	if creds == nil {
+		logrus.Warnf("credential helper %s has no credentials for %s", source.CredentialHelper, repo.RegistryStr())
+		return nil
+	}
+
+	source.setHelperCredentials(creds)
+
+	return nil
+}
+
+// setHelperCredentials sets the source's credentials to those returned by a
+// credential helper.
+func (source *Source) setHelperCredentials(creds *helperCredentials) {
+	if creds.Username == credentialHelperIdentityToken {
+		source.identityToken = creds.Secret
+		return
+	}
+
+	source.Username = creds.Username
+	source.Password = creds.Secret
+}
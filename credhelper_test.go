@@ -0,0 +1,107 @@
+package resource_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	resource "github.com/concourse/registry-image-resource"
+)
+
+var _ = Describe("AuthenticateWithCredentialHelper", func() {
+	var tmp string
+	var originalPath string
+
+	BeforeEach(func() {
+		var err error
+		tmp, err = ioutil.TempDir("", "credential-helper")
+		Expect(err).ToNot(HaveOccurred())
+
+		helper := `#!/bin/sh
+[ "$1" = "get" ] || exit 1
+read server
+case "$server" in
+  https://index.docker.io/v1/)
+    echo '{"ServerURL":"https://index.docker.io/v1/","Username":"hub-user","Secret":"hub-secret"}'
+    ;;
+  registry.example.com)
+    echo '{"ServerURL":"registry.example.com","Username":"some-user","Secret":"some-secret"}'
+    ;;
+  broken.example.com)
+    echo "helper exploded" >&2
+    exit 1
+    ;;
+  *)
+    echo "credentials not found in native keychain"
+    exit 1
+    ;;
+esac
+`
+		err = ioutil.WriteFile(filepath.Join(tmp, "docker-credential-fake"), []byte(helper), 0755)
+		Expect(err).ToNot(HaveOccurred())
+
+		originalPath = os.Getenv("PATH")
+		os.Setenv("PATH", tmp+string(os.PathListSeparator)+originalPath)
+	})
+
+	AfterEach(func() {
+		os.Setenv("PATH", originalPath)
+		os.RemoveAll(tmp)
+	})
+
+	It("gets the registry's credentials from the helper", func() {
+		source := resource.Source{
+			Repository:       "registry.example.com/some/image",
+			CredentialHelper: "fake",
+		}
+
+		Expect(source.AuthenticateWithCredentialHelper()).To(Succeed())
+		Expect(source.Username).To(Equal("some-user"))
+		Expect(source.Password).To(Equal("some-secret"))
+	})
+
+	It("looks up Docker Hub by its v1 URL", func() {
+		source := resource.Source{
+			Repository:       "concourse/concourse",
+			CredentialHelper: "fake",
+		}
+
+		Expect(source.AuthenticateWithCredentialHelper()).To(Succeed())
+		Expect(source.Username).To(Equal("hub-user"))
+		Expect(source.Password).To(Equal("hub-secret"))
+	})
+
+	It("leaves the source anonymous if the helper has no credentials", func() {
+		source := resource.Source{
+			Repository:       "other.example.com/some/image",
+			CredentialHelper: "fake",
+		}
+
+		Expect(source.AuthenticateWithCredentialHelper()).To(Succeed())
+		Expect(source.Username).To(BeEmpty())
+	})
+
+	It("fails with an auth error if the helper fails", func() {
+		source := resource.Source{
+			Repository:       "broken.example.com/some/image",
+			CredentialHelper: "fake",
+		}
+
+		err := source.AuthenticateWithCredentialHelper()
+		Expect(err).To(MatchError(ContainSubstring("helper exploded")))
+		Expect(resource.Categorized(err)).To(Equal(resource.CategoryAuth))
+	})
+
+	It("rejects a path as the helper", func() {
+		source := resource.Source{
+			Repository:       "registry.example.com/some/image",
+			CredentialHelper: "../fake",
+		}
+
+		err := source.AuthenticateWithCredentialHelper()
+		Expect(err).To(MatchError(ContainSubstring("invalid credential_helper")))
+	})
+})
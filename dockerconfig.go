@@ -0,0 +1,144 @@
+package resource
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// dockerConfig is the subset of a Docker CLI config.json with which
+// credentials are resolved.
+type dockerConfig struct {
+	Auths       map[string]dockerConfigAuth `json:"auths"`
+	CredHelpers map[string]string           `json:"credHelpers"`
+	CredsStore  string                      `json:"credsStore"`
+}
+
+type dockerConfigAuth struct {
+	Auth          string `json:"auth"`
+	Username      string `json:"username"`
+	Password      string `json:"password"`
+	IdentityToken string `json:"identitytoken"`
+	RegistryToken string `json:"registrytoken"`
+}
+
+// AuthenticateWithDockerConfig sets the source's credentials to those the
+// Docker CLI would use for its registry with its docker_config, if
+// configured: from the registry's credHelpers entry, the credsStore, or
+// the auths, in that order.
+func (source *Source) AuthenticateWithDockerConfig() error {
+	if source.DockerConfig == "" {
+		return nil
+	}
+
+	if source.Username != "" || source.Password != "" {
+		return Invalid("cannot specify 'username' or 'password' with 'docker_config'")
+	}
+
+	config, err := source.loadDockerConfig()
+	if err != nil {
+		return err
+	}
+
+	repo, err := source.NewRepository()
+	if err != nil {
+		return fmt.Errorf("resolve repository: %w", err)
+	}
+
+	registry := repo.RegistryStr()
+
+	helper := config.CredHelpers[registry]
+	if helper == "" && isDockerHub(registry) {
+		helper = config.CredHelpers["docker.io"]
+	}
+
+	if helper == "" {
+		helper = config.CredsStore
+	}
+
+	if helper != "" {
+		creds, err := getFromCredentialHelper(helper, credentialHelperServerURL(registry))
+		if err != nil {
+			return Categorize(CategoryAuth, fmt.Errorf("docker_config: %w", err))
+		}
+
+		if creds != nil {
+			source.setHelperCredentials(creds)
+			return nil
+		}
+
+		// the Docker CLI falls back to the auths for a credsStore, which may
+		// not have credentials for every registry
+	}
+
+	for key, auth := range config.Auths {
+		if dockerConfigHostname(key) != registry && !(isDockerHub(registry) && isDockerHub(dockerConfigHostname(key))) {
+			continue
+		}
+
+		return source.setDockerConfigAuth(key, auth)
+	}
+
+	return nil
+}
+
+func (source *Source) setDockerConfigAuth(key string, auth dockerConfigAuth) error {
+	switch {
+	case auth.RegistryToken != "":
+		source.bearerToken = auth.RegistryToken
+		return nil
+	case auth.IdentityToken != "":
+		source.identityToken = auth.IdentityToken
+		return nil
+	}
+
+	username, password := auth.Username, auth.Password
+	if auth.Auth != "" {
+		decoded, err := base64.StdEncoding.DecodeString(auth.Auth)
+		if err != nil {
+			return Invalid("docker_config: invalid auth for %s: %s", key, err)
+		}
+
+		var found bool
+		username, password, found = strings.Cut(string(decoded), ":")
+		if !found {
+			return Invalid("docker_config: invalid auth for %s: expected username:password", key)
+		}
+	}
+
+	source.Username = username
+	source.Password = password
+
+	return nil
+}
+
+// loadDockerConfig parses the docker_config, which is either the JSON of a
+// config.json or a path to one, e.g. in an input of a task.
+func (source *Source) loadDockerConfig() (*dockerConfig, error) {
+	content := []byte(source.DockerConfig)
+	if !strings.HasPrefix(strings.TrimSpace(source.DockerConfig), "{") {
+		var err error
+		content, err = ioutil.ReadFile(source.DockerConfig)
+		if err != nil {
+			return nil, Invalid("read docker_config: %s", err)
+		}
+	}
+
+	var config dockerConfig
+	err := json.Unmarshal(content, &config)
+	if err != nil {
+		return nil, Invalid("parse docker_config: %s", err)
+	}
+
+	return &config, nil
+}
+
+// dockerConfigHostname returns the hostname of a key in auths, which may be a
+// URL, e.g. https://index.docker.io/v1/, as the Docker CLI does.
+func dockerConfigHostname(key string) string {
+	hostname := strings.TrimPrefix(strings.TrimPrefix(key, "https://"), "http://")
+	hostname, _, _ = strings.Cut(hostname, "/")
+	return hostname
+}
@@ -0,0 +1,111 @@
+package resource_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	resource "github.com/concourse/registry-image-resource"
+)
+
+var _ = Describe("AuthenticateWithDockerConfig", func() {
+	var tmp string
+	var originalPath string
+
+	BeforeEach(func() {
+		var err error
+		tmp, err = ioutil.TempDir("", "docker-config")
+		Expect(err).ToNot(HaveOccurred())
+
+		// a fake credential helper which has credentials for one registry
+		helper := `#!/bin/sh
+read server
+if [ "$server" = "helped.example.com" ]; then
+  echo '{"ServerURL":"helped.example.com","Username":"helper-user","Secret":"helper-secret"}'
+else
+  echo "credentials not found in native keychain"
+  exit 1
+fi
+`
+		err = ioutil.WriteFile(filepath.Join(tmp, "docker-credential-fake"), []byte(helper), 0755)
+		Expect(err).ToNot(HaveOccurred())
+
+		originalPath = os.Getenv("PATH")
+		os.Setenv("PATH", tmp+string(os.PathListSeparator)+originalPath)
+	})
+
+	AfterEach(func() {
+		os.Setenv("PATH", originalPath)
+		os.RemoveAll(tmp)
+	})
+
+	config := `{
+		"auths": {
+			"https://index.docker.io/v1/": {"auth": "aHViLXVzZXI6aHViLXBhc3N3b3Jk"},
+			"registry.example.com": {"username": "some-user", "password": "some-password"}
+		},
+		"credHelpers": {
+			"helped.example.com": "fake"
+		}
+	}`
+
+	It("uses the auths entry for the registry", func() {
+		source := resource.Source{
+			Repository:   "registry.example.com/some/image",
+			DockerConfig: config,
+		}
+
+		Expect(source.AuthenticateWithDockerConfig()).To(Succeed())
+		Expect(source.Username).To(Equal("some-user"))
+		Expect(source.Password).To(Equal("some-password"))
+	})
+
+	It("matches Docker Hub's v1 URL", func() {
+		source := resource.Source{
+			Repository:   "concourse/concourse",
+			DockerConfig: config,
+		}
+
+		Expect(source.AuthenticateWithDockerConfig()).To(Succeed())
+		Expect(source.Username).To(Equal("hub-user"))
+		Expect(source.Password).To(Equal("hub-password"))
+	})
+
+	It("uses the registry's credential helper", func() {
+		source := resource.Source{
+			Repository:   "helped.example.com/some/image",
+			DockerConfig: config,
+		}
+
+		Expect(source.AuthenticateWithDockerConfig()).To(Succeed())
+		Expect(source.Username).To(Equal("helper-user"))
+		Expect(source.Password).To(Equal("helper-secret"))
+	})
+
+	It("reads the config from a path", func() {
+		path := filepath.Join(tmp, "config.json")
+		Expect(ioutil.WriteFile(path, []byte(config), 0644)).To(Succeed())
+
+		source := resource.Source{
+			Repository:   "registry.example.com/some/image",
+			DockerConfig: path,
+		}
+
+		Expect(source.AuthenticateWithDockerConfig()).To(Succeed())
+		Expect(source.Username).To(Equal("some-user"))
+	})
+
+	It("leaves registries without credentials anonymous", func() {
+		source := resource.Source{
+			Repository:   "other.example.com/some/image",
+			DockerConfig: config,
+		}
+
+		Expect(source.AuthenticateWithDockerConfig()).To(Succeed())
+		Expect(source.Username).To(BeEmpty())
+		Expect(source.Password).To(BeEmpty())
+	})
+})
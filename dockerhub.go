@@ -0,0 +1,148 @@
+package resource
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+)
+
+// DockerHubAPI is the base URL of Docker Hub's API, which is separate from
+// its registry.
+const DockerHubAPI = "https://hub.docker.com"
+
+// the number of pages of a repository's images to search for a tag's history
+const dockerHubMaxPages = 10
+
+type dockerHubImages struct {
+	Next    string           `json:"next"`
+	Results []dockerHubImage `json:"results"`
+}
+
+type dockerHubImage struct {
+	Digest     string    `json:"digest"`
+	LastPushed time.Time `json:"last_pushed"`
+	Tags       []struct {
+		Tag string `json:"tag"`
+	} `json:"tags"`
+}
+
+// DockerHubTagHistory returns the digests the tag has pointed to, oldest
+// first, using Docker Hub's image management API. The registry only knows the
+// tag's current digest.
+func DockerHubTagHistory(api string, repo name.Repository, tag string, creds BasicCredentials) ([]string, error) {
+	namespace, repository, found := strings.Cut(repo.RepositoryStr(), "/")
+	if !found {
+		return nil, fmt.Errorf("invalid Docker Hub repository: %s", repo.RepositoryStr())
+	}
+
+	client := &http.Client{Timeout: 30 * time.Second}
+
+	var token string
+	if creds.Username != "" && creds.Password != "" {
+		var err error
+		token, err = dockerHubLogin(client, api, creds)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	query := url.Values{}
+	query.Set("page_size", "100")
+	query.Set("ordering", "-last_activity")
+
+	next := fmt.Sprintf("%s/v2/namespaces/%s/repositories/%s/images?%s", api, namespace, repository, query.Encode())
+
+	images := []dockerHubImage{}
+	for page := 0; next != "" && page < dockerHubMaxPages; page++ {
+		req, err := http.NewRequestWithContext(RequestContext(), http.MethodGet, next, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+
+		res, err := client.Do(req)
+		if err != nil {
+			return nil, fmt.Errorf("list images: %w", err)
+		}
+
+		var body dockerHubImages
+		err = transport.CheckError(res, http.StatusOK)
+		if err == nil {
+			err = json.NewDecoder(res.Body).Decode(&body)
+		}
+
+		res.Body.Close()
+
+		if err != nil {
+			return nil, fmt.Errorf("list images: %w", err)
+		}
+
+		for _, image := range body.Results {
+			for _, t := range image.Tags {
+				if t.Tag == tag {
+					images = append(images, image)
+					break
+				}
+			}
+		}
+
+		next = body.Next
+	}
+
+	sort.SliceStable(images, func(i, j int) bool {
+		return images[i].LastPushed.Before(images[j].LastPushed)
+	})
+
+	digests := []string{}
+	for _, image := range images {
+		digests = append(digests, image.Digest)
+	}
+
+	return digests, nil
+}
+
+// dockerHubLogin exchanges the credentials (or a personal access token) for a
+// token for Docker Hub's API.
+func dockerHubLogin(client *http.Client, api string, creds BasicCredentials) (string, error) {
+	payload, err := json.Marshal(map[string]string{
+		"username": creds.Username,
+		"password": creds.Password,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	res, err := client.Post(api+"/v2/users/login", "application/json", bytes.NewReader(payload))
+	if err != nil {
+		return "", fmt.Errorf("log in to Docker Hub: %w", err)
+	}
+
+	defer res.Body.Close()
+
+	err = transport.CheckError(res, http.StatusOK)
+	if err != nil {
+		return "", fmt.Errorf("log in to Docker Hub: %w", err)
+	}
+
+	var body struct {
+		Token string `json:"token"`
+	}
+
+	err = json.NewDecoder(res.Body).Decode(&body)
+	if err != nil {
+		return "", fmt.Errorf("log in to Docker Hub: %w", err)
+	}
+
+	return body.Token, nil
+}
@@ -0,0 +1,61 @@
+package resource_test
+
+import (
+	"net/http"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/ghttp"
+
+	resource "github.com/concourse/registry-image-resource"
+)
+
+var _ = Describe("DockerHubTagHistory", func() {
+	var hub *ghttp.Server
+	var repo name.Repository
+
+	BeforeEach(func() {
+		hub = ghttp.NewServer()
+
+		var err error
+		repo, err = name.NewRepository("some-org/app")
+		Expect(err).ToNot(HaveOccurred())
+
+		hub.RouteToHandler("POST", "/v2/users/login", ghttp.CombineHandlers(
+			ghttp.VerifyJSON(`{"username":"some-user","password":"some-token"}`),
+			ghttp.RespondWith(http.StatusOK, `{"token":"some-jwt"}`),
+		))
+
+		hub.RouteToHandler("GET", "/v2/namespaces/some-org/repositories/app/images", ghttp.CombineHandlers(
+			ghttp.VerifyHeaderKV("Authorization", "Bearer some-jwt"),
+			func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Query().Get("page") == "2" {
+					w.Write([]byte(`{"next":null,"results":[
+						{"digest":"sha256:first","last_pushed":"2023-01-01T00:00:00Z","tags":[{"tag":"latest","is_current":false}]}
+					]}`))
+					return
+				}
+
+				w.Write([]byte(`{"next":"` + hub.URL() + `/v2/namespaces/some-org/repositories/app/images?page=2","results":[
+					{"digest":"sha256:third","last_pushed":"2023-03-01T00:00:00Z","tags":[{"tag":"latest","is_current":true}]},
+					{"digest":"sha256:other","last_pushed":"2023-02-15T00:00:00Z","tags":[{"tag":"1.0","is_current":true}]},
+					{"digest":"sha256:second","last_pushed":"2023-02-01T00:00:00Z","tags":[{"tag":"latest","is_current":false}]}
+				]}`))
+			},
+		))
+	})
+
+	AfterEach(func() {
+		hub.Close()
+	})
+
+	It("returns the digests the tag pointed to, oldest first", func() {
+		digests, err := resource.DockerHubTagHistory(hub.URL(), repo, "latest", resource.BasicCredentials{
+			Username: "some-user",
+			Password: "some-token",
+		})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(digests).To(Equal([]string{"sha256:first", "sha256:second", "sha256:third"}))
+	})
+})
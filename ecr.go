@@ -0,0 +1,230 @@
+package resource
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ecr"
+	ecrtypes "github.com/aws/aws-sdk-go-v2/service/ecr/types"
+	"github.com/sirupsen/logrus"
+)
+
+// ECRAPI is the subset of the ECR client's operations which are used, so that
+// it can be faked in tests.
+type ECRAPI interface {
+	GetAuthorizationToken(context.Context, *ecr.GetAuthorizationTokenInput, ...func(*ecr.Options)) (*ecr.GetAuthorizationTokenOutput, error)
+	CreateRepository(context.Context, *ecr.CreateRepositoryInput, ...func(*ecr.Options)) (*ecr.CreateRepositoryOutput, error)
+	DescribeImages(context.Context, *ecr.DescribeImagesInput, ...func(*ecr.Options)) (*ecr.DescribeImagesOutput, error)
+	GetLifecyclePolicy(context.Context, *ecr.GetLifecyclePolicyInput, ...func(*ecr.Options)) (*ecr.GetLifecyclePolicyOutput, error)
+}
+
+const (
+	// ECRIgnoreScanFailed ignores images whose scan failed.
+	ECRIgnoreScanFailed = "scan_failed"
+
+	// ECRIgnoreLifecycleExpiring ignores images which the repository's
+	// lifecycle policy has made eligible for expiry.
+	ECRIgnoreLifecycleExpiring = "lifecycle_expiring"
+)
+
+// describeImagesBatch is the most images DescribeImages accepts at once.
+const describeImagesBatch = 100
+
+// ECRIgnoredDigests returns the digests among those given which are to be
+// ignored per aws_ecr_ignore_tag_status, along with why.
+func (source *Source) ECRIgnoredDigests(client ECRAPI, repository string, digests []string, now time.Time) (map[string]string, error) {
+	var ignoreScanFailed, ignoreExpiring bool
+	for _, status := range source.AwsECRIgnoreTagStatus {
+		switch status {
+		case ECRIgnoreScanFailed:
+			ignoreScanFailed = true
+		case ECRIgnoreLifecycleExpiring:
+			ignoreExpiring = true
+		default:
+			return nil, Invalid("unknown aws_ecr_ignore_tag_status %q (must be '%s' or '%s')", status, ECRIgnoreScanFailed, ECRIgnoreLifecycleExpiring)
+		}
+	}
+
+	var policy *ecrLifecyclePolicy
+	if ignoreExpiring {
+		var err error
+		policy, err = source.ecrLifecyclePolicy(client, repository)
+		if err != nil {
+			return nil, fmt.Errorf("get lifecycle policy: %w", err)
+		}
+	}
+
+	ignored := map[string]string{}
+	for start := 0; start < len(digests); start += describeImagesBatch {
+		end := start + describeImagesBatch
+		if end > len(digests) {
+			end = len(digests)
+		}
+
+		input := &ecr.DescribeImagesInput{
+			RepositoryName: aws.String(repository),
+		}
+
+		if source.AWSECRRegistryId != "" {
+			input.RegistryId = aws.String(source.AWSECRRegistryId)
+		}
+
+		for _, digest := range digests[start:end] {
+			input.ImageIds = append(input.ImageIds, ecrtypes.ImageIdentifier{
+				ImageDigest: aws.String(digest),
+			})
+		}
+
+		output, err := client.DescribeImages(RequestContext(), input)
+		if err != nil {
+			return nil, fmt.Errorf("describe images: %w", err)
+		}
+
+		for _, image := range output.ImageDetails {
+			digest := aws.ToString(image.ImageDigest)
+
+			if ignoreScanFailed && image.ImageScanStatus != nil && image.ImageScanStatus.Status == ecrtypes.ScanStatusFailed {
+				ignored[digest] = "its scan failed"
+				continue
+			}
+
+			if policy != nil && image.ImagePushedAt != nil && policy.expires(image.ImageTags, *image.ImagePushedAt, now) {
+				ignored[digest] = "it is eligible for expiry by the lifecycle policy"
+			}
+		}
+	}
+
+	return ignored, nil
+}
+
+// ecrLifecyclePolicy returns the repository's lifecycle policy, or nil if it
+// has none.
+func (source *Source) ecrLifecyclePolicy(client ECRAPI, repository string) (*ecrLifecyclePolicy, error) {
+	input := &ecr.GetLifecyclePolicyInput{
+		RepositoryName: aws.String(repository),
+	}
+
+	if source.AWSECRRegistryId != "" {
+		input.RegistryId = aws.String(source.AWSECRRegistryId)
+	}
+
+	output, err := client.GetLifecyclePolicy(RequestContext(), input)
+	if err != nil {
+		var notFound *ecrtypes.LifecyclePolicyNotFoundException
+		if errors.As(err, &notFound) {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	var policy ecrLifecyclePolicy
+	err = json.Unmarshal([]byte(aws.ToString(output.LifecyclePolicyText)), &policy)
+	if err != nil {
+		return nil, fmt.Errorf("parse lifecycle policy: %w", err)
+	}
+
+	sort.SliceStable(policy.Rules, func(i, j int) bool {
+		return policy.Rules[i].RulePriority < policy.Rules[j].RulePriority
+	})
+
+	return &policy, nil
+}
+
+// ecrLifecyclePolicy is the subset of an ECR lifecycle policy needed to tell
+// whether an image is eligible for expiry.
+type ecrLifecyclePolicy struct {
+	Rules []ecrLifecycleRule `json:"rules"`
+}
+
+type ecrLifecycleRule struct {
+	RulePriority int `json:"rulePriority"`
+	Selection    struct {
+		TagStatus      string   `json:"tagStatus"`
+		TagPrefixList  []string `json:"tagPrefixList"`
+		TagPatternList []string `json:"tagPatternList"`
+		CountType      string   `json:"countType"`
+		CountUnit      string   `json:"countUnit"`
+		CountNumber    int      `json:"countNumber"`
+	} `json:"selection"`
+	Action struct {
+		Type string `json:"type"`
+	} `json:"action"`
+}
+
+// expires returns true if the first rule to select the image, in order of
+// priority, expires images pushed as long ago as it was.
+//
+// Rules which keep a count of images can't be evaluated for a single image,
+// so an image they select is never considered expiring.
+func (policy *ecrLifecyclePolicy) expires(tags []string, pushedAt time.Time, now time.Time) bool {
+	for _, rule := range policy.Rules {
+		if !rule.selects(tags) {
+			continue
+		}
+
+		if rule.Action.Type != "expire" || rule.Selection.CountType != "sinceImagePushed" {
+			logrus.Debugf("lifecycle rule %d selects tags %v but cannot be evaluated", rule.RulePriority, tags)
+			return false
+		}
+
+		age := time.Duration(rule.Selection.CountNumber) * 24 * time.Hour
+		return now.Sub(pushedAt) > age
+	}
+
+	return false
+}
+
+// selects returns true if the rule selects an image with the tags. A rule
+// with prefixes or patterns selects images with a tag matching each of them.
+func (rule ecrLifecycleRule) selects(tags []string) bool {
+	switch rule.Selection.TagStatus {
+	case "any":
+		return true
+	case "untagged":
+		return len(tags) == 0
+	case "tagged":
+	default:
+		return false
+	}
+
+	if len(tags) == 0 {
+		return false
+	}
+
+	for _, prefix := range rule.Selection.TagPrefixList {
+		if !anyTag(tags, func(tag string) bool { return strings.HasPrefix(tag, prefix) }) {
+			return false
+		}
+	}
+
+	for _, pattern := range rule.Selection.TagPatternList {
+		if !anyTag(tags, func(tag string) bool {
+			// tags cannot contain path separators or other glob syntax, so
+			// only the * wildcard is meaningful
+			matched, _ := path.Match(pattern, tag)
+			return matched
+		}) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func anyTag(tags []string, match func(string) bool) bool {
+	for _, tag := range tags {
+		if match(tag) {
+			return true
+		}
+	}
+
+	return false
+}
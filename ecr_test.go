@@ -0,0 +1,341 @@
+package resource_test
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/ghttp"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	ecrtypes "github.com/aws/aws-sdk-go-v2/service/ecr/types"
+	resource "github.com/concourse/registry-image-resource"
+)
+
+var _ = Describe("ECRIgnoredDigests", func() {
+	var source resource.Source
+	var m *mockECR
+	var now time.Time
+
+	BeforeEach(func() {
+		source = resource.Source{
+			Repository: "some/image",
+			AwsCredentials: resource.AwsCredentials{
+				AwsRegion: "us-east-1",
+			},
+		}
+
+		now = time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+
+		m = &mockECR{
+			imageDetails: []ecrtypes.ImageDetail{
+				{
+					ImageDigest:     aws.String("sha256:scanned"),
+					ImageTags:       []string{"1.0.0"},
+					ImagePushedAt:   aws.Time(now.Add(-time.Hour)),
+					ImageScanStatus: &ecrtypes.ImageScanStatus{Status: ecrtypes.ScanStatusComplete},
+				},
+				{
+					ImageDigest:     aws.String("sha256:scan-failed"),
+					ImageTags:       []string{"1.0.1"},
+					ImagePushedAt:   aws.Time(now.Add(-time.Hour)),
+					ImageScanStatus: &ecrtypes.ImageScanStatus{Status: ecrtypes.ScanStatusFailed},
+				},
+				{
+					ImageDigest:   aws.String("sha256:old-dev"),
+					ImageTags:     []string{"dev-1"},
+					ImagePushedAt: aws.Time(now.Add(-30 * 24 * time.Hour)),
+				},
+				{
+					ImageDigest:   aws.String("sha256:new-dev"),
+					ImageTags:     []string{"dev-2"},
+					ImagePushedAt: aws.Time(now.Add(-24 * time.Hour)),
+				},
+				{
+					ImageDigest:   aws.String("sha256:old-release"),
+					ImageTags:     []string{"release-1"},
+					ImagePushedAt: aws.Time(now.Add(-30 * 24 * time.Hour)),
+				},
+			},
+			lifecyclePolicy: `{"rules":[
+				{"rulePriority":1,"selection":{"tagStatus":"tagged","tagPrefixList":["release"],"countType":"imageCountMoreThan","countNumber":10},"action":{"type":"expire"}},
+				{"rulePriority":2,"selection":{"tagStatus":"tagged","tagPatternList":["dev-*"],"countType":"sinceImagePushed","countUnit":"days","countNumber":14},"action":{"type":"expire"}},
+				{"rulePriority":3,"selection":{"tagStatus":"any","countType":"sinceImagePushed","countUnit":"days","countNumber":7},"action":{"type":"expire"}}
+			]}`,
+		}
+	})
+
+	digests := []string{"sha256:scanned", "sha256:scan-failed", "sha256:old-dev", "sha256:new-dev", "sha256:old-release"}
+
+	It("ignores images whose scan failed", func() {
+		source.AwsECRIgnoreTagStatus = []string{"scan_failed"}
+
+		ignored, err := source.ECRIgnoredDigests(m, "some/image", digests, now)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(ignored).To(HaveLen(1))
+		Expect(ignored).To(HaveKey("sha256:scan-failed"))
+	})
+
+	It("ignores images the highest priority matching lifecycle rule expires", func() {
+		source.AwsECRIgnoreTagStatus = []string{"lifecycle_expiring"}
+
+		ignored, err := source.ECRIgnoredDigests(m, "some/image", digests, now)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(ignored).To(HaveLen(1))
+		Expect(ignored).To(HaveKey("sha256:old-dev"))
+	})
+
+	It("ignores nothing for expiry without a lifecycle policy", func() {
+		source.AwsECRIgnoreTagStatus = []string{"lifecycle_expiring"}
+		m.getLifecyclePolicyErr = &ecrtypes.LifecyclePolicyNotFoundException{Message: aws.String("no policy")}
+
+		ignored, err := source.ECRIgnoredDigests(m, "some/image", digests, now)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(ignored).To(BeEmpty())
+	})
+
+	It("describes images in batches", func() {
+		source.AwsECRIgnoreTagStatus = []string{"scan_failed"}
+
+		var many []string
+		for i := 0; i < 150; i++ {
+			many = append(many, fmt.Sprintf("sha256:%d", i))
+		}
+
+		_, err := source.ECRIgnoredDigests(m, "some/image", many, now)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(m.describeImagesInputs).To(HaveLen(2))
+		Expect(m.describeImagesInputs[0].ImageIds).To(HaveLen(100))
+		Expect(m.describeImagesInputs[1].ImageIds).To(HaveLen(50))
+	})
+
+	It("rejects unknown statuses", func() {
+		source.AwsECRIgnoreTagStatus = []string{"bogus"}
+
+		_, err := source.ECRIgnoredDigests(m, "some/image", digests, now)
+		Expect(err).To(MatchError(ContainSubstring(`unknown aws_ecr_ignore_tag_status "bogus"`)))
+	})
+})
+
+var _ = Describe("AWSConfig", func() {
+	var tmp string
+	var server *ghttp.Server
+	var source resource.Source
+
+	var originalEnv map[string]*string
+
+	setEnv := func(key string, value string) {
+		if _, saved := originalEnv[key]; !saved {
+			if original, found := os.LookupEnv(key); found {
+				originalEnv[key] = &original
+			} else {
+				originalEnv[key] = nil
+			}
+		}
+
+		if value == "" {
+			os.Unsetenv(key)
+		} else {
+			os.Setenv(key, value)
+		}
+	}
+
+	credentials := func() aws.Credentials {
+		awsConfig, err := source.AWSConfig()
+		Expect(err).ToNot(HaveOccurred())
+
+		creds, err := awsConfig.Credentials.Retrieve(context.Background())
+		Expect(err).ToNot(HaveOccurred())
+
+		return creds
+	}
+
+	stsCredentials := func(action string, key string) string {
+		return fmt.Sprintf(`<%[1]sResponse xmlns="https://sts.amazonaws.com/doc/2011-06-15/">
+  <%[1]sResult>
+    <Credentials>
+      <AccessKeyId>%[2]s</AccessKeyId>
+      <SecretAccessKey>%[2]s-secret</SecretAccessKey>
+      <SessionToken>%[2]s-token</SessionToken>
+      <Expiration>2099-01-01T00:00:00Z</Expiration>
+    </Credentials>
+  </%[1]sResult>
+</%[1]sResponse>`, action, key)
+	}
+
+	BeforeEach(func() {
+		var err error
+		tmp, err = ioutil.TempDir("", "aws-config")
+		Expect(err).ToNot(HaveOccurred())
+
+		server = ghttp.NewServer()
+
+		originalEnv = map[string]*string{}
+
+		// isolate the credential chain from the environment running the tests
+		for _, key := range []string{
+			"AWS_ACCESS_KEY_ID",
+			"AWS_SECRET_ACCESS_KEY",
+			"AWS_SESSION_TOKEN",
+			"AWS_PROFILE",
+			"AWS_DEFAULT_PROFILE",
+			"AWS_ROLE_ARN",
+			"AWS_WEB_IDENTITY_TOKEN_FILE",
+			"AWS_CONTAINER_CREDENTIALS_FULL_URI",
+			"AWS_CONTAINER_CREDENTIALS_RELATIVE_URI",
+			"AWS_REGION",
+			"AWS_DEFAULT_REGION",
+			"AWS_ENDPOINT_URL",
+		} {
+			setEnv(key, "")
+		}
+
+		setEnv("HOME", tmp)
+		setEnv("AWS_CONFIG_FILE", filepath.Join(tmp, "config"))
+		setEnv("AWS_SHARED_CREDENTIALS_FILE", filepath.Join(tmp, "credentials"))
+		setEnv("AWS_EC2_METADATA_DISABLED", "true")
+		setEnv("AWS_ENDPOINT_URL_STS", server.URL())
+		setEnv("AWS_ENDPOINT_URL_SSO", server.URL())
+
+		source = resource.Source{
+			Repository: "some/image",
+			AwsCredentials: resource.AwsCredentials{
+				AwsRegion: "us-east-1",
+			},
+		}
+	})
+
+	AfterEach(func() {
+		for key, value := range originalEnv {
+			if value == nil {
+				os.Unsetenv(key)
+			} else {
+				os.Setenv(key, *value)
+			}
+		}
+
+		server.Close()
+		os.RemoveAll(tmp)
+	})
+
+	It("uses the source's static credentials", func() {
+		setEnv("AWS_ACCESS_KEY_ID", "env-key")
+		setEnv("AWS_SECRET_ACCESS_KEY", "env-secret")
+
+		source.AwsAccessKeyId = "source-key"
+		source.AwsSecretAccessKey = "source-secret"
+
+		Expect(credentials().AccessKeyID).To(Equal("source-key"))
+	})
+
+	It("assumes each role with the credentials of the one before it", func() {
+		source.AwsAccessKeyId = "source-key"
+		source.AwsSecretAccessKey = "source-secret"
+		source.AwsRoleArns = []string{
+			"arn:aws:iam::012345678901:role/first-role",
+			"arn:aws:iam::012345678901:role/second-role",
+		}
+
+		server.AppendHandlers(
+			ghttp.CombineHandlers(
+				ghttp.VerifyFormKV("Action", "AssumeRole"),
+				ghttp.VerifyFormKV("RoleArn", "arn:aws:iam::012345678901:role/first-role"),
+				verifySignedBy("source-key"),
+				ghttp.RespondWith(http.StatusOK, stsCredentials("AssumeRole", "first-role-key")),
+			),
+			ghttp.CombineHandlers(
+				ghttp.VerifyFormKV("Action", "AssumeRole"),
+				ghttp.VerifyFormKV("RoleArn", "arn:aws:iam::012345678901:role/second-role"),
+				verifySignedBy("first-role-key"),
+				ghttp.RespondWith(http.StatusOK, stsCredentials("AssumeRole", "second-role-key")),
+			),
+		)
+
+		Expect(credentials().AccessKeyID).To(Equal("second-role-key"))
+		Expect(server.ReceivedRequests()).To(HaveLen(2))
+	})
+
+	It("exchanges a web identity token file, e.g. with IRSA", func() {
+		tokenFile := filepath.Join(tmp, "token")
+		Expect(ioutil.WriteFile(tokenFile, []byte("some-web-identity-token"), 0600)).To(Succeed())
+
+		setEnv("AWS_WEB_IDENTITY_TOKEN_FILE", tokenFile)
+		setEnv("AWS_ROLE_ARN", "arn:aws:iam::012345678901:role/some-role")
+
+		server.AppendHandlers(
+			ghttp.CombineHandlers(
+				ghttp.VerifyFormKV("Action", "AssumeRoleWithWebIdentity"),
+				ghttp.VerifyFormKV("RoleArn", "arn:aws:iam::012345678901:role/some-role"),
+				ghttp.VerifyFormKV("WebIdentityToken", "some-web-identity-token"),
+				ghttp.RespondWith(http.StatusOK, stsCredentials("AssumeRoleWithWebIdentity", "web-identity-key")),
+			),
+		)
+
+		Expect(credentials().AccessKeyID).To(Equal("web-identity-key"))
+	})
+
+	It("runs a profile's credential_process", func() {
+		process := filepath.Join(tmp, "credential-process")
+		Expect(ioutil.WriteFile(process, []byte(`#!/bin/sh
+echo '{"Version": 1, "AccessKeyId": "process-key", "SecretAccessKey": "process-secret"}'
+`), 0755)).To(Succeed())
+
+		Expect(ioutil.WriteFile(filepath.Join(tmp, "config"), []byte(`[profile some-profile]
+credential_process = `+process+`
+`), 0600)).To(Succeed())
+
+		setEnv("AWS_PROFILE", "some-profile")
+
+		creds := credentials()
+		Expect(creds.AccessKeyID).To(Equal("process-key"))
+		Expect(creds.SecretAccessKey).To(Equal("process-secret"))
+	})
+
+	It("gets an SSO profile's role credentials with its cached token", func() {
+		startURL := "https://some-org.awsapps.com/start"
+
+		Expect(ioutil.WriteFile(filepath.Join(tmp, "config"), []byte(`[profile some-profile]
+sso_start_url = `+startURL+`
+sso_region = us-east-1
+sso_account_id = 012345678901
+sso_role_name = some-role
+`), 0600)).To(Succeed())
+
+		sum := sha1.Sum([]byte(startURL))
+		cache := filepath.Join(tmp, ".aws", "sso", "cache")
+		Expect(os.MkdirAll(cache, 0755)).To(Succeed())
+		Expect(ioutil.WriteFile(filepath.Join(cache, hex.EncodeToString(sum[:])+".json"), []byte(`{
+  "accessToken": "some-sso-token",
+  "expiresAt": "2099-01-01T00:00:00Z",
+  "region": "us-east-1",
+  "startUrl": "`+startURL+`"
+}`), 0600)).To(Succeed())
+
+		setEnv("AWS_PROFILE", "some-profile")
+
+		server.AppendHandlers(
+			ghttp.CombineHandlers(
+				ghttp.VerifyRequest("GET", "/federation/credentials", "account_id=012345678901&role_name=some-role"),
+				ghttp.VerifyHeaderKV("X-Amz-Sso_bearer_token", "some-sso-token"),
+				ghttp.RespondWith(http.StatusOK, `{"roleCredentials": {"accessKeyId": "sso-key", "secretAccessKey": "sso-secret", "sessionToken": "sso-token", "expiration": 4070908800000}}`),
+			),
+		)
+
+		Expect(credentials().AccessKeyID).To(Equal("sso-key"))
+	})
+})
+
+// verifySignedBy verifies that a request is signed with the AWS access key.
+func verifySignedBy(accessKeyID string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		Expect(r.Header.Get("Authorization")).To(ContainSubstring("Credential=" + accessKeyID + "/"))
+	}
+}
@@ -0,0 +1,161 @@
+package resource
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+)
+
+// ErrorCategory classifies a failure so that automation wrapping the resource
+// can tell them apart by exit code.
+type ErrorCategory string
+
+const (
+	// Anything not covered by the other categories.
+	CategoryUnknown ErrorCategory = "unknown"
+
+	// Invalid configuration or inputs, which won't succeed when retried.
+	CategoryValidation ErrorCategory = "validation"
+
+	// Missing or rejected credentials.
+	CategoryAuth ErrorCategory = "auth"
+
+	// The repository, tag, digest, or blob does not exist.
+	CategoryNotFound ErrorCategory = "not_found"
+
+	// The registry responded 429 Too Many Requests, even after retrying.
+	CategoryRateLimited ErrorCategory = "rate_limited"
+
+	// The registry could not be reached or timed out.
+	CategoryNetwork ErrorCategory = "network"
+)
+
+// ExitCode returns the exit code for the category.
+func (category ErrorCategory) ExitCode() int {
+	switch category {
+	case CategoryValidation:
+		return 2
+	case CategoryAuth:
+		return 3
+	case CategoryNotFound:
+		return 4
+	case CategoryRateLimited:
+		return 5
+	case CategoryNetwork:
+		return 6
+	default:
+		return 1
+	}
+}
+
+// CategorizedError is an error explicitly assigned a category, for failures
+// which can't be classified from the error itself.
+type CategorizedError struct {
+	Category ErrorCategory
+	Err      error
+}
+
+func (err CategorizedError) Error() string {
+	return err.Err.Error()
+}
+
+func (err CategorizedError) Unwrap() error {
+	return err.Err
+}
+
+// Categorize assigns a category to the error.
+func Categorize(category ErrorCategory, err error) error {
+	return CategorizedError{
+		Category: category,
+		Err:      err,
+	}
+}
+
+// Invalid returns a validation error.
+func Invalid(format string, a ...interface{}) error {
+	return Categorize(CategoryValidation, fmt.Errorf(format, a...))
+}
+
+// Categorized returns the category of the error, determined by the first of
+// an explicit category, a registry error, or a network error in its chain.
+func Categorized(err error) ErrorCategory {
+	var categorized CategorizedError
+	if errors.As(err, &categorized) {
+		return categorized.Category
+	}
+
+	var transportErr *transport.Error
+	if errors.As(err, &transportErr) {
+		return transportErrorCategory(transportErr)
+	}
+
+	if errors.Is(err, context.DeadlineExceeded) {
+		return CategoryNetwork
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return CategoryNetwork
+	}
+
+	return CategoryUnknown
+}
+
+func transportErrorCategory(err *transport.Error) ErrorCategory {
+	for _, diagnostic := range err.Errors {
+		switch diagnostic.Code {
+		case transport.UnauthorizedErrorCode, transport.DeniedErrorCode:
+			return CategoryAuth
+		case transport.NameUnknownErrorCode, transport.ManifestUnknownErrorCode, transport.BlobUnknownErrorCode:
+			return CategoryNotFound
+		case transport.TooManyRequestsErrorCode:
+			return CategoryRateLimited
+		}
+	}
+
+	switch err.StatusCode {
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return CategoryAuth
+	case http.StatusNotFound:
+		return CategoryNotFound
+	case http.StatusTooManyRequests:
+		return CategoryRateLimited
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return CategoryNetwork
+	default:
+		return CategoryUnknown
+	}
+}
+
+// ErrorResponse is written as the final line of output when a script fails.
+type ErrorResponse struct {
+	Error ErrorDetails `json:"error"`
+}
+
+type ErrorDetails struct {
+	Category ErrorCategory `json:"category"`
+	ExitCode int           `json:"exit_code"`
+	Message  string        `json:"message"`
+}
+
+// ReportError writes the categorized error as JSON and returns the exit code
+// to exit with.
+func ReportError(w io.Writer, err error) int {
+	category := Categorized(err)
+
+	_ = json.NewEncoder(w).Encode(ErrorResponse{
+		Error: ErrorDetails{
+			Category: category,
+			ExitCode: category.ExitCode(),
+			Message:  err.Error(),
+		},
+	})
+
+	return category.ExitCode()
+}
@@ -0,0 +1,60 @@
+package resource_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+
+	resource "github.com/concourse/registry-image-resource"
+)
+
+var _ = Describe("Errors", func() {
+	DescribeTable("categorizing errors",
+		func(err error, category resource.ErrorCategory) {
+			Expect(resource.Categorized(fmt.Errorf("wrapped: %w", err))).To(Equal(category))
+		},
+		Entry("validation", resource.Invalid("invalid semantic version: %q", "bogus"), resource.CategoryValidation),
+		Entry("explicit category", resource.Categorize(resource.CategoryAuth, fmt.Errorf("cannot authenticate with ECR")), resource.CategoryAuth),
+		Entry("unauthorized", &transport.Error{
+			StatusCode: http.StatusUnauthorized,
+		}, resource.CategoryAuth),
+		Entry("denied", &transport.Error{
+			StatusCode: http.StatusBadRequest,
+			Errors:     []transport.Diagnostic{{Code: transport.DeniedErrorCode}},
+		}, resource.CategoryAuth),
+		Entry("manifest unknown", &transport.Error{
+			StatusCode: http.StatusNotFound,
+			Errors:     []transport.Diagnostic{{Code: transport.ManifestUnknownErrorCode}},
+		}, resource.CategoryNotFound),
+		Entry("rate limited", &transport.Error{
+			StatusCode: http.StatusTooManyRequests,
+		}, resource.CategoryRateLimited),
+		Entry("unavailable", &transport.Error{
+			StatusCode: http.StatusServiceUnavailable,
+		}, resource.CategoryNetwork),
+		Entry("network", &net.OpError{Op: "dial", Err: fmt.Errorf("connection refused")}, resource.CategoryNetwork),
+		Entry("anything else", fmt.Errorf("something went wrong"), resource.CategoryUnknown),
+	)
+
+	It("reports the error as JSON with its exit code", func() {
+		buf := new(bytes.Buffer)
+
+		code := resource.ReportError(buf, resource.Invalid("no tag specified"))
+		Expect(code).To(Equal(2))
+
+		var res resource.ErrorResponse
+		Expect(json.Unmarshal(buf.Bytes(), &res)).To(Succeed())
+		Expect(res.Error).To(Equal(resource.ErrorDetails{
+			Category: resource.CategoryValidation,
+			ExitCode: 2,
+			Message:  "no tag specified",
+		}))
+	})
+})
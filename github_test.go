@@ -0,0 +1,118 @@
+package resource_test
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/ghttp"
+
+	resource "github.com/concourse/registry-image-resource"
+)
+
+var _ = Describe("GitHub authentication", func() {
+	var api *ghttp.Server
+	var key *rsa.PrivateKey
+	var source resource.Source
+
+	BeforeEach(func() {
+		api = ghttp.NewServer()
+
+		var err error
+		key, err = rsa.GenerateKey(rand.Reader, 2048)
+		Expect(err).ToNot(HaveOccurred())
+
+		source = resource.Source{
+			Repository: "ghcr.io/some-org/some-image",
+			GitHubApp: &resource.GitHubApp{
+				AppID:          1234,
+				InstallationID: 5678,
+				PrivateKey: string(pem.EncodeToMemory(&pem.Block{
+					Type:  "RSA PRIVATE KEY",
+					Bytes: x509.MarshalPKCS1PrivateKey(key),
+				})),
+				APIURL: api.URL(),
+			},
+		}
+	})
+
+	AfterEach(func() {
+		api.Close()
+	})
+
+	It("mints an installation token with a JWT signed by the app's key", func() {
+		api.AppendHandlers(ghttp.CombineHandlers(
+			ghttp.VerifyRequest("POST", "/app/installations/5678/access_tokens"),
+			ghttp.VerifyHeaderKV("Accept", "application/vnd.github+json"),
+			func(w http.ResponseWriter, r *http.Request) {
+				jwt := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+				parts := strings.Split(jwt, ".")
+				Expect(parts).To(HaveLen(3))
+
+				signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+				Expect(err).ToNot(HaveOccurred())
+
+				digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+				Expect(rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, digest[:], signature)).To(Succeed())
+
+				payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+				Expect(err).ToNot(HaveOccurred())
+
+				var claims struct {
+					Issuer int64 `json:"iss"`
+				}
+				Expect(json.Unmarshal(payload, &claims)).To(Succeed())
+				Expect(claims.Issuer).To(Equal(int64(1234)))
+			},
+			ghttp.RespondWith(http.StatusCreated, `{"token":"ghs_some-token","expires_at":"2030-01-01T00:00:00Z"}`),
+		))
+
+		err := source.AuthenticateToGitHub()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(source.Username).To(Equal("x-access-token"))
+		Expect(source.Password).To(Equal("ghs_some-token"))
+	})
+
+	It("fails with an auth error if the token cannot be minted", func() {
+		api.AppendHandlers(ghttp.RespondWith(http.StatusUnauthorized, `{"message":"A JSON web token could not be decoded"}`))
+
+		err := source.AuthenticateToGitHub()
+		Expect(err).To(HaveOccurred())
+		Expect(resource.Categorized(err)).To(Equal(resource.CategoryAuth))
+	})
+
+	It("uses a github_token as the password", func() {
+		source.GitHubApp = nil
+		source.GitHubToken = "some-token"
+
+		err := source.AuthenticateToGitHub()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(source.Username).To(Equal("x-access-token"))
+		Expect(source.Password).To(Equal("some-token"))
+	})
+
+	It("rejects a github_token alongside a github_app", func() {
+		source.GitHubToken = "some-token"
+
+		err := source.AuthenticateToGitHub()
+		Expect(err).To(MatchError(ContainSubstring("cannot specify both")))
+	})
+
+	It("rejects a username and password alongside a github_token", func() {
+		source.GitHubApp = nil
+		source.GitHubToken = "some-token"
+		source.Username = "some-user"
+
+		err := source.AuthenticateToGitHub()
+		Expect(err).To(MatchError(ContainSubstring("cannot specify 'username' or 'password'")))
+	})
+})
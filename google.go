@@ -0,0 +1,336 @@
+package resource
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+)
+
+// GoogleIAMCredentialsAPI is the API with which service accounts are
+// impersonated.
+const GoogleIAMCredentialsAPI = "https://iamcredentials.googleapis.com"
+
+// googleCloudPlatformScope is the scope of the access tokens minted, which
+// covers both Artifact Registry and Container Registry.
+const googleCloudPlatformScope = "https://www.googleapis.com/auth/cloud-platform"
+
+// googleTokenUsername is the username given along with an OAuth2 access token
+// to Google's registries.
+const googleTokenUsername = "oauth2accesstoken"
+
+// GoogleAuth configures how to mint an OAuth2 access token for Artifact
+// Registry (*.pkg.dev) or Container Registry (*.gcr.io).
+type GoogleAuth struct {
+	// Credentials is the JSON of a service account key or of a workload
+	// identity federation (external account) configuration.
+	Credentials string `json:"credentials,omitempty"`
+
+	// AccessToken is an access token to use, or to impersonate a service
+	// account with.
+	AccessToken string `json:"access_token,omitempty"`
+
+	// ImpersonateServiceAccount is the email of a service account to
+	// impersonate with the credentials or access token.
+	ImpersonateServiceAccount string `json:"impersonate_service_account,omitempty"`
+}
+
+// googleCredentials is the subset of a service account key or external
+// account configuration needed to mint an access token.
+type googleCredentials struct {
+	Type string `json:"type"`
+
+	// service_account
+	ClientEmail string `json:"client_email"`
+	PrivateKey  string `json:"private_key"`
+	TokenURI    string `json:"token_uri"`
+
+	// external_account
+	Audience                       string                  `json:"audience"`
+	SubjectTokenType               string                  `json:"subject_token_type"`
+	TokenURL                       string                  `json:"token_url"`
+	ServiceAccountImpersonationURL string                  `json:"service_account_impersonation_url"`
+	CredentialSource               *googleCredentialSource `json:"credential_source"`
+}
+
+// googleCredentialSource is where an external account's subject token, e.g.
+// an OIDC token issued to the build, is read from.
+type googleCredentialSource struct {
+	File    string            `json:"file"`
+	URL     string            `json:"url"`
+	Headers map[string]string `json:"headers"`
+	Format  struct {
+		Type                  string `json:"type"`
+		SubjectTokenFieldName string `json:"subject_token_field_name"`
+	} `json:"format"`
+}
+
+// AuthenticateToGoogle sets the source's credentials to an access token
+// minted per its google_auth, if configured.
+func (source *Source) AuthenticateToGoogle() error {
+	if source.GoogleAuth == nil {
+		return nil
+	}
+
+	if source.Username != "" || source.Password != "" {
+		return Invalid("cannot specify 'username' or 'password' with 'google_auth'")
+	}
+
+	token, err := GoogleAccessToken(*source.GoogleAuth, GoogleIAMCredentialsAPI)
+	if err != nil {
+		return Categorize(CategoryAuth, fmt.Errorf("cannot authenticate with Google: %w", err))
+	}
+
+	source.Username = googleTokenUsername
+	source.Password = token
+
+	return nil
+}
+
+// GoogleAccessToken mints an access token per the auth, impersonating a
+// service account with the given IAM Credentials API if configured.
+func GoogleAccessToken(auth GoogleAuth, iamAPI string) (string, error) {
+	if (auth.Credentials == "") == (auth.AccessToken == "") {
+		return "", Invalid("google_auth requires one of 'credentials' or 'access_token'")
+	}
+
+	client := &http.Client{Timeout: 30 * time.Second}
+
+	token := auth.AccessToken
+	if auth.Credentials != "" {
+		var creds googleCredentials
+		err := json.Unmarshal([]byte(auth.Credentials), &creds)
+		if err != nil {
+			return "", Invalid("invalid google_auth credentials: %s", err)
+		}
+
+		switch creds.Type {
+		case "service_account":
+			token, err = googleServiceAccountToken(client, creds, time.Now())
+		case "external_account":
+			token, err = googleExternalAccountToken(client, creds)
+		default:
+			return "", Invalid("unsupported google_auth credentials type %q (must be 'service_account' or 'external_account')", creds.Type)
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+
+	if auth.ImpersonateServiceAccount != "" {
+		endpoint := fmt.Sprintf("%s/v1/projects/-/serviceAccounts/%s:generateAccessToken", strings.TrimSuffix(iamAPI, "/"), auth.ImpersonateServiceAccount)
+
+		var err error
+		token, err = googleImpersonate(client, endpoint, token)
+		if err != nil {
+			return "", fmt.Errorf("impersonate %s: %w", auth.ImpersonateServiceAccount, err)
+		}
+	}
+
+	return token, nil
+}
+
+// googleServiceAccountToken exchanges a JWT signed with the service account's
+// key for an access token.
+func googleServiceAccountToken(client *http.Client, creds googleCredentials, now time.Time) (string, error) {
+	key, err := parseRSAPrivateKey(creds.PrivateKey)
+	if err != nil {
+		return "", Invalid("invalid google_auth service account private_key: %s", err)
+	}
+
+	assertion, err := signJWT(key, map[string]interface{}{
+		"iss":   creds.ClientEmail,
+		"scope": googleCloudPlatformScope,
+		"aud":   creds.TokenURI,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "urn:ietf:params:oauth:grant-type:jwt-bearer")
+	form.Set("assertion", assertion)
+
+	req, err := http.NewRequestWithContext(RequestContext(), http.MethodPost, creds.TokenURI, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	token, err := googleTokenRequest(client, req)
+	if err != nil {
+		return "", fmt.Errorf("service account %s: %w", creds.ClientEmail, err)
+	}
+
+	return token, nil
+}
+
+// googleExternalAccountToken exchanges the external account's subject token
+// for a federated access token with the Security Token Service, and then for
+// a service account's access token if the configuration impersonates one.
+func googleExternalAccountToken(client *http.Client, creds googleCredentials) (string, error) {
+	if creds.CredentialSource == nil {
+		return "", Invalid("google_auth external account credentials have no 'credential_source'")
+	}
+
+	subjectToken, err := creds.CredentialSource.subjectToken(client)
+	if err != nil {
+		return "", fmt.Errorf("read subject token: %w", err)
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "urn:ietf:params:oauth:grant-type:token-exchange")
+	form.Set("audience", creds.Audience)
+	form.Set("scope", googleCloudPlatformScope)
+	form.Set("requested_token_type", "urn:ietf:params:oauth:token-type:access_token")
+	form.Set("subject_token_type", creds.SubjectTokenType)
+	form.Set("subject_token", subjectToken)
+
+	req, err := http.NewRequestWithContext(RequestContext(), http.MethodPost, creds.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	token, err := googleTokenRequest(client, req)
+	if err != nil {
+		return "", fmt.Errorf("exchange subject token: %w", err)
+	}
+
+	if creds.ServiceAccountImpersonationURL == "" {
+		return token, nil
+	}
+
+	token, err = googleImpersonate(client, creds.ServiceAccountImpersonationURL, token)
+	if err != nil {
+		return "", fmt.Errorf("impersonate service account: %w", err)
+	}
+
+	return token, nil
+}
+
+// subjectToken reads the subject token from the file or URL, taking it from a
+// field of a JSON response if so formatted.
+func (source *googleCredentialSource) subjectToken(client *http.Client) (string, error) {
+	var content []byte
+	switch {
+	case source.File != "":
+		var err error
+		content, err = ioutil.ReadFile(source.File)
+		if err != nil {
+			return "", err
+		}
+	case source.URL != "":
+		req, err := http.NewRequestWithContext(RequestContext(), http.MethodGet, source.URL, nil)
+		if err != nil {
+			return "", err
+		}
+
+		for key, value := range source.Headers {
+			req.Header.Set(key, value)
+		}
+
+		res, err := client.Do(req)
+		if err != nil {
+			return "", err
+		}
+
+		defer res.Body.Close()
+
+		err = transport.CheckError(res, http.StatusOK)
+		if err != nil {
+			return "", err
+		}
+
+		content, err = ioutil.ReadAll(res.Body)
+		if err != nil {
+			return "", err
+		}
+	default:
+		return "", Invalid("google_auth credential_source must have a 'file' or 'url'")
+	}
+
+	if source.Format.Type != "json" {
+		return strings.TrimSpace(string(content)), nil
+	}
+
+	var fields map[string]interface{}
+	err := json.Unmarshal(content, &fields)
+	if err != nil {
+		return "", fmt.Errorf("parse subject token: %w", err)
+	}
+
+	token, ok := fields[source.Format.SubjectTokenFieldName].(string)
+	if !ok {
+		return "", fmt.Errorf("subject token has no %q field", source.Format.SubjectTokenFieldName)
+	}
+
+	return token, nil
+}
+
+// googleImpersonate exchanges an access token for one of the service account
+// whose generateAccessToken URL is given.
+func googleImpersonate(client *http.Client, endpoint string, token string) (string, error) {
+	payload, err := json.Marshal(map[string]interface{}{
+		"scope": []string{googleCloudPlatformScope},
+	})
+	if err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequestWithContext(RequestContext(), http.MethodPost, endpoint, bytes.NewReader(payload))
+	if err != nil {
+		return "", err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	return googleTokenRequest(client, req)
+}
+
+// googleTokenRequest sends a request for an access token, which is in the
+// response's access_token field, or accessToken for the IAM Credentials API.
+func googleTokenRequest(client *http.Client, req *http.Request) (string, error) {
+	res, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+
+	defer res.Body.Close()
+
+	err = transport.CheckError(res, http.StatusOK)
+	if err != nil {
+		return "", err
+	}
+
+	var body struct {
+		AccessToken    string `json:"access_token"`
+		IAMAccessToken string `json:"accessToken"`
+	}
+
+	err = json.NewDecoder(res.Body).Decode(&body)
+	if err != nil {
+		return "", fmt.Errorf("decode token: %w", err)
+	}
+
+	if body.AccessToken != "" {
+		return body.AccessToken, nil
+	}
+
+	if body.IAMAccessToken != "" {
+		return body.IAMAccessToken, nil
+	}
+
+	return "", fmt.Errorf("no access token in response")
+}
@@ -0,0 +1,110 @@
+package resource
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// tracedRequestHeaders and tracedResponseHeaders are the headers worth seeing
+// when diagnosing proxy, auth, and mirror issues.
+var tracedRequestHeaders = []string{
+	"Authorization",
+	"Accept",
+	"Content-Type",
+	"Content-Length",
+	"Range",
+}
+
+var tracedResponseHeaders = []string{
+	"Content-Type",
+	"Content-Length",
+	"Docker-Content-Digest",
+	"Docker-Distribution-Api-Version",
+	"Location",
+	"Www-Authenticate",
+	"Retry-After",
+	"Ratelimit-Limit",
+	"Ratelimit-Remaining",
+	"Via",
+}
+
+// query parameters containing these are redacted, e.g. the signatures of
+// presigned blob URLs
+var secretQueryParams = []string{"sig", "token", "credential", "key", "secret", "password"}
+
+// TraceTransport writes a line for every request made through it and its
+// response, with key headers, redacting credentials.
+type TraceTransport struct {
+	Inner http.RoundTripper
+	Out   io.Writer
+}
+
+func (t *TraceTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	reqURL := redactURL(req.URL)
+
+	fmt.Fprintf(t.Out, "http: --> %s %s\n", req.Method, reqURL)
+	t.writeHeaders(req.Header, tracedRequestHeaders)
+
+	start := time.Now()
+
+	res, err := t.Inner.RoundTrip(req)
+	if err != nil {
+		fmt.Fprintf(t.Out, "http: <-- %s %s failed after %s: %s\n", req.Method, reqURL, time.Since(start).Round(time.Millisecond), err)
+		return nil, err
+	}
+
+	fmt.Fprintf(t.Out, "http: <-- %s %s %s (%s)\n", res.Status, req.Method, reqURL, time.Since(start).Round(time.Millisecond))
+	t.writeHeaders(res.Header, tracedResponseHeaders)
+
+	return res, nil
+}
+
+func (t *TraceTransport) writeHeaders(header http.Header, names []string) {
+	for _, name := range names {
+		for _, value := range header.Values(name) {
+			if name == "Authorization" {
+				// keep the scheme, e.g. 'Bearer', which helps diagnose auth issues
+				scheme, _, _ := strings.Cut(value, " ")
+				value = scheme + " REDACTED"
+			} else if name == "Location" {
+				value = redactLocation(value)
+			}
+
+			fmt.Fprintf(t.Out, "http:     %s: %s\n", name, value)
+		}
+	}
+}
+
+func redactLocation(location string) string {
+	u, err := url.Parse(location)
+	if err != nil {
+		return "REDACTED"
+	}
+
+	return redactURL(u)
+}
+
+func redactURL(u *url.URL) string {
+	redacted := *u
+
+	query := redacted.Query()
+	for param := range query {
+		lower := strings.ToLower(param)
+		for _, secret := range secretQueryParams {
+			if strings.Contains(lower, secret) {
+				query.Set(param, "REDACTED")
+				break
+			}
+		}
+	}
+
+	if len(query) > 0 {
+		redacted.RawQuery = query.Encode()
+	}
+
+	return redacted.Redacted()
+}
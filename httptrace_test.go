@@ -0,0 +1,58 @@
+package resource_test
+
+import (
+	"bytes"
+	"net/http"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/ghttp"
+
+	resource "github.com/concourse/registry-image-resource"
+)
+
+var _ = Describe("TraceTransport", func() {
+	var registry *ghttp.Server
+	var out *bytes.Buffer
+	var client *http.Client
+
+	BeforeEach(func() {
+		registry = ghttp.NewServer()
+		registry.RouteToHandler("GET", "/v2/some/repo/blobs/sha256:abc", ghttp.RespondWith(http.StatusTemporaryRedirect, "", http.Header{
+			"Location": {"https://storage.example.com/blob?X-Amz-Signature=some-signature&X-Amz-Expires=300"},
+		}))
+
+		out = new(bytes.Buffer)
+		client = &http.Client{
+			Transport: &resource.TraceTransport{
+				Inner: http.DefaultTransport,
+				Out:   out,
+			},
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		}
+	})
+
+	AfterEach(func() {
+		registry.Close()
+	})
+
+	It("writes each request and response with secrets redacted", func() {
+		req, err := http.NewRequest("GET", registry.URL()+"/v2/some/repo/blobs/sha256:abc", nil)
+		Expect(err).ToNot(HaveOccurred())
+
+		req.Header.Set("Authorization", "Bearer some-token")
+
+		res, err := client.Do(req)
+		Expect(err).ToNot(HaveOccurred())
+		res.Body.Close()
+
+		Expect(out.String()).To(ContainSubstring("http: --> GET " + registry.URL() + "/v2/some/repo/blobs/sha256:abc\n"))
+		Expect(out.String()).To(ContainSubstring("Authorization: Bearer REDACTED\n"))
+		Expect(out.String()).To(ContainSubstring("http: <-- 307 Temporary Redirect GET "))
+		Expect(out.String()).To(ContainSubstring("Location: https://storage.example.com/blob?X-Amz-Expires=300&X-Amz-Signature=REDACTED\n"))
+		Expect(out.String()).ToNot(ContainSubstring("some-token"))
+		Expect(out.String()).ToNot(ContainSubstring("some-signature"))
+	})
+})
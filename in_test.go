@@ -1,21 +1,45 @@
 package resource_test
 
 import (
+	"archive/tar"
 	"bytes"
+	"compress/gzip"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"encoding/pem"
+	"io"
 	"io/ioutil"
+	"math/big"
 	"net/http"
+	"net/http/httptest"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"syscall"
 	"time"
 
+	"github.com/google/go-containerregistry/pkg/compression"
 	"github.com/google/go-containerregistry/pkg/name"
 	v1 "github.com/google/go-containerregistry/pkg/v1"
 	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/static"
 	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/klauspost/compress/zstd"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 	"github.com/onsi/gomega/ghttp"
@@ -25,8 +49,9 @@ import (
 
 var _ = Describe("In", func() {
 	var (
-		actualErr error
-		destDir   string
+		actualErr       error
+		actualErrOutput string
+		destDir         string
 	)
 
 	var req struct {
@@ -69,12 +94,14 @@ var _ = Describe("In", func() {
 		Expect(err).ToNot(HaveOccurred())
 
 		outBuf := new(bytes.Buffer)
+		errBuf := new(bytes.Buffer)
 
 		cmd.Stdin = bytes.NewBuffer(payload)
 		cmd.Stdout = outBuf
-		cmd.Stderr = GinkgoWriter
+		cmd.Stderr = io.MultiWriter(GinkgoWriter, errBuf)
 
 		actualErr = cmd.Run()
+		actualErrOutput = errBuf.String()
 		if actualErr == nil {
 			err = json.Unmarshal(outBuf.Bytes(), &res)
 			Expect(err).ToNot(HaveOccurred())
@@ -110,6 +137,22 @@ var _ = Describe("In", func() {
 				"FOO=1",
 			}))
 		})
+
+		It("saves the raw manifest and config", func() {
+			Expect(actualErr).ToNot(HaveOccurred())
+
+			var manifest v1.Manifest
+			md, err := ioutil.ReadFile(filepath.Join(destDir, "manifest.json"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(json.Unmarshal(md, &manifest)).To(Succeed())
+			Expect(manifest.Layers).ToNot(BeEmpty())
+
+			var config v1.ConfigFile
+			cfg, err := ioutil.ReadFile(filepath.Join(destDir, "config.json"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(json.Unmarshal(cfg, &config)).To(Succeed())
+			Expect(config.Config.User).To(Equal("someuser"))
+		})
 	})
 
 	Describe("response metadata", func() {
@@ -125,16 +168,16 @@ var _ = Describe("In", func() {
 			Expect(actualErr).ToNot(HaveOccurred())
 
 			Expect(res.Version).To(Equal(req.Version))
-			Expect(res.Metadata).To(Equal([]resource.MetadataField{
-				{
+			Expect(res.Metadata).To(ConsistOf(append([]interface{}{
+				resource.MetadataField{
 					Name:  "repository",
 					Value: "concourse/test-image-metadata",
 				},
-				{
+				resource.MetadataField{
 					Name:  "tag",
 					Value: "latest",
 				},
-			}))
+			}, transferMetadata()...)...))
 		})
 	})
 
@@ -174,6 +217,28 @@ var _ = Describe("In", func() {
 			Expect(sys.Uid).To(Equal(uint32(1000)))
 			Expect(sys.Gid).To(Equal(uint32(1000)))
 		})
+
+		Context("with rootfs_owner", func() {
+			BeforeEach(func() {
+				if os.Geteuid() != 0 {
+					Skip("Must be run as root to validate file ownership")
+				}
+
+				req.Params.RootfsOwner = &resource.RootfsOwner{
+					UID: 2000,
+					GID: 3000,
+				}
+			})
+
+			It("chowns the files to the owner", func() {
+				Expect(actualErr).ToNot(HaveOccurred())
+
+				sys, ok := stat.Sys().(*syscall.Stat_t)
+				Expect(ok).To(BeTrue())
+				Expect(sys.Uid).To(Equal(uint32(2000)))
+				Expect(sys.Gid).To(Equal(uint32(3000)))
+			})
+		})
 	})
 
 	Describe("removed files in layers", func() {
@@ -219,215 +284,2186 @@ var _ = Describe("In", func() {
 			Expect(err).ToNot(HaveOccurred())
 			Expect(stat.IsDir()).To(BeTrue())
 
-			stat, err = os.Stat(rootfsPath("top-dir-2"))
-			Expect(err).To(HaveOccurred())
+			stat, err = os.Stat(rootfsPath("top-dir-2"))
+			Expect(err).To(HaveOccurred())
+
+			infos, err = ioutil.ReadDir(rootfsPath("top-dir-3"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(infos).To(HaveLen(1))
+
+			stat, err = os.Stat(rootfsPath("top-dir-3", "nested-dir"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(stat.IsDir()).To(BeTrue())
+
+			stat, err = os.Stat(rootfsPath("top-dir-4"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(stat.IsDir()).To(BeTrue())
+
+			if os.Geteuid() != 0 {
+				Skip("Must be run as root to validate file ownership")
+			}
+			sys, ok := stat.Sys().(*syscall.Stat_t)
+			Expect(ok).To(BeTrue())
+			Expect(sys.Uid).To(Equal(uint32(1000)))
+			Expect(sys.Gid).To(Equal(uint32(1000)))
+		})
+	})
+
+	Describe("a hardlink that is later removed", func() {
+		BeforeEach(func() {
+			req.Source.Repository = "concourse/test-image-removed-hardlinks"
+			req.Version = resource.Version{
+				Tag:    "latest",
+				Digest: latestDigest(req.Source.Repository),
+			}
+		})
+
+		It("works", func() {
+			Expect(actualErr).ToNot(HaveOccurred())
+
+			lstat, err := os.Lstat(rootfsPath("usr", "libexec", "git-core", "git"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(lstat.Mode() & os.ModeSymlink).To(BeZero())
+
+			stat, err := os.Stat(rootfsPath("usr", "libexec", "git-core", "git"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(stat.Mode() & os.ModeSymlink).To(BeZero())
+		})
+	})
+
+	Describe("layers that replace symlinks with regular files", func() {
+		BeforeEach(func() {
+			req.Source.Repository = "concourse/test-image-symlinks"
+			req.Version = resource.Version{
+				Tag:    "latest",
+				Digest: latestDigest(req.Source.Repository),
+			}
+		})
+
+		It("removes the symlink and writes to a new file rather than trying to open and write to it (thereby overwriting its target)", func() {
+			Expect(actualErr).ToNot(HaveOccurred())
+
+			Expect(cat(rootfsPath("a"))).To(Equal("symlinked\n"))
+			Expect(cat(rootfsPath("b"))).To(Equal("replaced\n"))
+		})
+	})
+
+	Describe("fetching from a private repository with credentials", func() {
+		BeforeEach(func() {
+			req.Source = resource.Source{
+				Repository: dockerPrivateRepo,
+				Tag:        "latest",
+
+				BasicCredentials: resource.BasicCredentials{
+					Username: dockerPrivateUsername,
+					Password: dockerPrivatePassword,
+				},
+			}
+
+			checkDockerPrivateUserConfigured()
+
+			req.Version = resource.Version{
+				Tag:    "latest",
+				Digest: PRIVATE_LATEST_STATIC_DIGEST,
+			}
+		})
+
+		It("works", func() {
+			Expect(actualErr).ToNot(HaveOccurred())
+
+			Expect(cat(rootfsPath("Dockerfile"))).To(ContainSubstring("hello!"))
+		})
+	})
+
+	Describe("fetching in OCI format", func() {
+		var manifest *v1.Manifest
+
+		BeforeEach(func() {
+			req.Source.Repository = "concourse/test-image-static"
+			req.Params.RawFormat = "oci"
+
+			req.Version.Tag = "latest"
+			req.Version.Digest, manifest = latestManifest(req.Source.Repository)
+		})
+
+		It("saves the tagged image as image.tar instead of saving the rootfs", func() {
+			Expect(actualErr).ToNot(HaveOccurred())
+
+			_, err := os.Stat(filepath.Join(destDir, "rootfs"))
+			Expect(os.IsNotExist(err)).To(BeTrue())
+
+			tag, err := name.NewTag("concourse/test-image-static:latest")
+			Expect(err).ToNot(HaveOccurred())
+
+			img, err := tarball.ImageFromPath(filepath.Join(destDir, "image.tar"), &tag)
+			Expect(err).ToNot(HaveOccurred())
+
+			fetchedManifest, err := img.Manifest()
+			Expect(err).ToNot(HaveOccurred())
+
+			// cannot assert against digest because the saved image's manifest isn't
+			// JSON-prettified, so it has a different sha256. so just assert against
+			// digest within manifest, which is what ends up being the 'image id'
+			// anyway.
+			Expect(fetchedManifest.Config.Digest).To(Equal(manifest.Config.Digest))
+		})
+	})
+
+	Describe("fetching in containerd format", func() {
+		var registry *ghttp.Server
+
+		BeforeEach(func() {
+			registry = ghttp.NewServer()
+
+			image, err := random.Image(1024, 2)
+			Expect(err).ToNot(HaveOccurred())
+
+			req.Source.Repository = registry.Addr() + "/some/fake-image"
+			req.Params.RawFormat = "containerd"
+
+			req.Version.Tag = "latest"
+			req.Version.Digest = serveImage(registry, "some/fake-image", "latest", image)
+		})
+
+		AfterEach(func() {
+			registry.Close()
+		})
+
+		It("saves the image as an annotated OCI archive with its name alongside", func() {
+			Expect(actualErr).ToNot(HaveOccurred())
+
+			_, err := os.Stat(filepath.Join(destDir, "rootfs"))
+			Expect(os.IsNotExist(err)).To(BeTrue())
+
+			imageName := registry.Addr() + "/some/fake-image:latest"
+			Expect(cat(filepath.Join(destDir, "image-name"))).To(Equal(imageName))
+
+			archive, err := os.Open(filepath.Join(destDir, "image.tar"))
+			Expect(err).ToNot(HaveOccurred())
+
+			defer archive.Close()
+
+			var index v1.IndexManifest
+
+			tr := tar.NewReader(archive)
+			for {
+				hdr, err := tr.Next()
+				if err == io.EOF {
+					break
+				}
+				Expect(err).ToNot(HaveOccurred())
+
+				if hdr.Name == "index.json" {
+					Expect(json.NewDecoder(tr).Decode(&index)).To(Succeed())
+				}
+			}
+
+			Expect(index.Manifests).To(HaveLen(1))
+			Expect(index.Manifests[0].Annotations).To(Equal(map[string]string{
+				"io.containerd.image.name":          imageName,
+				"org.opencontainers.image.ref.name": "latest",
+			}))
+
+			_, err = os.Stat(filepath.Join(destDir, "labels.json"))
+			Expect(err).ToNot(HaveOccurred())
+		})
+	})
+
+	Describe("fetching in oci-archive format", func() {
+		var registry *ghttp.Server
+		var image v1.Image
+
+		BeforeEach(func() {
+			registry = ghttp.NewServer()
+
+			var err error
+			image, err = random.Image(1024, 2)
+			Expect(err).ToNot(HaveOccurred())
+
+			req.Source.Repository = registry.Addr() + "/some/fake-image"
+			req.Params.RawFormat = "oci-archive"
+
+			req.Version.Tag = "latest"
+			req.Version.Digest = serveImage(registry, "some/fake-image", "latest", image)
+		})
+
+		AfterEach(func() {
+			registry.Close()
+		})
+
+		It("saves the image as a tarball of an OCI layout", func() {
+			Expect(actualErr).ToNot(HaveOccurred())
+
+			archive, err := os.Open(filepath.Join(destDir, "image.tar"))
+			Expect(err).ToNot(HaveOccurred())
+
+			defer archive.Close()
+
+			var index v1.IndexManifest
+			entries := []string{}
+
+			tr := tar.NewReader(archive)
+			for {
+				hdr, err := tr.Next()
+				if err == io.EOF {
+					break
+				}
+				Expect(err).ToNot(HaveOccurred())
+
+				entries = append(entries, hdr.Name)
+
+				if hdr.Name == "index.json" {
+					Expect(json.NewDecoder(tr).Decode(&index)).To(Succeed())
+				}
+			}
+
+			digest, err := image.Digest()
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(entries).To(ContainElement("oci-layout"))
+			Expect(entries).To(ContainElement("blobs/sha256/" + digest.Hex))
+
+			Expect(index.Manifests).To(HaveLen(1))
+			Expect(index.Manifests[0].Digest).To(Equal(digest))
+			Expect(index.Manifests[0].Annotations).To(Equal(map[string]string{
+				"org.opencontainers.image.ref.name": "latest",
+			}))
+		})
+	})
+
+	Describe("fetching in rootfs-tgz format", func() {
+		var registry *ghttp.Server
+		var image v1.Image
+
+		BeforeEach(func() {
+			registry = ghttp.NewServer()
+
+			var err error
+			image, err = random.Image(1024, 2)
+			Expect(err).ToNot(HaveOccurred())
+
+			req.Source.Repository = registry.Addr() + "/some/fake-image"
+			req.Params.RawFormat = "rootfs-tgz"
+
+			req.Version.Tag = "latest"
+			req.Version.Digest = serveImage(registry, "some/fake-image", "latest", image)
+		})
+
+		AfterEach(func() {
+			registry.Close()
+		})
+
+		flattenedFiles := func() []string {
+			fs := mutate.Extract(image)
+			defer fs.Close()
+
+			return tarEntries(fs)
+		}
+
+		It("saves the flattened rootfs as a gzipped tarball", func() {
+			Expect(actualErr).ToNot(HaveOccurred())
+
+			_, err := os.Stat(rootfsPath())
+			Expect(os.IsNotExist(err)).To(BeTrue())
+
+			archive, err := os.Open(filepath.Join(destDir, "rootfs.tar.gz"))
+			Expect(err).ToNot(HaveOccurred())
+
+			defer archive.Close()
+
+			gr, err := gzip.NewReader(archive)
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(tarEntries(gr)).To(Equal(flattenedFiles()))
+
+			_, err = os.Stat(filepath.Join(destDir, "metadata.json"))
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		Context("with zstd compression", func() {
+			BeforeEach(func() {
+				req.Params.RawCompression = "zstd"
+			})
+
+			It("saves the flattened rootfs as a zstd tarball", func() {
+				Expect(actualErr).ToNot(HaveOccurred())
+
+				archive, err := os.Open(filepath.Join(destDir, "rootfs.tar.zst"))
+				Expect(err).ToNot(HaveOccurred())
+
+				defer archive.Close()
+
+				zr, err := zstd.NewReader(archive)
+				Expect(err).ToNot(HaveOccurred())
+
+				defer zr.Close()
+
+				Expect(tarEntries(zr)).To(Equal(flattenedFiles()))
+			})
+		})
+	})
+
+	Describe("fetching with rewrite_absolute_symlinks", func() {
+		var registry *ghttp.Server
+
+		BeforeEach(func() {
+			registry = ghttp.NewServer()
+
+			buf := new(bytes.Buffer)
+			tw := tar.NewWriter(buf)
+			for _, hdr := range []*tar.Header{
+				{Name: "bin/bash", Typeflag: tar.TypeReg, Mode: 0755},
+				{Name: "usr/bin/sh", Typeflag: tar.TypeSymlink, Linkname: "/bin/bash", Mode: 0777},
+				{Name: "usr/bin/bash", Typeflag: tar.TypeSymlink, Linkname: "../../bin/bash", Mode: 0777},
+			} {
+				Expect(tw.WriteHeader(hdr)).To(Succeed())
+			}
+			Expect(tw.Close()).To(Succeed())
+
+			layer, err := tarball.LayerFromReader(buf)
+			Expect(err).ToNot(HaveOccurred())
+
+			image, err := mutate.AppendLayers(empty.Image, layer)
+			Expect(err).ToNot(HaveOccurred())
+
+			req.Source.Repository = registry.Addr() + "/some/fake-image"
+			req.Params.RewriteAbsoluteSymlinks = true
+
+			req.Version.Tag = "latest"
+			req.Version.Digest = serveImage(registry, "some/fake-image", "latest", image)
+		})
+
+		AfterEach(func() {
+			registry.Close()
+		})
+
+		It("rewrites absolute symlinks to be relative to the rootfs", func() {
+			Expect(actualErr).ToNot(HaveOccurred())
+
+			target, err := os.Readlink(rootfsPath("usr", "bin", "sh"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(target).To(Equal("../../bin/bash"))
+
+			target, err = os.Readlink(rootfsPath("usr", "bin", "bash"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(target).To(Equal("../../bin/bash"))
+
+			Expect(rootfsPath("usr", "bin", "sh")).To(BeARegularFile())
+		})
+	})
+
+	Describe("fetching an image with zstd and eStargz layers", func() {
+		var registry *ghttp.Server
+
+		BeforeEach(func() {
+			registry = ghttp.NewServer()
+
+			layerTar := func(name string) *bytes.Buffer {
+				buf := new(bytes.Buffer)
+				tw := tar.NewWriter(buf)
+				Expect(tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: 5})).To(Succeed())
+				_, err := tw.Write([]byte("hello"))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(tw.Close()).To(Succeed())
+				return buf
+			}
+
+			zstdLayer, err := tarball.LayerFromReader(
+				layerTar("zstd-file"),
+				tarball.WithCompression(compression.ZStd),
+				tarball.WithMediaType(types.OCILayerZStd),
+			)
+			Expect(err).ToNot(HaveOccurred())
+
+			// a file which only has special meaning in an eStargz layer
+			gzipLayer, err := tarball.LayerFromReader(layerTar(".no.prefetch.landmark"))
+			Expect(err).ToNot(HaveOccurred())
+
+			estargzLayer, err := tarball.LayerFromReader(layerTar("estargz-file"), tarball.WithEstargz)
+			Expect(err).ToNot(HaveOccurred())
+
+			image, err := mutate.AppendLayers(empty.Image, zstdLayer, gzipLayer, estargzLayer)
+			Expect(err).ToNot(HaveOccurred())
+
+			req.Source.Repository = registry.Addr() + "/some/fake-image"
+
+			req.Version.Tag = "latest"
+			req.Version.Digest = serveImage(registry, "some/fake-image", "latest", image)
+		})
+
+		AfterEach(func() {
+			registry.Close()
+		})
+
+		It("extracts every layer, leaving out the eStargz layer's lazy pulling metadata", func() {
+			Expect(actualErr).ToNot(HaveOccurred())
+
+			Expect(ioutil.ReadFile(rootfsPath("zstd-file"))).To(Equal([]byte("hello")))
+			Expect(ioutil.ReadFile(rootfsPath("estargz-file"))).To(Equal([]byte("hello")))
+			Expect(ioutil.ReadFile(rootfsPath(".no.prefetch.landmark"))).To(Equal([]byte("hello")))
+
+			_, err := os.Stat(rootfsPath("stargz.index.json"))
+			Expect(os.IsNotExist(err)).To(BeTrue())
+		})
+	})
+
+	Describe("fetching a schema 1 image", func() {
+		var registry *ghttp.Server
+
+		BeforeEach(func() {
+			registry = ghttp.NewServer()
+
+			buf := new(bytes.Buffer)
+			tw := tar.NewWriter(buf)
+			Expect(tw.WriteHeader(&tar.Header{Name: "hello", Typeflag: tar.TypeReg, Mode: 0644, Size: 5})).To(Succeed())
+			_, err := tw.Write([]byte("world"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(tw.Close()).To(Succeed())
+
+			layer, err := tarball.LayerFromReader(buf)
+			Expect(err).ToNot(HaveOccurred())
+
+			layerDigest, err := layer.Digest()
+			Expect(err).ToNot(HaveOccurred())
+
+			rc, err := layer.Compressed()
+			Expect(err).ToNot(HaveOccurred())
+			blob, err := ioutil.ReadAll(rc)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(rc.Close()).To(Succeed())
+
+			manifest, err := json.Marshal(map[string]interface{}{
+				"schemaVersion": 1,
+				"name":          "some/fake-image",
+				"tag":           "latest",
+				"architecture":  "amd64",
+				"fsLayers": []map[string]string{
+					{"blobSum": "sha256:a3ed95caeb02ffe68cdd9fd84406680ae93d633cb16422d00e8a7c22955b46d4"},
+					{"blobSum": layerDigest.String()},
+				},
+				"history": []map[string]string{
+					{"v1Compatibility": `{"id":"b","parent":"a","created":"2016-01-02T00:00:00Z","os":"linux","architecture":"amd64","config":{"Env":["FOO=1"],"User":"someuser"},"container_config":{"Cmd":["/bin/sh","-c","#(nop) ENV FOO=1"]},"throwaway":true}`},
+					{"v1Compatibility": `{"id":"a","created":"2016-01-01T00:00:00Z","container_config":{"Cmd":["/bin/sh","-c","#(nop) ADD file:hello in /"]}}`},
+				},
+			})
+			Expect(err).ToNot(HaveOccurred())
+
+			sum := sha256.Sum256(manifest)
+			digest := "sha256:" + hex.EncodeToString(sum[:])
+
+			manifestHeaders := http.Header{
+				"Content-Type":          {string(types.DockerManifestSchema1Signed)},
+				"Content-Length":        {strconv.Itoa(len(manifest))},
+				"Docker-Content-Digest": {digest},
+			}
+
+			registry.RouteToHandler("GET", "/v2/", ghttp.RespondWith(http.StatusOK, ""))
+			registry.RouteToHandler("GET", "/v2/some/fake-image/manifests/"+digest, ghttp.RespondWith(http.StatusOK, manifest, manifestHeaders))
+			registry.RouteToHandler("GET", "/v2/some/fake-image/blobs/"+layerDigest.String(), ghttp.RespondWith(http.StatusOK, blob))
+
+			// a schema 1 manifest has no layer sizes, so they're found with HEAD
+			registry.RouteToHandler("HEAD", "/v2/some/fake-image/blobs/"+layerDigest.String(), ghttp.RespondWith(http.StatusOK, nil, http.Header{
+				"Content-Length": {strconv.Itoa(len(blob))},
+			}))
+
+			req.Source.Repository = registry.Addr() + "/some/fake-image"
+			req.Version.Tag = "latest"
+			req.Version.Digest = digest
+		})
+
+		AfterEach(func() {
+			registry.Close()
+		})
+
+		It("fails with an actionable error", func() {
+			Expect(actualErr).To(HaveOccurred())
+			Expect(actualErrOutput).To(ContainSubstring("legacy Docker schema 1 manifest format"))
+			Expect(actualErrOutput).To(ContainSubstring("convert_schema1"))
+		})
+
+		Context("when convert_schema1 is set", func() {
+			BeforeEach(func() {
+				req.Source.ConvertSchema1 = true
+			})
+
+			It("converts the image", func() {
+				Expect(actualErr).ToNot(HaveOccurred())
+
+				Expect(cat(rootfsPath("hello"))).To(Equal("world"))
+
+				var meta struct {
+					Env  []string `json:"env"`
+					User string   `json:"user"`
+				}
+
+				md, err := ioutil.ReadFile(filepath.Join(destDir, "metadata.json"))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(json.Unmarshal(md, &meta)).To(Succeed())
+				Expect(meta.Env).To(Equal([]string{"FOO=1"}))
+				Expect(meta.User).To(Equal("someuser"))
+
+				Expect(cat(filepath.Join(destDir, "digest"))).To(Equal(req.Version.Digest))
+			})
+		})
+	})
+
+	Describe("fetching with world_readable and umask", func() {
+		var registry *ghttp.Server
+
+		BeforeEach(func() {
+			registry = ghttp.NewServer()
+
+			buf := new(bytes.Buffer)
+			tw := tar.NewWriter(buf)
+			for _, hdr := range []*tar.Header{
+				{Name: "etc/", Typeflag: tar.TypeDir, Mode: 0700},
+				{Name: "etc/secret", Typeflag: tar.TypeReg, Mode: 0600},
+				{Name: "bin/tool", Typeflag: tar.TypeReg, Mode: 0700},
+			} {
+				Expect(tw.WriteHeader(hdr)).To(Succeed())
+			}
+			Expect(tw.Close()).To(Succeed())
+
+			layer, err := tarball.LayerFromReader(buf)
+			Expect(err).ToNot(HaveOccurred())
+
+			image, err := mutate.AppendLayers(empty.Image, layer)
+			Expect(err).ToNot(HaveOccurred())
+
+			req.Source.Repository = registry.Addr() + "/some/fake-image"
+			req.Params.WorldReadable = true
+			req.Params.Umask = "002"
+
+			req.Version.Tag = "latest"
+			req.Version.Digest = serveImage(registry, "some/fake-image", "latest", image)
+		})
+
+		AfterEach(func() {
+			registry.Close()
+		})
+
+		It("normalizes the permissions of the extracted files", func() {
+			Expect(actualErr).ToNot(HaveOccurred())
+
+			for path, perm := range map[string]os.FileMode{
+				"etc":        0755,
+				"etc/secret": 0644,
+				"bin/tool":   0755,
+			} {
+				info, err := os.Stat(rootfsPath(filepath.FromSlash(path)))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(info.Mode().Perm()).To(Equal(perm), path)
+			}
+		})
+
+		Context("with an invalid umask", func() {
+			BeforeEach(func() {
+				req.Params.Umask = "999"
+			})
+
+			It("fails", func() {
+				Expect(actualErr).To(HaveOccurred())
+				Expect(actualErrOutput).To(ContainSubstring(`invalid umask "999"`))
+			})
+		})
+	})
+
+	Describe("fetching in layers format", func() {
+		var registry *ghttp.Server
+
+		layer := func(files ...string) v1.Layer {
+			buf := new(bytes.Buffer)
+			tw := tar.NewWriter(buf)
+			for _, file := range files {
+				Expect(tw.WriteHeader(&tar.Header{
+					Name:     file,
+					Typeflag: tar.TypeReg,
+					Mode:     0644,
+				})).To(Succeed())
+			}
+			Expect(tw.Close()).To(Succeed())
+
+			l, err := tarball.LayerFromReader(buf)
+			Expect(err).ToNot(HaveOccurred())
+
+			return l
+		}
+
+		BeforeEach(func() {
+			registry = ghttp.NewServer()
+
+			image, err := mutate.AppendLayers(empty.Image,
+				layer("some-file", "some-dir/gone"),
+				layer("some-dir/.wh.gone", "some-dir/new"),
+			)
+			Expect(err).ToNot(HaveOccurred())
+
+			req.Source.Repository = registry.Addr() + "/some/fake-image"
+			req.Params.RawFormat = "layers"
+
+			req.Version.Tag = "latest"
+			req.Version.Digest = serveImage(registry, "some/fake-image", "latest", image)
+		})
+
+		AfterEach(func() {
+			registry.Close()
+		})
+
+		It("extracts each layer into its own directory without applying whiteouts", func() {
+			Expect(actualErr).ToNot(HaveOccurred())
+
+			_, err := os.Stat(rootfsPath())
+			Expect(os.IsNotExist(err)).To(BeTrue())
+
+			Expect(filepath.Join(destDir, "layers", "0", "some-file")).To(BeARegularFile())
+			Expect(filepath.Join(destDir, "layers", "0", "some-dir", "gone")).To(BeARegularFile())
+			Expect(filepath.Join(destDir, "layers", "1", "some-dir", ".wh.gone")).To(BeARegularFile())
+			Expect(filepath.Join(destDir, "layers", "1", "some-dir", "new")).To(BeARegularFile())
+
+			_, err = os.Stat(filepath.Join(destDir, "metadata.json"))
+			Expect(err).ToNot(HaveOccurred())
+		})
+	})
+
+	Describe("fetching in helm format", func() {
+		var registry *httptest.Server
+
+		BeforeEach(func() {
+			registry = newFakeRegistry()
+
+			buf := new(bytes.Buffer)
+			gw := gzip.NewWriter(buf)
+			tw := tar.NewWriter(gw)
+
+			for file, content := range map[string]string{
+				"mychart/Chart.yaml":            "apiVersion: v2\nname: mychart\nversion: 0.1.0\n",
+				"mychart/templates/config.yaml": "kind: ConfigMap\n",
+			} {
+				Expect(tw.WriteHeader(&tar.Header{
+					Name:     file,
+					Typeflag: tar.TypeReg,
+					Mode:     0644,
+					Size:     int64(len(content)),
+				})).To(Succeed())
+
+				_, err := tw.Write([]byte(content))
+				Expect(err).ToNot(HaveOccurred())
+			}
+
+			Expect(tw.Close()).To(Succeed())
+			Expect(gw.Close()).To(Succeed())
+
+			chart := mutate.ConfigMediaType(mutate.MediaType(empty.Image, types.OCIManifestSchema1), "application/vnd.cncf.helm.config.v1+json")
+
+			chart, err := mutate.AppendLayers(chart, static.NewLayer(buf.Bytes(), "application/vnd.cncf.helm.chart.content.v1.tar+gzip"))
+			Expect(err).ToNot(HaveOccurred())
+
+			req.Source.Repository = strings.TrimPrefix(registry.URL, "http://") + "/charts/mychart"
+
+			repo, err := name.NewRepository(req.Source.Repository)
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(remote.Write(repo.Tag("0.1.0"), chart)).To(Succeed())
+
+			digest, err := chart.Digest()
+			Expect(err).ToNot(HaveOccurred())
+
+			req.Version.Tag = "0.1.0"
+			req.Version.Digest = digest.String()
+			req.Params.RawFormat = "helm"
+		})
+
+		AfterEach(func() {
+			registry.Close()
+		})
+
+		It("extracts the chart and writes its metadata", func() {
+			Expect(actualErr).ToNot(HaveOccurred())
+
+			Expect(cat(filepath.Join(destDir, "chart", "templates", "config.yaml"))).To(Equal("kind: ConfigMap\n"))
+			Expect(cat(filepath.Join(destDir, "Chart.yaml"))).To(ContainSubstring("name: mychart"))
+			Expect(filepath.Join(destDir, "chart.tgz")).To(BeARegularFile())
+			Expect(filepath.Join(destDir, "chart.json")).To(BeARegularFile())
+		})
+	})
+
+	Describe("fetching an image index", func() {
+		var registry *httptest.Server
+		var index v1.ImageIndex
+
+		BeforeEach(func() {
+			registry = newFakeRegistry()
+
+			amd64, err := random.Image(1024, 1)
+			Expect(err).ToNot(HaveOccurred())
+
+			arm64, err := random.Image(1024, 1)
+			Expect(err).ToNot(HaveOccurred())
+
+			index = mutate.AppendManifests(empty.Index,
+				mutate.IndexAddendum{
+					Add: amd64,
+					Descriptor: v1.Descriptor{
+						Platform: &v1.Platform{OS: "linux", Architecture: "amd64"},
+					},
+				},
+				mutate.IndexAddendum{
+					Add: arm64,
+					Descriptor: v1.Descriptor{
+						Platform: &v1.Platform{OS: "linux", Architecture: "arm64", Variant: "v8"},
+					},
+				},
+			)
+
+			req.Source.Repository = strings.TrimPrefix(registry.URL, "http://") + "/some/fake-image"
+
+			repo, err := name.NewRepository(req.Source.Repository)
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(remote.WriteIndex(repo.Tag("latest"), index)).To(Succeed())
+
+			digest, err := index.Digest()
+			Expect(err).ToNot(HaveOccurred())
+
+			req.Version.Tag = "latest"
+			req.Version.Digest = digest.String()
+		})
+
+		AfterEach(func() {
+			registry.Close()
+		})
+
+		It("writes the platforms and digests of its images to manifest-list.json", func() {
+			Expect(actualErr).ToNot(HaveOccurred())
+
+			manifest, err := index.IndexManifest()
+			Expect(err).ToNot(HaveOccurred())
+
+			var manifests []struct {
+				Digest       string `json:"digest"`
+				OS           string `json:"os"`
+				Architecture string `json:"architecture"`
+				Variant      string `json:"variant"`
+			}
+			content, err := ioutil.ReadFile(filepath.Join(destDir, "manifest-list.json"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(json.Unmarshal(content, &manifests)).To(Succeed())
+
+			Expect(manifests).To(HaveLen(2))
+			Expect(manifests[0].Digest).To(Equal(manifest.Manifests[0].Digest.String()))
+			Expect(manifests[0].Architecture).To(Equal("amd64"))
+			Expect(manifests[1].Digest).To(Equal(manifest.Manifests[1].Digest.String()))
+			Expect(manifests[1].OS).To(Equal("linux"))
+			Expect(manifests[1].Architecture).To(Equal("arm64"))
+			Expect(manifests[1].Variant).To(Equal("v8"))
+		})
+	})
+
+	Describe("fetching an image for a different platform", func() {
+		var registry *ghttp.Server
+
+		BeforeEach(func() {
+			registry = ghttp.NewServer()
+
+			image, err := random.Image(1024, 1)
+			Expect(err).ToNot(HaveOccurred())
+
+			cfg, err := image.ConfigFile()
+			Expect(err).ToNot(HaveOccurred())
+
+			cfg = cfg.DeepCopy()
+			cfg.OS = "linux"
+			cfg.Architecture = "s390x"
+
+			image, err = mutate.ConfigFile(image, cfg)
+			Expect(err).ToNot(HaveOccurred())
+
+			req.Source.Repository = registry.Addr() + "/some/fake-image"
+			req.Source.RawPlatform = &resource.PlatformField{
+				OS:           "linux",
+				Architecture: "arm64/v8",
+			}
+
+			req.Version.Tag = "latest"
+			req.Version.Digest = serveImage(registry, "some/fake-image", "latest", image)
+		})
+
+		AfterEach(func() {
+			registry.Close()
+		})
+
+		It("warns about the mismatch", func() {
+			Expect(actualErr).ToNot(HaveOccurred())
+			Expect(actualErrOutput).To(ContainSubstring("image is for linux/s390x, but linux/arm64 was requested"))
+		})
+
+		Context("with platform_mismatch set to fail", func() {
+			BeforeEach(func() {
+				req.Params.PlatformMismatch = "fail"
+			})
+
+			It("fails without fetching the image", func() {
+				Expect(actualErr).To(HaveOccurred())
+				Expect(actualErrOutput).To(ContainSubstring("image is for linux/s390x, but linux/arm64 was requested"))
+				Expect(rootfsPath()).ToNot(BeADirectory())
+			})
+		})
+	})
+
+	Describe("fetching in overlay format", func() {
+		var registry *ghttp.Server
+
+		BeforeEach(func() {
+			if os.Getuid() != 0 {
+				Skip("must be run as root to create overlay whiteouts")
+			}
+
+			registry = ghttp.NewServer()
+
+			layer := func(files ...string) v1.Layer {
+				buf := new(bytes.Buffer)
+				tw := tar.NewWriter(buf)
+				for _, file := range files {
+					Expect(tw.WriteHeader(&tar.Header{
+						Name:     file,
+						Typeflag: tar.TypeReg,
+						Mode:     0644,
+					})).To(Succeed())
+				}
+				Expect(tw.Close()).To(Succeed())
+
+				l, err := tarball.LayerFromReader(buf)
+				Expect(err).ToNot(HaveOccurred())
+
+				return l
+			}
+
+			image, err := mutate.AppendLayers(empty.Image,
+				layer("some-file", "some-dir/gone"),
+				layer("some-dir/.wh.gone", "some-dir/new"),
+			)
+			Expect(err).ToNot(HaveOccurred())
+
+			req.Source.Repository = registry.Addr() + "/some/fake-image"
+			req.Params.RawFormat = "overlay"
+
+			req.Version.Tag = "latest"
+			req.Version.Digest = serveImage(registry, "some/fake-image", "latest", image)
+		})
+
+		AfterEach(func() {
+			registry.Close()
+		})
+
+		It("extracts each layer with overlayfs whiteouts and writes their order", func() {
+			Expect(actualErr).ToNot(HaveOccurred())
+
+			Expect(filepath.Join(destDir, "layers", "0", "some-dir", "gone")).To(BeARegularFile())
+			Expect(filepath.Join(destDir, "layers", "1", "some-dir", "new")).To(BeARegularFile())
+
+			_, err := os.Lstat(filepath.Join(destDir, "layers", "1", "some-dir", ".wh.gone"))
+			Expect(os.IsNotExist(err)).To(BeTrue())
+
+			fi, err := os.Lstat(filepath.Join(destDir, "layers", "1", "some-dir", "gone"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(fi.Mode() & os.ModeCharDevice).ToNot(BeZero())
+
+			Expect(cat(filepath.Join(destDir, "order"))).To(Equal("layers/1\nlayers/0\n"))
+		})
+	})
+
+	Describe("fetching in runtime-bundle format", func() {
+		var registry *ghttp.Server
+
+		BeforeEach(func() {
+			registry = ghttp.NewServer()
+
+			image, err := random.Image(1024, 1)
+			Expect(err).ToNot(HaveOccurred())
+
+			image, err = mutate.Config(image, v1.Config{
+				Entrypoint: []string{"/bin/app"},
+				Cmd:        []string{"--serve"},
+				Env:        []string{"FOO=1"},
+				User:       "1000:1001",
+				WorkingDir: "/srv",
+			})
+			Expect(err).ToNot(HaveOccurred())
+
+			req.Source.Repository = registry.Addr() + "/some/fake-image"
+			req.Params.RawFormat = "runtime-bundle"
+
+			req.Version.Tag = "latest"
+			req.Version.Digest = serveImage(registry, "some/fake-image", "latest", image)
+		})
+
+		AfterEach(func() {
+			registry.Close()
+		})
+
+		It("saves the rootfs alongside a runtime config derived from the image config", func() {
+			Expect(actualErr).ToNot(HaveOccurred())
+
+			_, err := os.Stat(rootfsPath())
+			Expect(err).ToNot(HaveOccurred())
+
+			var spec struct {
+				Process struct {
+					User struct {
+						UID uint32 `json:"uid"`
+						GID uint32 `json:"gid"`
+					} `json:"user"`
+					Args []string `json:"args"`
+					Env  []string `json:"env"`
+					Cwd  string   `json:"cwd"`
+				} `json:"process"`
+				Root struct {
+					Path string `json:"path"`
+				} `json:"root"`
+			}
+
+			Expect(json.Unmarshal([]byte(cat(filepath.Join(destDir, "config.json"))), &spec)).To(Succeed())
+			Expect(spec.Process.Args).To(Equal([]string{"/bin/app", "--serve"}))
+			Expect(spec.Process.Env).To(Equal([]string{"FOO=1"}))
+			Expect(spec.Process.Cwd).To(Equal("/srv"))
+			Expect(spec.Process.User.UID).To(Equal(uint32(1000)))
+			Expect(spec.Process.User.GID).To(Equal(uint32(1001)))
+			Expect(spec.Root.Path).To(Equal("rootfs"))
+		})
+	})
+
+	Describe("reporting progress with a heartbeat", func() {
+		var registry *ghttp.Server
+		var layerDigests []string
+
+		BeforeEach(func() {
+			registry = ghttp.NewServer()
+
+			image, err := random.Image(1024, 2)
+			Expect(err).ToNot(HaveOccurred())
+
+			layers, err := image.Layers()
+			Expect(err).ToNot(HaveOccurred())
+
+			layerDigests = nil
+			for _, layer := range layers {
+				digest, err := layer.Digest()
+				Expect(err).ToNot(HaveOccurred())
+
+				layerDigests = append(layerDigests, digest.Hex[0:12])
+			}
+
+			req.Source.Repository = registry.Addr() + "/some/fake-image"
+			req.Source.HeartbeatInterval = 1
+
+			req.Version.Tag = "latest"
+			req.Version.Digest = serveImage(registry, "some/fake-image", "latest", image)
+		})
+
+		AfterEach(func() {
+			registry.Close()
+		})
+
+		It("prints a line as each layer completes", func() {
+			Expect(actualErr).ToNot(HaveOccurred())
+
+			Expect(actualErrOutput).To(ContainSubstring("layer 1/2 " + layerDigests[0] + ": done"))
+			Expect(actualErrOutput).To(ContainSubstring("layer 2/2 " + layerDigests[1] + ": done"))
+		})
+
+		Context("when extracting a layer fails", func() {
+			var rateLimited int32
+
+			BeforeEach(func() {
+				image, err := random.Image(1024, 1)
+				Expect(err).ToNot(HaveOccurred())
+
+				req.Version.Digest = serveImage(registry, "some/fake-image", "latest", image)
+
+				manifest, err := image.RawManifest()
+				Expect(err).ToNot(HaveOccurred())
+
+				mediaType, err := image.MediaType()
+				Expect(err).ToNot(HaveOccurred())
+
+				layers, err := image.Layers()
+				Expect(err).ToNot(HaveOccurred())
+
+				layerDigest, err := layers[0].Digest()
+				Expect(err).ToNot(HaveOccurred())
+
+				layerDigests = []string{layerDigest.Hex[0:12]}
+
+				rc, err := layers[0].Compressed()
+				Expect(err).ToNot(HaveOccurred())
+
+				layer, err := ioutil.ReadAll(rc)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(rc.Close()).To(Succeed())
+
+				atomic.StoreInt32(&rateLimited, 0)
+
+				// rate limit the first attempt at the layer, failing its
+				// extraction
+				registry.RouteToHandler("GET", "/v2/some/fake-image/blobs/"+layerDigest.String(), func(w http.ResponseWriter, r *http.Request) {
+					if atomic.CompareAndSwapInt32(&rateLimited, 0, 1) {
+						w.WriteHeader(http.StatusTooManyRequests)
+						return
+					}
+
+					w.Write(layer)
+				})
+
+				// take longer than the heartbeat to start the retry, during which
+				// only the failed attempt's heartbeat could report progress
+				registry.RouteToHandler("GET", "/v2/some/fake-image/manifests/"+req.Version.Digest, func(w http.ResponseWriter, r *http.Request) {
+					if atomic.LoadInt32(&rateLimited) == 1 {
+						time.Sleep(2500 * time.Millisecond)
+					}
+
+					w.Header().Set("Content-Type", string(mediaType))
+					w.Write(manifest)
+				})
+			})
+
+			It("stops reporting the failed attempt's progress", func() {
+				Expect(actualErr).ToNot(HaveOccurred())
+
+				Expect(actualErrOutput).To(ContainSubstring("too many requests"))
+				Expect(actualErrOutput).To(ContainSubstring("layer 1/1 " + layerDigests[0] + ": done"))
+				Expect(actualErrOutput).ToNot(MatchRegexp(`layer 1/1 [0-9a-f]+: [0-9.]+%`))
+			})
+		})
+	})
+
+	Describe("transfer statistics", func() {
+		var registry *ghttp.Server
+		var image v1.Image
+
+		BeforeEach(func() {
+			registry = ghttp.NewServer()
+
+			var err error
+			image, err = random.Image(1024, 2)
+			Expect(err).ToNot(HaveOccurred())
+
+			req.Source.Repository = registry.Addr() + "/some/fake-image"
+
+			req.Version.Tag = "latest"
+			req.Version.Digest = serveImage(registry, "some/fake-image", "latest", image)
+		})
+
+		AfterEach(func() {
+			registry.Close()
+		})
+
+		It("logs a summary of each layer and returns the totals in metadata", func() {
+			Expect(actualErr).ToNot(HaveOccurred())
+
+			layers, err := image.Layers()
+			Expect(err).ToNot(HaveOccurred())
+
+			var total int64
+			for _, layer := range layers {
+				digest, err := layer.Digest()
+				Expect(err).ToNot(HaveOccurred())
+
+				size, err := layer.Size()
+				Expect(err).ToNot(HaveOccurred())
+
+				total += size
+
+				Expect(actualErrOutput).To(ContainSubstring("layer " + digest.Hex[0:12] + ": "))
+			}
+
+			Expect(res.Metadata).To(ContainElement(resource.MetadataField{
+				Name:  "bytes_transferred",
+				Value: strconv.FormatInt(total, 10),
+			}))
+
+			var names []string
+			for _, field := range res.Metadata {
+				names = append(names, field.Name)
+			}
+
+			Expect(names).To(ContainElements("transfer_time", "transfer_speed"))
+		})
+	})
+
+	Describe("fetching from an eventually consistent registry", func() {
+		var registry *eventuallyConsistentRegistry
+
+		BeforeEach(func() {
+			registry = newEventuallyConsistentRegistry(2)
+
+			image, err := random.Image(1024, 1)
+			Expect(err).ToNot(HaveOccurred())
+
+			digest, err := image.Digest()
+			Expect(err).ToNot(HaveOccurred())
+
+			repo, err := name.NewRepository(strings.TrimPrefix(registry.URL, "http://") + "/fake-image")
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(remote.Write(repo.Digest(digest.String()), image)).To(Succeed())
+
+			req.Source.Repository = repo.Name()
+			req.Version.Tag = "latest"
+			req.Version.Digest = digest.String()
+		})
+
+		AfterEach(func() {
+			registry.Close()
+		})
+
+		Context("with consistency_wait", func() {
+			BeforeEach(func() {
+				req.Source.ConsistencyWait = 10
+			})
+
+			It("retries until the image is available", func() {
+				Expect(actualErr).ToNot(HaveOccurred())
+				Expect(registry.Missed).To(Equal(2))
+			})
+		})
+
+		Context("without consistency_wait", func() {
+			It("fails", func() {
+				Expect(actualErr).To(HaveOccurred())
+			})
+		})
+	})
+
+	Describe("extraction limits", func() {
+		var registry *ghttp.Server
+
+		BeforeEach(func() {
+			registry = ghttp.NewServer()
+
+			image, err := random.Image(1024, 2)
+			Expect(err).ToNot(HaveOccurred())
+
+			req.Source.Repository = registry.Addr() + "/some/fake-image"
+
+			req.Version.Tag = "latest"
+			req.Version.Digest = serveImage(registry, "some/fake-image", "latest", image)
+		})
+
+		AfterEach(func() {
+			registry.Close()
+		})
+
+		Context("when the image is within the limits", func() {
+			BeforeEach(func() {
+				req.Params.ExtractLimits = resource.ExtractLimits{
+					MaxSize:     2048,
+					MaxFiles:    2,
+					MaxFileSize: 1024,
+				}
+			})
+
+			It("extracts the image", func() {
+				Expect(actualErr).ToNot(HaveOccurred())
+			})
+		})
+
+		Context("when a file exceeds max_file_size", func() {
+			BeforeEach(func() {
+				req.Params.ExtractLimits.MaxFileSize = 1023
+			})
+
+			It("fails", func() {
+				Expect(actualErr).To(HaveOccurred())
+				Expect(actualErrOutput).To(ContainSubstring("exceeding max_file_size of 1023 bytes"))
+			})
+		})
+
+		Context("when the image exceeds max_files", func() {
+			BeforeEach(func() {
+				req.Params.ExtractLimits.MaxFiles = 1
+			})
+
+			It("fails", func() {
+				Expect(actualErr).To(HaveOccurred())
+				Expect(actualErrOutput).To(ContainSubstring("image has more than max_files of 1 files"))
+			})
+		})
+
+		Context("when the image exceeds max_size", func() {
+			BeforeEach(func() {
+				req.Params.ExtractLimits.MaxSize = 2047
+			})
+
+			It("fails", func() {
+				Expect(actualErr).To(HaveOccurred())
+				Expect(actualErrOutput).To(ContainSubstring("image exceeds max_size of 2047 bytes"))
+			})
+		})
+	})
+
+	Describe("verifying layer digests", func() {
+		var registry *ghttp.Server
+		var layerDigest v1.Hash
+
+		BeforeEach(func() {
+			registry = ghttp.NewServer()
+
+			image, err := random.Image(1024*1024, 1)
+			Expect(err).ToNot(HaveOccurred())
+
+			req.Source.Repository = registry.Addr() + "/some/fake-image"
+
+			req.Version.Tag = "latest"
+			req.Version.Digest = serveImage(registry, "some/fake-image", "latest", image)
+
+			layers, err := image.Layers()
+			Expect(err).ToNot(HaveOccurred())
+
+			layerDigest, err = layers[0].Digest()
+			Expect(err).ToNot(HaveOccurred())
+
+			rc, err := layers[0].Compressed()
+			Expect(err).ToNot(HaveOccurred())
+
+			blob, err := ioutil.ReadAll(rc)
+			Expect(err).ToNot(HaveOccurred())
+
+			// corrupt the end of the blob, past the end of the tar stream
+			blob[len(blob)-1]++
+
+			registry.RouteToHandler("GET", "/v2/some/fake-image/blobs/"+layerDigest.String(), ghttp.RespondWith(http.StatusOK, blob))
+		})
+
+		AfterEach(func() {
+			registry.Close()
+		})
+
+		It("fails when the layer does not match its digest", func() {
+			Expect(actualErr).To(HaveOccurred())
+			Expect(actualErrOutput).To(ContainSubstring(layerDigest.String()))
+		})
+	})
+
+	Describe("saving the layers", func() {
+		var registry *ghttp.Server
+		var image v1.Image
+
+		BeforeEach(func() {
+			registry = ghttp.NewServer()
+
+			var err error
+			image, err = random.Image(1024, 2)
+			Expect(err).ToNot(HaveOccurred())
+
+			req.Source.Repository = registry.Addr() + "/some/fake-image"
+
+			req.Version.Tag = "latest"
+			req.Version.Digest = serveImage(registry, "some/fake-image", "latest", image)
+		})
+
+		AfterEach(func() {
+			registry.Close()
+		})
+
+		It("describes each layer in layers.json", func() {
+			Expect(actualErr).ToNot(HaveOccurred())
+
+			var layers []struct {
+				Digest    string `json:"digest"`
+				DiffID    string `json:"diff_id"`
+				Size      int64  `json:"size"`
+				MediaType string `json:"media_type"`
+			}
+
+			Expect(json.Unmarshal([]byte(cat(filepath.Join(destDir, "layers.json"))), &layers)).To(Succeed())
+
+			manifest, err := image.Manifest()
+			Expect(err).ToNot(HaveOccurred())
+
+			cfg, err := image.ConfigFile()
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(layers).To(HaveLen(2))
+			for i, layer := range layers {
+				Expect(layer.Digest).To(Equal(manifest.Layers[i].Digest.String()))
+				Expect(layer.DiffID).To(Equal(cfg.RootFS.DiffIDs[i].String()))
+				Expect(layer.Size).To(Equal(manifest.Layers[i].Size))
+				Expect(layer.MediaType).To(Equal(string(manifest.Layers[i].MediaType)))
+			}
+		})
+	})
+
+	Describe("verifying cosign signatures", func() {
+		var registry *httptest.Server
+		var repo name.Repository
+		var digest v1.Hash
+		var key *ecdsa.PrivateKey
+
+		BeforeEach(func() {
+			registry = newFakeRegistry()
+
+			var err error
+			repo, err = name.NewRepository(strings.TrimPrefix(registry.URL, "http://") + "/fake-image")
+			Expect(err).ToNot(HaveOccurred())
+
+			image, err := random.Image(1024, 1)
+			Expect(err).ToNot(HaveOccurred())
+
+			digest, err = image.Digest()
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(remote.Write(repo.Tag("latest"), image)).To(Succeed())
+
+			key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+			Expect(err).ToNot(HaveOccurred())
+
+			req.Source.Repository = repo.Name()
+			req.Version = resource.Version{
+				Tag:    "latest",
+				Digest: digest.String(),
+			}
+		})
+
+		AfterEach(func() {
+			registry.Close()
+		})
+
+		Context("with a public key", func() {
+			BeforeEach(func() {
+				publicKey, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+				Expect(err).ToNot(HaveOccurred())
+
+				req.Params.Verify = &resource.VerifyParams{
+					CosignPublicKey: string(pem.EncodeToMemory(&pem.Block{
+						Type:  "PUBLIC KEY",
+						Bytes: publicKey,
+					})),
+				}
+			})
+
+			Context("when the image is signed with the key", func() {
+				BeforeEach(func() {
+					payload, signature := cosignSign(repo, digest, key, map[string]string{"env": "prod"})
+					pushCosignSignature(repo, digest, payload, signature, nil)
+				})
+
+				It("fetches the image", func() {
+					Expect(actualErr).ToNot(HaveOccurred())
+					Expect(rootfsPath()).To(BeADirectory())
+				})
+
+				Context("when annotations are required", func() {
+					BeforeEach(func() {
+						req.Params.Verify.Annotations = map[string]string{"env": "prod"}
+					})
+
+					It("fetches the image", func() {
+						Expect(actualErr).ToNot(HaveOccurred())
+					})
+				})
+
+				Context("when the signature does not have the required annotations", func() {
+					BeforeEach(func() {
+						req.Params.Verify.Annotations = map[string]string{"env": "staging"}
+					})
+
+					It("fails without fetching the image", func() {
+						Expect(actualErr).To(HaveOccurred())
+						Expect(rootfsPath()).ToNot(BeADirectory())
+					})
+				})
+			})
+
+			Context("when the image is signed with another key", func() {
+				BeforeEach(func() {
+					otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+					Expect(err).ToNot(HaveOccurred())
+
+					payload, signature := cosignSign(repo, digest, otherKey, nil)
+					pushCosignSignature(repo, digest, payload, signature, nil)
+				})
+
+				It("fails without fetching the image", func() {
+					Expect(actualErr).To(HaveOccurred())
+					Expect(rootfsPath()).ToNot(BeADirectory())
+				})
+			})
+
+			Context("when the image is not signed", func() {
+				It("fails without fetching the image", func() {
+					Expect(actualErr).To(HaveOccurred())
+					Expect(rootfsPath()).ToNot(BeADirectory())
+				})
+			})
+		})
+
+		Context("keyless", func() {
+			var rekor *ghttp.Server
+			var rekorKey *ecdsa.PrivateKey
+
+			const identity = "someone@example.com"
+			const issuer = "https://accounts.example.com"
+
+			BeforeEach(func() {
+				rekor = ghttp.NewServer()
+
+				caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+				Expect(err).ToNot(HaveOccurred())
+
+				caTemplate := &x509.Certificate{
+					SerialNumber:          big.NewInt(1),
+					Subject:               pkix.Name{CommonName: "fake-fulcio"},
+					NotBefore:             time.Now().Add(-24 * time.Hour),
+					NotAfter:              time.Now().Add(24 * time.Hour),
+					KeyUsage:              x509.KeyUsageCertSign,
+					BasicConstraintsValid: true,
+					IsCA:                  true,
+				}
+
+				caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+				Expect(err).ToNot(HaveOccurred())
+
+				caCert, err := x509.ParseCertificate(caDER)
+				Expect(err).ToNot(HaveOccurred())
+
+				issuerExt, err := asn1.MarshalWithParams(issuer, "utf8")
+				Expect(err).ToNot(HaveOccurred())
+
+				// like Fulcio's, the certificate has since expired
+				signedAt := time.Now().Add(-time.Hour)
+
+				leafDER, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+					SerialNumber:   big.NewInt(2),
+					NotBefore:      signedAt.Add(-time.Minute),
+					NotAfter:       signedAt.Add(10 * time.Minute),
+					KeyUsage:       x509.KeyUsageDigitalSignature,
+					ExtKeyUsage:    []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+					EmailAddresses: []string{identity},
+					ExtraExtensions: []pkix.Extension{
+						{Id: asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 57264, 1, 8}, Value: issuerExt},
+					},
+				}, caCert, &key.PublicKey, caKey)
+				Expect(err).ToNot(HaveOccurred())
+
+				leafPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: leafDER})
+
+				payload, signature := cosignSign(repo, digest, key, nil)
+
+				payloadHash := sha256.Sum256(payload)
+
+				body, err := json.Marshal(map[string]interface{}{
+					"apiVersion": "0.0.1",
+					"kind":       "hashedrekord",
+					"spec": map[string]interface{}{
+						"data": map[string]interface{}{
+							"hash": map[string]string{
+								"algorithm": "sha256",
+								"value":     hex.EncodeToString(payloadHash[:]),
+							},
+						},
+						"signature": map[string]interface{}{
+							"content": base64.StdEncoding.EncodeToString(signature),
+							"publicKey": map[string]string{
+								"content": base64.StdEncoding.EncodeToString(leafPEM),
+							},
+						},
+					},
+				})
+				Expect(err).ToNot(HaveOccurred())
+
+				rekorKey, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+				Expect(err).ToNot(HaveOccurred())
+
+				rekorKeyDER, err := x509.MarshalPKIXPublicKey(&rekorKey.PublicKey)
+				Expect(err).ToNot(HaveOccurred())
+
+				logID := sha256.Sum256(rekorKeyDER)
+
+				bundlePayload, err := json.Marshal(map[string]interface{}{
+					"body":           base64.StdEncoding.EncodeToString(body),
+					"integratedTime": signedAt.Unix(),
+					"logID":          hex.EncodeToString(logID[:]),
+					"logIndex":       42,
+				})
+				Expect(err).ToNot(HaveOccurred())
+
+				bundlePayloadHash := sha256.Sum256(bundlePayload)
+
+				signedEntryTimestamp, err := ecdsa.SignASN1(rand.Reader, rekorKey, bundlePayloadHash[:])
+				Expect(err).ToNot(HaveOccurred())
+
+				bundle, err := json.Marshal(map[string]interface{}{
+					"SignedEntryTimestamp": signedEntryTimestamp,
+					"Payload":              json.RawMessage(bundlePayload),
+				})
+				Expect(err).ToNot(HaveOccurred())
+
+				pushCosignSignature(repo, digest, payload, signature, map[string]string{
+					"dev.sigstore.cosign/certificate": string(leafPEM),
+					"dev.sigstore.cosign/bundle":      string(bundle),
+				})
+
+				rekor.RouteToHandler("POST", "/api/v1/index/retrieve", ghttp.CombineHandlers(
+					ghttp.VerifyJSON(`{"hash":"sha256:`+hex.EncodeToString(payloadHash[:])+`"}`),
+					ghttp.RespondWithJSONEncoded(http.StatusOK, []string{"some-uuid"}),
+				))
+
+				rekor.RouteToHandler("GET", "/api/v1/log/entries/some-uuid", ghttp.RespondWithJSONEncoded(http.StatusOK, map[string]interface{}{
+					"some-uuid": map[string]interface{}{
+						"body":           base64.StdEncoding.EncodeToString(body),
+						"integratedTime": signedAt.Unix(),
+					},
+				}))
+
+				req.Params.Verify = &resource.VerifyParams{
+					Keyless: &resource.KeylessVerification{
+						Identity:    identity,
+						Issuer:      issuer,
+						FulcioRoots: string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER})),
+						RekorURL:    rekor.URL(),
+					},
+				}
+			})
+
+			AfterEach(func() {
+				rekor.Close()
+			})
+
+			It("fetches the image", func() {
+				Expect(actualErr).ToNot(HaveOccurred())
+				Expect(rootfsPath()).To(BeADirectory())
+			})
+
+			Context("when the image was signed by another identity", func() {
+				BeforeEach(func() {
+					req.Params.Verify.Keyless.Identity = "someone-else@example.com"
+				})
+
+				It("fails without fetching the image", func() {
+					Expect(actualErr).To(HaveOccurred())
+					Expect(rootfsPath()).ToNot(BeADirectory())
+				})
+			})
+
+			Context("when the signature is not in the transparency log", func() {
+				BeforeEach(func() {
+					rekor.RouteToHandler("POST", "/api/v1/index/retrieve", ghttp.RespondWithJSONEncoded(http.StatusOK, []string{}))
+				})
+
+				It("fails without fetching the image", func() {
+					Expect(actualErr).To(HaveOccurred())
+					Expect(rootfsPath()).ToNot(BeADirectory())
+				})
+			})
+
+			Context("with an offline transparency log", func() {
+				var rekorPublicKey *ecdsa.PublicKey
+
+				BeforeEach(func() {
+					req.Params.Verify.Keyless.Tlog = "offline"
+					rekorPublicKey = &rekorKey.PublicKey
+				})
+
+				JustBeforeEach(func() {
+					Expect(rekor.ReceivedRequests()).To(BeEmpty())
+				})
+
+				setRekorPublicKey := func() {
+					rekorKeyDER, err := x509.MarshalPKIXPublicKey(rekorPublicKey)
+					Expect(err).ToNot(HaveOccurred())
+
+					req.Params.Verify.Keyless.RekorPublicKey = string(pem.EncodeToMemory(&pem.Block{
+						Type:  "PUBLIC KEY",
+						Bytes: rekorKeyDER,
+					}))
+				}
+
+				Context("when the bundle is signed by the log", func() {
+					BeforeEach(func() {
+						setRekorPublicKey()
+					})
+
+					It("fetches the image", func() {
+						Expect(actualErr).ToNot(HaveOccurred())
+						Expect(rootfsPath()).To(BeADirectory())
+					})
+				})
+
+				Context("when the bundle is from another log", func() {
+					BeforeEach(func() {
+						otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+						Expect(err).ToNot(HaveOccurred())
+
+						rekorPublicKey = &otherKey.PublicKey
+						setRekorPublicKey()
+					})
+
+					It("fails without fetching the image", func() {
+						Expect(actualErr).To(HaveOccurred())
+						Expect(rootfsPath()).ToNot(BeADirectory())
+					})
+				})
+
+				Context("without a rekor_public_key", func() {
+					It("exits as misconfigured without fetching the image", func() {
+						Expect(actualErr).To(HaveOccurred())
+						Expect(actualErr.(*exec.ExitError).ExitCode()).To(Equal(2))
+						Expect(actualErrOutput).To(ContainSubstring("'rekor_public_key' and 'fulcio_roots' must be specified to verify offline"))
+						Expect(rootfsPath()).ToNot(BeADirectory())
+					})
+				})
+			})
+		})
+	})
+
+	Describe("saving the digest", func() {
+		BeforeEach(func() {
+			req.Source.Repository = "concourse/test-image-static"
+			req.Version.Tag = "latest"
+			req.Version.Digest = LATEST_STATIC_DIGEST
+		})
+
+		It("saves the digest to a file", func() {
+			Expect(actualErr).ToNot(HaveOccurred())
+
+			digest, err := ioutil.ReadFile(filepath.Join(destDir, "digest"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(digest)).To(Equal(req.Version.Digest))
+		})
+	})
+
+	Describe("saving the tag", func() {
+		BeforeEach(func() {
+			req.Source.Repository = "concourse/test-image-static"
+			req.Version = resource.Version{
+				Tag:    "tagged",
+				Digest: LATEST_STATIC_DIGEST,
+			}
+		})
+
+		It("saves the tag to a file", func() {
+			Expect(actualErr).ToNot(HaveOccurred())
+
+			tag, err := ioutil.ReadFile(filepath.Join(destDir, "tag"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(tag)).To(Equal("tagged"))
+		})
+	})
+
+	Describe("fetching a version without a tag", func() {
+		BeforeEach(func() {
+			req.Source.Repository = "concourse/test-image-static"
+			req.Params.SkipDownload = true
+			req.Version = resource.Version{
+				Digest: LATEST_STATIC_DIGEST,
+			}
+		})
+
+		It("saves 'latest' as the tag", func() {
+			Expect(actualErr).ToNot(HaveOccurred())
+
+			tag, err := ioutil.ReadFile(filepath.Join(destDir, "tag"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(tag)).To(Equal("latest"))
+		})
+
+		Context("with default_tag", func() {
+			BeforeEach(func() {
+				req.Source.Tag = "some-tag"
+				req.Source.DefaultTag = "some-default-tag"
+			})
+
+			It("saves the default tag", func() {
+				Expect(actualErr).ToNot(HaveOccurred())
+
+				tag, err := ioutil.ReadFile(filepath.Join(destDir, "tag"))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(string(tag)).To(Equal("some-default-tag"))
+
+				Expect(res.Version).To(Equal(req.Version))
+			})
+		})
+	})
+
+	Describe("fetching with a pinned digest", func() {
+		BeforeEach(func() {
+			req.Source.Repository = "concourse/test-image-static"
+			req.Source.Digest = LATEST_STATIC_DIGEST
+			req.Params.SkipDownload = true
+			req.Version = resource.Version{
+				Tag:    "latest",
+				Digest: LATEST_STATIC_DIGEST,
+			}
+		})
+
+		It("fetches the digest", func() {
+			Expect(actualErr).ToNot(HaveOccurred())
+
+			digest, err := ioutil.ReadFile(filepath.Join(destDir, "digest"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(digest)).To(Equal(LATEST_STATIC_DIGEST))
+		})
+
+		Context("when the version is of another digest", func() {
+			BeforeEach(func() {
+				req.Version.Digest = OLDER_STATIC_DIGEST
+			})
+
+			It("exits non-zero without fetching it", func() {
+				Expect(actualErr).To(HaveOccurred())
+				Expect(actualErrOutput).To(ContainSubstring("is not the pinned digest"))
+
+				_, err := os.Stat(filepath.Join(destDir, "digest"))
+				Expect(err).To(HaveOccurred())
+			})
+		})
+	})
+
+	Describe("saving the repository", func() {
+		BeforeEach(func() {
+			req.Source.Repository = "concourse/test-image-static"
+			req.Version.Tag = "latest"
+			req.Version.Digest = LATEST_STATIC_DIGEST
+		})
+
+		It("saves the repository string to a file", func() {
+			Expect(actualErr).ToNot(HaveOccurred())
+
+			repository, err := ioutil.ReadFile(filepath.Join(destDir, "repository"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(repository)).To(Equal("concourse/test-image-static"))
+		})
+	})
+
+	Describe("saving the refs", func() {
+		BeforeEach(func() {
+			req.Source.Repository = "concourse/test-image-static"
+			req.Version.Tag = "latest"
+			req.Version.Digest = LATEST_STATIC_DIGEST
+		})
+
+		It("saves the digest and tag references to files", func() {
+			Expect(actualErr).ToNot(HaveOccurred())
+
+			ref, err := ioutil.ReadFile(filepath.Join(destDir, "ref"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(ref)).To(Equal("concourse/test-image-static@" + LATEST_STATIC_DIGEST))
+
+			tagRef, err := ioutil.ReadFile(filepath.Join(destDir, "tag_ref"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(tagRef)).To(Equal("concourse/test-image-static:latest"))
+		})
+	})
+
+	Describe("skipping the download", func() {
+		BeforeEach(func() {
+			req.Source.Repository = "concourse/test-image-static"
+			req.Params.SkipDownload = true
+			req.Version.Tag = "latest"
+			req.Version.Digest = LATEST_STATIC_DIGEST
+		})
+
+		It("does not download the image", func() {
+			Expect(actualErr).ToNot(HaveOccurred())
+
+			_, err := os.Stat(filepath.Join(destDir, "rootfs"))
+			Expect(os.IsNotExist(err)).To(BeTrue())
+
+			_, err = os.Stat(filepath.Join(destDir, "manifest.json"))
+			Expect(os.IsNotExist(err)).To(BeTrue())
+
+			_, err = os.Stat(filepath.Join(destDir, "image.tar"))
+			Expect(os.IsNotExist(err)).To(BeTrue())
+		})
+
+		It("saves the tag and digest files", func() {
+			Expect(actualErr).ToNot(HaveOccurred())
+
+			digest, err := ioutil.ReadFile(filepath.Join(destDir, "digest"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(digest)).To(Equal(LATEST_STATIC_DIGEST))
+
+			tag, err := ioutil.ReadFile(filepath.Join(destDir, "tag"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(tag)).To(Equal("latest"))
+		})
+	})
+
+	Describe("skipping the download but fetching metadata", func() {
+		var registry *ghttp.Server
+		var image v1.Image
+
+		BeforeEach(func() {
+			registry = ghttp.NewServer()
+
+			var err error
+			image, err = random.Image(1024, 2)
+			Expect(err).ToNot(HaveOccurred())
+
+			image, err = mutate.Config(image, v1.Config{
+				Env:    []string{"FOO=1"},
+				User:   "someuser",
+				Labels: map[string]string{"commit": "4e5c4ea"},
+			})
+			Expect(err).ToNot(HaveOccurred())
+
+			req.Source.Repository = registry.Addr() + "/some/fake-image"
+			req.Params.SkipDownload = true
+			req.Params.FetchMetadata = true
+
+			req.Version.Tag = "latest"
+			req.Version.Digest = serveImage(registry, "some/fake-image", "latest", image)
+		})
+
+		AfterEach(func() {
+			registry.Close()
+		})
+
+		It("writes the metadata without fetching any layers", func() {
+			Expect(actualErr).ToNot(HaveOccurred())
+
+			var meta struct {
+				Env  []string `json:"env"`
+				User string   `json:"user"`
+			}
+
+			md, err := ioutil.ReadFile(filepath.Join(destDir, "metadata.json"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(json.Unmarshal(md, &meta)).To(Succeed())
+			Expect(meta.Env).To(Equal([]string{"FOO=1"}))
+			Expect(meta.User).To(Equal("someuser"))
+
+			labels, err := ioutil.ReadFile(filepath.Join(destDir, "labels.json"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(labels).To(MatchJSON(`{"commit":"4e5c4ea"}`))
+
+			_, err = os.Stat(filepath.Join(destDir, "layers.json"))
+			Expect(err).ToNot(HaveOccurred())
+
+			rawManifest, err := image.RawManifest()
+			Expect(err).ToNot(HaveOccurred())
+
+			manifest, err := ioutil.ReadFile(filepath.Join(destDir, "manifest.json"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(manifest).To(Equal(rawManifest))
+
+			rawConfig, err := image.RawConfigFile()
+			Expect(err).ToNot(HaveOccurred())
+
+			config, err := ioutil.ReadFile(filepath.Join(destDir, "config.json"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(config).To(Equal(rawConfig))
+
+			size := int64(len(rawManifest) + len(rawConfig))
+			layers, err := image.Layers()
+			Expect(err).ToNot(HaveOccurred())
+
+			for _, layer := range layers {
+				layerSize, err := layer.Size()
+				Expect(err).ToNot(HaveOccurred())
+
+				size += layerSize
+			}
+
+			sizeFile, err := ioutil.ReadFile(filepath.Join(destDir, "size"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(sizeFile)).To(Equal(strconv.FormatInt(size, 10)))
+
+			_, err = os.Stat(filepath.Join(destDir, "rootfs"))
+			Expect(os.IsNotExist(err)).To(BeTrue())
+
+			for _, layer := range layers {
+				digest, err := layer.Digest()
+				Expect(err).ToNot(HaveOccurred())
+
+				for _, r := range registry.ReceivedRequests() {
+					Expect(r.URL.Path).ToNot(HaveSuffix(digest.String()))
+				}
+			}
+		})
+
+		Context("with metadata_labels", func() {
+			BeforeEach(func() {
+				req.Source.MetadataLabels = []string{"commit", "org.opencontainers.image.version"}
+			})
+
+			It("returns the labels the image has as metadata", func() {
+				Expect(actualErr).ToNot(HaveOccurred())
+
+				Expect(res.Metadata).To(ContainElement(resource.MetadataField{
+					Name:  "commit",
+					Value: "4e5c4ea",
+				}))
+
+				for _, field := range res.Metadata {
+					Expect(field.Name).ToNot(Equal("org.opencontainers.image.version"))
+				}
+			})
+		})
+	})
+
+	Context("when a layer download is cut off", func() {
+		var registry *ghttp.Server
+		var ranges []string
+		var keepsCuttingOff bool
+
+		BeforeEach(func() {
+			registry = ghttp.NewServer()
+			ranges = nil
+			keepsCuttingOff = false
+
+			image, err := random.Image(1024, 1)
+			Expect(err).ToNot(HaveOccurred())
+
+			req.Source.Repository = registry.Addr() + "/some/fake-image"
+			req.Version.Tag = "latest"
+			req.Version.Digest = serveImage(registry, "some/fake-image", "latest", image)
+
+			layers, err := image.Layers()
+			Expect(err).ToNot(HaveOccurred())
+
+			digest, err := layers[0].Digest()
+			Expect(err).ToNot(HaveOccurred())
+
+			rc, err := layers[0].Compressed()
+			Expect(err).ToNot(HaveOccurred())
+
+			blob, err := ioutil.ReadAll(rc)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(rc.Close()).To(Succeed())
+
+			half := len(blob) / 2
+
+			cutOff := func(w http.ResponseWriter) {
+				w.(http.Flusher).Flush()
+
+				conn, _, err := w.(http.Hijacker).Hijack()
+				Expect(err).ToNot(HaveOccurred())
+				conn.Close()
+			}
+
+			registry.RouteToHandler("GET", "/v2/some/fake-image/blobs/"+digest.String(), func(w http.ResponseWriter, r *http.Request) {
+				ranges = append(ranges, r.Header.Get("Range"))
+
+				if r.Header.Get("Range") == "" {
+					w.Header().Set("Content-Length", strconv.Itoa(len(blob)))
+					w.WriteHeader(http.StatusOK)
+					w.Write(blob[:half])
+					cutOff(w)
+					return
+				}
+
+				offset, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(r.Header.Get("Range"), "bytes="), "-"))
+				Expect(err).ToNot(HaveOccurred())
+
+				if keepsCuttingOff {
+					w.Header().Set("Content-Length", strconv.Itoa(len(blob)-offset))
+					w.WriteHeader(http.StatusPartialContent)
+					cutOff(w)
+					return
+				}
+
+				w.WriteHeader(http.StatusPartialContent)
+				w.Write(blob[offset:])
+			})
+		})
+
+		AfterEach(func() {
+			registry.Close()
+		})
 
-			infos, err = ioutil.ReadDir(rootfsPath("top-dir-3"))
-			Expect(err).ToNot(HaveOccurred())
-			Expect(infos).To(HaveLen(1))
+		It("resumes it where it left off", func() {
+			Expect(actualErr).ToNot(HaveOccurred())
+			Expect(ranges).To(HaveLen(2))
+			Expect(ranges[1]).To(MatchRegexp(`^bytes=[1-9]\d*-$`))
 
-			stat, err = os.Stat(rootfsPath("top-dir-3", "nested-dir"))
+			_, err := os.Stat(rootfsPath())
 			Expect(err).ToNot(HaveOccurred())
-			Expect(stat.IsDir()).To(BeTrue())
+		})
 
-			stat, err = os.Stat(rootfsPath("top-dir-4"))
-			Expect(err).ToNot(HaveOccurred())
-			Expect(stat.IsDir()).To(BeTrue())
+		Context("and keeps being cut off when resumed", func() {
+			BeforeEach(func() {
+				keepsCuttingOff = true
+			})
 
-			if os.Geteuid() != 0 {
-				Skip("Must be run as root to validate file ownership")
-			}
-			sys, ok := stat.Sys().(*syscall.Stat_t)
-			Expect(ok).To(BeTrue())
-			Expect(sys.Uid).To(Equal(uint32(1000)))
-			Expect(sys.Gid).To(Equal(uint32(1000)))
+			It("fails once it runs out of resumes and sources, rather than hanging", func() {
+				Expect(actualErr).To(HaveOccurred())
+				Expect(ranges).To(HaveLen(4))
+				Expect(actualErrOutput).To(ContainSubstring("no more sources"))
+			})
 		})
 	})
 
-	Describe("a hardlink that is later removed", func() {
-		BeforeEach(func() {
-			req.Source.Repository = "concourse/test-image-removed-hardlinks"
-			req.Version = resource.Version{
-				Tag:    "latest",
-				Digest: latestDigest(req.Source.Repository),
-			}
-		})
+	Context("with cache_path", func() {
+		var registry *ghttp.Server
+		var image v1.Image
+		var cacheDir string
 
-		It("works", func() {
-			Expect(actualErr).ToNot(HaveOccurred())
+		BeforeEach(func() {
+			registry = ghttp.NewServer()
 
-			lstat, err := os.Lstat(rootfsPath("usr", "libexec", "git-core", "git"))
+			var err error
+			image, err = random.Image(1024, 2)
 			Expect(err).ToNot(HaveOccurred())
-			Expect(lstat.Mode() & os.ModeSymlink).To(BeZero())
 
-			stat, err := os.Stat(rootfsPath("usr", "libexec", "git-core", "git"))
+			cacheDir, err = ioutil.TempDir("", "layer-cache")
 			Expect(err).ToNot(HaveOccurred())
-			Expect(stat.Mode() & os.ModeSymlink).To(BeZero())
+
+			req.Source.Repository = registry.Addr() + "/some/fake-image"
+			req.Source.CachePath = cacheDir
+
+			req.Version.Tag = "latest"
+			req.Version.Digest = serveImage(registry, "some/fake-image", "latest", image)
 		})
-	})
 
-	Describe("layers that replace symlinks with regular files", func() {
-		BeforeEach(func() {
-			req.Source.Repository = "concourse/test-image-symlinks"
-			req.Version = resource.Version{
-				Tag:    "latest",
-				Digest: latestDigest(req.Source.Repository),
-			}
+		AfterEach(func() {
+			registry.Close()
+			Expect(os.RemoveAll(cacheDir)).To(Succeed())
 		})
 
-		It("removes the symlink and writes to a new file rather than trying to open and write to it (thereby overwriting its target)", func() {
+		It("caches the layers", func() {
 			Expect(actualErr).ToNot(HaveOccurred())
 
-			Expect(cat(rootfsPath("a"))).To(Equal("symlinked\n"))
-			Expect(cat(rootfsPath("b"))).To(Equal("replaced\n"))
-		})
-	})
+			layers, err := image.Layers()
+			Expect(err).ToNot(HaveOccurred())
 
-	Describe("fetching from a private repository with credentials", func() {
-		BeforeEach(func() {
-			req.Source = resource.Source{
-				Repository: dockerPrivateRepo,
-				Tag:        "latest",
+			for _, layer := range layers {
+				digest, err := layer.Digest()
+				Expect(err).ToNot(HaveOccurred())
 
-				BasicCredentials: resource.BasicCredentials{
-					Username: dockerPrivateUsername,
-					Password: dockerPrivatePassword,
-				},
-			}
+				rc, err := layer.Compressed()
+				Expect(err).ToNot(HaveOccurred())
 
-			checkDockerPrivateUserConfigured()
+				blob, err := ioutil.ReadAll(rc)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(rc.Close()).To(Succeed())
 
-			req.Version = resource.Version{
-				Tag:    "latest",
-				Digest: PRIVATE_LATEST_STATIC_DIGEST,
+				cached, err := ioutil.ReadFile(filepath.Join(cacheDir, "sha256-"+digest.Hex))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(cached).To(Equal(blob))
 			}
+
+			entries, err := ioutil.ReadDir(cacheDir)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(entries).To(HaveLen(len(layers)))
 		})
 
-		It("works", func() {
-			Expect(actualErr).ToNot(HaveOccurred())
+		Context("when the layers are already cached", func() {
+			BeforeEach(func() {
+				layers, err := image.Layers()
+				Expect(err).ToNot(HaveOccurred())
 
-			Expect(cat(rootfsPath("Dockerfile"))).To(ContainSubstring("hello!"))
-		})
-	})
+				for _, layer := range layers {
+					digest, err := layer.Digest()
+					Expect(err).ToNot(HaveOccurred())
 
-	Describe("fetching in OCI format", func() {
-		var manifest *v1.Manifest
+					rc, err := layer.Compressed()
+					Expect(err).ToNot(HaveOccurred())
 
-		BeforeEach(func() {
-			req.Source.Repository = "concourse/test-image-static"
-			req.Params.RawFormat = "oci"
+					blob, err := ioutil.ReadAll(rc)
+					Expect(err).ToNot(HaveOccurred())
+					Expect(rc.Close()).To(Succeed())
 
-			req.Version.Tag = "latest"
-			req.Version.Digest, manifest = latestManifest(req.Source.Repository)
+					Expect(ioutil.WriteFile(filepath.Join(cacheDir, "sha256-"+digest.Hex), blob, 0644)).To(Succeed())
+
+					registry.RouteToHandler("GET", "/v2/some/fake-image/blobs/"+digest.String(), ghttp.RespondWith(http.StatusInternalServerError, "should be cached"))
+				}
+			})
+
+			It("extracts the image without fetching its layers", func() {
+				Expect(actualErr).ToNot(HaveOccurred())
+
+				_, err := os.Stat(rootfsPath())
+				Expect(err).ToNot(HaveOccurred())
+			})
 		})
 
-		It("saves the tagged image as image.tar instead of saving the rootfs", func() {
-			Expect(actualErr).ToNot(HaveOccurred())
+		Context("when the cache grows past cache_max_size", func() {
+			var stalePath string
 
-			_, err := os.Stat(filepath.Join(destDir, "rootfs"))
-			Expect(os.IsNotExist(err)).To(BeTrue())
+			BeforeEach(func() {
+				layers, err := image.Layers()
+				Expect(err).ToNot(HaveOccurred())
 
-			_, err = os.Stat(filepath.Join(destDir, "manifest.json"))
-			Expect(os.IsNotExist(err)).To(BeTrue())
+				var size int64
+				for _, layer := range layers {
+					layerSize, err := layer.Size()
+					Expect(err).ToNot(HaveOccurred())
 
-			tag, err := name.NewTag("concourse/test-image-static:latest")
-			Expect(err).ToNot(HaveOccurred())
+					size += layerSize
+				}
 
-			img, err := tarball.ImageFromPath(filepath.Join(destDir, "image.tar"), &tag)
-			Expect(err).ToNot(HaveOccurred())
+				req.Source.CacheMaxSize = size
 
-			fetchedManifest, err := img.Manifest()
-			Expect(err).ToNot(HaveOccurred())
+				stalePath = filepath.Join(cacheDir, "sha256-"+strings.Repeat("0", 64))
+				Expect(ioutil.WriteFile(stalePath, []byte("some unused layer"), 0644)).To(Succeed())
 
-			// cannot assert against digest because the saved image's manifest isn't
-			// JSON-prettified, so it has a different sha256. so just assert against
-			// digest within manifest, which is what ends up being the 'image id'
-			// anyway.
-			Expect(fetchedManifest.Config.Digest).To(Equal(manifest.Config.Digest))
-		})
-	})
+				lastUsed := time.Now().Add(-time.Hour)
+				Expect(os.Chtimes(stalePath, lastUsed, lastUsed)).To(Succeed())
+			})
 
-	Describe("saving the digest", func() {
-		BeforeEach(func() {
-			req.Source.Repository = "concourse/test-image-static"
-			req.Version.Tag = "latest"
-			req.Version.Digest = LATEST_STATIC_DIGEST
-		})
+			It("prunes the least recently used layers", func() {
+				Expect(actualErr).ToNot(HaveOccurred())
 
-		It("saves the digest to a file", func() {
-			Expect(actualErr).ToNot(HaveOccurred())
+				_, err := os.Stat(stalePath)
+				Expect(os.IsNotExist(err)).To(BeTrue())
 
-			digest, err := ioutil.ReadFile(filepath.Join(destDir, "digest"))
-			Expect(err).ToNot(HaveOccurred())
-			Expect(string(digest)).To(Equal(req.Version.Digest))
+				layers, err := image.Layers()
+				Expect(err).ToNot(HaveOccurred())
+
+				for _, layer := range layers {
+					digest, err := layer.Digest()
+					Expect(err).ToNot(HaveOccurred())
+
+					Expect(filepath.Join(cacheDir, "sha256-"+digest.Hex)).To(BeARegularFile())
+				}
+			})
 		})
 	})
 
-	Describe("saving the tag", func() {
-		BeforeEach(func() {
-			req.Source.Repository = "concourse/test-image-static"
-			req.Version = resource.Version{
-				Tag:    "tagged",
-				Digest: LATEST_STATIC_DIGEST,
-			}
-		})
+	Context("when the registry hangs past the timeout", func() {
+		var registry *ghttp.Server
+		var hang chan struct{}
 
-		It("saves the tag to a file", func() {
-			Expect(actualErr).ToNot(HaveOccurred())
+		BeforeEach(func() {
+			registry = ghttp.NewServer()
+			hang = make(chan struct{})
 
-			tag, err := ioutil.ReadFile(filepath.Join(destDir, "tag"))
+			image, err := random.Image(1024, 1)
 			Expect(err).ToNot(HaveOccurred())
-			Expect(string(tag)).To(Equal("tagged"))
-		})
-	})
 
-	Describe("saving the repository", func() {
-		BeforeEach(func() {
-			req.Source.Repository = "concourse/test-image-static"
+			req.Source.Repository = registry.Addr() + "/some/fake-image"
+			req.Source.Timeout = "1s"
+
 			req.Version.Tag = "latest"
-			req.Version.Digest = LATEST_STATIC_DIGEST
+			req.Version.Digest = serveImage(registry, "some/fake-image", "latest", image)
+
+			registry.RouteToHandler("GET", "/v2/some/fake-image/manifests/"+req.Version.Digest, func(w http.ResponseWriter, r *http.Request) {
+				<-hang
+			})
 		})
 
-		It("saves the repository string to a file", func() {
-			Expect(actualErr).ToNot(HaveOccurred())
+		AfterEach(func() {
+			close(hang)
+			registry.Close()
+		})
 
-			repository, err := ioutil.ReadFile(filepath.Join(destDir, "repository"))
-			Expect(err).ToNot(HaveOccurred())
-			Expect(string(repository)).To(Equal("concourse/test-image-static"))
+		It("exits non-zero with the timeout", func() {
+			Expect(actualErr).To(HaveOccurred())
+			Expect(actualErrOutput).To(ContainSubstring("timed out after 1s"))
 		})
 	})
 
-	Describe("skipping the download", func() {
+	Context("with an invalid timeout", func() {
 		BeforeEach(func() {
 			req.Source.Repository = "concourse/test-image-static"
-			req.Params.SkipDownload = true
+			req.Source.Timeout = "soon"
 			req.Version.Tag = "latest"
-			req.Version.Digest = LATEST_STATIC_DIGEST
-		})
-
-		It("does not download the image", func() {
-			Expect(actualErr).ToNot(HaveOccurred())
-
-			_, err := os.Stat(filepath.Join(destDir, "rootfs"))
-			Expect(os.IsNotExist(err)).To(BeTrue())
-
-			_, err = os.Stat(filepath.Join(destDir, "manifest.json"))
-			Expect(os.IsNotExist(err)).To(BeTrue())
-
-			_, err = os.Stat(filepath.Join(destDir, "image.tar"))
-			Expect(os.IsNotExist(err)).To(BeTrue())
 		})
 
-		It("saves the tag and digest files", func() {
-			Expect(actualErr).ToNot(HaveOccurred())
-
-			digest, err := ioutil.ReadFile(filepath.Join(destDir, "digest"))
-			Expect(err).ToNot(HaveOccurred())
-			Expect(string(digest)).To(Equal(LATEST_STATIC_DIGEST))
-
-			tag, err := ioutil.ReadFile(filepath.Join(destDir, "tag"))
-			Expect(err).ToNot(HaveOccurred())
-			Expect(string(tag)).To(Equal("latest"))
+		It("exits non-zero without fetching", func() {
+			Expect(actualErr).To(HaveOccurred())
+			Expect(actualErrOutput).To(ContainSubstring(`invalid timeout "soon"`))
 		})
 	})
 
@@ -474,11 +2510,7 @@ var _ = Describe("In", func() {
 					ghttp.RespondWith(http.StatusTooManyRequests, "calm down"),
 				),
 
-				// 429 on blob fetch
-				ghttp.CombineHandlers(
-					ghttp.VerifyRequest("GET", "/v2/"),
-					ghttp.RespondWith(http.StatusOK, `welcome to zombocom`),
-				),
+				// 429 on blob fetch, reusing the transport from the last attempt
 				ghttp.CombineHandlers(
 					ghttp.VerifyRequest("GET", "/v2/fake-image/manifests/"+digest.String()),
 					ghttp.RespondWith(http.StatusOK, manifest),
@@ -489,10 +2521,6 @@ var _ = Describe("In", func() {
 				),
 
 				// successful sequence
-				ghttp.CombineHandlers(
-					ghttp.VerifyRequest("GET", "/v2/"),
-					ghttp.RespondWith(http.StatusOK, `welcome to zombocom`),
-				),
 				ghttp.CombineHandlers(
 					ghttp.VerifyRequest("GET", "/v2/fake-image/manifests/"+digest.String()),
 					ghttp.RespondWith(http.StatusOK, manifest),
@@ -751,6 +2779,78 @@ var _ = Describe("In", func() {
 			})
 		})
 
+		Context("which fails to serve a layer", func() {
+			var layerDigest v1.Hash
+
+			BeforeEach(func() {
+				req.Source.Repository = "concourse/test-image-static"
+				req.Source.RegistryMirror = &resource.RegistryMirror{
+					Host: mirror.Addr(),
+				}
+
+				req.Version.Tag = "latest"
+				req.Version.Digest = LATEST_STATIC_DIGEST
+
+				ref, err := name.NewDigest(req.Source.Repository + "@" + req.Version.Digest)
+				Expect(err).ToNot(HaveOccurred())
+
+				image, err := remote.Image(ref)
+				Expect(err).ToNot(HaveOccurred())
+
+				manifest, err := image.RawManifest()
+				Expect(err).ToNot(HaveOccurred())
+
+				mediaType, err := image.MediaType()
+				Expect(err).ToNot(HaveOccurred())
+
+				config, err := image.RawConfigFile()
+				Expect(err).ToNot(HaveOccurred())
+
+				configDigest, err := image.ConfigName()
+				Expect(err).ToNot(HaveOccurred())
+
+				layers, err := image.Layers()
+				Expect(err).ToNot(HaveOccurred())
+
+				layerDigest, err = layers[0].Digest()
+				Expect(err).ToNot(HaveOccurred())
+
+				mirror.RouteToHandler("GET", "/v2/", ghttp.RespondWith(http.StatusOK, `welcome to zombocom`))
+				mirror.RouteToHandler("GET", "/v2/concourse/test-image-static/manifests/"+req.Version.Digest, ghttp.RespondWith(http.StatusOK, manifest, http.Header{
+					"Content-Type": {string(mediaType)},
+				}))
+				mirror.RouteToHandler("GET", "/v2/concourse/test-image-static/blobs/"+configDigest.String(), ghttp.RespondWith(http.StatusOK, config))
+
+				for _, layer := range layers {
+					digest, err := layer.Digest()
+					Expect(err).ToNot(HaveOccurred())
+
+					mirror.RouteToHandler("GET", "/v2/concourse/test-image-static/blobs/"+digest.String(), ghttp.RespondWith(http.StatusBadGateway, "upstream unavailable"))
+				}
+			})
+
+			It("fetches just the failing layers from the origin", func() {
+				Expect(actualErr).ToNot(HaveOccurred())
+
+				_, err := os.Stat(rootfsPath("Dockerfile"))
+				Expect(err).ToNot(HaveOccurred())
+
+				layerRequests := 0
+				manifestRequests := 0
+				for _, r := range mirror.ReceivedRequests() {
+					switch r.URL.Path {
+					case "/v2/concourse/test-image-static/blobs/" + layerDigest.String():
+						layerRequests++
+					case "/v2/concourse/test-image-static/manifests/" + req.Version.Digest:
+						manifestRequests++
+					}
+				}
+
+				Expect(layerRequests).ToNot(BeZero())
+				Expect(manifestRequests).To(Equal(1))
+			})
+		})
+
 		Context("which is missing the image", func() {
 			BeforeEach(func() {
 				req.Source.RegistryMirror = &resource.RegistryMirror{
@@ -0,0 +1,121 @@
+package resource
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+	"github.com/sirupsen/logrus"
+)
+
+const oauthClientID = "registry-image-resource"
+
+// exchangeOAuthToken exchanges the credentials for a refresh token using the
+// OAuth2 password grant against the registry's token endpoint, as described in
+// https://docs.docker.com/registry/spec/auth/oauth/.
+//
+// The returned authenticator carries the refresh token, which the transport
+// then uses to POST for access tokens (and any refresh tokens the endpoint
+// rotates to) instead of sending the credentials with every token request.
+//
+// A nil authenticator is returned if the registry doesn't use bearer tokens or
+// its token endpoint doesn't support the exchange, in which case the
+// credentials should be used as-is.
+func exchangeOAuthToken(registry name.Registry, creds BasicCredentials, tr http.RoundTripper, scopes []string) (authn.Authenticator, error) {
+	client := &http.Client{Transport: tr}
+
+	req, err := http.NewRequestWithContext(RequestContext(), http.MethodGet, fmt.Sprintf("%s://%s/v2/", registry.Scheme(), registry.RegistryStr()), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	ping, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("ping registry: %w", err)
+	}
+
+	ping.Body.Close()
+
+	if ping.StatusCode != http.StatusUnauthorized {
+		return nil, nil
+	}
+
+	scheme, params := parseChallenge(ping.Header.Get("WWW-Authenticate"))
+	if !strings.EqualFold(scheme, "bearer") || params["realm"] == "" {
+		return nil, nil
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "password")
+	form.Set("username", creds.Username)
+	form.Set("password", creds.Password)
+	form.Set("client_id", oauthClientID)
+	form.Set("access_type", "offline")
+	form.Set("scope", strings.Join(scopes, " "))
+	if params["service"] != "" {
+		form.Set("service", params["service"])
+	}
+
+	res, err := client.PostForm(params["realm"], form)
+	if err != nil {
+		return nil, fmt.Errorf("exchange token: %w", err)
+	}
+
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusNotFound || res.StatusCode == http.StatusMethodNotAllowed {
+		logrus.Debugf("token endpoint %s does not support oauth2; falling back to basic auth", params["realm"])
+		return nil, nil
+	}
+
+	err = transport.CheckError(res, http.StatusOK)
+	if err != nil {
+		return nil, fmt.Errorf("exchange token: %w", err)
+	}
+
+	var token struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+
+	err = json.NewDecoder(res.Body).Decode(&token)
+	if err != nil {
+		return nil, fmt.Errorf("decode token response: %w", err)
+	}
+
+	if token.RefreshToken == "" {
+		logrus.Debugf("token endpoint %s did not return a refresh token; falling back to basic auth", params["realm"])
+		return nil, nil
+	}
+
+	return authn.FromConfig(authn.AuthConfig{
+		IdentityToken: token.RefreshToken,
+	}), nil
+}
+
+// parseChallenge parses a WWW-Authenticate header, e.g.
+//
+//	Bearer realm="https://auth.example.com/token",service="registry.example.com"
+func parseChallenge(header string) (string, map[string]string) {
+	scheme, rest, _ := strings.Cut(strings.TrimSpace(header), " ")
+
+	params := map[string]string{}
+	for rest != "" {
+		var key, value string
+		key, rest, _ = strings.Cut(strings.TrimLeft(rest, " ,"), "=")
+
+		if strings.HasPrefix(rest, `"`) {
+			value, rest, _ = strings.Cut(rest[1:], `"`)
+		} else {
+			value, rest, _ = strings.Cut(rest, ",")
+		}
+
+		params[strings.ToLower(strings.TrimSpace(key))] = value
+	}
+
+	return scheme, params
+}
@@ -0,0 +1,123 @@
+package resource
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+)
+
+// OAuth configures an OAuth2 token endpoint from which to obtain a bearer
+// token for the registry, e.g. for Harbor or Quay robot accounts federated
+// with an OIDC provider.
+type OAuth struct {
+	TokenURL string `json:"token_url"`
+
+	// ClientID and ClientSecret obtain a token with the client credentials
+	// grant.
+	ClientID     string `json:"client_id,omitempty"`
+	ClientSecret string `json:"client_secret,omitempty"`
+
+	// IDToken, e.g. from Concourse's idtoken var source, is exchanged for a
+	// token with the token exchange grant (RFC 8693).
+	IDToken string `json:"id_token,omitempty"`
+
+	Scopes   []string `json:"scopes,omitempty"`
+	Audience string   `json:"audience,omitempty"`
+}
+
+// AuthenticateWithOAuth obtains a bearer token per the source's oauth, if
+// configured, with which to authenticate to the registry.
+func (source *Source) AuthenticateWithOAuth() error {
+	if source.OAuth == nil {
+		return nil
+	}
+
+	if source.Username != "" || source.Password != "" {
+		return Invalid("cannot specify 'username' or 'password' with 'oauth'")
+	}
+
+	token, err := OAuthToken(*source.OAuth)
+	if err != nil {
+		return Categorize(CategoryAuth, fmt.Errorf("cannot authenticate with %s: %w", source.OAuth.TokenURL, err))
+	}
+
+	source.bearerToken = token
+
+	return nil
+}
+
+// OAuthToken obtains an access token from the token endpoint, with the
+// client credentials grant or by exchanging the ID token.
+func OAuthToken(oauth OAuth) (string, error) {
+	if oauth.TokenURL == "" {
+		return "", Invalid("oauth requires 'token_url'")
+	}
+
+	form := url.Values{}
+	if len(oauth.Scopes) > 0 {
+		form.Set("scope", strings.Join(oauth.Scopes, " "))
+	}
+
+	if oauth.Audience != "" {
+		form.Set("audience", oauth.Audience)
+	}
+
+	switch {
+	case oauth.IDToken != "":
+		form.Set("grant_type", "urn:ietf:params:oauth:grant-type:token-exchange")
+		form.Set("subject_token", oauth.IDToken)
+		form.Set("subject_token_type", "urn:ietf:params:oauth:token-type:id_token")
+		form.Set("requested_token_type", "urn:ietf:params:oauth:token-type:access_token")
+	case oauth.ClientID != "" && oauth.ClientSecret != "":
+		form.Set("grant_type", "client_credentials")
+	default:
+		return "", Invalid("oauth requires 'client_id' and 'client_secret', or 'id_token'")
+	}
+
+	req, err := http.NewRequestWithContext(RequestContext(), http.MethodPost, oauth.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	if oauth.ClientID != "" {
+		// also identify the client when exchanging an ID token, as some
+		// providers require
+		req.SetBasicAuth(url.QueryEscape(oauth.ClientID), url.QueryEscape(oauth.ClientSecret))
+	}
+
+	client := &http.Client{Timeout: 30 * time.Second}
+
+	res, err := client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("get token: %w", err)
+	}
+
+	defer res.Body.Close()
+
+	err = transport.CheckError(res, http.StatusOK)
+	if err != nil {
+		return "", fmt.Errorf("get token: %w", err)
+	}
+
+	var body struct {
+		AccessToken string `json:"access_token"`
+	}
+
+	err = json.NewDecoder(res.Body).Decode(&body)
+	if err != nil {
+		return "", fmt.Errorf("decode token: %w", err)
+	}
+
+	if body.AccessToken == "" {
+		return "", fmt.Errorf("get token: no access token in response")
+	}
+
+	return body.AccessToken, nil
+}
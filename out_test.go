@@ -1,17 +1,28 @@
 package resource_test
 
 import (
+	"archive/tar"
 	"bytes"
+	"compress/gzip"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
 	"encoding/json"
 	"encoding/pem"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
+	"net/http/httptest"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"regexp"
+	"strconv"
+	"strings"
 	"sync"
 
 	"github.com/google/go-containerregistry/pkg/authn"
@@ -19,15 +30,21 @@ import (
 	v1 "github.com/google/go-containerregistry/pkg/v1"
 	"github.com/google/go-containerregistry/pkg/v1/empty"
 	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
 	"github.com/google/go-containerregistry/pkg/v1/partial"
 	"github.com/google/go-containerregistry/pkg/v1/random"
 	"github.com/google/go-containerregistry/pkg/v1/remote"
 	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
 	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/google/go-containerregistry/pkg/v1/validate"
+	"github.com/klauspost/compress/zstd"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/ginkgo/extensions/table"
 	. "github.com/onsi/gomega"
 	"github.com/onsi/gomega/ghttp"
+	"golang.org/x/crypto/nacl/secretbox"
+	"golang.org/x/crypto/scrypt"
 
 	resource "github.com/concourse/registry-image-resource"
 )
@@ -44,6 +61,12 @@ var _ = Describe("Out", func() {
 		Params resource.PutParams
 	}
 
+	// params not supported by this version of the resource type
+	var unknownParams map[string]interface{}
+
+	// environment variables to run the command with, besides TEST
+	var env []string
+
 	var res struct {
 		Version  resource.Version
 		Metadata []resource.MetadataField
@@ -56,6 +79,8 @@ var _ = Describe("Out", func() {
 
 		req.Source = resource.Source{}
 		req.Params = resource.PutParams{}
+		unknownParams = nil
+		env = nil
 
 		res.Version = resource.Version{}
 		res.Metadata = nil
@@ -67,11 +92,23 @@ var _ = Describe("Out", func() {
 
 	JustBeforeEach(func() {
 		cmd := exec.Command(bins.Out, srcDir)
-		cmd.Env = []string{"TEST=true"}
+		cmd.Env = append([]string{"TEST=true"}, env...)
 
 		payload, err := json.Marshal(req)
 		Expect(err).ToNot(HaveOccurred())
 
+		if len(unknownParams) > 0 {
+			var fields map[string]map[string]interface{}
+			Expect(json.Unmarshal(payload, &fields)).To(Succeed())
+
+			for key, value := range unknownParams {
+				fields["Params"][key] = value
+			}
+
+			payload, err = json.Marshal(fields)
+			Expect(err).ToNot(HaveOccurred())
+		}
+
 		outBuf := new(bytes.Buffer)
 		errBuf := new(bytes.Buffer)
 
@@ -141,16 +178,28 @@ var _ = Describe("Out", func() {
 		It("returns metadata", func() {
 			Expect(actualErr).ToNot(HaveOccurred())
 
-			Expect(res.Metadata).To(Equal([]resource.MetadataField{
-				{
+			expected := []interface{}{
+				resource.MetadataField{
 					Name:  "repository",
 					Value: dockerPushRepo,
 				},
-				{
+				resource.MetadataField{
 					Name:  "tags",
 					Value: parallelTag("latest"),
 				},
-			}))
+			}
+
+			digest, err := name.NewDigest(dockerPushRepo + "@" + res.Version.Digest)
+			Expect(err).ToNot(HaveOccurred())
+
+			if url := resource.WebURL(digest); url != "" {
+				expected = append(expected, resource.MetadataField{
+					Name:  "url",
+					Value: url,
+				})
+			}
+
+			Expect(res.Metadata).To(ConsistOf(append(expected, transferMetadata()...)...))
 		})
 
 		Context("When using bump_aliases", func() {
@@ -262,134 +311,1953 @@ var _ = Describe("Out", func() {
 				Expect(err).ToNot(HaveOccurred())
 			})
 
-			It("pushes provided tags in addition to the tag in 'source'", func() {
-				randomDigest, err := randomImage.Digest()
-				Expect(err).ToNot(HaveOccurred())
+			It("pushes provided tags in addition to the tag in 'source'", func() {
+				randomDigest, err := randomImage.Digest()
+				Expect(err).ToNot(HaveOccurred())
+
+				for _, t := range []string{"latest", "additional", "tags"} {
+					tag := parallelTag(t)
+
+					name, err := name.ParseReference(req.Source.Repository + ":" + tag)
+					Expect(err).ToNot(HaveOccurred())
+
+					auth := &authn.Basic{
+						Username: req.Source.Username,
+						Password: req.Source.Password,
+					}
+
+					image, err := remote.Image(name, remote.WithAuth(auth))
+					Expect(err).ToNot(HaveOccurred())
+
+					pushedDigest, err := image.Digest()
+					Expect(err).ToNot(HaveOccurred())
+
+					Expect(pushedDigest).To(Equal(randomDigest))
+				}
+			})
+		})
+	})
+
+	Context("pushing an OCI imageIndex (multi-arch) image to dockerhub", func() {
+		var randomImageIndex v1.ImageIndex
+
+		BeforeEach(func() {
+			checkDockerPushUserConfigured()
+
+			req.Source = resource.Source{
+				Repository: dockerPushRepo,
+				Tag:        resource.Tag(parallelTag("latest")),
+
+				BasicCredentials: resource.BasicCredentials{
+					Username: dockerPushUsername,
+					Password: dockerPushPassword,
+				},
+			}
+
+			var err error
+
+			randomImageIndex, err = random.Index(1024, 1, 2)
+			Expect(err).ToNot(HaveOccurred())
+
+			path := filepath.Join(srcDir, "multi-arch")
+			p, err := layout.Write(path, empty.Index)
+			Expect(err).ToNot(HaveOccurred())
+
+			err = p.AppendIndex(randomImageIndex)
+			Expect(err).ToNot(HaveOccurred())
+
+			req.Params.Image = "multi-arch"
+		})
+
+		It("works", func() {
+			Expect(actualErr).ToNot(HaveOccurred())
+
+			name, err := name.ParseReference(req.Source.Name())
+			Expect(err).ToNot(HaveOccurred())
+
+			auth := &authn.Basic{
+				Username: req.Source.Username,
+				Password: req.Source.Password,
+			}
+
+			index, err := remote.Index(name, remote.WithAuth(auth))
+			Expect(err).ToNot(HaveOccurred())
+
+			pushedDigest, err := index.Digest()
+			Expect(err).ToNot(HaveOccurred())
+
+			randomDigest, err := randomImageIndex.Digest()
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(pushedDigest).To(Equal(randomDigest))
+		})
+
+		It("returns metadata", func() {
+			Expect(actualErr).ToNot(HaveOccurred())
+
+			expected := []interface{}{
+				resource.MetadataField{
+					Name:  "repository",
+					Value: dockerPushRepo,
+				},
+				resource.MetadataField{
+					Name:  "tags",
+					Value: parallelTag("latest"),
+				},
+			}
+
+			digest, err := name.NewDigest(dockerPushRepo + "@" + res.Version.Digest)
+			Expect(err).ToNot(HaveOccurred())
+
+			if url := resource.WebURL(digest); url != "" {
+				expected = append(expected, resource.MetadataField{
+					Name:  "url",
+					Value: url,
+				})
+			}
+
+			Expect(res.Metadata).To(ConsistOf(append(expected, transferMetadata()...)...))
+		})
+
+		Context("When using bump_aliases", func() {
+			BeforeEach(func() {
+				req.Params.BumpAliases = true
+				req.Params.Version = "1.0.0"
+			})
+
+			It("Push the right tags", func() {
+				Expect(actualErr).ToNot(HaveOccurred())
+
+				tags := []string{"1.0.0", "1.0", "1", req.Source.Tag.String()}
+
+				for _, tag := range tags {
+					name, err := name.ParseReference(dockerPushRepo + ":" + tag)
+					Expect(err).ToNot(HaveOccurred())
+
+					auth := &authn.Basic{
+						Username: req.Source.Username,
+						Password: req.Source.Password,
+					}
+
+					index, err := remote.Index(name, remote.WithAuth(auth))
+					Expect(err).ToNot(HaveOccurred())
+
+					pushedDigest, err := index.Digest()
+					Expect(err).ToNot(HaveOccurred())
+
+					randomDigest, err := randomImageIndex.Digest()
+					Expect(err).ToNot(HaveOccurred())
+
+					Expect(pushedDigest).To(Equal(randomDigest))
+				}
+			})
+		})
+	})
+
+	Context("with unknown params", func() {
+		var registry *httptest.Server
+
+		BeforeEach(func() {
+			registry = newFakeRegistry()
+
+			req.Source = resource.Source{
+				Repository: strings.TrimPrefix(registry.URL, "http://") + "/fake-image",
+				Tag:        "some-tag",
+			}
+
+			tag, err := name.NewTag(req.Source.Name())
+			Expect(err).ToNot(HaveOccurred())
+
+			randomImage, err := random.Image(1024, 1)
+			Expect(err).ToNot(HaveOccurred())
+
+			err = tarball.WriteToFile(filepath.Join(srcDir, "image.tar"), tag, randomImage)
+			Expect(err).ToNot(HaveOccurred())
+
+			req.Params.Image = "image.tar"
+
+			unknownParams = map[string]interface{}{
+				"some_future_param": true,
+			}
+		})
+
+		AfterEach(func() {
+			registry.Close()
+		})
+
+		It("exits non-zero and returns an error", func() {
+			Expect(actualErr).To(HaveOccurred())
+			Expect(actualErrOutput).To(ContainSubstring(`unknown field "some_future_param"`))
+		})
+
+		Context("when strict is false", func() {
+			BeforeEach(func() {
+				strict := false
+				req.Source.Strict = &strict
+			})
+
+			It("warns and pushes the image", func() {
+				Expect(actualErr).ToNot(HaveOccurred())
+				Expect(actualErrOutput).To(ContainSubstring(`ignoring unknown field "some_future_param"`))
+				Expect(res.Version.Digest).ToNot(BeEmpty())
+			})
+		})
+	})
+
+	Context("with labels_file", func() {
+		var registry *httptest.Server
+
+		BeforeEach(func() {
+			registry = newFakeRegistry()
+
+			req.Source = resource.Source{
+				Repository: strings.TrimPrefix(registry.URL, "http://") + "/fake-image",
+				Tag:        "some-tag",
+			}
+
+			tag, err := name.NewTag(req.Source.Name())
+			Expect(err).ToNot(HaveOccurred())
+
+			randomImage, err := random.Image(1024, 1)
+			Expect(err).ToNot(HaveOccurred())
+
+			cfg, err := randomImage.ConfigFile()
+			Expect(err).ToNot(HaveOccurred())
+
+			cfg = cfg.DeepCopy()
+			cfg.Config.Labels = map[string]string{
+				"org.opencontainers.image.vendor":   "some-vendor",
+				"org.opencontainers.image.revision": "old-revision",
+			}
+
+			labelledImage, err := mutate.ConfigFile(randomImage, cfg)
+			Expect(err).ToNot(HaveOccurred())
+
+			err = tarball.WriteToFile(filepath.Join(srcDir, "image.tar"), tag, labelledImage)
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(os.MkdirAll(filepath.Join(srcDir, "metadata"), 0755)).To(Succeed())
+			Expect(ioutil.WriteFile(
+				filepath.Join(srcDir, "metadata", "labels.json"),
+				[]byte(`{"org.opencontainers.image.revision":"some-revision","build":"42"}`),
+				0644,
+			)).To(Succeed())
+
+			req.Params.Image = "image.tar"
+			req.Params.LabelsFile = "metadata/labels.json"
+		})
+
+		AfterEach(func() {
+			registry.Close()
+		})
+
+		It("merges the labels into the pushed image's config", func() {
+			Expect(actualErr).ToNot(HaveOccurred())
+
+			ref, err := name.ParseReference(req.Source.Name())
+			Expect(err).ToNot(HaveOccurred())
+
+			image, err := remote.Image(ref)
+			Expect(err).ToNot(HaveOccurred())
+
+			digest, err := image.Digest()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(res.Version.Digest).To(Equal(digest.String()))
+
+			cfg, err := image.ConfigFile()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(cfg.Config.Labels).To(Equal(map[string]string{
+				"org.opencontainers.image.vendor":   "some-vendor",
+				"org.opencontainers.image.revision": "some-revision",
+				"build":                             "42",
+			}))
+		})
+
+		Context("with metadata_labels", func() {
+			BeforeEach(func() {
+				req.Source.MetadataLabels = []string{"org.opencontainers.image.revision", "build"}
+			})
+
+			It("returns the pushed image's labels as metadata", func() {
+				Expect(actualErr).ToNot(HaveOccurred())
+
+				Expect(res.Metadata).To(ContainElements(
+					resource.MetadataField{
+						Name:  "org.opencontainers.image.revision",
+						Value: "some-revision",
+					},
+					resource.MetadataField{
+						Name:  "build",
+						Value: "42",
+					},
+				))
+			})
+		})
+
+		Context("when the labels file is not an object of strings", func() {
+			BeforeEach(func() {
+				Expect(ioutil.WriteFile(
+					filepath.Join(srcDir, "metadata", "labels.json"),
+					[]byte(`{"build":42}`),
+					0644,
+				)).To(Succeed())
+			})
+
+			It("exits non-zero and returns an error", func() {
+				Expect(actualErr).To(HaveOccurred())
+				Expect(actualErrOutput).To(ContainSubstring("invalid labels"))
+			})
+		})
+	})
+
+	Context("with platforms", func() {
+		var registry *httptest.Server
+
+		BeforeEach(func() {
+			registry = newFakeRegistry()
+
+			req.Source = resource.Source{
+				Repository: strings.TrimPrefix(registry.URL, "http://") + "/fake-image",
+				Tag:        "some-tag",
+			}
+
+			var index v1.ImageIndex = empty.Index
+			for _, platform := range []v1.Platform{
+				{OS: "linux", Architecture: "amd64"},
+				{OS: "linux", Architecture: "arm64"},
+				{OS: "linux", Architecture: "arm", Variant: "v7"},
+			} {
+				platform := platform
+
+				image, err := random.Image(1024, 1)
+				Expect(err).ToNot(HaveOccurred())
+
+				digest, err := image.Digest()
+				Expect(err).ToNot(HaveOccurred())
+
+				attestation, err := random.Image(1024, 1)
+				Expect(err).ToNot(HaveOccurred())
+
+				index = mutate.AppendManifests(index, mutate.IndexAddendum{
+					Add: image,
+					Descriptor: v1.Descriptor{
+						Platform: &platform,
+					},
+				}, mutate.IndexAddendum{
+					Add: attestation,
+					Descriptor: v1.Descriptor{
+						Platform: &v1.Platform{OS: "unknown", Architecture: "unknown"},
+						Annotations: map[string]string{
+							"vnd.docker.reference.type":   "attestation-manifest",
+							"vnd.docker.reference.digest": digest.String(),
+						},
+					},
+				})
+			}
+
+			p, err := layout.Write(filepath.Join(srcDir, "multi-arch"), empty.Index)
+			Expect(err).ToNot(HaveOccurred())
+
+			err = p.AppendIndex(index)
+			Expect(err).ToNot(HaveOccurred())
+
+			req.Params.Image = "multi-arch"
+			req.Params.Platforms = []string{"linux/amd64", "linux/arm64"}
+		})
+
+		AfterEach(func() {
+			registry.Close()
+		})
+
+		It("pushes only the images for those platforms and their attestations", func() {
+			Expect(actualErr).ToNot(HaveOccurred())
+
+			ref, err := name.ParseReference(req.Source.Name())
+			Expect(err).ToNot(HaveOccurred())
+
+			index, err := remote.Index(ref)
+			Expect(err).ToNot(HaveOccurred())
+
+			digest, err := index.Digest()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(res.Version.Digest).To(Equal(digest.String()))
+
+			manifest, err := index.IndexManifest()
+			Expect(err).ToNot(HaveOccurred())
+
+			platforms := []string{}
+			for _, desc := range manifest.Manifests {
+				platforms = append(platforms, desc.Platform.String())
+			}
+
+			Expect(platforms).To(Equal([]string{
+				"linux/amd64",
+				"unknown/unknown",
+				"linux/arm64",
+				"unknown/unknown",
+			}))
+		})
+
+		Context("when no image matches", func() {
+			BeforeEach(func() {
+				req.Params.Platforms = []string{"windows/amd64"}
+			})
+
+			It("exits non-zero and returns an error", func() {
+				Expect(actualErr).To(HaveOccurred())
+				Expect(actualErrOutput).To(ContainSubstring("no images in the index match platforms"))
+			})
+		})
+	})
+
+	Context("with recompress", func() {
+		var registry *httptest.Server
+		var image v1.Image
+
+		BeforeEach(func() {
+			registry = newFakeRegistry()
+
+			req.Source = resource.Source{
+				Repository: strings.TrimPrefix(registry.URL, "http://") + "/fake-image",
+				Tag:        "some-tag",
+			}
+
+			tag, err := name.NewTag(req.Source.Name())
+			Expect(err).ToNot(HaveOccurred())
+
+			image, err = random.Image(1024, 2)
+			Expect(err).ToNot(HaveOccurred())
+
+			err = tarball.WriteToFile(filepath.Join(srcDir, "image.tar"), tag, image)
+			Expect(err).ToNot(HaveOccurred())
+
+			req.Params.Image = "image.tar"
+			req.Params.Recompress = "zstd"
+		})
+
+		AfterEach(func() {
+			registry.Close()
+		})
+
+		expectZstd := func(pushed v1.Image) {
+			layers, err := pushed.Layers()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(layers).To(HaveLen(2))
+
+			for _, layer := range layers {
+				mediaType, err := layer.MediaType()
+				Expect(err).ToNot(HaveOccurred())
+				Expect(mediaType).To(Equal(types.OCILayerZStd))
+			}
+
+			pushedCfg, err := pushed.ConfigFile()
+			Expect(err).ToNot(HaveOccurred())
+
+			cfg, err := image.ConfigFile()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(pushedCfg.RootFS.DiffIDs).To(Equal(cfg.RootFS.DiffIDs))
+		}
+
+		It("pushes the image with zstd layers", func() {
+			Expect(actualErr).ToNot(HaveOccurred())
+
+			ref, err := name.ParseReference(req.Source.Name())
+			Expect(err).ToNot(HaveOccurred())
+
+			pushed, err := remote.Image(ref)
+			Expect(err).ToNot(HaveOccurred())
+
+			expectZstd(pushed)
+		})
+
+		Context("with both", func() {
+			BeforeEach(func() {
+				req.Params.Recompress = "both"
+			})
+
+			It("pushes an index with the original image and the zstd image", func() {
+				Expect(actualErr).ToNot(HaveOccurred())
+
+				ref, err := name.ParseReference(req.Source.Name())
+				Expect(err).ToNot(HaveOccurred())
+
+				index, err := remote.Index(ref)
+				Expect(err).ToNot(HaveOccurred())
+
+				manifest, err := index.IndexManifest()
+				Expect(err).ToNot(HaveOccurred())
+				Expect(manifest.Manifests).To(HaveLen(2))
+
+				digest, err := image.Digest()
+				Expect(err).ToNot(HaveOccurred())
+				Expect(manifest.Manifests[0].Digest).To(Equal(digest))
+				Expect(manifest.Manifests[1].Annotations).To(HaveKeyWithValue("io.github.containers.compression.zstd", "true"))
+
+				zstdImage, err := index.Image(manifest.Manifests[1].Digest)
+				Expect(err).ToNot(HaveOccurred())
+
+				expectZstd(zstdImage)
+			})
+		})
+
+		Context("with the expected_digest of the image given", func() {
+			BeforeEach(func() {
+				digest, err := image.Digest()
+				Expect(err).ToNot(HaveOccurred())
+
+				req.Params.ExpectedDigest = digest.String()
+			})
+
+			It("compares it before recompressing, and pushes the zstd image", func() {
+				Expect(actualErr).ToNot(HaveOccurred())
+
+				ref, err := name.ParseReference(req.Source.Name())
+				Expect(err).ToNot(HaveOccurred())
+
+				pushed, err := remote.Image(ref)
+				Expect(err).ToNot(HaveOccurred())
+
+				expectZstd(pushed)
+			})
+		})
+
+		Context("with an unknown compression", func() {
+			BeforeEach(func() {
+				req.Params.Recompress = "brotli"
+			})
+
+			It("exits non-zero and returns an error", func() {
+				Expect(actualErr).To(HaveOccurred())
+				Expect(actualErrOutput).To(ContainSubstring(`unknown recompress "brotli"`))
+			})
+		})
+	})
+
+	Context("with additional_tags_template", func() {
+		var registry *httptest.Server
+		var image v1.Image
+
+		BeforeEach(func() {
+			registry = newFakeRegistry()
+
+			req.Source = resource.Source{
+				Repository: strings.TrimPrefix(registry.URL, "http://") + "/fake-image",
+			}
+
+			tag, err := name.NewTag(req.Source.Repository + ":latest")
+			Expect(err).ToNot(HaveOccurred())
+
+			image, err = random.Image(1024, 1)
+			Expect(err).ToNot(HaveOccurred())
+
+			err = tarball.WriteToFile(filepath.Join(srcDir, "image.tar"), tag, image)
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(os.MkdirAll(filepath.Join(srcDir, "repo", ".git"), 0755)).To(Succeed())
+			Expect(ioutil.WriteFile(
+				filepath.Join(srcDir, "repo", ".git", "ref"),
+				[]byte("4e5c4ea\n"),
+				0644,
+			)).To(Succeed())
+
+			req.Params.Image = "image.tar"
+			req.Params.Version = "1.2.3"
+			req.Params.Variants = []string{"alpine", "slim"}
+			req.Params.AdditionalTagsTemplate = "{{.Vars.commit}} {{.Version}}-{{.Variant}}-{{.Vars.commit}} build-{{.Date}}"
+			req.Params.TemplateVars = map[string]string{
+				"commit": "repo/.git/ref",
+			}
+		})
+
+		AfterEach(func() {
+			registry.Close()
+		})
+
+		It("pushes the expanded tags", func() {
+			Expect(actualErr).ToNot(HaveOccurred())
+
+			repo, err := name.NewRepository(req.Source.Repository)
+			Expect(err).ToNot(HaveOccurred())
+
+			tags, err := remote.List(repo)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(tags).To(ConsistOf(
+				"1.2.3-alpine",
+				"1.2.3-slim",
+				"4e5c4ea",
+				"1.2.3-alpine-4e5c4ea",
+				"1.2.3-slim-4e5c4ea",
+				MatchRegexp(`^build-\d{8}$`),
+			))
+		})
+
+		Context("when a variable is not configured", func() {
+			BeforeEach(func() {
+				req.Params.AdditionalTagsTemplate = "{{.Vars.branch}}"
+			})
+
+			It("exits non-zero without pushing", func() {
+				Expect(actualErr).To(HaveOccurred())
+				Expect(actualErrOutput).To(ContainSubstring("expand additional_tags_template"))
+				Expect(actualErrOutput).To(ContainSubstring("branch"))
+			})
+		})
+	})
+
+	Context("with additional_repositories", func() {
+		var registry, otherRegistry *httptest.Server
+		var image v1.Image
+
+		BeforeEach(func() {
+			registry = newFakeRegistry()
+			otherRegistry = newFakeRegistry()
+
+			req.Source = resource.Source{
+				Repository: strings.TrimPrefix(registry.URL, "http://") + "/fake-image",
+				Tag:        "some-tag",
+			}
+
+			req.Params.AdditionalRepositories = []resource.Source{
+				{Repository: strings.TrimPrefix(otherRegistry.URL, "http://") + "/other-image"},
+			}
+
+			tag, err := name.NewTag(req.Source.Name())
+			Expect(err).ToNot(HaveOccurred())
+
+			image, err = random.Image(1024, 1)
+			Expect(err).ToNot(HaveOccurred())
+
+			err = tarball.WriteToFile(filepath.Join(srcDir, "image.tar"), tag, image)
+			Expect(err).ToNot(HaveOccurred())
+
+			req.Params.Image = "image.tar"
+		})
+
+		AfterEach(func() {
+			registry.Close()
+			otherRegistry.Close()
+		})
+
+		It("pushes the tags to every repository", func() {
+			Expect(actualErr).ToNot(HaveOccurred())
+
+			digest, err := image.Digest()
+			Expect(err).ToNot(HaveOccurred())
+
+			for _, repo := range []string{req.Source.Repository, req.Params.AdditionalRepositories[0].Repository} {
+				ref, err := name.ParseReference(repo + ":some-tag")
+				Expect(err).ToNot(HaveOccurred())
+
+				desc, err := remote.Head(ref)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(desc.Digest).To(Equal(digest))
+			}
+
+			Expect(res.Metadata).To(ContainElement(resource.MetadataField{
+				Name:  "additional_repositories",
+				Value: req.Params.AdditionalRepositories[0].Repository,
+			}))
+		})
+
+		Context("with several additional repositories in each registry", func() {
+			var primaryRegistry, mirrorRegistry *mountingRegistry
+
+			BeforeEach(func() {
+				primaryRegistry = newMountingRegistry()
+				mirrorRegistry = newMountingRegistry()
+
+				req.Source.Repository = strings.TrimPrefix(primaryRegistry.URL, "http://") + "/fake-image"
+
+				req.Params.AdditionalRepositories = []resource.Source{
+					{Repository: strings.TrimPrefix(primaryRegistry.URL, "http://") + "/same-registry-image"},
+					{Repository: strings.TrimPrefix(mirrorRegistry.URL, "http://") + "/some-image"},
+					{Repository: strings.TrimPrefix(mirrorRegistry.URL, "http://") + "/another-image"},
+				}
+			})
+
+			AfterEach(func() {
+				primaryRegistry.Close()
+				mirrorRegistry.Close()
+			})
+
+			It("uploads each layer to each registry once, mounting it into the other repositories", func() {
+				Expect(actualErr).ToNot(HaveOccurred())
+
+				digest, err := image.Digest()
+				Expect(err).ToNot(HaveOccurred())
+
+				repos := []string{req.Source.Repository}
+				for _, repo := range req.Params.AdditionalRepositories {
+					repos = append(repos, repo.Repository)
+				}
+
+				for _, repo := range repos {
+					ref, err := name.ParseReference(repo + ":some-tag")
+					Expect(err).ToNot(HaveOccurred())
+
+					desc, err := remote.Head(ref)
+					Expect(err).ToNot(HaveOccurred())
+					Expect(desc.Digest).To(Equal(digest))
+				}
+
+				layers, err := image.Layers()
+				Expect(err).ToNot(HaveOccurred())
+
+				layerDigest, err := layers[0].Digest()
+				Expect(err).ToNot(HaveOccurred())
+
+				configDigest, err := image.ConfigName()
+				Expect(err).ToNot(HaveOccurred())
+
+				blobs := map[string]int{
+					layerDigest.String():  1,
+					configDigest.String(): 1,
+				}
+
+				Expect(primaryRegistry.Uploads).To(Equal(blobs))
+				Expect(primaryRegistry.Mounts).To(Equal(map[string]int{"same-registry-image": len(blobs)}))
+
+				Expect(mirrorRegistry.Uploads).To(Equal(blobs))
+				Expect(mirrorRegistry.Mounts).To(Equal(map[string]int{"another-image": len(blobs)}))
+			})
+		})
+
+		Context("with several additional repositories in the same ECR registry", func() {
+			var ecrRegistry *mountingRegistry
+			var ecr *ghttp.Server
+
+			BeforeEach(func() {
+				ecrRegistry = newMountingRegistry()
+				ecr = newFakeECR(strings.Replace(ecrRegistry.URL, "http://", "https://", 1))
+				env = append(env, "AWS_ENDPOINT_URL_ECR="+ecr.URL())
+
+				aws := resource.AwsCredentials{
+					AwsAccessKeyId:     "some-access-key",
+					AwsSecretAccessKey: "some-secret-key",
+					AwsRegion:          "us-east-1",
+				}
+
+				// each authenticates separately
+				req.Params.AdditionalRepositories = []resource.Source{
+					{Repository: "some-image", AwsCredentials: aws},
+					{Repository: "another-image", AwsCredentials: aws},
+				}
+			})
+
+			AfterEach(func() {
+				ecrRegistry.Close()
+				ecr.Close()
+			})
+
+			It("authenticates once, and uploads each layer once, mounting it into the other repository", func() {
+				Expect(actualErr).ToNot(HaveOccurred())
+				Expect(ecr.ReceivedRequests()).To(HaveLen(1))
+
+				layers, err := image.Layers()
+				Expect(err).ToNot(HaveOccurred())
+
+				layerDigest, err := layers[0].Digest()
+				Expect(err).ToNot(HaveOccurred())
+
+				configDigest, err := image.ConfigName()
+				Expect(err).ToNot(HaveOccurred())
+
+				blobs := map[string]int{
+					layerDigest.String():  1,
+					configDigest.String(): 1,
+				}
+
+				Expect(ecrRegistry.Uploads).To(Equal(blobs))
+				Expect(ecrRegistry.Mounts).To(Equal(map[string]int{"another-image": len(blobs)}))
+			})
+		})
+
+		Context("when an additional repository includes a tag", func() {
+			BeforeEach(func() {
+				req.Params.AdditionalRepositories[0].Repository += ":other-tag"
+			})
+
+			It("exits non-zero without pushing", func() {
+				Expect(actualErr).To(HaveOccurred())
+				Expect(actualErrOutput).To(ContainSubstring("a tag or digest cannot be specified"))
+
+				ref, err := name.ParseReference(req.Source.Name())
+				Expect(err).ToNot(HaveOccurred())
+
+				_, err = remote.Head(ref)
+				Expect(err).To(HaveOccurred())
+			})
+		})
+	})
+
+	Context("with from_registry", func() {
+		var devRegistry, prodRegistry *httptest.Server
+		var index v1.ImageIndex
+
+		BeforeEach(func() {
+			devRegistry = newFakeRegistry()
+			prodRegistry = newFakeRegistry()
+
+			var err error
+			index, err = random.Index(1024, 1, 2)
+			Expect(err).ToNot(HaveOccurred())
+
+			devRepo := strings.TrimPrefix(devRegistry.URL, "http://") + "/dev-image"
+
+			ref, err := name.ParseReference(devRepo + ":some-tag")
+			Expect(err).ToNot(HaveOccurred())
+
+			err = remote.WriteIndex(ref, index)
+			Expect(err).ToNot(HaveOccurred())
+
+			req.Source = resource.Source{
+				Repository: strings.TrimPrefix(prodRegistry.URL, "http://") + "/prod-image",
+				Tag:        "prod-tag",
+			}
+
+			req.Params.FromRegistry = &resource.Source{
+				Repository: devRepo,
+				Tag:        "some-tag",
+			}
+		})
+
+		AfterEach(func() {
+			devRegistry.Close()
+			prodRegistry.Close()
+		})
+
+		It("copies the whole index to the repository", func() {
+			Expect(actualErr).ToNot(HaveOccurred())
+
+			digest, err := index.Digest()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(res.Version.Digest).To(Equal(digest.String()))
+
+			ref, err := name.ParseReference(req.Source.Name())
+			Expect(err).ToNot(HaveOccurred())
+
+			pushed, err := remote.Index(ref)
+			Expect(err).ToNot(HaveOccurred())
+
+			pushedDigest, err := pushed.Digest()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(pushedDigest).To(Equal(digest))
+
+			manifest, err := pushed.IndexManifest()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(manifest.Manifests).To(HaveLen(2))
+
+			// fetches every blob
+			Expect(validate.Index(pushed)).To(Succeed())
+		})
+
+		Context("when the repository to copy from is in ECR", func() {
+			var ecr *ghttp.Server
+
+			BeforeEach(func() {
+				ecr = newFakeECR(strings.Replace(devRegistry.URL, "http://", "https://", 1))
+				env = append(env, "AWS_ENDPOINT_URL_ECR="+ecr.URL())
+
+				req.Params.FromRegistry = &resource.Source{
+					Repository: "dev-image",
+					Tag:        "some-tag",
+					AwsCredentials: resource.AwsCredentials{
+						AwsAccessKeyId:     "some-access-key",
+						AwsSecretAccessKey: "some-secret-key",
+						AwsRegion:          "us-east-1",
+					},
+				}
+			})
+
+			AfterEach(func() {
+				ecr.Close()
+			})
+
+			It("authenticates to ECR to copy from its registry", func() {
+				Expect(actualErr).ToNot(HaveOccurred())
+				Expect(ecr.ReceivedRequests()).To(HaveLen(1))
+
+				digest, err := index.Digest()
+				Expect(err).ToNot(HaveOccurred())
+				Expect(res.Version.Digest).To(Equal(digest.String()))
+			})
+		})
+
+		Context("when an image is also specified", func() {
+			BeforeEach(func() {
+				req.Params.Image = "image.tar"
+			})
+
+			It("exits non-zero and returns an error", func() {
+				Expect(actualErr).To(HaveOccurred())
+				Expect(actualErrOutput).To(ContainSubstring("cannot specify 'from_registry' with 'image' or 'rootfs'"))
+			})
+		})
+	})
+
+	Context("with cosign", func() {
+		var registry *httptest.Server
+		var key *ecdsa.PrivateKey
+
+		BeforeEach(func() {
+			registry = newFakeRegistry()
+
+			var err error
+			key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+			Expect(err).ToNot(HaveOccurred())
+
+			keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+			Expect(err).ToNot(HaveOccurred())
+
+			req.Source = resource.Source{
+				Repository: strings.TrimPrefix(registry.URL, "http://") + "/fake-image",
+				Tag:        "some-tag",
+				Cosign: &resource.CosignSigning{
+					Key: string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})),
+					Annotations: map[string]string{
+						"build": "42",
+					},
+				},
+			}
+
+			tag, err := name.NewTag(req.Source.Name())
+			Expect(err).ToNot(HaveOccurred())
+
+			randomImage, err := random.Image(1024, 1)
+			Expect(err).ToNot(HaveOccurred())
+
+			err = tarball.WriteToFile(filepath.Join(srcDir, "image.tar"), tag, randomImage)
+			Expect(err).ToNot(HaveOccurred())
+
+			req.Params.Image = "image.tar"
+		})
+
+		AfterEach(func() {
+			registry.Close()
+		})
+
+		It("attaches a signature of the pushed digest", func() {
+			Expect(actualErr).ToNot(HaveOccurred())
+
+			repo, err := name.NewRepository(req.Source.Repository)
+			Expect(err).ToNot(HaveOccurred())
+
+			sigImage, err := remote.Image(repo.Tag(strings.Replace(res.Version.Digest, ":", "-", 1) + ".sig"))
+			Expect(err).ToNot(HaveOccurred())
+
+			manifest, err := sigImage.Manifest()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(manifest.Layers).To(HaveLen(1))
+
+			layers, err := sigImage.Layers()
+			Expect(err).ToNot(HaveOccurred())
+
+			rc, err := layers[0].Uncompressed()
+			Expect(err).ToNot(HaveOccurred())
+
+			payload, err := ioutil.ReadAll(rc)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(rc.Close()).To(Succeed())
+
+			var signed struct {
+				Critical struct {
+					Image struct {
+						DockerManifestDigest string `json:"docker-manifest-digest"`
+					} `json:"image"`
+				} `json:"critical"`
+				Optional map[string]interface{} `json:"optional"`
+			}
+			Expect(json.Unmarshal(payload, &signed)).To(Succeed())
+			Expect(signed.Critical.Image.DockerManifestDigest).To(Equal(res.Version.Digest))
+			Expect(signed.Optional).To(Equal(map[string]interface{}{"build": "42"}))
+
+			signature, err := base64.StdEncoding.DecodeString(manifest.Layers[0].Annotations["dev.cosignproject.cosign/signature"])
+			Expect(err).ToNot(HaveOccurred())
+
+			payloadHash := sha256.Sum256(payload)
+			Expect(ecdsa.VerifyASN1(&key.PublicKey, payloadHash[:], signature)).To(BeTrue())
+		})
+
+		Context("with an encrypted key", func() {
+			BeforeEach(func() {
+				keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+				Expect(err).ToNot(HaveOccurred())
+
+				req.Source.Cosign.Key = encryptCosignKey(keyDER, "some-password")
+				req.Source.Cosign.Password = "some-password"
+			})
+
+			It("decrypts it to sign the pushed digest", func() {
+				Expect(actualErr).ToNot(HaveOccurred())
+
+				repo, err := name.NewRepository(req.Source.Repository)
+				Expect(err).ToNot(HaveOccurred())
+
+				_, err = remote.Head(repo.Tag(strings.Replace(res.Version.Digest, ":", "-", 1) + ".sig"))
+				Expect(err).ToNot(HaveOccurred())
+			})
+
+			Context("when what it decrypts to is not a private key", func() {
+				BeforeEach(func() {
+					req.Source.Cosign.Key = encryptCosignKey([]byte("not a key"), "some-password")
+				})
+
+				It("exits non-zero with the parse error", func() {
+					Expect(actualErr).To(HaveOccurred())
+					Expect(actualErrOutput).To(ContainSubstring("asn1"))
+					Expect(actualErrOutput).ToNot(ContainSubstring("unsupported private key type"))
+				})
+			})
+		})
+
+		Context("when neither a key nor keyless is configured", func() {
+			BeforeEach(func() {
+				req.Source.Cosign.Key = ""
+			})
+
+			It("exits non-zero without pushing", func() {
+				Expect(actualErr).To(HaveOccurred())
+				Expect(actualErrOutput).To(ContainSubstring("exactly one of 'key' or 'keyless'"))
+
+				ref, err := name.ParseReference(req.Source.Name())
+				Expect(err).ToNot(HaveOccurred())
+
+				_, err = remote.Head(ref)
+				Expect(err).To(HaveOccurred())
+			})
+		})
+	})
+
+	Context("pushing an image built from a rootfs directory", func() {
+		var registry *httptest.Server
+
+		BeforeEach(func() {
+			registry = newFakeRegistry()
+
+			req.Source = resource.Source{
+				Repository: strings.TrimPrefix(registry.URL, "http://") + "/fake-image",
+				Tag:        "some-tag",
+				RawPlatform: &resource.PlatformField{
+					OS:           "linux",
+					Architecture: "arm64",
+				},
+			}
+
+			Expect(os.MkdirAll(filepath.Join(srcDir, "rootfs", "etc"), 0755)).To(Succeed())
+			Expect(ioutil.WriteFile(filepath.Join(srcDir, "rootfs", "etc", "motd"), []byte("hello"), 0644)).To(Succeed())
+			Expect(os.Symlink("motd", filepath.Join(srcDir, "rootfs", "etc", "issue"))).To(Succeed())
+
+			Expect(ioutil.WriteFile(
+				filepath.Join(srcDir, "metadata.json"),
+				[]byte(`{"env":["FOO=1"],"user":"someuser"}`),
+				0644,
+			)).To(Succeed())
+
+			req.Params.Rootfs = "rootfs"
+			req.Params.Metadata = "metadata.json"
+			req.Params.Entrypoint = []string{"/bin/app"}
+			req.Params.Cmd = []string{"--serve"}
+		})
+
+		AfterEach(func() {
+			registry.Close()
+		})
+
+		It("pushes a single-layer image configured from the metadata and params", func() {
+			Expect(actualErr).ToNot(HaveOccurred())
+
+			ref, err := name.ParseReference(req.Source.Name())
+			Expect(err).ToNot(HaveOccurred())
+
+			image, err := remote.Image(ref)
+			Expect(err).ToNot(HaveOccurred())
+
+			digest, err := image.Digest()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(res.Version.Digest).To(Equal(digest.String()))
+
+			cfg, err := image.ConfigFile()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(cfg.OS).To(Equal("linux"))
+			Expect(cfg.Architecture).To(Equal("arm64"))
+			Expect(cfg.Config.Env).To(Equal([]string{"FOO=1"}))
+			Expect(cfg.Config.User).To(Equal("someuser"))
+			Expect(cfg.Config.Entrypoint).To(Equal([]string{"/bin/app"}))
+			Expect(cfg.Config.Cmd).To(Equal([]string{"--serve"}))
+
+			layers, err := image.Layers()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(layers).To(HaveLen(1))
+
+			rc, err := layers[0].Uncompressed()
+			Expect(err).ToNot(HaveOccurred())
+
+			defer rc.Close()
+
+			Expect(tarEntries(rc)).To(Equal([]string{"etc/", "etc/issue", "etc/motd"}))
+		})
+
+		Context("with an expected_digest that does not match", func() {
+			BeforeEach(func() {
+				Expect(ioutil.WriteFile(
+					filepath.Join(srcDir, "digest"),
+					[]byte("sha256:"+strings.Repeat("a", 64)+"\n"),
+					0644,
+				)).To(Succeed())
+
+				req.Params.ExpectedDigest = "digest"
+			})
+
+			It("exits non-zero without pushing", func() {
+				Expect(actualErr).To(HaveOccurred())
+				Expect(actualErrOutput).To(ContainSubstring("does not match expected digest sha256:" + strings.Repeat("a", 64)))
+
+				ref, err := name.ParseReference(req.Source.Name())
+				Expect(err).ToNot(HaveOccurred())
+
+				_, err = remote.Head(ref)
+				Expect(err).To(HaveOccurred())
+			})
+		})
+
+		Context("when an image is also given", func() {
+			BeforeEach(func() {
+				req.Params.Image = "image.tar"
+			})
+
+			It("exits non-zero and returns an error", func() {
+				Expect(actualErr).To(HaveOccurred())
+				Expect(actualErrOutput).To(ContainSubstring("cannot specify both 'image' and 'rootfs'"))
+			})
+		})
+	})
+
+	Context("pushing an OCI archive", func() {
+		var registry *httptest.Server
+		var randomImage v1.Image
+
+		BeforeEach(func() {
+			registry = newFakeRegistry()
+
+			var err error
+			randomImage, err = random.Image(1024, 2)
+			Expect(err).ToNot(HaveOccurred())
+
+			layoutDir := filepath.Join(srcDir, "layout")
+			p, err := layout.Write(layoutDir, empty.Index)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(p.AppendImage(randomImage)).To(Succeed())
+
+			// as written by `buildx -o type=oci`
+			archive, err := os.Create(filepath.Join(srcDir, "image.oci.tar"))
+			Expect(err).ToNot(HaveOccurred())
+
+			tw := tar.NewWriter(archive)
+			err = filepath.Walk(layoutDir, func(path string, info os.FileInfo, err error) error {
+				if err != nil || !info.Mode().IsRegular() {
+					return err
+				}
+
+				rel, err := filepath.Rel(layoutDir, path)
+				if err != nil {
+					return err
+				}
+
+				content, err := ioutil.ReadFile(path)
+				if err != nil {
+					return err
+				}
+
+				err = tw.WriteHeader(&tar.Header{
+					Name:     filepath.ToSlash(rel),
+					Typeflag: tar.TypeReg,
+					Mode:     0644,
+					Size:     int64(len(content)),
+				})
+				if err != nil {
+					return err
+				}
+
+				_, err = tw.Write(content)
+				return err
+			})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(tw.Close()).To(Succeed())
+			Expect(archive.Close()).To(Succeed())
+
+			req.Source = resource.Source{
+				Repository: strings.TrimPrefix(registry.URL, "http://") + "/some/image",
+				Tag:        "latest",
+			}
+
+			req.Params.Image = "image.oci.tar"
+		})
+
+		AfterEach(func() {
+			registry.Close()
+		})
+
+		It("pushes the image in the layout", func() {
+			Expect(actualErr).ToNot(HaveOccurred())
+
+			ref, err := name.ParseReference(req.Source.Name())
+			Expect(err).ToNot(HaveOccurred())
+
+			image, err := remote.Image(ref)
+			Expect(err).ToNot(HaveOccurred())
+
+			pushedDigest, err := image.Digest()
+			Expect(err).ToNot(HaveOccurred())
+
+			randomDigest, err := randomImage.Digest()
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(pushedDigest).To(Equal(randomDigest))
+			Expect(res.Version.Digest).To(Equal(randomDigest.String()))
+		})
+	})
+
+	Context("pushing a docker save archive of several images", func() {
+		var registry *httptest.Server
+		var appImage, debugImage v1.Image
+
+		BeforeEach(func() {
+			registry = newFakeRegistry()
+
+			req.Source = resource.Source{
+				Repository: strings.TrimPrefix(registry.URL, "http://") + "/some/image",
+				Tag:        "latest",
+			}
+
+			var err error
+			appImage, err = random.Image(1024, 1)
+			Expect(err).ToNot(HaveOccurred())
+
+			debugImage, err = random.Image(1024, 1)
+			Expect(err).ToNot(HaveOccurred())
+
+			err = tarball.MultiRefWriteToFile(filepath.Join(srcDir, "images.tar"), map[name.Reference]v1.Image{
+				name.MustParseReference("my-app:1.2.3"): appImage,
+				name.MustParseReference("my-app:debug"): debugImage,
+			})
+			Expect(err).ToNot(HaveOccurred())
+
+			req.Params.Image = "images.tar"
+			req.Params.ArchiveTag = "my-app:debug"
+		})
+
+		AfterEach(func() {
+			registry.Close()
+		})
+
+		It("pushes the image with the archive tag", func() {
+			Expect(actualErr).ToNot(HaveOccurred())
+
+			digest, err := debugImage.Digest()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(res.Version.Digest).To(Equal(digest.String()))
+
+			ref, err := name.ParseReference(req.Source.Name())
+			Expect(err).ToNot(HaveOccurred())
+
+			desc, err := remote.Head(ref)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(desc.Digest).To(Equal(digest))
+		})
+
+		Context("without archive_tag", func() {
+			BeforeEach(func() {
+				req.Params.ArchiveTag = ""
+			})
+
+			It("exits non-zero and lists the tags to choose from", func() {
+				Expect(actualErr).To(HaveOccurred())
+				Expect(actualErrOutput).To(ContainSubstring("specify which to push with archive_tag"))
+				Expect(actualErrOutput).To(ContainSubstring("my-app:1.2.3"))
+				Expect(actualErrOutput).To(ContainSubstring("my-app:debug"))
+			})
+		})
+	})
+
+	Context("pushing a compressed tarball", func() {
+		var registry *httptest.Server
+		var randomImage v1.Image
+
+		var compress func(io.Writer) io.WriteCloser
+
+		BeforeEach(func() {
+			registry = newFakeRegistry()
+
+			req.Source = resource.Source{
+				Repository: strings.TrimPrefix(registry.URL, "http://") + "/some/image",
+				Tag:        "latest",
+			}
+
+			var err error
+			randomImage, err = random.Image(1024, 2)
+			Expect(err).ToNot(HaveOccurred())
+
+			req.Params.Image = "image.tar.compressed"
+		})
+
+		AfterEach(func() {
+			registry.Close()
+		})
+
+		writeCompressed := func() {
+			tag, err := name.NewTag(req.Source.Name())
+			Expect(err).ToNot(HaveOccurred())
+
+			archive, err := os.Create(filepath.Join(srcDir, req.Params.Image))
+			Expect(err).ToNot(HaveOccurred())
+
+			w := compress(archive)
+			Expect(tarball.Write(tag, randomImage, w)).To(Succeed())
+			Expect(w.Close()).To(Succeed())
+			Expect(archive.Close()).To(Succeed())
+		}
+
+		itPushesTheImage := func() {
+			It("pushes the decompressed image", func() {
+				Expect(actualErr).ToNot(HaveOccurred())
+
+				ref, err := name.ParseReference(req.Source.Name())
+				Expect(err).ToNot(HaveOccurred())
+
+				image, err := remote.Image(ref)
+				Expect(err).ToNot(HaveOccurred())
+
+				pushedDigest, err := image.Digest()
+				Expect(err).ToNot(HaveOccurred())
+
+				randomDigest, err := randomImage.Digest()
+				Expect(err).ToNot(HaveOccurred())
+
+				Expect(pushedDigest).To(Equal(randomDigest))
+			})
+		}
+
+		Context("with gzip", func() {
+			BeforeEach(func() {
+				compress = func(w io.Writer) io.WriteCloser {
+					return gzip.NewWriter(w)
+				}
+
+				writeCompressed()
+			})
+
+			itPushesTheImage()
+		})
+
+		Context("with zstd", func() {
+			BeforeEach(func() {
+				compress = func(w io.Writer) io.WriteCloser {
+					zw, err := zstd.NewWriter(w)
+					Expect(err).ToNot(HaveOccurred())
+					return zw
+				}
+
+				writeCompressed()
+			})
+
+			itPushesTheImage()
+		})
+	})
+
+	Context("pushing the output of a previous get", func() {
+		var registry *httptest.Server
+		var randomImage v1.Image
+
+		BeforeEach(func() {
+			registry = newFakeRegistry()
+
+			repository := strings.TrimPrefix(registry.URL, "http://")
+
+			var err error
+			randomImage, err = random.Image(1024, 2)
+			Expect(err).ToNot(HaveOccurred())
+
+			digest, err := randomImage.Digest()
+			Expect(err).ToNot(HaveOccurred())
+
+			origin, err := name.NewRepository(repository + "/origin-image")
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(remote.Write(origin.Digest(digest.String()), randomImage)).To(Succeed())
+
+			getDir := filepath.Join(srcDir, "fetched-image")
+			Expect(os.MkdirAll(getDir, 0755)).To(Succeed())
+			Expect(ioutil.WriteFile(filepath.Join(getDir, "repository"), []byte(origin.Name()), 0644)).To(Succeed())
+			Expect(ioutil.WriteFile(filepath.Join(getDir, "digest"), []byte(digest.String()), 0644)).To(Succeed())
+			Expect(ioutil.WriteFile(filepath.Join(getDir, "tag"), []byte("latest"), 0644)).To(Succeed())
+
+			req.Source = resource.Source{
+				Repository: repository + "/promoted-image",
+				Tag:        "some-tag",
+			}
+
+			req.Params.Image = "fetched-image"
+		})
+
+		AfterEach(func() {
+			registry.Close()
+		})
+
+		pushedDigest := func() v1.Hash {
+			ref, err := name.ParseReference(req.Source.Name())
+			Expect(err).ToNot(HaveOccurred())
+
+			image, err := remote.Image(ref)
+			Expect(err).ToNot(HaveOccurred())
+
+			digest, err := image.Digest()
+			Expect(err).ToNot(HaveOccurred())
+
+			return digest
+		}
+
+		Context("when the get did not save the image", func() {
+			It("pushes the image by reference", func() {
+				Expect(actualErr).ToNot(HaveOccurred())
+
+				randomDigest, err := randomImage.Digest()
+				Expect(err).ToNot(HaveOccurred())
+
+				Expect(pushedDigest()).To(Equal(randomDigest))
+				Expect(res.Version.Digest).To(Equal(randomDigest.String()))
+			})
+		})
+
+		Context("when the get saved an OCI tarball", func() {
+			var savedImage v1.Image
+
+			BeforeEach(func() {
+				var err error
+				savedImage, err = random.Image(1024, 1)
+				Expect(err).ToNot(HaveOccurred())
+
+				tag, err := name.NewTag("some/image:latest")
+				Expect(err).ToNot(HaveOccurred())
+
+				err = tarball.WriteToFile(filepath.Join(srcDir, "fetched-image", "image.tar"), tag, savedImage)
+				Expect(err).ToNot(HaveOccurred())
+			})
+
+			It("pushes the saved image", func() {
+				Expect(actualErr).ToNot(HaveOccurred())
+
+				savedDigest, err := savedImage.Digest()
+				Expect(err).ToNot(HaveOccurred())
+
+				Expect(pushedDigest()).To(Equal(savedDigest))
+			})
+
+			It("returns the transfer totals in metadata", func() {
+				Expect(actualErr).ToNot(HaveOccurred())
+
+				layers, err := savedImage.Layers()
+				Expect(err).ToNot(HaveOccurred())
+
+				size, err := layers[0].Size()
+				Expect(err).ToNot(HaveOccurred())
+
+				Expect(res.Metadata).To(ContainElement(resource.MetadataField{
+					Name:  "bytes_transferred",
+					Value: strconv.FormatInt(size, 10),
+				}))
+			})
+		})
+
+		Context("with copy_signatures", func() {
+			var referrer v1.Image
+
+			BeforeEach(func() {
+				req.Params.CopySignatures = true
+
+				repository := strings.TrimPrefix(registry.URL, "http://")
+
+				origin, err := name.NewRepository(repository + "/origin-image")
+				Expect(err).ToNot(HaveOccurred())
+
+				digest, err := randomImage.Digest()
+				Expect(err).ToNot(HaveOccurred())
+
+				key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+				Expect(err).ToNot(HaveOccurred())
+
+				payload, signature := cosignSign(origin, digest, key, nil)
+				pushCosignSignature(origin, digest, payload, signature, nil)
+
+				desc, err := partial.Descriptor(randomImage)
+				Expect(err).ToNot(HaveOccurred())
+
+				referrer = mutate.Subject(mutate.ConfigMediaType(empty.Image, "application/vnd.example.sbom"), *desc).(v1.Image)
+
+				referrerDigest, err := referrer.Digest()
+				Expect(err).ToNot(HaveOccurred())
+
+				Expect(remote.Write(origin.Digest(referrerDigest.String()), referrer)).To(Succeed())
+			})
+
+			It("copies the signatures and referrers", func() {
+				Expect(actualErr).ToNot(HaveOccurred())
+
+				ref, err := name.ParseReference(req.Source.Name())
+				Expect(err).ToNot(HaveOccurred())
+
+				digest, err := randomImage.Digest()
+				Expect(err).ToNot(HaveOccurred())
+
+				_, err = remote.Image(ref.Context().Tag(digest.Algorithm + "-" + digest.Hex + ".sig"))
+				Expect(err).ToNot(HaveOccurred())
+
+				referrers, err := remote.Referrers(ref.Context().Digest(digest.String()))
+				Expect(err).ToNot(HaveOccurred())
+
+				manifest, err := referrers.IndexManifest()
+				Expect(err).ToNot(HaveOccurred())
+
+				referrerDigest, err := referrer.Digest()
+				Expect(err).ToNot(HaveOccurred())
+
+				Expect(manifest.Manifests).To(HaveLen(1))
+				Expect(manifest.Manifests[0].Digest).To(Equal(referrerDigest))
+			})
+		})
+
+		Context("when the get came from a registry that is not allowed", func() {
+			BeforeEach(func() {
+				err := ioutil.WriteFile(filepath.Join(srcDir, "fetched-image", "repository"), []byte("evil.example.com/origin-image"), 0644)
+				Expect(err).ToNot(HaveOccurred())
+
+				req.Source.AllowedRegistries = []string{strings.TrimPrefix(registry.URL, "http://")}
+			})
+
+			It("fails without pushing", func() {
+				Expect(actualErr).To(HaveOccurred())
+				Expect(actualErrOutput).To(ContainSubstring("registry evil.example.com is not in allowed_registries"))
+
+				ref, err := name.ParseReference(req.Source.Name())
+				Expect(err).ToNot(HaveOccurred())
+
+				_, err = remote.Image(ref)
+				Expect(err).To(HaveOccurred())
+			})
+		})
+	})
+
+	Context("pushing to an eventually consistent registry", func() {
+		var registry *eventuallyConsistentRegistry
+
+		BeforeEach(func() {
+			registry = newEventuallyConsistentRegistry(2)
+
+			req.Source = resource.Source{
+				Repository:      strings.TrimPrefix(registry.URL, "http://") + "/fake-image",
+				Tag:             "latest",
+				ConsistencyWait: 10,
+			}
+
+			randomImage, err := random.Image(1024, 1)
+			Expect(err).ToNot(HaveOccurred())
+
+			tag, err := name.NewTag(req.Source.Name())
+			Expect(err).ToNot(HaveOccurred())
+
+			err = tarball.WriteToFile(filepath.Join(srcDir, "image.tar"), tag, randomImage)
+			Expect(err).ToNot(HaveOccurred())
+
+			req.Params.Image = "image.tar"
+		})
+
+		AfterEach(func() {
+			registry.Close()
+		})
+
+		It("waits for the pushed tag to become available", func() {
+			Expect(actualErr).ToNot(HaveOccurred())
+			Expect(registry.Missed).To(Equal(2))
+		})
+	})
+
+	Context("pushing with tag_annotations", func() {
+		var registry *httptest.Server
+		var randomImage v1.Image
+
+		BeforeEach(func() {
+			registry = newFakeRegistry()
+
+			req.Source = resource.Source{
+				Repository: strings.TrimPrefix(registry.URL, "http://") + "/fake-image",
+				Tag:        "latest",
+			}
+
+			var err error
+			randomImage, err = random.Image(1024, 1)
+			Expect(err).ToNot(HaveOccurred())
+
+			tag, err := name.NewTag(req.Source.Name())
+			Expect(err).ToNot(HaveOccurred())
+
+			err = tarball.WriteToFile(filepath.Join(srcDir, "image.tar"), tag, randomImage)
+			Expect(err).ToNot(HaveOccurred())
+
+			req.Params.Image = "image.tar"
+			req.Params.Version = "1.2.3"
+			req.Params.TagAnnotations = map[string]map[string]string{
+				"latest": {"channel": "stable"},
+				"1.2.3":  {"channel": "pinned"},
+			}
+		})
+
+		AfterEach(func() {
+			registry.Close()
+		})
+
+		It("pushes a referrer of the image annotated for each tag", func() {
+			Expect(actualErr).ToNot(HaveOccurred())
+
+			digest, err := randomImage.Digest()
+			Expect(err).ToNot(HaveOccurred())
+
+			repo, err := name.NewRepository(req.Source.Repository)
+			Expect(err).ToNot(HaveOccurred())
+
+			referrers, err := remote.Referrers(repo.Digest(digest.String()))
+			Expect(err).ToNot(HaveOccurred())
+
+			manifest, err := referrers.IndexManifest()
+			Expect(err).ToNot(HaveOccurred())
+
+			tagAnnotations := map[string]string{}
+			for _, desc := range manifest.Manifests {
+				Expect(desc.ArtifactType).To(Equal("application/vnd.concourse.tag-annotations.v1+json"))
+
+				artifact, err := remote.Image(repo.Digest(desc.Digest.String()))
+				Expect(err).ToNot(HaveOccurred())
+
+				artifactManifest, err := artifact.Manifest()
+				Expect(err).ToNot(HaveOccurred())
+
+				tagAnnotations[artifactManifest.Annotations["org.opencontainers.image.ref.name"]] = artifactManifest.Annotations["channel"]
+			}
+
+			Expect(tagAnnotations).To(Equal(map[string]string{
+				"latest": "stable",
+				"1.2.3":  "pinned",
+			}))
+
+			// the tags still share the image's digest
+			for _, tag := range []string{"latest", "1.2.3"} {
+				desc, err := remote.Get(repo.Tag(tag))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(desc.Digest).To(Equal(digest))
+			}
+		})
+
+		Context("when the registry rejects the referrers API", func() {
+			BeforeEach(func() {
+				registry.Close()
+				registry = newFakeRegistryWithoutReferrers()
+
+				req.Source.Repository = strings.TrimPrefix(registry.URL, "http://") + "/fake-image"
+			})
+
+			It("lists the referrers under the referrers tag", func() {
+				Expect(actualErr).ToNot(HaveOccurred())
+
+				digest, err := randomImage.Digest()
+				Expect(err).ToNot(HaveOccurred())
+
+				repo, err := name.NewRepository(req.Source.Repository)
+				Expect(err).ToNot(HaveOccurred())
+
+				index, err := remote.Index(repo.Tag(strings.Replace(digest.String(), ":", "-", 1)))
+				Expect(err).ToNot(HaveOccurred())
+
+				manifest, err := index.IndexManifest()
+				Expect(err).ToNot(HaveOccurred())
+
+				Expect(manifest.Manifests).To(HaveLen(2))
+				for _, desc := range manifest.Manifests {
+					Expect(desc.ArtifactType).To(Equal("application/vnd.concourse.tag-annotations.v1+json"))
+					Expect(desc.Annotations).To(HaveKey("org.opencontainers.image.ref.name"))
+				}
+			})
+		})
+	})
+
+	Context("pushing with dry_run", func() {
+		var registry *httptest.Server
+		var randomImage v1.Image
+		var oldDigest v1.Hash
+		var repo name.Repository
+
+		BeforeEach(func() {
+			registry = newFakeRegistry()
+
+			req.Source = resource.Source{
+				Repository: strings.TrimPrefix(registry.URL, "http://") + "/fake-image",
+				Tag:        "latest",
+			}
+
+			var err error
+			repo, err = name.NewRepository(req.Source.Repository)
+			Expect(err).ToNot(HaveOccurred())
+
+			oldImage, err := random.Image(1024, 1)
+			Expect(err).ToNot(HaveOccurred())
+
+			oldDigest, err = oldImage.Digest()
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(remote.Write(repo.Tag("latest"), oldImage)).To(Succeed())
+			Expect(remote.Write(repo.Tag("1.3.0"), oldImage)).To(Succeed())
+
+			randomImage, err = random.Image(1024, 1)
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(remote.Write(repo.Tag("1.2"), randomImage)).To(Succeed())
+
+			err = tarball.WriteToFile(filepath.Join(srcDir, "image.tar"), repo.Tag("latest"), randomImage)
+			Expect(err).ToNot(HaveOccurred())
+
+			req.Params.Image = "image.tar"
+			req.Params.Version = "1.2.3"
+			req.Params.BumpAliases = true
+			req.Params.DryRun = true
+		})
+
+		AfterEach(func() {
+			registry.Close()
+		})
+
+		It("reports what would change without pushing anything", func() {
+			Expect(actualErr).ToNot(HaveOccurred())
+
+			digest, err := randomImage.Digest()
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(res.Version).To(Equal(resource.Version{Tag: "latest", Digest: oldDigest.String()}))
+			Expect(res.Metadata).To(ContainElement(resource.MetadataField{Name: "dry_run", Value: "true"}))
 
-				for _, t := range []string{"latest", "additional", "tags"} {
-					tag := parallelTag(t)
+			Expect(actualErrOutput).To(ContainSubstring("create    1.2.3"))
+			Expect(actualErrOutput).To(MatchRegexp(`change    latest: sha256:[0-9a-f]+ -> ` + digest.String()))
+			Expect(actualErrOutput).To(ContainSubstring("untouched 1.2"))
+			Expect(actualErrOutput).To(ContainSubstring("skip      1 (a newer version exists)"))
 
-					name, err := name.ParseReference(req.Source.Repository + ":" + tag)
-					Expect(err).ToNot(HaveOccurred())
+			_, err = remote.Head(repo.Tag("1.2.3"))
+			Expect(err).To(HaveOccurred())
 
-					auth := &authn.Basic{
-						Username: req.Source.Username,
-						Password: req.Source.Password,
-					}
+			desc, err := remote.Head(repo.Tag("latest"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(desc.Digest).ToNot(Equal(digest))
+		})
 
-					image, err := remote.Image(name, remote.WithAuth(auth))
-					Expect(err).ToNot(HaveOccurred())
+		Context("when the first tag does not exist yet", func() {
+			BeforeEach(func() {
+				req.Source.Tag = "edge"
+			})
 
-					pushedDigest, err := image.Digest()
-					Expect(err).ToNot(HaveOccurred())
+			It("reports what would change, then fails rather than emitting a version which wasn't pushed", func() {
+				Expect(actualErr).To(HaveOccurred())
 
-					Expect(pushedDigest).To(Equal(randomDigest))
-				}
+				Expect(actualErrOutput).To(ContainSubstring("create    edge"))
+				Expect(actualErrOutput).To(ContainSubstring("tag edge does not exist yet"))
+
+				_, err := remote.Head(repo.Tag("edge"))
+				Expect(err).To(HaveOccurred())
 			})
 		})
 	})
 
-	Context("pushing an OCI imageIndex (multi-arch) image to dockerhub", func() {
-		var randomImageIndex v1.ImageIndex
+	Context("pushing with artifact_type and config_media_type", func() {
+		var registry *httptest.Server
 
 		BeforeEach(func() {
-			checkDockerPushUserConfigured()
+			registry = newFakeRegistry()
 
 			req.Source = resource.Source{
-				Repository: dockerPushRepo,
-				Tag:        resource.Tag(parallelTag("latest")),
-
-				BasicCredentials: resource.BasicCredentials{
-					Username: dockerPushUsername,
-					Password: dockerPushPassword,
-				},
+				Repository: strings.TrimPrefix(registry.URL, "http://") + "/fake-artifact",
+				Tag:        "latest",
 			}
 
-			var err error
-
-			randomImageIndex, err = random.Index(1024, 1, 2)
+			image, err := random.Image(1024, 1)
 			Expect(err).ToNot(HaveOccurred())
 
-			path := filepath.Join(srcDir, "multi-arch")
-			p, err := layout.Write(path, empty.Index)
+			tag, err := name.NewTag(req.Source.Name())
 			Expect(err).ToNot(HaveOccurred())
 
-			err = p.AppendIndex(randomImageIndex)
+			err = tarball.WriteToFile(filepath.Join(srcDir, "image.tar"), tag, image)
 			Expect(err).ToNot(HaveOccurred())
 
-			req.Params.Image = "multi-arch"
+			req.Params.Image = "image.tar"
+			req.Params.ArtifactType = "application/vnd.example.policy.v1"
+			req.Params.ConfigMediaType = "application/vnd.example.policy.config.v1+json"
 		})
 
-		It("works", func() {
+		AfterEach(func() {
+			registry.Close()
+		})
+
+		It("declares them in the pushed manifest", func() {
 			Expect(actualErr).ToNot(HaveOccurred())
 
-			name, err := name.ParseReference(req.Source.Name())
+			tag, err := name.NewTag(req.Source.Name())
 			Expect(err).ToNot(HaveOccurred())
 
-			auth := &authn.Basic{
-				Username: req.Source.Username,
-				Password: req.Source.Password,
+			desc, err := remote.Get(tag)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(desc.Digest.String()).To(Equal(res.Version.Digest))
+
+			var manifest struct {
+				MediaType    string `json:"mediaType"`
+				ArtifactType string `json:"artifactType"`
+				Config       struct {
+					MediaType string `json:"mediaType"`
+				} `json:"config"`
 			}
+			Expect(json.Unmarshal(desc.Manifest, &manifest)).To(Succeed())
 
-			index, err := remote.Index(name, remote.WithAuth(auth))
+			Expect(manifest.MediaType).To(Equal("application/vnd.oci.image.manifest.v1+json"))
+			Expect(manifest.ArtifactType).To(Equal("application/vnd.example.policy.v1"))
+			Expect(manifest.Config.MediaType).To(Equal("application/vnd.example.policy.config.v1+json"))
+		})
+	})
+
+	Context("pushing a version for multiple variants", func() {
+		var registry *httptest.Server
+		var randomImage v1.Image
+
+		BeforeEach(func() {
+			registry = newFakeRegistry()
+
+			req.Source = resource.Source{
+				Repository: strings.TrimPrefix(registry.URL, "http://") + "/fake-image",
+				Variant:    "ignored",
+			}
+
+			var err error
+			randomImage, err = random.Image(1024, 1)
 			Expect(err).ToNot(HaveOccurred())
 
-			pushedDigest, err := index.Digest()
+			tag, err := name.NewTag(req.Source.Repository)
 			Expect(err).ToNot(HaveOccurred())
 
-			randomDigest, err := randomImageIndex.Digest()
+			err = tarball.WriteToFile(filepath.Join(srcDir, "image.tar"), tag, randomImage)
 			Expect(err).ToNot(HaveOccurred())
 
-			Expect(pushedDigest).To(Equal(randomDigest))
+			req.Params.Image = "image.tar"
+			req.Params.Version = "1.2.3"
+			req.Params.Variants = []string{"alpine", "slim"}
+			req.Params.BumpAliases = true
 		})
 
-		It("returns metadata", func() {
+		AfterEach(func() {
+			registry.Close()
+		})
+
+		It("pushes the version and aliases for each variant", func() {
 			Expect(actualErr).ToNot(HaveOccurred())
 
-			Expect(res.Metadata).To(Equal([]resource.MetadataField{
-				{
-					Name:  "repository",
-					Value: dockerPushRepo,
+			expectedDigest, err := randomImage.Digest()
+			Expect(err).ToNot(HaveOccurred())
+
+			for _, tag := range []string{
+				"1.2.3-alpine", "1.2-alpine", "1-alpine", "alpine",
+				"1.2.3-slim", "1.2-slim", "1-slim", "slim",
+			} {
+				ref, err := name.ParseReference(req.Source.Repository + ":" + tag)
+				Expect(err).ToNot(HaveOccurred())
+
+				desc, err := remote.Get(ref)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(desc.Digest).To(Equal(expectedDigest))
+			}
+
+			ref, err := name.ParseReference(req.Source.Repository + ":1.2.3-ignored")
+			Expect(err).ToNot(HaveOccurred())
+
+			_, err = remote.Get(ref)
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Context("pushing an image index with platform_tags", func() {
+		var registry *httptest.Server
+		var amd64Image, armImage v1.Image
+
+		BeforeEach(func() {
+			registry = newFakeRegistry()
+
+			req.Source = resource.Source{
+				Repository: strings.TrimPrefix(registry.URL, "http://") + "/fake-image",
+				Tag:        "some-tag",
+			}
+
+			var err error
+			amd64Image, err = random.Image(1024, 1)
+			Expect(err).ToNot(HaveOccurred())
+
+			armImage, err = random.Image(1024, 1)
+			Expect(err).ToNot(HaveOccurred())
+
+			index := mutate.AppendManifests(empty.Index,
+				mutate.IndexAddendum{
+					Add: amd64Image,
+					Descriptor: v1.Descriptor{
+						Platform: &v1.Platform{OS: "linux", Architecture: "amd64"},
+					},
 				},
-				{
-					Name:  "tags",
-					Value: parallelTag("latest"),
+				mutate.IndexAddendum{
+					Add: armImage,
+					Descriptor: v1.Descriptor{
+						Platform: &v1.Platform{OS: "linux", Architecture: "arm", Variant: "v7"},
+					},
 				},
-			}))
-		})
+			)
 
-		Context("When using bump_aliases", func() {
-			BeforeEach(func() {
-				req.Params.BumpAliases = true
-				req.Params.Version = "1.0.0"
-			})
+			p, err := layout.Write(filepath.Join(srcDir, "multi-arch"), empty.Index)
+			Expect(err).ToNot(HaveOccurred())
 
-			It("Push the right tags", func() {
-				Expect(actualErr).ToNot(HaveOccurred())
+			Expect(p.AppendIndex(index)).To(Succeed())
 
-				tags := []string{"1.0.0", "1.0", "1", req.Source.Tag.String()}
+			req.Params.Image = "multi-arch"
+			req.Params.Version = "1.2.3"
+			req.Params.PlatformTags = true
+		})
 
-				for _, tag := range tags {
-					name, err := name.ParseReference(dockerPushRepo + ":" + tag)
-					Expect(err).ToNot(HaveOccurred())
+		AfterEach(func() {
+			registry.Close()
+		})
 
-					auth := &authn.Basic{
-						Username: req.Source.Username,
-						Password: req.Source.Password,
-					}
+		It("pushes each image to platform-suffixed tags", func() {
+			Expect(actualErr).ToNot(HaveOccurred())
 
-					index, err := remote.Index(name, remote.WithAuth(auth))
-					Expect(err).ToNot(HaveOccurred())
+			for tag, expected := range map[string]v1.Image{
+				"some-tag-amd64":  amd64Image,
+				"some-tag-arm-v7": armImage,
+				"1.2.3-amd64":     amd64Image,
+				"1.2.3-arm-v7":    armImage,
+			} {
+				ref, err := name.ParseReference(req.Source.Repository + ":" + tag)
+				Expect(err).ToNot(HaveOccurred())
 
-					pushedDigest, err := index.Digest()
-					Expect(err).ToNot(HaveOccurred())
+				desc, err := remote.Get(ref)
+				Expect(err).ToNot(HaveOccurred())
 
-					randomDigest, err := randomImageIndex.Digest()
-					Expect(err).ToNot(HaveOccurred())
+				expectedDigest, err := expected.Digest()
+				Expect(err).ToNot(HaveOccurred())
 
-					Expect(pushedDigest).To(Equal(randomDigest))
-				}
-			})
+				Expect(desc.Digest).To(Equal(expectedDigest))
+			}
+
+			ref, err := name.ParseReference(req.Source.Repository + ":1.2.3")
+			Expect(err).ToNot(HaveOccurred())
+
+			desc, err := remote.Get(ref)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(desc.MediaType.IsIndex()).To(BeTrue())
 		})
 	})
 
@@ -518,6 +2386,86 @@ var _ = Describe("Out", func() {
 		})
 	})
 
+	Context("when pushing the manifest is rate limited", func() {
+		var registry *ghttp.Server
+
+		var lock sync.Mutex
+		var blobUploads, manifestUpdates int
+
+		BeforeEach(func() {
+			registry = ghttp.NewServer()
+
+			blobUploads, manifestUpdates = 0, 0
+
+			req.Source = resource.Source{
+				Repository: registry.Addr() + "/fake-image",
+				Tag:        "some-tag",
+			}
+
+			tag, err := name.NewTag(req.Source.Name())
+			Expect(err).ToNot(HaveOccurred())
+
+			randomImage, err := random.Image(1024, 1)
+			Expect(err).ToNot(HaveOccurred())
+
+			err = tarball.WriteToFile(filepath.Join(srcDir, "image.tar"), tag, randomImage)
+			Expect(err).ToNot(HaveOccurred())
+
+			req.Params.Image = "image.tar"
+
+			registry.RouteToHandler("GET", "/v2/", ghttp.RespondWith(http.StatusOK, "welcome to zombocom"))
+
+			registry.RouteToHandler("HEAD", regexp.MustCompile(`/v2/fake-image/blobs/.*`), ghttp.RespondWith(http.StatusNotFound, "needs upload"))
+
+			registry.RouteToHandler("POST", "/v2/fake-image/blobs/uploads/", func(w http.ResponseWriter, r *http.Request) {
+				lock.Lock()
+				blobUploads++
+				lock.Unlock()
+
+				w.Header().Add("Location", "/upload/some-blob")
+				w.WriteHeader(http.StatusAccepted)
+			})
+
+			registry.RouteToHandler("PATCH", "/upload/some-blob", func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Add("Location", "/commit/some-blob")
+				w.WriteHeader(http.StatusAccepted)
+			})
+
+			registry.RouteToHandler("PUT", "/commit/some-blob", ghttp.RespondWith(http.StatusCreated, "upload complete"))
+
+			registry.RouteToHandler("HEAD", "/v2/fake-image/manifests/some-tag", ghttp.RespondWith(http.StatusNotFound, "needs upload"))
+
+			registry.RouteToHandler("PUT", "/v2/fake-image/manifests/some-tag", func(w http.ResponseWriter, r *http.Request) {
+				lock.Lock()
+				manifestUpdates++
+				first := manifestUpdates == 1
+				lock.Unlock()
+
+				if first {
+					ghttp.RespondWith(http.StatusTooManyRequests, "update manifest limited")(w, r)
+				} else {
+					ghttp.RespondWith(http.StatusCreated, "manifest updated")(w, r)
+				}
+			})
+		})
+
+		AfterEach(func() {
+			registry.Close()
+		})
+
+		It("retries the manifest without uploading the blobs again", func() {
+			Expect(actualErr).ToNot(HaveOccurred())
+
+			lock.Lock()
+			defer lock.Unlock()
+
+			Expect(manifestUpdates).To(Equal(2))
+
+			// the config and the layer
+			Expect(blobUploads).To(Equal(2))
+		})
+	})
+
 	Context("using a registry with self-signed certificate", func() {
 		var registry *ghttp.Server
 		var randomImage v1.Image
@@ -616,6 +2564,40 @@ var _ = Describe("Out", func() {
 	})
 })
 
+// encryptCosignKey encrypts the DER-encoded private key with the password as
+// `cosign generate-key-pair` does, returning it PEM-encoded.
+func encryptCosignKey(der []byte, password string) string {
+	salt := make([]byte, 32)
+	_, err := rand.Read(salt)
+	Expect(err).ToNot(HaveOccurred())
+
+	var nonce [24]byte
+	_, err = rand.Read(nonce[:])
+	Expect(err).ToNot(HaveOccurred())
+
+	derived, err := scrypt.Key([]byte(password), salt, 32768, 8, 1, 32)
+	Expect(err).ToNot(HaveOccurred())
+
+	var secret [32]byte
+	copy(secret[:], derived)
+
+	encrypted, err := json.Marshal(map[string]interface{}{
+		"kdf": map[string]interface{}{
+			"name":   "scrypt",
+			"params": map[string]int{"N": 32768, "r": 8, "p": 1},
+			"salt":   salt,
+		},
+		"cipher": map[string]interface{}{
+			"name":  "nacl/secretbox",
+			"nonce": nonce[:],
+		},
+		"ciphertext": secretbox.Seal(nil, der, &nonce, &secret),
+	})
+	Expect(err).ToNot(HaveOccurred())
+
+	return string(pem.EncodeToMemory(&pem.Block{Type: "ENCRYPTED SIGSTORE PRIVATE KEY", Bytes: encrypted}))
+}
+
 func parallelTag(tag string) string {
 	return fmt.Sprintf("%s-%d", tag, GinkgoParallelNode())
 }
@@ -714,6 +2696,18 @@ var _ = DescribeTable("pushing semver tags",
 			PushedTags: []string{"1.2.3"},
 		},
 	),
+	Entry("not bumping aliases claimed by a newer version pushed concurrently",
+		SemverTagPushExample{
+			Tags:           []string{"1.2.2"},
+			ConcurrentTags: []string{"1.3.0"},
+
+			Variant:     "",
+			Version:     "1.2.3",
+			BumpAliases: true,
+
+			PushedTags: []string{"1.2.3", "1.2"},
+		},
+	),
 	Entry("not bumping major if a newer minor already exists",
 		SemverTagPushExample{
 			Tags: []string{"1.3.0"},
@@ -852,13 +2846,49 @@ var _ = DescribeTable("pushing semver tags",
 			PushedTags: []string{"1.2.3-hello", "1.2-hello"},
 		},
 	),
+	Entry("prefixing the version and aliases with the tag prefix",
+		SemverTagPushExample{
+			Tags: []string{"release-1.2.2", "2.0.0"},
+
+			TagPrefix:   "release-",
+			Version:     "1.2.3",
+			BumpAliases: true,
+
+			PushedTags: []string{"release-1.2.3", "release-1.2", "release-1", "latest"},
+		},
+	),
+	Entry("not bumping aliases if a newer version exists with the tag prefix",
+		SemverTagPushExample{
+			Tags: []string{"release-1.3.0"},
+
+			TagPrefix:   "release-",
+			Version:     "1.2.3",
+			BumpAliases: true,
+
+			PushedTags: []string{"release-1.2.3", "release-1.2"},
+		},
+	),
+	Entry("accepting a version which includes the tag prefix",
+		SemverTagPushExample{
+			Tags: []string{},
+
+			TagPrefix: "release-",
+			Version:   "release-1.2.3",
+
+			PushedTags: []string{"release-1.2.3"},
+		},
+	),
 )
 
 type SemverTagPushExample struct {
 	Tags              []string
 	TagsResponseError *transport.Error
 
-	Variant string
+	// tags pushed by another build while this one is pushing
+	ConcurrentTags []string
+
+	Variant   string
+	TagPrefix string
 
 	ImageDigest string
 	Version     string
@@ -907,12 +2937,28 @@ func (example SemverTagPushExample) Run() {
 		ghttp.RespondWith(http.StatusOK, ""),
 	)
 
+	pushedTags := new(sync.Map)
+
 	var response http.HandlerFunc
 	if example.TagsResponseError == nil {
-		response = ghttp.RespondWithJSONEncoded(http.StatusOK, registryTagsResponse{
-			Name: "some-name",
-			Tags: example.Tags,
-		})
+		response = func(w http.ResponseWriter, r *http.Request) {
+			tags := example.Tags
+
+			pushing := false
+			pushedTags.Range(func(key, val interface{}) bool {
+				pushing = true
+				return false
+			})
+
+			if pushing {
+				tags = append(append([]string{}, tags...), example.ConcurrentTags...)
+			}
+
+			ghttp.RespondWithJSONEncoded(http.StatusOK, registryTagsResponse{
+				Name: "some-name",
+				Tags: tags,
+			})(w, r)
+		}
 	} else {
 		response = ghttp.RespondWithJSONEncoded(example.TagsResponseError.StatusCode, example.TagsResponseError)
 	}
@@ -954,8 +3000,6 @@ func (example SemverTagPushExample) Run() {
 		ghttp.RespondWith(http.StatusCreated, "upload complete")(w, r)
 	})
 
-	pushedTags := new(sync.Map)
-
 	registry.RouteToHandler("HEAD", regexp.MustCompile("/v2/test-image/manifests/.*"), func(w http.ResponseWriter, r *http.Request) {
 		ghttp.RespondWith(http.StatusNotFound, "needs upload")(w, r)
 	})
@@ -976,6 +3020,7 @@ func (example SemverTagPushExample) Run() {
 		Source: resource.Source{
 			Repository: repo.Name(),
 			Variant:    example.Variant,
+			TagPrefix:  example.TagPrefix,
 		},
 		Params: resource.PutParams{
 			Image:       filepath.Base(imagePath),
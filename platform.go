@@ -0,0 +1,98 @@
+package resource
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"regexp"
+	"strconv"
+	"strings"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/sirupsen/logrus"
+)
+
+// e.g. 'ARMv6-compatible processor rev 7 (v6l)'
+var armModelVariantRegexp = regexp.MustCompile(`\((v[5-8])l\)`)
+
+// V1Platform returns the platform to select from image indexes, splitting a
+// variant included in the architecture, e.g. 'arm/v7'.
+func (p PlatformField) V1Platform() v1.Platform {
+	arch, variant, found := strings.Cut(p.Architecture, "/")
+	if !found {
+		variant = p.Variant
+	}
+
+	return v1.Platform{
+		OS:           p.OS,
+		Architecture: arch,
+		Variant:      variant,
+	}
+}
+
+// defaultVariant returns the variant of the worker's architecture which its
+// CPU can run.
+func defaultVariant(goarch string) string {
+	if goarch != "arm" {
+		// arm64 images are listed both with and without the 'v8' variant, and
+		// other architectures don't have variants
+		return ""
+	}
+
+	cpuinfo, err := ioutil.ReadFile("/proc/cpuinfo")
+	if err != nil {
+		logrus.Debugf("could not detect arm variant: %s", err)
+		return ""
+	}
+
+	return ARMVariant(cpuinfo)
+}
+
+// ARMVariant returns the 32-bit arm variant supported by the CPU described by
+// /proc/cpuinfo, or an empty string if it can't be determined.
+//
+// A 64-bit CPU (e.g. running a 32-bit userland on an arm64 kernel) runs v7
+// images, as 32-bit v8 images are rare.
+func ARMVariant(cpuinfo []byte) string {
+	var arch int
+
+	scanner := bufio.NewScanner(bytes.NewReader(cpuinfo))
+	for scanner.Scan() {
+		key, value, found := strings.Cut(scanner.Text(), ":")
+		if !found {
+			continue
+		}
+
+		key = strings.TrimSpace(key)
+		value = strings.TrimSpace(value)
+
+		switch key {
+		case "model name", "Processor":
+			// more precise than 'CPU architecture', which is 7 for e.g. the
+			// ARMv6 CPU of the original Raspberry Pi
+			if match := armModelVariantRegexp.FindStringSubmatch(value); match != nil {
+				if match[1] == "v8" {
+					return "v7"
+				}
+
+				return match[1]
+			}
+		case "CPU architecture":
+			// e.g. '7' or 'AArch64'
+			if n, err := strconv.Atoi(value); err == nil {
+				arch = n
+			} else if strings.EqualFold(value, "AArch64") {
+				arch = 8
+			}
+		}
+	}
+
+	switch {
+	case arch >= 7:
+		return "v7"
+	case arch >= 5:
+		return "v" + strconv.Itoa(arch)
+	default:
+		return ""
+	}
+}
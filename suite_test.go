@@ -1,19 +1,37 @@
 package resource_test
 
 import (
+	"archive/tar"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
 	"encoding/json"
+	"fmt"
+	"io"
 	"io/ioutil"
+	"log"
 	"net/http"
+	"net/http/httptest"
 	"os"
 	"strconv"
+	"strings"
+	"sync"
 	"testing"
 
 	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
 	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
 	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/static"
+	"github.com/google/go-containerregistry/pkg/v1/types"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 	"github.com/onsi/gomega/gexec"
+	"github.com/onsi/gomega/ghttp"
+	"github.com/onsi/gomega/gstruct"
 )
 
 var bins struct {
@@ -144,6 +162,261 @@ func latestManifest(ref string) (string, *v1.Manifest) {
 	return digest.String(), manifest
 }
 
+// newFakeRegistry starts an in-memory registry which images can be pushed to
+// and fetched from.
+func newFakeRegistry() *httptest.Server {
+	return httptest.NewServer(registry.New(registry.Logger(log.New(GinkgoWriter, "", 0))))
+}
+
+// newFakeRegistryWithoutReferrers returns a fake registry which, like some
+// registries predating OCI 1.1, responds 405 to the referrers API.
+func newFakeRegistryWithoutReferrers() *httptest.Server {
+	handler := registry.New(registry.Logger(log.New(GinkgoWriter, "", 0)))
+
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.Path, "/referrers/") {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		handler.ServeHTTP(w, r)
+	}))
+}
+
+// eventuallyConsistentRegistry is a fake registry which, like some Artifactory
+// instances, responds 404 to the first few requests for a manifest after it is
+// pushed.
+type eventuallyConsistentRegistry struct {
+	*httptest.Server
+
+	lock    sync.Mutex
+	misses  int
+	pending map[string]int
+
+	// number of requests which were answered with a 404
+	Missed int
+}
+
+func newEventuallyConsistentRegistry(misses int) *eventuallyConsistentRegistry {
+	reg := &eventuallyConsistentRegistry{
+		misses:  misses,
+		pending: map[string]int{},
+	}
+
+	handler := registry.New(registry.Logger(log.New(GinkgoWriter, "", 0)))
+
+	reg.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.Path, "/manifests/") {
+			reg.lock.Lock()
+			switch r.Method {
+			case http.MethodPut:
+				reg.pending[r.URL.Path] = reg.misses
+			case http.MethodGet, http.MethodHead:
+				if reg.pending[r.URL.Path] > 0 {
+					reg.pending[r.URL.Path]--
+					reg.Missed++
+					reg.lock.Unlock()
+					http.NotFound(w, r)
+					return
+				}
+			}
+			reg.lock.Unlock()
+		}
+
+		handler.ServeHTTP(w, r)
+	}))
+
+	return reg
+}
+
+// mountingRegistry is a fake registry which, like most real registries, only
+// has a blob in the repositories it was uploaded or mounted to, counting the
+// uploads of each blob and the mounts into each repository.
+type mountingRegistry struct {
+	*httptest.Server
+
+	lock  sync.Mutex
+	blobs map[string]bool
+
+	// number of times each blob was uploaded, by digest
+	Uploads map[string]int
+
+	// number of blobs mounted into each repository
+	Mounts map[string]int
+}
+
+func newMountingRegistry() *mountingRegistry {
+	reg := &mountingRegistry{
+		blobs:   map[string]bool{},
+		Uploads: map[string]int{},
+		Mounts:  map[string]int{},
+	}
+
+	handler := registry.New(registry.Logger(log.New(GinkgoWriter, "", 0)))
+
+	reg.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		repo, blob, found := strings.Cut(strings.TrimPrefix(r.URL.Path, "/v2/"), "/blobs/")
+		if !found {
+			handler.ServeHTTP(w, r)
+			return
+		}
+
+		reg.lock.Lock()
+		defer reg.lock.Unlock()
+
+		switch {
+		case r.Method == http.MethodPost && r.URL.Query().Get("mount") != "":
+			digest := r.URL.Query().Get("mount")
+			if reg.blobs[r.URL.Query().Get("from")+"@"+digest] {
+				reg.blobs[repo+"@"+digest] = true
+				reg.Mounts[repo]++
+
+				w.Header().Set("Docker-Content-Digest", digest)
+				w.Header().Set("Location", "/v2/"+repo+"/blobs/"+digest)
+				w.WriteHeader(http.StatusCreated)
+				return
+			}
+		case r.Method == http.MethodPut:
+			digest := r.URL.Query().Get("digest")
+
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, r)
+
+			if recorder.Code == http.StatusCreated {
+				reg.blobs[repo+"@"+digest] = true
+				reg.Uploads[digest]++
+			}
+
+			for key, values := range recorder.Header() {
+				w.Header()[key] = values
+			}
+
+			w.WriteHeader(recorder.Code)
+			w.Write(recorder.Body.Bytes())
+			return
+		case r.Method == http.MethodGet || r.Method == http.MethodHead:
+			if !strings.HasPrefix(blob, "uploads/") && !reg.blobs[repo+"@"+blob] {
+				http.NotFound(w, r)
+				return
+			}
+		}
+
+		handler.ServeHTTP(w, r)
+	}))
+
+	return reg
+}
+
+// metadataField matches a metadata field with the name, whose value matches.
+func metadataField(name string, value OmegaMatcher) OmegaMatcher {
+	return gstruct.MatchAllFields(gstruct.Fields{
+		"Name":  Equal(name),
+		"Value": value,
+	})
+}
+
+// transferMetadata matches the metadata fields with the totals of a
+// transfer, whose values vary from run to run.
+func transferMetadata() []interface{} {
+	return []interface{}{
+		metadataField("bytes_transferred", MatchRegexp(`^[1-9]\d*$`)),
+		metadataField("transfer_time", MatchRegexp(`^[\dhm.]+s$`)),
+		metadataField("transfer_speed", HaveSuffix("/s")),
+	}
+}
+
+// newFakeECR returns a fake ECR API, for AWS_ENDPOINT_URL_ECR, which grants
+// authorization tokens for the registry at the proxy endpoint, with a new
+// password each time, as ECR does.
+func newFakeECR(proxyEndpoint string) *ghttp.Server {
+	server := ghttp.NewServer()
+
+	var tokens int
+	server.RouteToHandler("POST", "/", func(w http.ResponseWriter, r *http.Request) {
+		Expect(r.Header.Get("X-Amz-Target")).To(Equal("AmazonEC2ContainerRegistry_V20150921.GetAuthorizationToken"))
+
+		tokens++
+		token := base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("AWS:password-%d", tokens)))
+
+		w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+		fmt.Fprintf(w, `{"authorizationData": [{"authorizationToken": %q, "proxyEndpoint": %q}]}`, token, proxyEndpoint)
+	})
+
+	return server
+}
+
+// serveImage routes requests for the image's manifest (by digest and by tag)
+// and blobs to the fake registry, returning the image's digest.
+func serveImage(registry *ghttp.Server, repo string, tag string, image v1.Image) string {
+	digest, err := image.Digest()
+	Expect(err).ToNot(HaveOccurred())
+
+	manifest, err := image.RawManifest()
+	Expect(err).ToNot(HaveOccurred())
+
+	mediaType, err := image.MediaType()
+	Expect(err).ToNot(HaveOccurred())
+
+	manifestHeaders := http.Header{
+		"Content-Type":          {string(mediaType)},
+		"Content-Length":        {strconv.Itoa(len(manifest))},
+		"Docker-Content-Digest": {digest.String()},
+	}
+
+	registry.RouteToHandler("GET", "/v2/", ghttp.RespondWith(http.StatusOK, ""))
+
+	for _, ref := range []string{digest.String(), tag} {
+		registry.RouteToHandler("HEAD", "/v2/"+repo+"/manifests/"+ref, ghttp.RespondWith(http.StatusOK, "", manifestHeaders))
+		registry.RouteToHandler("GET", "/v2/"+repo+"/manifests/"+ref, ghttp.RespondWith(http.StatusOK, manifest, manifestHeaders))
+	}
+
+	config, err := image.RawConfigFile()
+	Expect(err).ToNot(HaveOccurred())
+
+	configDigest, err := image.ConfigName()
+	Expect(err).ToNot(HaveOccurred())
+
+	registry.RouteToHandler("GET", "/v2/"+repo+"/blobs/"+configDigest.String(), ghttp.RespondWith(http.StatusOK, config))
+
+	layers, err := image.Layers()
+	Expect(err).ToNot(HaveOccurred())
+
+	for _, layer := range layers {
+		layerDigest, err := layer.Digest()
+		Expect(err).ToNot(HaveOccurred())
+
+		rc, err := layer.Compressed()
+		Expect(err).ToNot(HaveOccurred())
+
+		blob, err := ioutil.ReadAll(rc)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(rc.Close()).To(Succeed())
+
+		registry.RouteToHandler("GET", "/v2/"+repo+"/blobs/"+layerDigest.String(), ghttp.RespondWith(http.StatusOK, blob))
+	}
+
+	return digest.String()
+}
+
+// tarEntries returns the names of the entries in the tar stream, in order.
+func tarEntries(r io.Reader) []string {
+	names := []string{}
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+
+		Expect(err).ToNot(HaveOccurred())
+
+		names = append(names, hdr.Name)
+	}
+
+	return names
+}
+
 func cat(path string) string {
 	bytes, err := ioutil.ReadFile(path)
 	Expect(err).ToNot(HaveOccurred())
@@ -154,3 +427,45 @@ type registryTagsResponse struct {
 	Name string   `json:"name"`
 	Tags []string `json:"tags"`
 }
+
+// cosignSign signs the digest with the key in the same way as `cosign sign`,
+// returning the payload and signature.
+func cosignSign(repo name.Repository, digest v1.Hash, key *ecdsa.PrivateKey, optional map[string]string) ([]byte, []byte) {
+	payload, err := json.Marshal(map[string]interface{}{
+		"critical": map[string]interface{}{
+			"identity": map[string]string{"docker-reference": repo.Name()},
+			"image":    map[string]string{"docker-manifest-digest": digest.String()},
+			"type":     "cosign container image signature",
+		},
+		"optional": optional,
+	})
+	Expect(err).ToNot(HaveOccurred())
+
+	payloadHash := sha256.Sum256(payload)
+
+	signature, err := ecdsa.SignASN1(rand.Reader, key, payloadHash[:])
+	Expect(err).ToNot(HaveOccurred())
+
+	return payload, signature
+}
+
+// pushCosignSignature pushes a signature of the digest to the repository
+// where cosign would, with any additional layer annotations.
+func pushCosignSignature(repo name.Repository, digest v1.Hash, payload []byte, signature []byte, annotations map[string]string) {
+	layerAnnotations := map[string]string{
+		"dev.cosignproject.cosign/signature": base64.StdEncoding.EncodeToString(signature),
+	}
+
+	for k, v := range annotations {
+		layerAnnotations[k] = v
+	}
+
+	sigImage, err := mutate.Append(empty.Image, mutate.Addendum{
+		Layer:       static.NewLayer(payload, types.MediaType("application/vnd.dev.cosign.simplesigning.v1+json")),
+		Annotations: layerAnnotations,
+	})
+	Expect(err).ToNot(HaveOccurred())
+
+	err = remote.Write(repo.Tag(digest.Algorithm+"-"+digest.Hex+".sig"), sigImage)
+	Expect(err).ToNot(HaveOccurred())
+}
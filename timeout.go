@@ -0,0 +1,112 @@
+package resource
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// requestContext is the context of every request made to registries, which
+// is cancelled once the step times out so that a wedged connection fails the
+// step rather than hanging it.
+var requestContext = struct {
+	sync.Mutex
+	ctx context.Context
+}{
+	ctx: context.Background(),
+}
+
+// invocation is held from StartTimeout until Stop, so that only one check,
+// get, or put runs at a time: the request context, like the log level, is
+// shared by the whole process, so concurrent calls to the commands package's
+// exported API would otherwise replace each other's deadline.
+var invocation sync.Mutex
+
+// RequestContext returns the context with which to make requests to
+// registries.
+func RequestContext() context.Context {
+	requestContext.Lock()
+	defer requestContext.Unlock()
+
+	return requestContext.ctx
+}
+
+// Timeout aborts requests to registries once the source's timeout elapses.
+type Timeout struct {
+	duration time.Duration
+	ctx      context.Context
+	cancel   context.CancelFunc
+}
+
+// StartTimeout starts the source's timeout, if it has one, after which
+// requests made with RequestContext fail. It waits for any other invocation
+// to Stop first, so it must be paired with a call to Stop.
+func (source Source) StartTimeout() (*Timeout, error) {
+	var duration time.Duration
+	if source.Timeout != "" {
+		var err error
+		duration, err = time.ParseDuration(source.Timeout)
+		if err != nil {
+			return nil, Invalid("invalid timeout %q: %s", source.Timeout, err)
+		}
+
+		if duration <= 0 {
+			return nil, Invalid("invalid timeout %q: must be positive", source.Timeout)
+		}
+	}
+
+	invocation.Lock()
+	startTransportCache()
+	startECRTokenCache()
+
+	if duration == 0 {
+		return &Timeout{}, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), duration)
+
+	requestContext.Lock()
+	requestContext.ctx = ctx
+	requestContext.Unlock()
+
+	return &Timeout{
+		duration: duration,
+		ctx:      ctx,
+		cancel:   cancel,
+	}, nil
+}
+
+// Stop stops the timeout, after which requests are no longer limited by it,
+// and lets the next invocation start.
+func (t *Timeout) Stop() {
+	defer invocation.Unlock()
+	defer stopTransportCache()
+	defer stopECRTokenCache()
+
+	if t.cancel == nil {
+		return
+	}
+
+	requestContext.Lock()
+	if requestContext.ctx == t.ctx {
+		requestContext.ctx = context.Background()
+	}
+	requestContext.Unlock()
+
+	t.cancel()
+}
+
+// Explain returns the error with the timeout, if the timeout caused it.
+func (t *Timeout) Explain(err error) error {
+	if err == nil || t.ctx == nil {
+		return err
+	}
+
+	if !errors.Is(err, context.DeadlineExceeded) && t.ctx.Err() != context.DeadlineExceeded {
+		return err
+	}
+
+	return Categorize(CategoryNetwork, fmt.Errorf("timed out after %s (see 'timeout' in source): %w", t.duration, err))
+}
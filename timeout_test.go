@@ -0,0 +1,66 @@
+package resource_test
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	resource "github.com/concourse/registry-image-resource"
+)
+
+var _ = Describe("Timeout", func() {
+	It("limits requests made while it is running", func() {
+		timeout, err := resource.Source{Timeout: "1m"}.StartTimeout()
+		Expect(err).ToNot(HaveOccurred())
+
+		deadline, ok := resource.RequestContext().Deadline()
+		Expect(ok).To(BeTrue())
+		Expect(deadline).To(BeTemporally("~", time.Now().Add(time.Minute), time.Second))
+
+		timeout.Stop()
+
+		_, ok = resource.RequestContext().Deadline()
+		Expect(ok).To(BeFalse())
+	})
+
+	It("waits for the previous invocation to stop, rather than replacing its deadline", func() {
+		first, err := resource.Source{Timeout: "1m"}.StartTimeout()
+		Expect(err).ToNot(HaveOccurred())
+
+		started := make(chan *resource.Timeout)
+		go func() {
+			defer GinkgoRecover()
+
+			second, err := resource.Source{}.StartTimeout()
+			Expect(err).ToNot(HaveOccurred())
+
+			started <- second
+		}()
+
+		Consistently(started).ShouldNot(Receive())
+
+		deadline, ok := resource.RequestContext().Deadline()
+		Expect(ok).To(BeTrue())
+		Expect(deadline).To(BeTemporally("~", time.Now().Add(time.Minute), time.Second))
+
+		first.Stop()
+
+		var second *resource.Timeout
+		Eventually(started).Should(Receive(&second))
+
+		_, ok = resource.RequestContext().Deadline()
+		Expect(ok).To(BeFalse())
+
+		second.Stop()
+	})
+
+	It("does not wait when the timeout is invalid", func() {
+		_, err := resource.Source{Timeout: "bogus"}.StartTimeout()
+		Expect(err).To(HaveOccurred())
+
+		timeout, err := resource.Source{}.StartTimeout()
+		Expect(err).ToNot(HaveOccurred())
+		timeout.Stop()
+	})
+})
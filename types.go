@@ -5,6 +5,7 @@ import (
 	"crypto/x509"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
@@ -12,14 +13,20 @@ import (
 	"os"
 	"path/filepath"
 	"runtime"
+	"sort"
+	"strconv"
 	"strings"
-
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/credentials"
-	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/ecr"
-	"github.com/aws/aws-sdk-go/service/ecr/ecriface"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
+	"github.com/aws/aws-sdk-go-v2/service/ecr"
+	ecrtypes "github.com/aws/aws-sdk-go-v2/service/ecr/types"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
 	"github.com/google/go-containerregistry/pkg/authn"
 	"github.com/google/go-containerregistry/pkg/name"
 	v1 "github.com/google/go-containerregistry/pkg/v1"
@@ -51,6 +58,16 @@ type OutRequest struct {
 	Params PutParams `json:"params"`
 }
 
+// Variants returns the variants to push the version for, which is just the
+// source's variant (if any) unless variants are given in params.
+func (req OutRequest) Variants() []string {
+	if len(req.Params.Variants) > 0 {
+		return req.Params.Variants
+	}
+
+	return []string{req.Source.Variant}
+}
+
 type OutResponse struct {
 	Version  Version         `json:"version"`
 	Metadata []MetadataField `json:"metadata"`
@@ -65,6 +82,24 @@ type AwsCredentials struct {
 	AwsRoleArn         string   `json:"aws_role_arn,omitempty"`
 	AwsRoleArns        []string `json:"aws_role_arns,omitempty"`
 	AwsAccountId       string   `json:"aws_account_id,omitempty"`
+
+	// Use the FIPS endpoints of ECR, e.g. in GovCloud.
+	AwsUseFIPSEndpoint bool `json:"aws_use_fips_endpoint,omitempty"`
+
+	// Use the dual-stack (IPv4 and IPv6) endpoints of ECR.
+	AwsUseDualStackEndpoint bool `json:"aws_use_dualstack_endpoint,omitempty"`
+
+	// Create the repository when a put finds that it doesn't exist.
+	AwsECRCreateRepository bool `json:"aws_ecr_create_repository,omitempty"`
+
+	// Tags to apply to a repository created by put.
+	AwsECRRepositoryTags map[string]string `json:"aws_ecr_repository_tags,omitempty"`
+
+	// Enable scan on push for a repository created by put.
+	AwsECRScanOnPush bool `json:"aws_ecr_scan_on_push,omitempty"`
+
+	// Statuses of images for check to ignore, e.g. lifecycle_expiring.
+	AwsECRIgnoreTagStatus []string `json:"aws_ecr_ignore_tag_status,omitempty"`
 }
 
 type BasicCredentials struct {
@@ -76,47 +111,456 @@ type RegistryMirror struct {
 	Host string `json:"host,omitempty"`
 
 	BasicCredentials
+
+	// AzureAuth authenticates to a mirror hosted on ACR.
+	AzureAuth *AzureAuth `json:"azure_auth,omitempty"`
+
+	// Priority is 'mirror_first' (the default) or 'origin_first', to only use
+	// the mirror as a fallback.
+	Priority string `json:"priority,omitempty"`
+
+	// SkipCheck checks the origin only, using the mirror just for fetching.
+	SkipCheck bool `json:"skip_check,omitempty"`
+
+	// DomainCerts are CA certificates to trust for the mirror instead of the
+	// source's.
+	DomainCerts []string `json:"ca_certs,omitempty"`
 }
 
 type PlatformField struct {
 	Architecture string `json:"architecture,omitempty"`
 	OS           string `json:"os,omitempty"`
+	Variant      string `json:"variant,omitempty"`
 }
 
 type Source struct {
 	Repository string `json:"repository"`
 
+	// Registry is joined onto the repository, e.g. 'ghcr.io' and 'org/app', so
+	// that it can be configured separately.
+	Registry string `json:"registry,omitempty"`
+
 	Insecure bool `json:"insecure"`
 
 	PreReleases bool   `json:"pre_releases,omitempty"`
 	Variant     string `json:"variant,omitempty"`
 
+	// Prefix of version tags, e.g. 'release-' for release-1.2.3, which is
+	// stripped before parsing them.
+	TagPrefix string `json:"tag_prefix,omitempty"`
+
 	SemverConstraint string `json:"semver_constraint,omitempty"`
 
+	// Accept versions with more than three components, e.g. 8.0.36.1.
+	TolerantVersions bool `json:"tolerant_versions,omitempty"`
+
 	Tag Tag `json:"tag,omitempty"`
 
+	// TagHistory is the number of digests the tag previously pointed to to
+	// emit along with its current digest, for Docker Hub repositories.
+	TagHistory int `json:"tag_history,omitempty"`
+
+	// Digest pins the resource to a single version of the image.
+	Digest string `json:"digest,omitempty"`
+
+	// DefaultTag is used for versions without a tag, e.g. ones pinned by
+	// digest alone.
+	DefaultTag Tag `json:"default_tag,omitempty"`
+
 	Regex         string `json:"tag_regex,omitempty"`
 	CreatedAtSort bool   `json:"created_at_sort,omitempty"`
 
+	// Emit one version per digest for tags matching the regex.
+	DedupeDigests bool `json:"dedupe_digests,omitempty"`
+
+	// Only fetch the digests of (and emit) the newest N tags which pass the
+	// tag filters, for repositories with thousands of tags.
+	MaxVersions int `json:"max_versions,omitempty"`
+
+	// Number of tag digests to fetch concurrently when checking.
+	CheckConcurrency int `json:"check_concurrency,omitempty"`
+
+	// Labels which the image config of each version must have, with these
+	// values, for check to emit it.
+	LabelFilters map[string]string `json:"label_filters,omitempty"`
+
+	// Labels of the image to show as metadata of gets and puts, e.g.
+	// org.opencontainers.image.revision.
+	MetadataLabels []string `json:"metadata_labels,omitempty"`
+
+	// InitialTag and InitialDigest are the version to start checking from
+	// when there is no previous version.
+	InitialTag    Tag    `json:"initial_tag,omitempty"`
+	InitialDigest string `json:"initial_digest,omitempty"`
+
 	BasicCredentials
 	AwsCredentials
 
+	OAuth2TokenExchange bool `json:"oauth2_token_exchange,omitempty"`
+
+	// GitHubToken is a token for GHCR, e.g. a workflow's GITHUB_TOKEN, used in
+	// place of a username and password.
+	GitHubToken string `json:"github_token,omitempty"`
+
+	// GitHubApp configures an app installation to mint tokens for GHCR with.
+	GitHubApp *GitHubApp `json:"github_app,omitempty"`
+
+	// GoogleAuth configures how to mint an access token for Artifact Registry.
+	GoogleAuth *GoogleAuth `json:"google_auth,omitempty"`
+
+	// AzureAuth configures an Entra ID identity to authenticate to ACR with.
+	AzureAuth *AzureAuth `json:"azure_auth,omitempty"`
+
+	// OAuth configures a token endpoint to obtain a bearer token from.
+	OAuth *OAuth `json:"oauth,omitempty"`
+
+	// DockerConfig is a Docker CLI config.json, or a path to one, with which
+	// to resolve credentials for the registry.
+	DockerConfig string `json:"docker_config,omitempty"`
+
+	// CredentialHelper is the name of a docker-credential-<name> program with
+	// which to get credentials for the registry.
+	CredentialHelper string `json:"credential_helper,omitempty"`
+
+	// bearerToken is the token obtained per OAuth, or a registry token from
+	// the DockerConfig, used instead of any username and password.
+	bearerToken string
+
+	// identityToken is a refresh token from the DockerConfig or a credential
+	// helper, used instead of any username and password.
+	identityToken string
+
 	RegistryMirror *RegistryMirror `json:"registry_mirror,omitempty"`
 
+	// RegistryMirrors are tried in order before the origin, e.g. a primary
+	// and a secondary cache.
+	RegistryMirrors []RegistryMirror `json:"registry_mirrors,omitempty"`
+
 	ContentTrust *ContentTrust `json:"content_trust,omitempty"`
 
+	Cosign *CosignSigning `json:"cosign,omitempty"`
+
 	DomainCerts []string `json:"ca_certs,omitempty"`
 
 	RawPlatform *PlatformField `json:"platform,omitempty"`
 
+	AllowedRegistries []string `json:"allowed_registries,omitempty"`
+
+	PinPolicy string `json:"pin_policy,omitempty"`
+
+	HeartbeatInterval int `json:"heartbeat_interval,omitempty"`
+
+	// Timeout for the whole step, e.g. '15m', after which requests to
+	// registries are aborted.
+	Timeout string `json:"timeout,omitempty"`
+
+	ConsistencyWait int `json:"consistency_wait,omitempty"`
+
+	DisableHeadRequests bool `json:"disable_head_requests,omitempty"`
+
+	ConvertSchema1 bool `json:"convert_schema1,omitempty"`
+
+	// Directory in which to cache layers across gets, e.g. one persisted on
+	// the worker. Defaults to $REGISTRY_IMAGE_CACHE_PATH.
+	CachePath string `json:"cache_path,omitempty"`
+
+	// Size in bytes to prune the layer cache to after each get, removing the
+	// least recently used layers first.
+	CacheMaxSize int64 `json:"cache_max_size,omitempty"`
+
 	Debug bool `json:"debug,omitempty"`
+
+	// DebugHTTP logs every request made to the registry and its response.
+	DebugHTTP bool `json:"debug_http,omitempty"`
+
+	// Strict rejects unknown fields in the source and params when unset or
+	// true; when false, they're ignored with a warning.
+	Strict *bool `json:"strict,omitempty"`
+}
+
+// CachePathEnv configures the layer cache for every get when the source
+// doesn't, e.g. by the worker's resource type configuration.
+const CachePathEnv = "REGISTRY_IMAGE_CACHE_PATH"
+
+// LayerCachePath is the directory in which to cache layers, or empty to not
+// cache them.
+func (source Source) LayerCachePath() string {
+	if source.CachePath != "" {
+		return source.CachePath
+	}
+
+	return os.Getenv(CachePathEnv)
+}
+
+// DefaultCacheMaxSize is the size the layer cache is pruned to, unless
+// configured.
+const DefaultCacheMaxSize = 10 * 1024 * 1024 * 1024
+
+// LayerCacheMaxSize is the size in bytes to prune the layer cache to.
+func (source Source) LayerCacheMaxSize() int64 {
+	if source.CacheMaxSize > 0 {
+		return source.CacheMaxSize
+	}
+
+	return DefaultCacheMaxSize
+}
+
+// Heartbeat is the interval at which to print a line of progress in place of
+// progress bars, or zero to show progress bars.
+func (source Source) Heartbeat() time.Duration {
+	return time.Duration(source.HeartbeatInterval) * time.Second
+}
+
+// ConsistencyTimeout is how long to keep retrying when the registry can't find
+// a manifest which was just pushed, or zero to not retry.
+func (source Source) ConsistencyTimeout() time.Duration {
+	return time.Duration(source.ConsistencyWait) * time.Second
+}
+
+// DefaultCheckConcurrency is the number of tag digests fetched concurrently
+// when checking, unless configured.
+const DefaultCheckConcurrency = 8
+
+// CheckWorkers is the number of tag digests, or image configs, to fetch
+// concurrently when checking.
+func (source Source) CheckWorkers() int {
+	if source.CheckConcurrency > 0 {
+		return source.CheckConcurrency
+	}
+
+	return DefaultCheckConcurrency
+}
+
+// FloatingTags are tags which are conventionally moved to point to newer
+// images, as opposed to identifying a particular release.
+var FloatingTags = []string{"latest", "stable", "edge", "nightly"}
+
+// TracksFloatingTag returns true if the source is configured with a tag that
+// is expected to move, i.e. one of FloatingTags, and isn't pinned to a digest.
+func (source Source) TracksFloatingTag() bool {
+	if source.Digest != "" {
+		return false
+	}
+
+	for _, tag := range FloatingTags {
+		if source.Tag.String() == tag {
+			return true
+		}
+	}
+
+	return false
+}
+
+// InitialVersion returns the version configured to start checking from, or
+// nil if there isn't one.
+func (source Source) InitialVersion() (*Version, error) {
+	if source.InitialTag == "" && source.InitialDigest == "" {
+		return nil, nil
+	}
+
+	if source.Digest != "" {
+		return nil, Invalid("initial_tag and initial_digest cannot be used with digest")
+	}
+
+	if source.Regex != "" {
+		return nil, Invalid("initial_tag and initial_digest cannot be used with tag_regex")
+	}
+
+	if source.Tag != "" {
+		if source.InitialTag != "" && source.InitialTag != source.Tag {
+			return nil, Invalid("initial_tag must match tag; configure initial_digest to start from a previous digest of the tag")
+		}
+
+		if source.InitialDigest == "" {
+			return nil, Invalid("initial_digest must be set when tracking tag %q", source.Tag)
+		}
+
+		return &Version{Tag: source.Tag.String(), Digest: source.InitialDigest}, nil
+	}
+
+	if source.InitialTag == "" {
+		return nil, Invalid("initial_tag must be set with initial_digest when tracking version tags")
+	}
+
+	return &Version{Tag: source.InitialTag.String(), Digest: source.InitialDigest}, nil
+}
+
+// CheckAllowedRegistries returns an error if the repository, or the registry
+// mirror that would be used in its place, is not in allowed_registries.
+func (source Source) CheckAllowedRegistries() error {
+	repo, err := source.NewRepository()
+	if err != nil {
+		return fmt.Errorf("parse repository: %w", err)
+	}
+
+	err = source.CheckRegistryAllowed(repo.Registry)
+	if err != nil {
+		return err
+	}
+
+	mirrors, err := source.Mirrors()
+	if err != nil {
+		return fmt.Errorf("resolve mirror: %w", err)
+	}
+
+	for _, mirror := range mirrors {
+		mirrorRepo, err := mirror.NewRepository()
+		if err != nil {
+			return fmt.Errorf("parse mirror repository: %w", err)
+		}
+
+		err = source.CheckRegistryAllowed(mirrorRepo.Registry)
+		if err != nil {
+			return fmt.Errorf("registry mirror: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// CheckRegistryAllowed returns an error if allowed_registries is configured
+// and does not include the given registry.
+func (source Source) CheckRegistryAllowed(registry name.Registry) error {
+	if len(source.AllowedRegistries) == 0 {
+		return nil
+	}
+
+	for _, host := range source.AllowedRegistries {
+		// parse so that e.g. docker.io matches index.docker.io
+		allowed, err := name.NewRegistry(host)
+		if err != nil {
+			return fmt.Errorf("parse allowed registry %q: %w", host, err)
+		}
+
+		if allowed.RegistryStr() == registry.RegistryStr() {
+			return nil
+		}
+	}
+
+	return Invalid("registry %s is not in allowed_registries", registry.RegistryStr())
 }
 
-func (source Source) Mirror() (Source, bool, error) {
+// SourcesToTry returns the sources to try in turn: the origin and, if they
+// apply, the registry mirrors. A registry_mirror is tried in the configured
+// priority, while registry_mirrors are tried in order before the origin.
+// Mirrors are skipped when checking if configured to.
+func (source Source) SourcesToTry(checking bool) ([]Source, error) {
+	configs, err := source.mirrorConfigs()
+	if err != nil {
+		return nil, err
+	}
+
+	var mirrors []Source
+	for i, config := range configs {
+		mirror, hasMirror, err := source.mirrorSource(config)
+		if err != nil {
+			return nil, err
+		}
+
+		if !hasMirror || (checking && config.SkipCheck) {
+			continue
+		}
+
+		err = mirror.authenticateMirror()
+		if err != nil {
+			if len(source.RegistryMirrors) > 0 {
+				return nil, fmt.Errorf("registry_mirrors[%d]: %w", i, err)
+			}
+
+			return nil, fmt.Errorf("registry mirror: %w", err)
+		}
+
+		mirrors = append(mirrors, mirror)
+	}
+
+	if len(mirrors) == 0 {
+		return []Source{source}, nil
+	}
+
 	if source.RegistryMirror == nil {
-		return Source{}, false, nil
+		return append(mirrors, source), nil
+	}
+
+	switch source.RegistryMirror.Priority {
+	case "", "mirror_first":
+		return append(mirrors, source), nil
+	case "origin_first":
+		return append([]Source{source}, mirrors...), nil
+	default:
+		return nil, Invalid("unknown registry_mirror priority %q (must be 'mirror_first' or 'origin_first')", source.RegistryMirror.Priority)
+	}
+}
+
+// authenticateMirror resolves a mirror's credentials, from its azure_auth,
+// or otherwise the docker_config or credential_helper shared with the origin.
+func (source *Source) authenticateMirror() error {
+	err := source.AuthenticateToAzure()
+	if err != nil {
+		return err
+	}
+
+	if source.Username != "" || source.Password != "" || source.AzureAuth != nil {
+		return nil
+	}
+
+	// resolve the mirror's own credentials from the same config or helper
+	err = source.AuthenticateWithDockerConfig()
+	if err != nil {
+		return err
+	}
+
+	return source.AuthenticateWithCredentialHelper()
+}
+
+// OriginFirst returns whether the registry mirror is only a fallback for the
+// origin.
+func (source Source) OriginFirst() bool {
+	return source.RegistryMirror != nil && source.RegistryMirror.Priority == "origin_first"
+}
+
+// Mirrors returns a source for each registry mirror which applies to the
+// source's repository, in order.
+func (source Source) Mirrors() ([]Source, error) {
+	configs, err := source.mirrorConfigs()
+	if err != nil {
+		return nil, err
+	}
+
+	var mirrors []Source
+	for _, config := range configs {
+		mirror, hasMirror, err := source.mirrorSource(config)
+		if err != nil {
+			return nil, err
+		}
+
+		if hasMirror {
+			mirrors = append(mirrors, mirror)
+		}
+	}
+
+	return mirrors, nil
+}
+
+// mirrorConfigs returns the registry_mirror or registry_mirrors.
+func (source Source) mirrorConfigs() ([]RegistryMirror, error) {
+	if source.RegistryMirror != nil && len(source.RegistryMirrors) > 0 {
+		return nil, Invalid("cannot specify both 'registry_mirror' and 'registry_mirrors'")
+	}
+
+	if source.RegistryMirror != nil {
+		return []RegistryMirror{*source.RegistryMirror}, nil
+	}
+
+	for i, config := range source.RegistryMirrors {
+		if config.Priority != "" {
+			return nil, Invalid("registry_mirrors[%d]: 'priority' is not supported; registry_mirrors are tried in order before the origin", i)
+		}
 	}
 
+	return source.RegistryMirrors, nil
+}
+
+func (source Source) mirrorSource(config RegistryMirror) (Source, bool, error) {
 	repo, err := name.NewRepository(source.Repository)
 	if err != nil {
 		return Source{}, false, fmt.Errorf("parse repository: %w", err)
@@ -136,15 +580,23 @@ func (source Source) Mirror() (Source, bool, error) {
 		return Source{}, false, fmt.Errorf("resolve implicit namespace: %w", err)
 	}
 
-	mirror.Registry, err = name.NewRegistry(source.RegistryMirror.Host)
+	mirror.Registry, err = name.NewRegistry(config.Host)
 	if err != nil {
 		return Source{}, false, fmt.Errorf("parse mirror registry: %w", err)
 	}
 
 	copy := source
 	copy.Repository = mirror.Name()
-	copy.BasicCredentials = source.RegistryMirror.BasicCredentials
+	copy.BasicCredentials = config.BasicCredentials
+	copy.AzureAuth = config.AzureAuth
+	copy.bearerToken = ""
+	copy.identityToken = ""
 	copy.RegistryMirror = nil
+	copy.RegistryMirrors = nil
+
+	if len(config.DomainCerts) > 0 {
+		copy.DomainCerts = config.DomainCerts
+	}
 
 	return copy, true, nil
 }
@@ -162,7 +614,7 @@ func (source Source) NewOptions() Options {
 func (source Source) SetOptions(opts *Options) error {
 	opts.Name = source.RepositoryOptions()
 
-	r, err := name.NewRepository(source.Repository, opts.Name...)
+	r, err := source.NewRepository()
 	if err != nil {
 		return fmt.Errorf("resolve repository name: %w", err)
 	}
@@ -173,12 +625,66 @@ func (source Source) SetOptions(opts *Options) error {
 		return err
 	}
 
+	// share one pusher across all writes so that blobs already known to exist
+	// aren't checked again, including when a put is retried after being rate
+	// limited, which then resumes from the manifests
+	pusher, err := remote.NewPusher(opts.Remote...)
+	if err != nil {
+		return fmt.Errorf("initialize pusher: %w", err)
+	}
+
+	opts.Remote = append(opts.Remote, remote.Reuse(pusher))
+
 	return nil
 }
 
+// PullOptions returns the AuthOptions for pulling from the repository along
+// with a shared puller, so that all requests made with them reuse the same
+// connections and tokens.
+func (source Source) PullOptions(repo name.Repository) ([]remote.Option, error) {
+	opts, err := source.AuthOptions(repo, []string{transport.PullScope})
+	if err != nil {
+		return nil, err
+	}
+
+	puller, err := remote.NewPuller(opts...)
+	if err != nil {
+		return nil, fmt.Errorf("initialize puller: %w", err)
+	}
+
+	return append(opts, remote.Reuse(puller)), nil
+}
+
 func (source Source) AuthOptions(repo name.Repository, scopeActions []string) ([]remote.Option, error) {
+	auth, rt, err := source.authTransport(repo, scopeActions)
+	if err != nil {
+		return nil, err
+	}
+
+	platform := source.Platform()
+
+	return []remote.Option{remote.WithAuth(auth), remote.WithTransport(rt), remote.WithPlatform(platform.V1Platform()), remote.WithContext(RequestContext())}, nil
+}
+
+// PullTransport returns a transport authenticated for pulling from the
+// repository, for requests the remote package doesn't make, e.g. fetching
+// part of a blob.
+func (source Source) PullTransport(repo name.Repository) (http.RoundTripper, error) {
+	_, rt, err := source.authTransport(repo, []string{transport.PullScope})
+	return rt, err
+}
+
+func (source Source) authTransport(repo name.Repository, scopeActions []string) (authn.Authenticator, http.RoundTripper, error) {
 	var auth authn.Authenticator
-	if source.Username != "" && source.Password != "" {
+	if source.bearerToken != "" {
+		auth = &authn.Bearer{
+			Token: source.bearerToken,
+		}
+	} else if source.identityToken != "" {
+		auth = authn.FromConfig(authn.AuthConfig{
+			IdentityToken: source.identityToken,
+		})
+	} else if source.Username != "" && source.Password != "" {
 		auth = &authn.Basic{
 			Username: source.Username,
 			Password: source.Password,
@@ -190,9 +696,13 @@ func (source Source) AuthOptions(repo name.Repository, scopeActions []string) ([
 	tr := http.DefaultTransport.(*http.Transport)
 	// a cert was provided
 	if len(source.DomainCerts) > 0 {
+		// don't share the certs with other sources, e.g. registry mirrors
+		// with their own
+		tr = tr.Clone()
+
 		rootCAs, err := x509.SystemCertPool()
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 		if rootCAs == nil {
 			rootCAs = x509.NewCertPool()
@@ -201,7 +711,7 @@ func (source Source) AuthOptions(repo name.Repository, scopeActions []string) ([
 		for _, cert := range source.DomainCerts {
 			// append our cert to the system pool
 			if ok := rootCAs.AppendCertsFromPEM([]byte(cert)); !ok {
-				return nil, fmt.Errorf("failed to append registry certificate: %w", err)
+				return nil, nil, fmt.Errorf("failed to append registry certificate: %w", err)
 			}
 		}
 
@@ -218,18 +728,121 @@ func (source Source) AuthOptions(repo name.Repository, scopeActions []string) ([
 		scopes[i] = repo.Scope(action)
 	}
 
-	rt, err := transport.New(repo.Registry, auth, tr, scopes)
+	var base http.RoundTripper = tr
+	if source.DebugHTTP {
+		base = &TraceTransport{
+			Inner: tr,
+			Out:   logrus.StandardLogger().Out,
+		}
+	}
+
+	rt, err := cachedTransport(source.transportKey(repo), repo.Registry, source.BasicCredentials, source.OAuth2TokenExchange, auth, base, scopes)
+	if err != nil {
+		return nil, nil, fmt.Errorf("initialize transport: %w", err)
+	}
+
+	return auth, rt, nil
+}
+
+// transportKey identifies a cached transport by everything it was built
+// with: the registry, the credentials, and the trust and tracing settings.
+type transportKey struct {
+	scheme        string
+	registry      string
+	username      string
+	password      string
+	bearerToken   string
+	identityToken string
+	domainCerts   string
+	insecure      bool
+	debugHTTP     bool
+}
+
+func (source Source) transportKey(repo name.Repository) transportKey {
+	return transportKey{
+		scheme:        repo.Registry.Scheme(),
+		registry:      repo.RegistryStr(),
+		username:      source.Username,
+		password:      source.Password,
+		bearerToken:   source.bearerToken,
+		identityToken: source.identityToken,
+		domainCerts:   strings.Join(source.DomainCerts, "\n"),
+		insecure:      source.Insecure,
+		debugHTTP:     source.DebugHTTP,
+	}
+}
+
+// SharesTransport returns true if the other source is in the same registry,
+// with the same credentials and transport settings, so that the same
+// transport can talk to both of their repositories.
+func (source Source) SharesTransport(other Source) bool {
+	repo, err := source.NewRepository()
 	if err != nil {
-		return nil, fmt.Errorf("initialize transport: %w", err)
+		return false
 	}
 
-	plat := source.Platform()
-	v1plat := v1.Platform{
-		Architecture: plat.Architecture,
-		OS:           plat.OS,
+	otherRepo, err := other.NewRepository()
+	if err != nil {
+		return false
 	}
 
-	return []remote.Option{remote.WithAuth(auth), remote.WithTransport(rt), remote.WithPlatform(v1plat)}, nil
+	return source.transportKey(repo) == other.transportKey(otherRepo)
+}
+
+// transports caches authenticated transports by registry and credentials, so
+// that talking to the same registry more than once (e.g. to check aliases and
+// then push) only pings it and exchanges a token once per invocation. The
+// cache only lives from StartTimeout until Stop, as the transports hold
+// credentials and tokens which expire; outside of an invocation nothing is
+// cached.
+var transports = struct {
+	sync.Mutex
+	cache map[transportKey]http.RoundTripper
+}{}
+
+func startTransportCache() {
+	transports.Lock()
+	transports.cache = map[transportKey]http.RoundTripper{}
+	transports.Unlock()
+}
+
+func stopTransportCache() {
+	transports.Lock()
+	transports.cache = nil
+	transports.Unlock()
+}
+
+func cachedTransport(key transportKey, registry name.Registry, creds BasicCredentials, oauth bool, auth authn.Authenticator, tr http.RoundTripper, scopes []string) (http.RoundTripper, error) {
+	transports.Lock()
+	defer transports.Unlock()
+
+	if rt, found := transports.cache[key]; found {
+		// the transport requests any additional scopes it needs when
+		// challenged by the registry
+		return rt, nil
+	}
+
+	if oauth && creds.Username != "" && creds.Password != "" {
+		exchanged, err := exchangeOAuthToken(registry, creds, tr, scopes)
+		if err != nil {
+			return nil, err
+		}
+
+		if exchanged != nil {
+			auth = exchanged
+		}
+	}
+
+	rt, err := transport.New(registry, auth, tr, scopes)
+	if err != nil {
+		return nil, err
+	}
+
+	if transports.cache != nil {
+		transports.cache[key] = rt
+	}
+
+	return rt, nil
 }
 
 func (source *Source) Platform() PlatformField {
@@ -243,6 +856,10 @@ func (source *Source) Platform() PlatformField {
 
 	if p.Architecture == "" {
 		p.Architecture = DefaultArchitecture
+
+		if p.Variant == "" {
+			p.Variant = defaultVariant(DefaultArchitecture)
+		}
 	}
 
 	if p.OS == "" {
@@ -256,6 +873,60 @@ func (source Source) NewRepository() (name.Repository, error) {
 	return name.NewRepository(source.Repository, source.RepositoryOptions()...)
 }
 
+// SplitReference moves a tag or digest included in the repository, e.g.
+// 'nginx:1.25' or 'ghcr.io/org/app@sha256:...', into the tag and digest
+// fields, so that references copied from other tools work as expected. A
+// separately configured registry is joined onto the repository first.
+func (source *Source) SplitReference() error {
+	if source.Registry != "" {
+		if source.AwsRegion != "" {
+			return fmt.Errorf("registry cannot be configured with aws_region, which determines the registry")
+		}
+
+		first, _, found := strings.Cut(source.Repository, "/")
+		if found && (strings.ContainsAny(first, ".:") || first == "localhost") {
+			return fmt.Errorf("repository %q includes a registry which conflicts with registry %q", source.Repository, source.Registry)
+		}
+
+		source.Repository = strings.TrimSuffix(source.Registry, "/") + "/" + source.Repository
+		source.Registry = ""
+	}
+
+	ref, err := name.ParseReference(source.Repository, source.RepositoryOptions()...)
+	if err != nil {
+		// leave it to NewRepository to report
+		return nil
+	}
+
+	switch r := ref.(type) {
+	case name.Digest:
+		if source.Digest != "" && source.Digest != r.DigestStr() {
+			return fmt.Errorf("repository %q includes a digest which conflicts with digest %q", source.Repository, source.Digest)
+		}
+
+		source.Digest = r.DigestStr()
+		source.Repository, _, _ = strings.Cut(source.Repository, "@")
+
+		// the repository may also include a tag, e.g. nginx:1.25@sha256:...
+		return source.SplitReference()
+
+	case name.Tag:
+		if !strings.HasSuffix(source.Repository, ":"+r.TagStr()) {
+			// default tag
+			return nil
+		}
+
+		if source.Tag != "" && source.Tag.String() != r.TagStr() {
+			return fmt.Errorf("repository %q includes a tag which conflicts with tag %q", source.Repository, source.Tag)
+		}
+
+		source.Tag = Tag(r.TagStr())
+		source.Repository = strings.TrimSuffix(source.Repository, ":"+r.TagStr())
+	}
+
+	return nil
+}
+
 func (source Source) RepositoryOptions() []name.Option {
 	var opts []name.Option
 	if source.Insecure {
@@ -273,9 +944,37 @@ type ContentTrust struct {
 	TLSCert              string `json:"tls_cert"`
 	Scopes               string `json:"scopes,omitempty"`
 
+	// Verify that versions are signed before emitting them from check or
+	// fetching them in get.
+	Verify bool `json:"verify,omitempty"`
+
 	BasicCredentials
 }
 
+// CosignSigning configures signing pushed images with cosign, with either a
+// key or a short-lived certificate issued by Fulcio (keyless).
+type CosignSigning struct {
+	// PEM-encoded private key, e.g. as generated by `cosign
+	// generate-key-pair`, and the password it is encrypted with.
+	Key      string `json:"key,omitempty"`
+	Password string `json:"password,omitempty"`
+
+	Keyless *KeylessSigning `json:"keyless,omitempty"`
+
+	// Annotations to include in the signature payload.
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// KeylessSigning configures signing with a certificate issued by Fulcio for
+// an OIDC identity, recording the signature in the Rekor transparency log.
+type KeylessSigning struct {
+	// OIDC identity token to exchange for a signing certificate.
+	IdentityToken string `json:"identity_token"`
+
+	FulcioURL string `json:"fulcio_url,omitempty"`
+	RekorURL  string `json:"rekor_url,omitempty"`
+}
+
 /*
 	Create notary config directory with following structure
 
@@ -361,6 +1060,19 @@ func (source *Source) Name() string {
 	return fmt.Sprintf("%s:%s", source.Repository, source.Tag)
 }
 
+// DefaultVersionTag returns the tag to use for versions without one.
+func (source *Source) DefaultVersionTag() string {
+	if source.DefaultTag != "" {
+		return source.DefaultTag.String()
+	}
+
+	if source.Tag != "" {
+		return source.Tag.String()
+	}
+
+	return "latest"
+}
+
 func (source *Source) Metadata() []MetadataField {
 	return []MetadataField{
 		{
@@ -370,48 +1082,84 @@ func (source *Source) Metadata() []MetadataField {
 	}
 }
 
-func (source *Source) AuthenticateToECR() bool {
-	logrus.Warnln("ECR integration is experimental and untested")
+// LabelMetadata returns a metadata field for each of the metadata_labels
+// which the image has, named after the label.
+func (source *Source) LabelMetadata(labels map[string]string) []MetadataField {
+	var fields []MetadataField
+	for _, label := range source.MetadataLabels {
+		value, found := labels[label]
+		if !found {
+			continue
+		}
 
-	if source.AwsRoleArn != "" && len(source.AwsRoleArns) != 0 {
-		logrus.Errorf("`aws_role_arn` cannot be set at the same time as `aws_role_arns`")
-		return false
+		fields = append(fields, MetadataField{
+			Name:  label,
+			Value: value,
+		})
 	}
 
-	awsConfig := aws.Config{
-		Region: aws.String(source.AwsRegion),
+	return fields
+}
+
+// Authenticate resolves the source's credentials from whichever of its
+// authentication methods is configured: ECR, GitHub, Google, Azure, OAuth,
+// docker_config, or credential_helper.
+func (source *Source) Authenticate() error {
+	if source.AwsRegion != "" {
+		if !source.AuthenticateToECR() {
+			return Categorize(CategoryAuth, fmt.Errorf("cannot authenticate with ECR"))
+		}
 	}
 
-	if source.AwsAccessKeyId != "" && source.AwsSecretAccessKey != "" {
-		awsConfig.Credentials = credentials.NewStaticCredentials(source.AwsAccessKeyId, source.AwsSecretAccessKey, source.AwsSessionToken)
+	err := source.AuthenticateToGitHub()
+	if err != nil {
+		return err
 	}
 
-	mySession := session.Must(session.NewSession(&awsConfig))
+	err = source.AuthenticateToGoogle()
+	if err != nil {
+		return err
+	}
 
-	// Note: This implementation gives precedence to `aws_role_arn` since it
-	// assumes that we've errored if both `aws_role_arn` and `aws_role_arns`
-	// are set
-	awsRoleArns := source.AwsRoleArns
-	if source.AwsRoleArn != "" {
-		awsRoleArns = []string{source.AwsRoleArn}
+	err = source.AuthenticateToAzure()
+	if err != nil {
+		return err
 	}
-	for _, roleArn := range awsRoleArns {
-		logrus.Debugf("assuming new role: %s", roleArn)
-		mySession = session.Must(session.NewSession(&aws.Config{
-			Region:      aws.String(source.AwsRegion),
-			Credentials: stscreds.NewCredentials(mySession, roleArn),
-		}))
+
+	err = source.AuthenticateWithOAuth()
+	if err != nil {
+		return err
 	}
 
-	client := ecr.New(mySession)
-	result, err := source.GetECRAuthorizationToken(client)
+	err = source.AuthenticateWithDockerConfig()
+	if err != nil {
+		return err
+	}
+
+	return source.AuthenticateWithCredentialHelper()
+}
+
+func (source *Source) AuthenticateToECR() bool {
+	logrus.Warnln("ECR integration is experimental and untested")
+
+	if source.AwsRoleArn != "" && len(source.AwsRoleArns) != 0 {
+		logrus.Errorf("`aws_role_arn` cannot be set at the same time as `aws_role_arns`")
+		return false
+	}
+
+	result, err := source.cachedECRAuthorizationToken()
 	if err != nil {
 		logrus.Errorf("failed to authenticate to ECR: %s", err)
 		return false
 	}
 
+	if len(result.AuthorizationData) == 0 {
+		logrus.Errorf("failed to authenticate to ECR: no authorization data")
+		return false
+	}
+
 	for _, data := range result.AuthorizationData {
-		output, err := base64.StdEncoding.DecodeString(*data.AuthorizationToken)
+		output, err := base64.StdEncoding.DecodeString(aws.ToString(data.AuthorizationToken))
 
 		if err != nil {
 			logrus.Errorf("failed to decode credential (%s)", err.Error())
@@ -431,21 +1179,229 @@ func (source *Source) AuthenticateToECR() bool {
 	// Update username and repository
 	source.Username = "AWS"
 
-	if source.AwsAccountId != "" {
-		source.Repository = fmt.Sprintf("%s.dkr.ecr.%s.amazonaws.com/%s", source.AwsAccountId, source.AwsRegion, source.Repository)
+	proxyEndpoint := strings.TrimPrefix(aws.ToString(result.AuthorizationData[0].ProxyEndpoint), "https://")
+
+	accountId := source.AwsAccountId
+	if accountId == "" && (source.AwsUseFIPSEndpoint || source.AwsUseDualStackEndpoint) {
+		// e.g. 012345678910.dkr.ecr.us-east-1.amazonaws.com
+		accountId, _, _ = strings.Cut(proxyEndpoint, ".")
+	}
+
+	if accountId != "" {
+		source.Repository = fmt.Sprintf("%s/%s", source.ECRRegistry(accountId), source.Repository)
 	} else {
-		source.Repository = fmt.Sprintf("%s/%s", strings.TrimPrefix(*result.AuthorizationData[0].ProxyEndpoint, "https://"), source.Repository)
+		source.Repository = fmt.Sprintf("%s/%s", proxyEndpoint, source.Repository)
 	}
 
 	return true
 }
 
-func (source *Source) GetECRAuthorizationToken(client ecriface.ECRAPI) (*ecr.GetAuthorizationTokenOutput, error) {
+// ecrTokenKey identifies a cached ECR authorization token by everything it
+// was requested with: the registry, the region and endpoints, and the AWS
+// credentials and roles.
+type ecrTokenKey struct {
+	registryID      string
+	region          string
+	fips            bool
+	dualStack       bool
+	accessKeyID     string
+	secretAccessKey string
+	sessionToken    string
+	roleArn         string
+	roleArns        string
+}
+
+func (source Source) ecrTokenKey() ecrTokenKey {
+	return ecrTokenKey{
+		registryID:      source.AWSECRRegistryId,
+		region:          source.AwsRegion,
+		fips:            source.AwsUseFIPSEndpoint,
+		dualStack:       source.AwsUseDualStackEndpoint,
+		accessKeyID:     source.AwsAccessKeyId,
+		secretAccessKey: source.AwsSecretAccessKey,
+		sessionToken:    source.AwsSessionToken,
+		roleArn:         source.AwsRoleArn,
+		roleArns:        strings.Join(source.AwsRoleArns, "\n"),
+	}
+}
+
+// ecrTokens caches the ECR authorization tokens granted during an invocation.
+// ECR grants a new password every time, so without it repositories in the
+// same registry (e.g. additional_repositories) would each have their own
+// credentials, and couldn't share a transport (see SharesTransport). Like
+// transports, the cache only lives from StartTimeout until Stop.
+var ecrTokens = struct {
+	sync.Mutex
+	cache map[ecrTokenKey]*ecr.GetAuthorizationTokenOutput
+}{}
+
+func startECRTokenCache() {
+	ecrTokens.Lock()
+	ecrTokens.cache = map[ecrTokenKey]*ecr.GetAuthorizationTokenOutput{}
+	ecrTokens.Unlock()
+}
+
+func stopECRTokenCache() {
+	ecrTokens.Lock()
+	ecrTokens.cache = nil
+	ecrTokens.Unlock()
+}
+
+func (source *Source) cachedECRAuthorizationToken() (*ecr.GetAuthorizationTokenOutput, error) {
+	ecrTokens.Lock()
+	defer ecrTokens.Unlock()
+
+	key := source.ecrTokenKey()
+	if result, found := ecrTokens.cache[key]; found {
+		return result, nil
+	}
+
+	client, err := source.NewECRClient()
+	if err != nil {
+		return nil, fmt.Errorf("create ECR client: %w", err)
+	}
+
+	result, err := source.GetECRAuthorizationToken(client)
+	if err != nil {
+		return nil, err
+	}
+
+	if ecrTokens.cache != nil {
+		ecrTokens.cache[key] = result
+	}
+
+	return result, nil
+}
+
+// NewECRClient returns a client for ECR in the source's region, with the
+// source's credentials and roles.
+func (source *Source) NewECRClient() (ECRAPI, error) {
+	awsConfig, err := source.AWSConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	return ecr.NewFromConfig(awsConfig), nil
+}
+
+// AWSConfig returns the configuration for AWS clients in the source's region,
+// with the source's credentials, assuming each of its roles in turn.
+//
+// Without static credentials, the SDK's default credential chain is used:
+// environment variables, the shared config and credentials files (including
+// SSO and credential_process profiles), web identity token files (e.g. IRSA),
+// container credentials (e.g. EKS Pod Identity), and the EC2 instance
+// profile.
+func (source *Source) AWSConfig() (aws.Config, error) {
+	var opts []func(*config.LoadOptions) error
+
+	if source.AwsRegion != "" {
+		opts = append(opts, config.WithRegion(source.AwsRegion))
+	}
+
+	if source.AwsUseFIPSEndpoint {
+		opts = append(opts, config.WithUseFIPSEndpoint(aws.FIPSEndpointStateEnabled))
+	}
+
+	if source.AwsUseDualStackEndpoint {
+		opts = append(opts, config.WithUseDualStackEndpoint(aws.DualStackEndpointStateEnabled))
+	}
+
+	if source.AwsAccessKeyId != "" && source.AwsSecretAccessKey != "" {
+		opts = append(opts, config.WithCredentialsProvider(credentials.NewStaticCredentialsProvider(source.AwsAccessKeyId, source.AwsSecretAccessKey, source.AwsSessionToken)))
+	}
+
+	awsConfig, err := config.LoadDefaultConfig(RequestContext(), opts...)
+	if err != nil {
+		return aws.Config{}, fmt.Errorf("load AWS config: %w", err)
+	}
+
+	// Note: This implementation gives precedence to `aws_role_arn` since it
+	// assumes that we've errored if both `aws_role_arn` and `aws_role_arns`
+	// are set
+	awsRoleArns := source.AwsRoleArns
+	if source.AwsRoleArn != "" {
+		awsRoleArns = []string{source.AwsRoleArn}
+	}
+	for _, roleArn := range awsRoleArns {
+		logrus.Debugf("assuming new role: %s", roleArn)
+
+		// each role is assumed with the credentials of the one before it
+		client := sts.NewFromConfig(awsConfig)
+		awsConfig.Credentials = aws.NewCredentialsCache(stscreds.NewAssumeRoleProvider(client, roleArn))
+	}
+
+	return awsConfig, nil
+}
+
+// ECRRegistry returns the hostname of the account's registry in the source's
+// region, e.g. 012345678910.dkr.ecr.us-east-1.amazonaws.com, or with FIPS and
+// dual-stack endpoints, 012345678910.dkr-ecr-fips.us-east-1.on.aws.
+func (source *Source) ECRRegistry(accountId string) string {
+	if source.AwsUseDualStackEndpoint {
+		service := "dkr-ecr"
+		if source.AwsUseFIPSEndpoint {
+			service += "-fips"
+		}
+
+		return fmt.Sprintf("%s.%s.%s.on.aws", accountId, service, source.AwsRegion)
+	}
+
+	service := "dkr.ecr"
+	if source.AwsUseFIPSEndpoint {
+		service += "-fips"
+	}
+
+	return fmt.Sprintf("%s.%s.%s.amazonaws.com", accountId, service, source.AwsRegion)
+}
+
+func (source *Source) GetECRAuthorizationToken(client ECRAPI) (*ecr.GetAuthorizationTokenOutput, error) {
 	input := &ecr.GetAuthorizationTokenInput{}
 	if source.AWSECRRegistryId != "" {
-		input.RegistryIds = append(input.RegistryIds, aws.String(source.AWSECRRegistryId))
+		input.RegistryIds = append(input.RegistryIds, source.AWSECRRegistryId)
+	}
+	return client.GetAuthorizationToken(RequestContext(), input)
+}
+
+// CreateECRRepository creates the repository, e.g. some/image for
+// 012345678910.dkr.ecr.us-east-1.amazonaws.com/some/image, with the source's
+// repository tags and scan on push setting. A repository created in the
+// meantime, e.g. by a concurrent put, is not an error.
+func (source *Source) CreateECRRepository(client ECRAPI, repository string) error {
+	input := &ecr.CreateRepositoryInput{
+		RepositoryName: aws.String(repository),
+		ImageScanningConfiguration: &ecrtypes.ImageScanningConfiguration{
+			ScanOnPush: source.AwsECRScanOnPush,
+		},
+	}
+
+	if source.AWSECRRegistryId != "" {
+		input.RegistryId = aws.String(source.AWSECRRegistryId)
+	}
+
+	for key, value := range source.AwsECRRepositoryTags {
+		input.Tags = append(input.Tags, ecrtypes.Tag{
+			Key:   aws.String(key),
+			Value: aws.String(value),
+		})
+	}
+
+	// sort for a deterministic request
+	sort.Slice(input.Tags, func(i, j int) bool {
+		return *input.Tags[i].Key < *input.Tags[j].Key
+	})
+
+	_, err := client.CreateRepository(RequestContext(), input)
+	if err != nil {
+		var exists *ecrtypes.RepositoryAlreadyExistsException
+		if errors.As(err, &exists) {
+			return nil
+		}
+
+		return err
 	}
-	return client.GetAuthorizationToken(input)
+
+	return nil
 }
 
 // Tag refers to a tag for an image in the registry.
@@ -480,22 +1436,158 @@ type MetadataField struct {
 }
 
 type GetParams struct {
-	RawFormat    string `json:"format"`
-	SkipDownload bool   `json:"skip_download"`
+	RawFormat      string        `json:"format"`
+	SkipDownload   bool          `json:"skip_download"`
+	FetchMetadata  bool          `json:"fetch_metadata"`
+	RawCompression string        `json:"compression"`
+	Verify         *VerifyParams `json:"verify,omitempty"`
+	ExtractLimits  ExtractLimits `json:"extract_limits"`
+
+	// What to do when the image's config is for a different platform than
+	// the one requested: "warn" (the default) or "fail".
+	PlatformMismatch string `json:"platform_mismatch"`
+
+	// Rewrite symlinks to absolute paths in the extracted filesystem to be
+	// relative, so that they resolve within it when it isn't chrooted into.
+	RewriteAbsoluteSymlinks bool `json:"rewrite_absolute_symlinks"`
+
+	// Make the extracted files readable by anyone, and directories and
+	// executables traversable and executable by anyone.
+	WorldReadable bool `json:"world_readable"`
+
+	// Octal permissions to remove from the extracted files, e.g. "027".
+	Umask string `json:"umask"`
+
+	// Owner to give all extracted files in place of the owners recorded in
+	// the image.
+	RootfsOwner *RootfsOwner `json:"rootfs_owner,omitempty"`
+}
+
+// RootfsOwner is the user and group to own an extracted filesystem.
+type RootfsOwner struct {
+	UID int `json:"uid"`
+	GID int `json:"gid"`
 }
 
+// CheckRootfsOwner returns an error if the configured rootfs_owner is invalid.
+func (p GetParams) CheckRootfsOwner() error {
+	if p.RootfsOwner == nil {
+		return nil
+	}
+
+	if p.RootfsOwner.UID < 0 || p.RootfsOwner.GID < 0 {
+		return Invalid("invalid rootfs_owner %d:%d (uid and gid must not be negative)", p.RootfsOwner.UID, p.RootfsOwner.GID)
+	}
+
+	return nil
+}
+
+// ExtractLimits bounds what may be written to disk when extracting an image's
+// rootfs. Zero values mean no limit.
+type ExtractLimits struct {
+	// Total size in bytes of all files extracted, across all layers.
+	MaxSize int64 `json:"max_size,omitempty"`
+
+	// Number of entries extracted, across all layers.
+	MaxFiles int `json:"max_files,omitempty"`
+
+	// Size in bytes of any single file.
+	MaxFileSize int64 `json:"max_file_size,omitempty"`
+}
+
+// VerifyParams configures verification of an image's cosign signatures
+// before it is fetched. Exactly one of CosignPublicKey or Keyless must be set.
+type VerifyParams struct {
+	// PEM-encoded public key the image must be signed with.
+	CosignPublicKey string `json:"cosign_public_key,omitempty"`
+
+	// Identity the image must be signed by, via a Fulcio certificate.
+	Keyless *KeylessVerification `json:"keyless,omitempty"`
+
+	// Annotations which must be present in the signature payload.
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+type KeylessVerification struct {
+	// Subject of the signing certificate, e.g. an email address or a
+	// workflow URI.
+	Identity string `json:"identity"`
+
+	// OIDC issuer which authenticated the identity.
+	Issuer string `json:"issuer"`
+
+	// PEM-encoded root certificates to verify the signing certificate with.
+	// If not set, they are fetched from FulcioURL.
+	FulcioRoots string `json:"fulcio_roots,omitempty"`
+
+	FulcioURL string `json:"fulcio_url,omitempty"`
+	RekorURL  string `json:"rekor_url,omitempty"`
+
+	// How to find the signature in the Rekor transparency log: "online"
+	// searches RekorURL, while "offline" verifies the Rekor bundle attached
+	// to the signature using RekorPublicKey.
+	Tlog string `json:"tlog,omitempty"`
+
+	// PEM-encoded public key of the Rekor log, for offline verification.
+	RekorPublicKey string `json:"rekor_public_key,omitempty"`
+}
+
+const (
+	DefaultFulcioURL = "https://fulcio.sigstore.dev"
+	DefaultRekorURL  = "https://rekor.sigstore.dev"
+)
+
 func (p GetParams) Format() string {
 	if p.RawFormat == "" {
+		if runtime.GOOS == "windows" {
+			// Windows workers can't run images from a rootfs, and unpacking one
+			// requires symlinks and Unix permissions
+			return "oci"
+		}
+
 		return "rootfs"
 	}
 
 	return p.RawFormat
 }
 
+// ParseUmask parses the octal umask, returning 0 if none is configured.
+func (p GetParams) ParseUmask() (os.FileMode, error) {
+	if p.Umask == "" {
+		return 0, nil
+	}
+
+	umask, err := strconv.ParseUint(p.Umask, 8, 32)
+	if err != nil || umask > 0777 {
+		return 0, Invalid("invalid umask %q (must be octal, e.g. 022)", p.Umask)
+	}
+
+	return os.FileMode(umask), nil
+}
+
+// Compression is the algorithm used to compress the rootfs tarball when
+// fetching with the rootfs-tgz format.
+func (p GetParams) Compression() string {
+	if p.RawCompression == "" {
+		return "gzip"
+	}
+
+	return p.RawCompression
+}
+
 type PutParams struct {
 	// Path to an OCI image tarball to push.
 	Image string `json:"image"`
 
+	// Tag of the image to push from a `docker save` archive of several images,
+	// e.g. 'my-app:1.2.3'.
+	ArchiveTag string `json:"archive_tag"`
+
+	// Repository (and tag or digest) of an image or index to copy directly
+	// from, in place of Image, e.g. to promote an image between registries.
+	// Credentials are configured as in the source.
+	FromRegistry *Source `json:"from_registry"`
+
 	// Version number to publish. If a variant is configured, it will be
 	// appended to this value to form the tag.
 	Version string `json:"version"`
@@ -512,8 +1604,80 @@ type PutParams struct {
 	//   if no variant is configured.
 	BumpAliases bool `json:"bump_aliases"`
 
+	// Variants to push the version for, in place of the variant configured in
+	// the source, e.g. [alpine, slim] pushes 1.2.3-alpine and 1.2.3-slim.
+	Variants []string `json:"variants"`
+
 	// Path to a file containing line-separated tags to push.
 	AdditionalTags string `json:"additional_tags"`
+
+	// Template of whitespace-separated tags to push, e.g.
+	// '{{.Version}}-{{.Vars.commit}}', expanded once per variant.
+	AdditionalTagsTemplate string `json:"additional_tags_template"`
+
+	// Variables for AdditionalTagsTemplate, each read from the file at the
+	// given path, e.g. 'commit: repo/.git/ref'.
+	TemplateVars map[string]string `json:"template_vars"`
+
+	// Other repositories, each with its own credentials, to push the same
+	// tags to after pushing to the source's repository.
+	AdditionalRepositories []Source `json:"additional_repositories"`
+
+	// Re-encode the image's layers with zstd before pushing: 'zstd' to push
+	// just the zstd-compressed image, or 'both' to push an index with the
+	// original image and the zstd-compressed one.
+	Recompress string `json:"recompress"`
+
+	// Path to a JSON file containing labels to merge into the image's config,
+	// e.g. as computed by a build task.
+	LabelsFile string `json:"labels_file"`
+
+	// Digest the image must have in order to be pushed, or the path to a file
+	// containing it.
+	ExpectedDigest string `json:"expected_digest"`
+
+	// OCI 1.1 artifactType to declare in the pushed manifest, classifying
+	// artifacts which aren't runnable images.
+	ArtifactType string `json:"artifact_type"`
+
+	// Media type of the pushed image's config, e.g. for artifacts with their
+	// own config format.
+	ConfigMediaType string `json:"config_media_type"`
+
+	// Report the tags which would be created, changed, or left untouched,
+	// including alias decisions, without pushing anything.
+	DryRun bool `json:"dry_run"`
+
+	// Annotations to attach to individual tags, keyed by tag. Since tags of the
+	// same image share a manifest, these are pushed as a referrer of the image
+	// annotated with the tag it describes.
+	TagAnnotations map[string]map[string]string `json:"tag_annotations"`
+
+	// When pushing an image index, additionally push each of its images to
+	// every tag suffixed with the image's platform, e.g. 1.2.3-arm64.
+	PlatformTags bool `json:"platform_tags"`
+
+	// When pushing an image index, prune it to the images for these
+	// platforms, e.g. [linux/amd64, linux/arm64], before pushing.
+	Platforms []string `json:"platforms"`
+
+	// When Image is the output of a `get`, or with FromRegistry, also copy the
+	// cosign signatures, attestations, and referrers of the fetched image to
+	// the repository.
+	CopySignatures bool `json:"copy_signatures"`
+
+	// Path to a directory to push as the filesystem of a single-layer image,
+	// in place of Image.
+	Rootfs string `json:"rootfs"`
+
+	// Path to a metadata.json file, as written by `get` in rootfs format,
+	// providing the env and user for the image built from Rootfs.
+	Metadata string `json:"metadata"`
+
+	// Process configuration for the image built from Rootfs.
+	Entrypoint []string `json:"entrypoint"`
+	Cmd        []string `json:"cmd"`
+	WorkingDir string   `json:"working_dir"`
 }
 
 func (p *PutParams) ParseAdditionalTags(src string) ([]string, error) {
@@ -530,3 +1694,125 @@ func (p *PutParams) ParseAdditionalTags(src string) ([]string, error) {
 
 	return strings.Fields(string(content)), nil
 }
+
+// TagTemplateData is the data available to the additional tags template.
+type TagTemplateData struct {
+	// Version is the version tag pushed, without the variant, if a version is
+	// given.
+	Version string
+
+	// Variant is the variant being pushed, if any.
+	Variant string
+
+	// Date is the UTC date of the put, as YYYYMMDD.
+	Date string
+
+	// Vars are the contents of the template_vars files, with surrounding
+	// whitespace trimmed.
+	Vars map[string]string
+}
+
+// ParseAdditionalTagsTemplate expands the additional tags template for each
+// variant, returning the tags without duplicates.
+func (p *PutParams) ParseAdditionalTagsTemplate(src string, version string, variants []string, now time.Time) ([]string, error) {
+	if p.AdditionalTagsTemplate == "" {
+		if len(p.TemplateVars) > 0 {
+			return nil, Invalid("'template_vars' requires 'additional_tags_template'")
+		}
+
+		return []string{}, nil
+	}
+
+	tmpl, err := template.New("additional_tags_template").
+		Option("missingkey=error").
+		Parse(p.AdditionalTagsTemplate)
+	if err != nil {
+		return nil, Invalid("invalid additional_tags_template: %s", err)
+	}
+
+	vars := map[string]string{}
+	for name, path := range p.TemplateVars {
+		filepath := filepath.Join(src, path)
+
+		content, err := ioutil.ReadFile(filepath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read file at %q: %s", filepath, err)
+		}
+
+		vars[name] = strings.TrimSpace(string(content))
+	}
+
+	seen := map[string]bool{}
+	tags := []string{}
+	for _, variant := range variants {
+		var buf strings.Builder
+		err := tmpl.Execute(&buf, TagTemplateData{
+			Version: version,
+			Variant: variant,
+			Date:    now.UTC().Format("20060102"),
+			Vars:    vars,
+		})
+		if err != nil {
+			return nil, Invalid("expand additional_tags_template: %s", err)
+		}
+
+		for _, tag := range strings.Fields(buf.String()) {
+			if seen[tag] {
+				continue
+			}
+
+			seen[tag] = true
+			tags = append(tags, tag)
+		}
+	}
+
+	return tags, nil
+}
+
+// ParseLabels returns the labels in the labels file, if any.
+func (p *PutParams) ParseLabels(src string) (map[string]string, error) {
+	if p.LabelsFile == "" {
+		return nil, nil
+	}
+
+	filepath := filepath.Join(src, p.LabelsFile)
+
+	content, err := ioutil.ReadFile(filepath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read file at %q: %s", filepath, err)
+	}
+
+	var labels map[string]string
+	err = json.Unmarshal(content, &labels)
+	if err != nil {
+		return nil, Invalid("invalid labels in %q (must be a JSON object of strings): %s", filepath, err)
+	}
+
+	return labels, nil
+}
+
+// ParseExpectedDigest returns the expected digest, reading it from the file
+// at the given path within src if it is not a digest itself.
+func (p *PutParams) ParseExpectedDigest(src string) (string, error) {
+	if p.ExpectedDigest == "" {
+		return "", nil
+	}
+
+	if _, err := v1.NewHash(p.ExpectedDigest); err == nil {
+		return p.ExpectedDigest, nil
+	}
+
+	filepath := filepath.Join(src, p.ExpectedDigest)
+
+	content, err := ioutil.ReadFile(filepath)
+	if err != nil {
+		return "", fmt.Errorf("failed to read file at %q: %s", filepath, err)
+	}
+
+	digest := strings.TrimSpace(string(content))
+	if _, err := v1.NewHash(digest); err != nil {
+		return "", fmt.Errorf("invalid digest in %q: %w", filepath, err)
+	}
+
+	return digest, nil
+}
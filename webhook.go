@@ -0,0 +1,287 @@
+package resource
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/sirupsen/logrus"
+)
+
+// WebhookConfig configures the webhook helper, which receives webhooks from
+// registries and triggers checks of the resources tracking the pushed
+// repositories via Concourse's resource check webhooks.
+type WebhookConfig struct {
+	// Address to listen on, e.g. ":8080".
+	Listen string `json:"listen"`
+
+	// Secret the registries must present, either as the key used to sign
+	// GitHub's X-Hub-Signature-256, or as the Authorization header or the
+	// 'secret' query parameter for other registries.
+	Secret string `json:"secret"`
+
+	Resources []WebhookResource `json:"resources"`
+}
+
+type WebhookResource struct {
+	// Fully-qualified repository of the resource, e.g. for ECR
+	// 012345678910.dkr.ecr.us-east-1.amazonaws.com/alpine.
+	Repository string `json:"repository"`
+
+	// Concourse check webhook URL of the resource, including its
+	// webhook_token.
+	CheckURL string `json:"check_url"`
+}
+
+// webhookEvent parses a webhook payload, returning the repositories pushed
+// to, if any.
+type webhookEvent func(r *http.Request, body []byte) ([]string, error)
+
+type webhookHandler struct {
+	config WebhookConfig
+	client *http.Client
+	github bool
+	parse  webhookEvent
+}
+
+// NewWebhookHandler returns a handler accepting webhooks from Docker Hub
+// (/dockerhub), Harbor (/harbor), GitHub packages (/github), and ECR via
+// EventBridge API destinations (/ecr).
+func NewWebhookHandler(config WebhookConfig, client *http.Client) http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/dockerhub", webhookHandler{config: config, client: client, parse: parseDockerHubEvent})
+	mux.Handle("/harbor", webhookHandler{config: config, client: client, parse: parseHarborEvent})
+	mux.Handle("/github", webhookHandler{config: config, client: client, parse: parseGitHubEvent, github: true})
+	mux.Handle("/ecr", webhookHandler{config: config, client: client, parse: parseECREvent})
+	return mux
+}
+
+func (h webhookHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
+		http.Error(w, "read body", http.StatusBadRequest)
+		return
+	}
+
+	if !h.authorized(r, body) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	repositories, err := h.parse(r, body)
+	if err != nil {
+		logrus.Warnf("invalid webhook payload for %s: %s", r.URL.Path, err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	checked := 0
+	for _, repository := range repositories {
+		for _, resource := range h.config.Resources {
+			if !sameRepository(repository, resource.Repository) {
+				continue
+			}
+
+			logrus.Infof("triggering check for %s", repository)
+
+			err := h.check(resource.CheckURL)
+			if err != nil {
+				logrus.Errorf("triggering check for %s failed: %s", repository, err)
+				http.Error(w, "trigger check failed", http.StatusBadGateway)
+				return
+			}
+
+			checked++
+		}
+	}
+
+	fmt.Fprintf(w, "triggered %d check(s)\n", checked)
+}
+
+func (h webhookHandler) authorized(r *http.Request, body []byte) bool {
+	if h.config.Secret == "" {
+		return true
+	}
+
+	if h.github {
+		mac := hmac.New(sha256.New, []byte(h.config.Secret))
+		mac.Write(body)
+		expected := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+		return hmac.Equal([]byte(expected), []byte(r.Header.Get("X-Hub-Signature-256")))
+	}
+
+	for _, presented := range []string{
+		r.URL.Query().Get("secret"),
+		r.Header.Get("Authorization"),
+		strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "),
+	} {
+		if subtle.ConstantTimeCompare([]byte(presented), []byte(h.config.Secret)) == 1 {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (h webhookHandler) check(url string) error {
+	res, err := h.client.Post(url, "application/json", nil)
+	if err != nil {
+		return err
+	}
+
+	res.Body.Close()
+
+	if res.StatusCode >= 300 {
+		return fmt.Errorf("%s", res.Status)
+	}
+
+	return nil
+}
+
+func sameRepository(a, b string) bool {
+	ra, err := name.NewRepository(a)
+	if err != nil {
+		return false
+	}
+
+	rb, err := name.NewRepository(b)
+	if err != nil {
+		return false
+	}
+
+	return ra.Name() == rb.Name()
+}
+
+// referenceRepository returns the repository of an image reference, e.g.
+// harbor.example.com/library/app:1.2.3.
+func referenceRepository(ref string) (string, error) {
+	parsed, err := name.ParseReference(ref)
+	if err != nil {
+		return "", err
+	}
+
+	return parsed.Context().Name(), nil
+}
+
+func parseDockerHubEvent(r *http.Request, body []byte) ([]string, error) {
+	var event struct {
+		Repository struct {
+			RepoName string `json:"repo_name"`
+		} `json:"repository"`
+	}
+
+	err := json.Unmarshal(body, &event)
+	if err != nil {
+		return nil, err
+	}
+
+	if event.Repository.RepoName == "" {
+		return nil, fmt.Errorf("missing repository.repo_name")
+	}
+
+	return []string{event.Repository.RepoName}, nil
+}
+
+func parseHarborEvent(r *http.Request, body []byte) ([]string, error) {
+	var event struct {
+		Type      string `json:"type"`
+		EventData struct {
+			Resources []struct {
+				ResourceURL string `json:"resource_url"`
+			} `json:"resources"`
+		} `json:"event_data"`
+	}
+
+	err := json.Unmarshal(body, &event)
+	if err != nil {
+		return nil, err
+	}
+
+	if event.Type != "PUSH_ARTIFACT" && event.Type != "pushImage" {
+		return nil, nil
+	}
+
+	var repositories []string
+	for _, resource := range event.EventData.Resources {
+		repository, err := referenceRepository(resource.ResourceURL)
+		if err != nil {
+			return nil, fmt.Errorf("parse resource_url: %w", err)
+		}
+
+		repositories = append(repositories, repository)
+	}
+
+	return repositories, nil
+}
+
+func parseGitHubEvent(r *http.Request, body []byte) ([]string, error) {
+	switch r.Header.Get("X-GitHub-Event") {
+	case "package", "registry_package":
+	default:
+		return nil, nil
+	}
+
+	var event struct {
+		Action  string `json:"action"`
+		Package struct {
+			PackageType    string `json:"package_type"`
+			PackageVersion struct {
+				PackageURL string `json:"package_url"`
+			} `json:"package_version"`
+		} `json:"package"`
+	}
+
+	err := json.Unmarshal(body, &event)
+	if err != nil {
+		return nil, err
+	}
+
+	if event.Action != "published" || !strings.EqualFold(event.Package.PackageType, "container") {
+		return nil, nil
+	}
+
+	// untagged versions have an empty tag, e.g. ghcr.io/org/app:
+	repository, err := referenceRepository(strings.TrimSuffix(event.Package.PackageVersion.PackageURL, ":"))
+	if err != nil {
+		return nil, fmt.Errorf("parse package_url: %w", err)
+	}
+
+	return []string{repository}, nil
+}
+
+func parseECREvent(r *http.Request, body []byte) ([]string, error) {
+	var event struct {
+		Source  string `json:"source"`
+		Account string `json:"account"`
+		Region  string `json:"region"`
+		Detail  struct {
+			ActionType     string `json:"action-type"`
+			Result         string `json:"result"`
+			RepositoryName string `json:"repository-name"`
+		} `json:"detail"`
+	}
+
+	err := json.Unmarshal(body, &event)
+	if err != nil {
+		return nil, err
+	}
+
+	if event.Source != "aws.ecr" || event.Detail.ActionType != "PUSH" || event.Detail.Result != "SUCCESS" {
+		return nil, nil
+	}
+
+	return []string{fmt.Sprintf("%s.dkr.ecr.%s.amazonaws.com/%s", event.Account, event.Region, event.Detail.RepositoryName)}, nil
+}
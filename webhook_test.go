@@ -0,0 +1,117 @@
+package resource_test
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/ghttp"
+
+	resource "github.com/concourse/registry-image-resource"
+)
+
+var _ = Describe("Webhook", func() {
+	var concourse *ghttp.Server
+	var handler http.Handler
+
+	BeforeEach(func() {
+		concourse = ghttp.NewServer()
+		concourse.RouteToHandler("POST", "/check/app", ghttp.RespondWith(http.StatusCreated, "{}"))
+		concourse.RouteToHandler("POST", "/check/ecr-app", ghttp.RespondWith(http.StatusCreated, "{}"))
+
+		handler = resource.NewWebhookHandler(resource.WebhookConfig{
+			Secret: "some-secret",
+			Resources: []resource.WebhookResource{
+				{
+					Repository: "some-org/app",
+					CheckURL:   concourse.URL() + "/check/app",
+				},
+				{
+					Repository: "ghcr.io/some-org/app",
+					CheckURL:   concourse.URL() + "/check/app",
+				},
+				{
+					Repository: "012345678910.dkr.ecr.us-east-1.amazonaws.com/app",
+					CheckURL:   concourse.URL() + "/check/ecr-app",
+				},
+			},
+		}, http.DefaultClient)
+	})
+
+	AfterEach(func() {
+		concourse.Close()
+	})
+
+	deliver := func(path string, body string, header http.Header) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", path, strings.NewReader(body))
+		for k, v := range header {
+			req.Header[k] = v
+		}
+
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	checkedPaths := func() []string {
+		paths := []string{}
+		for _, req := range concourse.ReceivedRequests() {
+			paths = append(paths, req.URL.Path)
+		}
+
+		return paths
+	}
+
+	It("triggers a check for a Docker Hub push", func() {
+		rec := deliver("/dockerhub?secret=some-secret", `{"push_data":{"tag":"latest"},"repository":{"repo_name":"some-org/app"}}`, nil)
+		Expect(rec.Code).To(Equal(http.StatusOK))
+		Expect(checkedPaths()).To(Equal([]string{"/check/app"}))
+	})
+
+	It("rejects a webhook without the secret", func() {
+		rec := deliver("/dockerhub?secret=bogus", `{"repository":{"repo_name":"some-org/app"}}`, nil)
+		Expect(rec.Code).To(Equal(http.StatusUnauthorized))
+		Expect(checkedPaths()).To(BeEmpty())
+	})
+
+	It("ignores pushes to other repositories", func() {
+		rec := deliver("/harbor", `{"type":"PUSH_ARTIFACT","event_data":{"resources":[{"resource_url":"harbor.example.com/library/other:1.0"}]}}`, http.Header{
+			"Authorization": {"some-secret"},
+		})
+		Expect(rec.Code).To(Equal(http.StatusOK))
+		Expect(checkedPaths()).To(BeEmpty())
+	})
+
+	It("triggers a check for a GitHub package event signed with the secret", func() {
+		body := `{"action":"published","package":{"package_type":"CONTAINER","package_version":{"package_url":"ghcr.io/some-org/app:1.2.3"}}}`
+
+		mac := hmac.New(sha256.New, []byte("some-secret"))
+		mac.Write([]byte(body))
+
+		rec := deliver("/github", body, http.Header{
+			"X-Github-Event":      {"package"},
+			"X-Hub-Signature-256": {"sha256=" + hex.EncodeToString(mac.Sum(nil))},
+		})
+		Expect(rec.Code).To(Equal(http.StatusOK))
+		Expect(checkedPaths()).To(Equal([]string{"/check/app"}))
+
+		rec = deliver("/github", body, http.Header{
+			"X-Github-Event":      {"package"},
+			"X-Hub-Signature-256": {"sha256=bogus"},
+		})
+		Expect(rec.Code).To(Equal(http.StatusUnauthorized))
+	})
+
+	It("triggers a check for an ECR push event", func() {
+		rec := deliver("/ecr", `{"source":"aws.ecr","detail-type":"ECR Image Action","account":"012345678910","region":"us-east-1","detail":{"action-type":"PUSH","result":"SUCCESS","repository-name":"app","image-tag":"latest"}}`, http.Header{
+			"Authorization": {"Bearer some-secret"},
+		})
+		Expect(rec.Code).To(Equal(http.StatusOK))
+		Expect(checkedPaths()).To(Equal([]string{"/check/ecr-app"}))
+	})
+})
@@ -0,0 +1,66 @@
+package resource
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+)
+
+var ecrRegistryRegexp = regexp.MustCompile(`^(\d+)\.dkr[.-]ecr(?:-fips)?\.([a-z0-9-]+)\.(?:amazonaws\.com|on\.aws)$`)
+var artifactRegistryRegexp = regexp.MustCompile(`^([a-z0-9-]+)-docker\.pkg\.dev$`)
+var gcrRegistryRegexp = regexp.MustCompile(`^(?:([a-z]+)\.)?gcr\.io$`)
+
+// WebURL returns a link to the web page of an image pushed to a well-known
+// registry, or an empty string if the registry isn't recognized.
+func WebURL(digest name.Digest) string {
+	registry := digest.RegistryStr()
+	path := digest.RepositoryStr()
+
+	switch {
+	case registry == name.DefaultRegistry:
+		if official := strings.TrimPrefix(path, "library/"); official != path {
+			return "https://hub.docker.com/_/" + official
+		}
+
+		return "https://hub.docker.com/r/" + path
+
+	case registry == "ghcr.io":
+		return "https://ghcr.io/" + path
+
+	case registry == "quay.io":
+		return fmt.Sprintf("https://quay.io/repository/%s/manifest/%s", path, digest.DigestStr())
+
+	case gcrRegistryRegexp.MatchString(registry):
+		location := gcrRegistryRegexp.FindStringSubmatch(registry)[1]
+		if location == "" {
+			location = "global"
+		}
+
+		project, image, found := strings.Cut(path, "/")
+		if !found {
+			return ""
+		}
+
+		return fmt.Sprintf("https://console.cloud.google.com/gcr/images/%s/%s/%s@%s", project, strings.ToUpper(location), image, digest.DigestStr())
+
+	case artifactRegistryRegexp.MatchString(registry):
+		location := artifactRegistryRegexp.FindStringSubmatch(registry)[1]
+
+		segments := strings.SplitN(path, "/", 3)
+		if len(segments) != 3 {
+			return ""
+		}
+
+		return fmt.Sprintf("https://console.cloud.google.com/artifacts/docker/%s/%s/%s/%s/%s", segments[0], location, segments[1], segments[2], digest.DigestStr())
+
+	case ecrRegistryRegexp.MatchString(registry):
+		match := ecrRegistryRegexp.FindStringSubmatch(registry)
+		account, region := match[1], match[2]
+
+		return fmt.Sprintf("https://%s.console.aws.amazon.com/ecr/repositories/private/%s/%s?region=%s", region, account, path, region)
+	}
+
+	return ""
+}